@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/spf13/viper"
+	"github.com/wang900115/LCA/did"
 	"github.com/wang900115/LCA/internal/adapter/controller"
 	response "github.com/wang900115/LCA/internal/adapter/controller/response/json"
 	"github.com/wang900115/LCA/internal/adapter/middleware"
@@ -31,6 +32,11 @@ func main() {
 	kafka := bootstrap.NewKafka(appOptions.Kafka)
 	postgresql := bootstrap.NewPostgresql(appOptions.Postgresql)
 	casbin := bootstrap.NewCasbin(postgresql, appOptions.Casbin)
+	identity := did.NewDIDIdentifier(nil)
+	discovery, err := bootstrap.NewDiscovery(appOptions.Discovery, identity.Keys())
+	if err != nil {
+		panic(err)
+	}
 
 	job1 := infrastructurejob.NewPostgresqlJob(zaplogger, postgresql)
 	job2 := infrastructurejob.NewRedisJob(zaplogger, redispool)
@@ -93,5 +99,5 @@ func main() {
 	srv := server.Run(appOptions.Server)
 	sch := scheduler.Run(appOptions.Gocron)
 
-	bootstrap.Run(appOptions.Server.CancelTimeout, srv, *sch)
+	bootstrap.Run(appOptions.Server.CancelTimeout, srv, *sch, discovery)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// The export file is a flat dump of a key-value store:
+//
+//	magic(8) | version(1)
+//	{ 0x01 | uvarint(len(key)) | key | uvarint(len(value)) | value }*
+//	0x00 | count(8) | crc32(4)
+//
+// The trailer holds the number of entries and the CRC32 (IEEE) of every entry
+// record, so truncated or damaged files are detected on import.
+var exportMagic = []byte("LCADBEXP")
+
+const (
+	exportVersion = 1
+
+	exportEntry = 0x01
+	exportEnd   = 0x00
+)
+
+var (
+	errExportMagic    = errors.New("not an lcadb export file")
+	errExportChecksum = errors.New("export file checksum mismatch")
+)
+
+// exportWriter writes key-value pairs into an export file.
+type exportWriter struct {
+	file  *os.File
+	w     *bufio.Writer
+	crc   hash.Hash32
+	count uint64
+}
+
+// createExport creates a new export file, failing if path already exists.
+func createExport(path string) (*exportWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := &exportWriter{file: file, w: bufio.NewWriter(file), crc: crc32.NewIEEE()}
+	e.w.Write(exportMagic)
+	e.w.WriteByte(exportVersion)
+	return e, nil
+}
+
+// Put appends a key-value pair to the export.
+func (e *exportWriter) Put(key, value []byte) error {
+	record := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(key)+len(value))
+	record = append(record, exportEntry)
+	record = binary.AppendUvarint(record, uint64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendUvarint(record, uint64(len(value)))
+	record = append(record, value...)
+
+	e.crc.Write(record)
+	e.count++
+	_, err := e.w.Write(record)
+	return err
+}
+
+// Close writes the trailer and flushes the export to disk.
+func (e *exportWriter) Close() error {
+	var trailer [13]byte
+	trailer[0] = exportEnd
+	binary.BigEndian.PutUint64(trailer[1:], e.count)
+	binary.BigEndian.PutUint32(trailer[9:], e.crc.Sum32())
+	if _, err := e.w.Write(trailer[:]); err != nil {
+		e.file.Close()
+		return err
+	}
+	if err := e.w.Flush(); err != nil {
+		e.file.Close()
+		return err
+	}
+	if err := e.file.Sync(); err != nil {
+		e.file.Close()
+		return err
+	}
+	return e.file.Close()
+}
+
+// readExport calls fn for every key-value pair of the export file at path, in
+// the order they were written. The trailer is verified once all entries were
+// read, so fn may have seen entries of a damaged file by the time it fails.
+func readExport(path string, fn func(key, value []byte) error) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]byte, len(exportMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header[:len(exportMagic)], exportMagic) {
+		return 0, errExportMagic
+	}
+	if version := header[len(exportMagic)]; version != exportVersion {
+		return 0, fmt.Errorf("unsupported export version %d", version)
+	}
+	var (
+		crc   = crc32.NewIEEE()
+		count uint64
+	)
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return count, fmt.Errorf("export truncated after %d entries: %w", count, err)
+		}
+		if kind == exportEnd {
+			break
+		}
+		if kind != exportEntry {
+			return count, fmt.Errorf("invalid export record type %#x", kind)
+		}
+		crc.Write([]byte{kind})
+		key, err := readBlob(r, crc)
+		if err != nil {
+			return count, fmt.Errorf("export entry %d: %w", count, err)
+		}
+		value, err := readBlob(r, crc)
+		if err != nil {
+			return count, fmt.Errorf("export entry %d: %w", count, err)
+		}
+		if err := fn(key, value); err != nil {
+			return count, err
+		}
+		count++
+	}
+	var trailer [12]byte
+	if _, err := io.ReadFull(r, trailer[:]); err != nil {
+		return count, fmt.Errorf("export trailer: %w", err)
+	}
+	if want := binary.BigEndian.Uint64(trailer[:8]); want != count {
+		return count, fmt.Errorf("%w: read %d entries, expected %d", errExportChecksum, count, want)
+	}
+	if binary.BigEndian.Uint32(trailer[8:]) != crc.Sum32() {
+		return count, errExportChecksum
+	}
+	return count, nil
+}
+
+// readBlob reads a length prefixed byte slice, feeding the raw record bytes
+// into the checksum.
+func readBlob(r *bufio.Reader, crc hash.Hash32) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	crc.Write(binary.AppendUvarint(nil, size))
+	// Read through a limited reader instead of allocating size bytes up front,
+	// a damaged length would otherwise allocate arbitrary amounts of memory
+	blob, err := io.ReadAll(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(blob)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	crc.Write(blob)
+	return blob, nil
+}
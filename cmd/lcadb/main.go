@@ -0,0 +1,560 @@
+// Command lcadb inspects and migrates LCA key-value stores offline.
+//
+// Usage:
+//
+//	lcadb <command> [flags] [args]
+//
+// Every command takes -db with the path of the store and -type with its
+// backend (leveldb, pebble or export). The type is detected from the files
+// on disk when omitted. Keys and values given on the command line are taken
+// verbatim, unless they start with 0x in which case they are hex decoded.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/leveldb"
+	"github.com/wang900115/LCA/store/pebbledb"
+)
+
+const (
+	typeLevelDB = "leveldb"
+	typePebble  = "pebble"
+	typeExport  = "export"
+
+	// idealBatchSize is the amount of data buffered before a migration batch
+	// is written out.
+	idealBatchSize = 100 * 1024
+)
+
+// command is a single lcadb subcommand.
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(fs *flag.FlagSet, args []string, out io.Writer) error
+}
+
+var commands = []*command{
+	{"get", "KEY", "print the value stored under a key", runGet},
+	{"put", "KEY VALUE", "store a value under a key", runPut},
+	{"delete", "KEY", "delete a key", runDelete},
+	{"dump", "", "print the entries with a given prefix", runDump},
+	{"count", "", "count the keys with a given prefix", runCount},
+	{"stats", "", "show key counts and sizes grouped by key prefix", runStats},
+	{"compact", "", "compact the store", runCompact},
+	{"migrate", "", "copy every entry into a new store or export file", runMigrate},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "lcadb:", err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command line args, writing the output to out.
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		usage(out)
+		return errors.New("no command given")
+	}
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		fs.SetOutput(out)
+		fs.Usage = func() {
+			fmt.Fprintf(out, "Usage: lcadb %s [flags] %s\n\n%s.\n\nFlags:\n", cmd.name, cmd.args, cmd.usage)
+			fs.PrintDefaults()
+		}
+		return cmd.run(fs, args[1:], out)
+	}
+	usage(out)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func usage(out io.Writer) {
+	fmt.Fprintln(out, "Usage: lcadb <command> [flags] [args]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.usage)
+	}
+	w.Flush()
+}
+
+// storeFlags registers the flags selecting a store on fs.
+func storeFlags(fs *flag.FlagSet) (path, typ *string) {
+	path = fs.String("db", "", "path of the store")
+	typ = fs.String("type", "", "store backend: leveldb, pebble or export (detected when empty)")
+	return path, typ
+}
+
+// parseArgs parses the flags and checks the number of positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, want int) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != want {
+		fs.Usage()
+		return fmt.Errorf("%s takes %d arguments, got %d", fs.Name(), want, fs.NArg())
+	}
+	return nil
+}
+
+// detectType guesses the backend of the store at path. Pebble leaves an
+// OPTIONS file next to its manifest, goleveldb only the CURRENT pointer.
+func detectType(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return typeExport, nil
+	}
+	if matches, _ := filepath.Glob(filepath.Join(path, "OPTIONS-*")); len(matches) > 0 {
+		return typePebble, nil
+	}
+	if _, err := os.Stat(filepath.Join(path, "CURRENT")); err == nil {
+		return typeLevelDB, nil
+	}
+	return "", fmt.Errorf("cannot detect the store type of %s, use -type", path)
+}
+
+// openStore opens the key-value store at path. An empty typ is detected from
+// the files on disk.
+func openStore(path, typ string, readonly bool) (store.KeyValueStore, error) {
+	if path == "" {
+		return nil, errors.New("no store given, use -db")
+	}
+	if typ == "" {
+		var err error
+		if typ, err = detectType(path); err != nil {
+			return nil, err
+		}
+	}
+	switch typ {
+	case typeLevelDB:
+		if readonly {
+			return leveldb.NewLevelDBStoreReadOnly(path)
+		}
+		return leveldb.NewLevelDBStore(path)
+	case typePebble:
+		if readonly {
+			return pebbledb.NewPebbleDBStoreReadOnly(path)
+		}
+		return pebbledb.NewPebbleDBStore(path)
+	case typeExport:
+		return nil, fmt.Errorf("%s is an export file, only migrate can read it", path)
+	}
+	return nil, fmt.Errorf("unknown store type %q", typ)
+}
+
+// parseBytes decodes a key or value given on the command line.
+func parseBytes(s string) ([]byte, error) {
+	if rest, ok := strings.CutPrefix(s, "0x"); ok {
+		return hex.DecodeString(rest)
+	}
+	return []byte(s), nil
+}
+
+func runGet(fs *flag.FlagSet, args []string, out io.Writer) error {
+	path, typ := storeFlags(fs)
+	raw := fs.Bool("raw", false, "print the value as is instead of hex encoded")
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	key, err := parseBytes(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	db, err := openStore(*path, *typ, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	value, err := db.Get(key)
+	if err != nil {
+		return err
+	}
+	if *raw {
+		_, err = out.Write(value)
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%#x\n", value)
+	return err
+}
+
+func runPut(fs *flag.FlagSet, args []string, out io.Writer) error {
+	path, typ := storeFlags(fs)
+	if err := parseArgs(fs, args, 2); err != nil {
+		return err
+	}
+	key, err := parseBytes(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	value, err := parseBytes(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	db, err := openStore(*path, *typ, false)
+	if err != nil {
+		return err
+	}
+	if err := db.Put(key, value); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+func runDelete(fs *flag.FlagSet, args []string, out io.Writer) error {
+	path, typ := storeFlags(fs)
+	if err := parseArgs(fs, args, 1); err != nil {
+		return err
+	}
+	key, err := parseBytes(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	db, err := openStore(*path, *typ, false)
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(key); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// dumpEntry is a single line of the JSON dump.
+type dumpEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func runDump(fs *flag.FlagSet, args []string, out io.Writer) error {
+	path, typ := storeFlags(fs)
+	prefixFlag := fs.String("prefix", "", "only dump keys with this prefix")
+	format := fs.String("format", "hex", "output format: hex or json")
+	limit := fs.Int("limit", 0, "stop after this many entries (0 means all)")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if *format != "hex" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	prefix, err := parseBytes(*prefixFlag)
+	if err != nil {
+		return err
+	}
+	db, err := openStore(*path, *typ, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	it, err := db.NewIterator(prefix, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+
+	enc := json.NewEncoder(out)
+	for n := 0; it.Next() && (*limit == 0 || n < *limit); n++ {
+		if *format == "json" {
+			err = enc.Encode(dumpEntry{Key: fmt.Sprintf("%#x", it.Key()), Value: fmt.Sprintf("%#x", it.Value())})
+		} else {
+			_, err = fmt.Fprintf(out, "%#x %#x\n", it.Key(), it.Value())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+func runCount(fs *flag.FlagSet, args []string, out io.Writer) error {
+	path, typ := storeFlags(fs)
+	prefixFlag := fs.String("prefix", "", "only count keys with this prefix")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	prefix, err := parseBytes(*prefixFlag)
+	if err != nil {
+		return err
+	}
+	db, err := openStore(*path, *typ, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	it, err := db.NewIterator(prefix, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+
+	var count int
+	for it.Next() {
+		count++
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, count)
+	return err
+}
+
+// prefixStat accumulates the entries sharing a key prefix.
+type prefixStat struct {
+	prefix     []byte
+	count      int
+	keyBytes   int64
+	valueBytes int64
+}
+
+func runStats(fs *flag.FlagSet, args []string, out io.Writer) error {
+	path, typ := storeFlags(fs)
+	prefixFlag := fs.String("prefix", "", "only include keys with this prefix")
+	depth := fs.Int("depth", 1, "number of key bytes to group by")
+	engine := fs.Bool("engine", false, "also print the statistics reported by the engine")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	prefix, err := parseBytes(*prefixFlag)
+	if err != nil {
+		return err
+	}
+	db, err := openStore(*path, *typ, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	it, err := db.NewIterator(prefix, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+
+	var (
+		groups []*prefixStat
+		total  = &prefixStat{prefix: []byte("total")}
+	)
+	for it.Next() {
+		key := it.Key()
+		group := key[:min(len(key), *depth)]
+		// Keys arrive in order, so equal prefixes are always adjacent
+		if len(groups) == 0 || !bytes.Equal(groups[len(groups)-1].prefix, group) {
+			groups = append(groups, &prefixStat{prefix: bytes.Clone(group)})
+		}
+		for _, stat := range []*prefixStat{groups[len(groups)-1], total} {
+			stat.count++
+			stat.keyBytes += int64(len(key))
+			stat.valueBytes += int64(len(it.Value()))
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "PREFIX\tCOUNT\tKEY BYTES\tVALUE BYTES\t")
+	for _, stat := range groups {
+		fmt.Fprintf(w, "%#x\t%d\t%d\t%d\t\n", stat.prefix, stat.count, stat.keyBytes, stat.valueBytes)
+	}
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t\n", total.prefix, total.count, total.keyBytes, total.valueBytes)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if !*engine {
+		return nil
+	}
+	stats, err := db.Stat()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(out)
+	for _, name := range names {
+		fmt.Fprintf(out, "%s: %v\n", name, stats[name])
+	}
+	return nil
+}
+
+func runCompact(fs *flag.FlagSet, args []string, out io.Writer) error {
+	path, typ := storeFlags(fs)
+	startFlag := fs.String("start", "", "first key to compact (default: start of the store)")
+	endFlag := fs.String("end", "", "key to stop compacting at (default: end of the store)")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	var start, end []byte
+	var err error
+	if *startFlag != "" {
+		if start, err = parseBytes(*startFlag); err != nil {
+			return err
+		}
+	}
+	if *endFlag != "" {
+		if end, err = parseBytes(*endFlag); err != nil {
+			return err
+		}
+	}
+	db, err := openStore(*path, *typ, false)
+	if err != nil {
+		return err
+	}
+	if err := db.Compact(start, end); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// sink is the destination of a migration.
+type sink interface {
+	Put(key, value []byte) error
+	Close() error
+}
+
+// storeSink writes migrated entries into a key-value store in batches.
+type storeSink struct {
+	db    store.KeyValueStore
+	batch store.Batch
+}
+
+func (s *storeSink) Put(key, value []byte) error {
+	if err := s.batch.Put(key, value); err != nil {
+		return err
+	}
+	if s.batch.ValueSize() < idealBatchSize {
+		return nil
+	}
+	if err := s.batch.Write(); err != nil {
+		return err
+	}
+	return s.batch.Reset()
+}
+
+func (s *storeSink) Close() error {
+	if err := s.batch.Write(); err != nil {
+		s.db.Close()
+		return err
+	}
+	if err := s.db.Sync(); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+// createSink creates the destination of a migration. It refuses to write into
+// an existing store or file, so a migration never mixes with older data.
+func createSink(path, typ string) (sink, error) {
+	if path == "" {
+		return nil, errors.New("no destination given, use -to")
+	}
+	// Export files are created exclusively, stores may only go into an empty
+	// or missing directory
+	if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("destination %s is not empty", path)
+	}
+	switch typ {
+	case typeLevelDB, typePebble:
+		db, err := openStore(path, typ, false)
+		if err != nil {
+			return nil, err
+		}
+		return &storeSink{db: db, batch: db.NewBatch()}, nil
+	case typeExport:
+		return createExport(path)
+	case "":
+		return nil, errors.New("no destination type given, use -to-type")
+	}
+	return nil, fmt.Errorf("unknown store type %q", typ)
+}
+
+func runMigrate(fs *flag.FlagSet, args []string, out io.Writer) error {
+	path, typ := storeFlags(fs)
+	to := fs.String("to", "", "path of the new store or export file")
+	toType := fs.String("to-type", "", "backend of the new store: leveldb, pebble or export")
+	if err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if *path == "" {
+		return errors.New("no store given, use -db")
+	}
+	if *typ == "" {
+		var err error
+		if *typ, err = detectType(*path); err != nil {
+			return err
+		}
+	}
+	dst, err := createSink(*to, *toType)
+	if err != nil {
+		return err
+	}
+	var count uint64
+	if *typ == typeExport {
+		count, err = readExport(*path, dst.Put)
+	} else {
+		count, err = migrateStore(*path, *typ, dst)
+	}
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "migrated %d entries from %s to %s\n", count, *path, *to)
+	return err
+}
+
+// migrateStore copies every entry of the store at path into dst.
+func migrateStore(path, typ string, dst sink) (uint64, error) {
+	db, err := openStore(path, typ, true)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	it, err := db.NewIterator(nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Release()
+
+	var count uint64
+	for it.Next() {
+		if err := dst.Put(it.Key(), it.Value()); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, it.Error()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lcadb runs the command line and returns its output.
+func lcadb(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := run(args, &out)
+	return out.String(), err
+}
+
+func mustLcadb(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := lcadb(t, args...)
+	require.NoError(t, err, out)
+	return out
+}
+
+func TestCommands(t *testing.T) {
+	for _, typ := range []string{typeLevelDB, typePebble} {
+		t.Run(typ, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "db")
+			mustLcadb(t, "put", "-db", dir, "-type", typ, "a1", "x")
+			mustLcadb(t, "put", "-db", dir, "a2", "0x0102")
+			mustLcadb(t, "put", "-db", dir, "b1", "yy")
+			mustLcadb(t, "put", "-db", dir, "0x0001", "z")
+
+			// The type is detected from here on
+			assert.Equal(t, "0x0102\n", mustLcadb(t, "get", "-db", dir, "a2"))
+			assert.Equal(t, "x", mustLcadb(t, "get", "-db", dir, "-raw", "0x6131"))
+			assert.Equal(t, "2\n", mustLcadb(t, "count", "-db", dir, "-prefix", "a"))
+			assert.Equal(t, "4\n", mustLcadb(t, "count", "-db", dir))
+
+			assert.Equal(t, "0x6131 0x78\n0x6132 0x0102\n", mustLcadb(t, "dump", "-db", dir, "-prefix", "a"))
+			assert.Equal(t, `{"key":"0x6131","value":"0x78"}`+"\n", mustLcadb(t, "dump", "-db", dir, "-format", "json", "-limit", "1", "-prefix", "a"))
+
+			stats := strings.Fields(mustLcadb(t, "stats", "-db", dir))
+			assert.Equal(t, []string{
+				"PREFIX", "COUNT", "KEY", "BYTES", "VALUE", "BYTES",
+				"0x00", "1", "2", "1",
+				"0x61", "2", "4", "3",
+				"0x62", "1", "2", "2",
+				"total", "4", "8", "6",
+			}, stats)
+
+			mustLcadb(t, "delete", "-db", dir, "b1")
+			_, err := lcadb(t, "get", "-db", dir, "b1")
+			assert.Error(t, err)
+			mustLcadb(t, "compact", "-db", dir)
+			mustLcadb(t, "compact", "-db", dir, "-start", "a", "-end", "b")
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	level, export, pebble := filepath.Join(dir, "level"), filepath.Join(dir, "dump.lcadb"), filepath.Join(dir, "pebble")
+
+	for i := 0; i < 300; i++ {
+		mustLcadb(t, "put", "-db", level, "-type", typeLevelDB, strings.Repeat("k", i%7+1)+string(rune('a'+i%26)), strings.Repeat("v", 3*i))
+	}
+	want := mustLcadb(t, "dump", "-db", level)
+
+	assert.Contains(t, mustLcadb(t, "migrate", "-db", level, "-to", export, "-to-type", typeExport), "migrated")
+	mustLcadb(t, "migrate", "-db", export, "-to", pebble, "-to-type", typePebble)
+	assert.Equal(t, want, mustLcadb(t, "dump", "-db", pebble, "-type", typePebble))
+
+	// Existing destinations are never written into
+	_, err := lcadb(t, "migrate", "-db", level, "-to", pebble, "-to-type", typePebble)
+	assert.Error(t, err)
+	_, err = lcadb(t, "migrate", "-db", level, "-to", export, "-to-type", typeExport)
+	assert.Error(t, err)
+
+	// Damaged exports are rejected
+	data, err := os.ReadFile(export)
+	require.NoError(t, err)
+	data[len(data)-20] ^= 1
+	damaged := filepath.Join(dir, "damaged.lcadb")
+	require.NoError(t, os.WriteFile(damaged, data, 0644))
+	_, err = lcadb(t, "migrate", "-db", damaged, "-to", filepath.Join(dir, "out"), "-to-type", typeLevelDB)
+	assert.ErrorIs(t, err, errExportChecksum)
+
+	truncated := filepath.Join(dir, "truncated.lcadb")
+	require.NoError(t, os.WriteFile(truncated, data[:len(data)/2], 0644))
+	_, err = lcadb(t, "migrate", "-db", truncated, "-to", filepath.Join(dir, "out2"), "-to-type", typeLevelDB)
+	assert.Error(t, err)
+}
+
+func TestUsage(t *testing.T) {
+	out, err := lcadb(t)
+	assert.Error(t, err)
+	assert.Contains(t, out, "migrate")
+	_, err = lcadb(t, "unknown")
+	assert.Error(t, err)
+	_, err = lcadb(t, "get", "-db", t.TempDir())
+	assert.Error(t, err)
+	_, err = lcadb(t, "count", "-db", t.TempDir())
+	assert.Error(t, err)
+}
@@ -83,17 +83,81 @@ func AESCBCDecrypto(cipherText []byte, key []byte) ([]byte, error) {
 	return cipherText, nil
 }
 
+// AESGCMEncrypt: seal plaintext using AES-GCM with shared key, the random nonce is
+// prepended to the ciphertext and additionalData is authenticated but not encrypted
+func AESGCMEncrypt(plainText, key, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plainText)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plainText, additionalData), nil
+}
+
+// AESGCMDecrypt: open ciphertext produced by AESGCMEncrypt, failing if the ciphertext
+// or the additionalData was tampered with
+func AESGCMDecrypt(cipherText, key, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherText) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("cipherText too short")
+	}
+	nonce, sealed := cipherText[:gcm.NonceSize()], cipherText[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, additionalData)
+}
+
 // derivedKey = KDF(sharedKey || senderPublicKey || receiverPublicKey)
 func DeriveAESKey(sharedKey []byte, senderPub, receiverPub ed25519.PublicKey) ([]byte, []byte, error) {
+	return DeriveAESKeyBytes(sharedKey, senderPub, receiverPub)
+}
+
+// DeriveAESKeyBytes: DeriveAESKey for public keys given as raw bytes, so keys
+// which are not Ed25519 keys, like an ephemeral X25519 key, can be bound too
+func DeriveAESKeyBytes(sharedKey, senderPub, receiverPub []byte) ([]byte, []byte, error) {
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return nil, nil, err
 	}
-	info := append(senderPub, receiverPub...)
-	hkdf := hkdf.New(sha256.New, sharedKey, salt, info)
-	key := make([]byte, 32)
-	if _, err := io.ReadFull(hkdf, key); err != nil {
+	key, err := DeriveKey(sharedKey, salt, DeriveAESKeyInfoBytes(senderPub, receiverPub))
+	if err != nil {
 		return nil, nil, err
 	}
 	return key, salt, nil
 }
+
+// DeriveAESKeyInfo: the HKDF info DeriveAESKey binds the key to, the receiver derives
+// the same key with DeriveKey(sharedKey, salt, DeriveAESKeyInfo(senderPub, receiverPub))
+func DeriveAESKeyInfo(senderPub, receiverPub ed25519.PublicKey) []byte {
+	return DeriveAESKeyInfoBytes(senderPub, receiverPub)
+}
+
+// DeriveAESKeyInfoBytes: the HKDF info DeriveAESKeyBytes binds the key to
+func DeriveAESKeyInfoBytes(senderPub, receiverPub []byte) []byte {
+	info := make([]byte, 0, len(senderPub)+len(receiverPub))
+	info = append(info, senderPub...)
+	return append(info, receiverPub...)
+}
+
+// DeriveKey: expand secret into a 32-byte key with HKDF-SHA256, the same secret,
+// salt and info always derive the same key
+func DeriveKey(secret, salt, info []byte) ([]byte, error) {
+	hkdf := hkdf.New(sha256.New, secret, salt, info)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
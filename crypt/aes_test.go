@@ -1,6 +1,8 @@
 package crypto
 
 import (
+	"bytes"
+	"crypto/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -20,3 +22,67 @@ func TestCBC(t *testing.T) {
 
 	assert.Equal(t, plaintText, resText)
 }
+
+func TestGCM(t *testing.T) {
+	plaintText := []byte("AESTEST")
+	key := bytes.Repeat([]byte{1}, 32)
+	ad := []byte("key")
+
+	cipherText, err := AESGCMEncrypt(plaintText, key, ad)
+	t.Logf("cipherText: %v", cipherText)
+	assert.Nil(t, err)
+
+	resText, err := AESGCMDecrypt(cipherText, key, ad)
+	assert.Nil(t, err)
+	assert.Equal(t, plaintText, resText)
+
+	_, err = AESGCMDecrypt(cipherText, key, []byte("other"))
+	assert.NotNil(t, err)
+	cipherText[len(cipherText)-1] ^= 1
+	_, err = AESGCMDecrypt(cipherText, key, ad)
+	assert.NotNil(t, err)
+}
+
+func TestDeriveKey(t *testing.T) {
+	secret := []byte("master")
+	key1, err := DeriveKey(secret, nil, []byte("info"))
+	assert.Nil(t, err)
+	key2, err := DeriveKey(secret, nil, []byte("info"))
+	assert.Nil(t, err)
+	assert.Equal(t, key1, key2)
+	assert.Len(t, key1, 32)
+
+	key3, err := DeriveKey(secret, nil, []byte("other"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, key1, key3)
+}
+
+func TestDeriveAESKey(t *testing.T) {
+	secret := []byte("shared")
+	sender, _, _ := ED25519GenerateKey(nil)
+	receiver, _, _ := ED25519GenerateKey(nil)
+
+	key, salt, err := DeriveAESKey(secret, sender, receiver)
+	assert.Nil(t, err)
+	assert.Len(t, salt, 16)
+	// The receiver derives the same key from the salt
+	same, err := DeriveKey(secret, salt, DeriveAESKeyInfo(sender, receiver))
+	assert.Nil(t, err)
+	assert.Equal(t, key, same)
+	// The key is bound to its direction
+	other, err := DeriveKey(secret, salt, DeriveAESKeyInfo(receiver, sender))
+	assert.Nil(t, err)
+	assert.NotEqual(t, key, other)
+}
+
+func TestDeriveAESKeyBytes(t *testing.T) {
+	secret := []byte("shared")
+	sender, _, _ := X25519GenerateKey(rand.Reader)
+	receiver, _, _ := ED25519GenerateKey(nil)
+
+	key, salt, err := DeriveAESKeyBytes(secret, sender.Bytes(), receiver)
+	assert.Nil(t, err)
+	same, err := DeriveKey(secret, salt, DeriveAESKeyInfoBytes(sender.Bytes(), receiver))
+	assert.Nil(t, err)
+	assert.Equal(t, key, same)
+}
@@ -0,0 +1,58 @@
+/*
+	KDF Chain Module (Forward Secrecy of Private Conversations)
+	------------------------------------------------------------
+	Key derivation chains of the double ratchet and the X3DH key agreement.
+
+	Root chain:    every new Diffie-Hellman output advances the root key
+	               and starts a new sending or receiving chain.
+	Message chain: every message advances its chain key and gets a
+	               message key of its own, which is used once.
+
+	Since the chains only move forward, a leaked chain key does not
+	expose the messages before it, and the next Diffie-Hellman ratchet
+	step heals the session after a compromise.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	rootKDFInfo = []byte("lca/ratchet/root")
+	x3dhInfo    = []byte("lca/x3dh")
+)
+
+// KDFRoot: advance the root chain with a Diffie-Hellman output, returning the new
+// root key and the key of the chain it starts
+func KDFRoot(rootKey, dhOut []byte) ([]byte, []byte, error) {
+	out := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dhOut, rootKey, rootKDFInfo), out); err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+// KDFChain: advance a message chain, returning the next chain key and the key of
+// the current message
+func KDFChain(chainKey []byte) ([]byte, []byte) {
+	messageKey := HMACSign(sha256.New, chainKey, []byte{0x01})
+	next := HMACSign(sha256.New, chainKey, []byte{0x02})
+	return next, messageKey
+}
+
+// X3DHSecret: combine the Diffie-Hellman outputs of an X3DH agreement, in the
+// order both sides compute them, into the initial root key of a session
+func X3DHSecret(dhs ...[]byte) ([]byte, error) {
+	// 32 0xff bytes separate the secret from curve points, as in X3DH
+	secret := bytes.Repeat([]byte{0xff}, 32)
+	for _, dh := range dhs {
+		secret = append(secret, dh...)
+	}
+	return DeriveKey(secret, make([]byte, 32), x3dhInfo)
+}
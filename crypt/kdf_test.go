@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKDFRoot(t *testing.T) {
+	root := bytes.Repeat([]byte{1}, 32)
+	newRoot, chain, err := KDFRoot(root, []byte("dh output"))
+	require.NoError(t, err)
+	assert.Len(t, newRoot, 32)
+	assert.Len(t, chain, 32)
+	assert.NotEqual(t, root, newRoot)
+	assert.NotEqual(t, newRoot, chain)
+
+	again, _, err := KDFRoot(root, []byte("dh output"))
+	require.NoError(t, err)
+	assert.Equal(t, newRoot, again)
+	other, _, err := KDFRoot(root, []byte("other output"))
+	require.NoError(t, err)
+	assert.NotEqual(t, newRoot, other)
+}
+
+func TestKDFChain(t *testing.T) {
+	chain := bytes.Repeat([]byte{2}, 32)
+	seen := map[string]bool{}
+	for range 10 {
+		next, mk := KDFChain(chain)
+		assert.Len(t, mk, 32)
+		assert.False(t, seen[string(mk)], "message keys are never reused")
+		seen[string(mk)] = true
+		assert.NotEqual(t, next, mk)
+		chain = next
+	}
+}
+
+func TestX3DHSecret(t *testing.T) {
+	sk, err := X3DHSecret([]byte("dh1"), []byte("dh2"), []byte("dh3"))
+	require.NoError(t, err)
+	assert.Len(t, sk, 32)
+	swapped, err := X3DHSecret([]byte("dh2"), []byte("dh1"), []byte("dh3"))
+	require.NoError(t, err)
+	assert.NotEqual(t, sk, swapped, "the order of the outputs matters")
+}
@@ -1,10 +1,14 @@
 package did
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/btcsuite/btcutil/base58"
+	crypto "github.com/wang900115/LCA/crypt"
 )
 
 const (
@@ -15,6 +19,13 @@ const (
 	DIDContext       = "https://www.w3.org/ns/did/v1"
 )
 
+var (
+	ErrInvalidKey      = errors.New("document key is malformed")
+	ErrKeyAgreementKey = errors.New("document has no key agreement key")
+	ErrKeyAgreementSig = errors.New("key agreement key signature is invalid")
+	ErrIDMismatch      = errors.New("document id does not match its verification key")
+)
+
 // Document represents the DID's Document structure following W3C DID spec.
 type Document struct {
 	Context              []string             `json:"@context"`
@@ -36,6 +47,7 @@ type VerificationMethod struct {
 	Type               string `json:"type"`
 	Controller         string `json:"controller"`
 	PublicKeyMultibase string `json:"publicKeyMultibase"`
+	Signature          string `json:"signature,omitempty"` // Of a key agreement key by the verification key
 }
 
 // ServiceEndpoint represents a service endpoint in the DID Document.
@@ -46,7 +58,7 @@ type ServiceEndpoint struct {
 }
 
 // NewDocument creates a new DID Document based on the provided DIDIdentifier and creation time.
-func NewDocument(did DIDIdentifier, createdAt time.Time) *Document {
+func NewDocument(did *DIDIdentifier, createdAt time.Time) *Document {
 	vmId := composeID(did.ID, VerificationID)
 	kaId := composeID(did.ID, KeyAgreementID)
 
@@ -57,14 +69,14 @@ func NewDocument(did DIDIdentifier, createdAt time.Time) *Document {
 		ID: did.ID,
 		VerificationMethod: []VerificationMethod{
 			newVerificationMethod(vmId, did.Metadata.Controller, VerificationType, did.KeyPair.GetEd25519PublicKey()),
-			newKeyAgreementMethod(kaId, did.Metadata.Controller, KeyAgreementType, did.KeyPair.GetX25519PublicKey()),
+			newKeyAgreementMethod(kaId, did.Metadata.Controller, KeyAgreementType, did.KeyPair),
 		},
 		Authentication:       []string{vmId},
 		AssertionMethod:      []string{vmId},
 		KeyAgreement:         []string{kaId},
 		CapabilityInvocation: []string{vmId},
 		CapabilityDelegation: []string{vmId},
-		Service:              convertToW3CServices(did.Services),
+		Service:              convertToW3CServices(did.services()),
 		Created:              createdAt.Format(time.RFC3339),
 		Updated:              createdAt.Format(time.RFC3339),
 	}
@@ -80,13 +92,20 @@ func newVerificationMethod(id, controller, keyType string, publicKey []byte) Ver
 	}
 }
 
-func newKeyAgreementMethod(id, controller, keyType string, publicKey []byte) VerificationMethod {
-	return VerificationMethod{
+// newKeyAgreementMethod publishes the X25519 key of keys signed with its
+// Ed25519 key. Without a signature the method is rejected by KeyAgreementKey.
+func newKeyAgreementMethod(id, controller, keyType string, keys KeyPair) VerificationMethod {
+	publicKey := keys.GetX25519PublicKey()
+	vm := VerificationMethod{
 		ID:                 id,
 		Type:               keyType,
 		Controller:         controller,
 		PublicKeyMultibase: "z" + base58.Encode(publicKey), // multibase with base58btc prefix
 	}
+	if signature, err := keys.SignData(publicKey); err == nil {
+		vm.Signature = "z" + base58.Encode(signature)
+	}
+	return vm
 }
 
 func convertToW3CServices(services []ServiceEndpoint) []ServiceEndpoint {
@@ -112,7 +131,7 @@ const (
 )
 
 // NewDocumentWithNewStandards creates a new DID Document following the latest W3C DID standards.
-func NewDocumentWithNewStandards(did DIDIdentifier, createdAt time.Time) *Document {
+func NewDocumentWithNewStandards(did *DIDIdentifier, createdAt time.Time) *Document {
 	vmId := composeID(did.ID, VerificationID)
 	kaId := composeID(did.ID, KeyAgreementID)
 
@@ -130,19 +149,14 @@ func NewDocumentWithNewStandards(did DIDIdentifier, createdAt time.Time) *Docume
 				Controller:         did.Metadata.Controller,
 				PublicKeyMultibase: "z" + base58.Encode(did.KeyPair.GetEd25519PublicKey()),
 			},
-			{
-				ID:                 kaId,
-				Type:               X25519KeyAgreementKey2020,
-				Controller:         did.Metadata.Controller,
-				PublicKeyMultibase: "z" + base58.Encode(did.KeyPair.GetX25519PublicKey()),
-			},
+			newKeyAgreementMethod(kaId, did.Metadata.Controller, X25519KeyAgreementKey2020, did.KeyPair),
 		},
 		Authentication:       []string{vmId},
 		AssertionMethod:      []string{vmId},
 		KeyAgreement:         []string{kaId},
 		CapabilityInvocation: []string{vmId},
 		CapabilityDelegation: []string{vmId},
-		Service:              convertToW3CServices(did.Services),
+		Service:              convertToW3CServices(did.services()),
 		Created:              createdAt.Format(time.RFC3339),
 		Updated:              createdAt.Format(time.RFC3339),
 	}
@@ -156,6 +170,51 @@ func (d *Document) JSONUnmarshal(data []byte) error {
 	return json.Unmarshal(data, d)
 }
 
+// VerificationKey returns the Ed25519 verification key of the document.
+func (d *Document) VerificationKey() (ed25519.PublicKey, error) {
+	return extract(d)
+}
+
+// KeyAgreementKey returns the X25519 key agreement key of the document,
+// checking its signature. Only the signature binds the key to the DID, as
+// ValidateID covers the verification key alone.
+func (d *Document) KeyAgreementKey() (*ecdh.PublicKey, error) {
+	for _, vm := range d.VerificationMethod {
+		if vm.Type == KeyAgreementType || vm.Type == X25519KeyAgreementKey2020 {
+			key, err := decodeMultibase(vm.PublicKeyMultibase, 32)
+			if err != nil {
+				return nil, err
+			}
+			signature, err := decodeMultibase(vm.Signature, 64)
+			if err != nil {
+				return nil, ErrKeyAgreementSig
+			}
+			edKey, err := d.VerificationKey()
+			if err != nil {
+				return nil, err
+			}
+			if ok, err := crypto.ED25519Verify(edKey, key, signature); err != nil || !ok {
+				return nil, ErrKeyAgreementSig
+			}
+			return ecdh.X25519().NewPublicKey(key)
+		}
+	}
+	return nil, ErrKeyAgreementKey
+}
+
+// ValidateID checks that the document ID is the did:key of its verification
+// key, so the document can not claim someone else's DID.
+func (d *Document) ValidateID() error {
+	key, err := d.VerificationKey()
+	if err != nil {
+		return err
+	}
+	if d.ID != KeyID(key) {
+		return ErrIDMismatch
+	}
+	return nil
+}
+
 func composeID(id, fragment string) string {
 	return id + fragment
 }
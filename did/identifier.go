@@ -3,6 +3,8 @@ package did
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/btcsuite/btcutil/base58"
@@ -19,6 +21,10 @@ type IdentifierDID interface {
 	Document() *Document
 	SignDocument() ([]byte, error)
 	SignMessage(data []byte) ([]byte, error)
+	Keys() KeyPair
+	// SetService publishes a service in the document, replacing the service
+	// with the same ID.
+	SetService(ServiceEndpoint)
 }
 
 // Metadata holds metadata for a DID.
@@ -27,13 +33,16 @@ type Metadata struct {
 	Version    int
 }
 
-// DIDIdentifier represents a Decentralized Identifier.
+// DIDIdentifier represents a Decentralized Identifier. Once it is in use,
+// Services is only changed through SetService.
 type DIDIdentifier struct {
 	ID       string
 	Address  string
 	KeyPair  KeyPair
 	Metadata Metadata
 	Services []ServiceEndpoint
+
+	mu sync.RWMutex // Guards Services
 }
 
 // NewDID creates a new IdentifierDID instance.
@@ -61,7 +70,7 @@ func (d *DIDIdentifier) Addr() string {
 
 // Document converts the DID to a DID Document.
 func (d *DIDIdentifier) Document() *Document {
-	return NewDocument(*d, time.Now())
+	return NewDocument(d, time.Now())
 }
 
 // SignDocument signs the DID Document.
@@ -87,12 +96,56 @@ func (d *DIDIdentifier) SignMessage(data []byte) ([]byte, error) {
 	return signature, nil
 }
 
+// Keys returns the key pair backing the DID.
+func (d *DIDIdentifier) Keys() KeyPair {
+	return d.KeyPair
+}
+
 // extract extracts the Ed25519 public key from the DID Document.
 func extract(doc *Document) (ed25519.PublicKey, error) {
 	for _, vm := range doc.VerificationMethod {
-		if vm.Type == VerificationType {
-			return base58.Decode(vm.PublicKeyMultibase[1:]), nil
+		if vm.Type == VerificationType || vm.Type == Ed25519VerificationKey2020 {
+			key, err := decodeMultibase(vm.PublicKeyMultibase, ed25519.PublicKeySize)
+			if err != nil {
+				return nil, err
+			}
+			return ed25519.PublicKey(key), nil
 		}
 	}
 	return nil, crypto.ErrED25519PublicKeyMissing
 }
+
+// decodeMultibase decodes a base58btc multibase key of the given size.
+func decodeMultibase(value string, size int) ([]byte, error) {
+	if len(value) < 2 || value[0] != 'z' {
+		return nil, ErrInvalidKey
+	}
+	key := base58.Decode(value[1:])
+	if len(key) != size {
+		return nil, ErrInvalidKey
+	}
+	return key, nil
+}
+
+// SetService publishes a service in the document, replacing the service with
+// the same ID. Documents built before keep the services they had.
+func (d *DIDIdentifier) SetService(service ServiceEndpoint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	services := slices.Clone(d.Services)
+	for i, s := range services {
+		if s.ID == service.ID {
+			services[i] = service
+			d.Services = services
+			return
+		}
+	}
+	d.Services = append(services, service)
+}
+
+// services returns the current services.
+func (d *DIDIdentifier) services() []ServiceEndpoint {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Services
+}
@@ -1,9 +1,13 @@
 package did
 
 import (
+	"crypto/rand"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	crypto "github.com/wang900115/LCA/crypt"
 )
 
 func TestDocument(t *testing.T) {
@@ -33,3 +37,100 @@ func TestSign(t *testing.T) {
 	assert.NoError(t, err)
 	t.Logf("Signature: %x\n", signature)
 }
+
+func TestDocumentKeys(t *testing.T) {
+	did := NewDIDIdentifier(nil)
+	doc := did.Document()
+
+	edKey, err := doc.VerificationKey()
+	assert.NoError(t, err)
+	assert.Equal(t, did.Keys().GetEd25519PublicKey(), []byte(edKey))
+	xKey, err := doc.KeyAgreementKey()
+	assert.NoError(t, err)
+	assert.Equal(t, did.Keys().GetX25519PublicKey(), xKey.Bytes())
+	assert.NoError(t, doc.ValidateID())
+
+	// A swapped key agreement key keeps the ID valid but loses the signature
+	swapped := *doc
+	swapped.VerificationMethod = append([]VerificationMethod(nil), doc.VerificationMethod...)
+	swapped.VerificationMethod[1].PublicKeyMultibase = NewDIDIdentifier(nil).Document().VerificationMethod[1].PublicKeyMultibase
+	assert.NoError(t, swapped.ValidateID())
+	_, err = swapped.KeyAgreementKey()
+	assert.ErrorIs(t, err, ErrKeyAgreementSig)
+	swapped.VerificationMethod[1].Signature = ""
+	_, err = swapped.KeyAgreementKey()
+	assert.ErrorIs(t, err, ErrKeyAgreementSig)
+	_, err = NewDocumentWithNewStandards(did.(*DIDIdentifier), time.Now()).KeyAgreementKey()
+	assert.NoError(t, err)
+
+	// A document claiming another DID
+	doc.ID = NewDIDIdentifier(nil).Document().ID
+	assert.ErrorIs(t, doc.ValidateID(), ErrIDMismatch)
+
+	// Truncated keys are rejected instead of reaching ed25519.Verify
+	doc.VerificationMethod[0].PublicKeyMultibase = doc.VerificationMethod[0].PublicKeyMultibase[:10]
+	_, err = doc.VerificationKey()
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = NewDefaultDIDVerifier().VerifyDocument(doc, make([]byte, 64))
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestPublicKeyFromID(t *testing.T) {
+	did := NewDIDIdentifier(nil)
+	pub, err := PublicKeyFromID(did.Document().ID)
+	assert.NoError(t, err)
+	assert.Equal(t, did.Keys().GetEd25519PublicKey(), []byte(pub))
+
+	for _, id := range []string{"", "did:web:example.com", "did:key:zabc", did.Addr()} {
+		_, err := PublicKeyFromID(id)
+		assert.ErrorIs(t, err, ErrInvalidKey, id)
+	}
+}
+
+func TestSignedPrekey(t *testing.T) {
+	did := NewDIDIdentifier(nil)
+	_, err := did.Document().SignedPrekey()
+	assert.ErrorIs(t, err, ErrPrekeyMissing)
+
+	prekey, _, err := crypto.X25519GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	service, err := NewPrekeyService(did.Document().ID, did.Keys(), prekey)
+	assert.NoError(t, err)
+	did.SetService(service)
+	did.SetService(service)
+	assert.Len(t, did.Document().Service, 1, "services are replaced by ID")
+
+	// The prekey survives the JSON encoding of the document
+	data, err := did.Document().JSONMarshal()
+	assert.NoError(t, err)
+	doc := new(Document)
+	assert.NoError(t, doc.JSONUnmarshal(data))
+	got, err := doc.SignedPrekey()
+	assert.NoError(t, err)
+	assert.Equal(t, prekey.Bytes(), got.Bytes())
+
+	// A prekey signed by someone else is rejected
+	forged, err := NewPrekeyService(did.Document().ID, NewDIDIdentifier(nil).Keys(), prekey)
+	assert.NoError(t, err)
+	did.SetService(forged)
+	_, err = did.Document().SignedPrekey()
+	assert.ErrorIs(t, err, ErrPrekeySignature)
+}
+
+func TestSetService_Concurrent(t *testing.T) {
+	did := NewDIDIdentifier(nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 100 {
+			did.SetService(ServiceEndpoint{ID: fmt.Sprint("service", i%3)})
+		}
+	}()
+	for range 100 {
+		_, err := did.SignDocument()
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(did.Document().Service), 3)
+	}
+	<-done
+	assert.Len(t, did.Document().Service, 3)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/ed25519"
 	"crypto/sha3"
 	"io"
+	"strings"
 
 	c "github.com/wang900115/LCA/crypt"
 	"github.com/wang900115/LCA/pkg/util/encode"
@@ -20,6 +21,7 @@ type KeyPair interface {
 	VerifyData(data []byte, signature []byte) (bool, error)
 	Shake(peerPublicKey *ecdh.PublicKey) ([]byte, error)
 	Unshake(peerPublicKey *ecdh.PublicKey, signature []byte, peerEdPublicKey ed25519.PublicKey) ([]byte, error)
+	SharedSecret(peerPublicKey *ecdh.PublicKey) ([]byte, error)
 }
 
 // PeerKeyPair holds the key pairs for a Peer DID.
@@ -71,11 +73,33 @@ func (k *PeerKeyPair) VerifyData(data []byte, signature []byte) (bool, error) {
 
 // GenerateDID generates a DID from the Ed25519 public key.
 func (k *PeerKeyPair) GenerateID() string {
+	return KeyID(k.EdPublic)
+}
+
+// KeyID returns the did:key identifier of an Ed25519 public key.
+func KeyID(edPublic ed25519.PublicKey) string {
 	header := []byte{0xed, 0x01}
-	payload := append(header, k.EdPublic...)
+	payload := append(header, edPublic...)
 	return "did:key:z" + encode.Base58Encode(payload)
 }
 
+// PublicKeyFromID returns the Ed25519 public key a did:key identifier
+// encodes, the inverse of KeyID.
+func PublicKeyFromID(id string) (ed25519.PublicKey, error) {
+	value, ok := strings.CutPrefix(id, "did:key:")
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	payload, err := decodeMultibase(value, 2+ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	if payload[0] != 0xed || payload[1] != 0x01 {
+		return nil, ErrInvalidKey
+	}
+	return ed25519.PublicKey(payload[2:]), nil
+}
+
 // GenerateAddr generates an address from the ED25519 public key.
 func (k *PeerKeyPair) GenerateAddr() string {
 	hash := sha3.Sum256(k.EdPublic)
@@ -96,3 +120,9 @@ func (k *PeerKeyPair) Unshake(peerPublicKey *ecdh.PublicKey, signature []byte, p
 	}
 	return c.ComputeX25519SharedKey(k.XPrivate, peerPublicKey)
 }
+
+// SharedSecret computes the X25519 shared secret with a key agreement key of
+// a peer, taken from a document which was verified before.
+func (k *PeerKeyPair) SharedSecret(peerPublicKey *ecdh.PublicKey) ([]byte, error) {
+	return c.ComputeX25519SharedKey(k.XPrivate, peerPublicKey)
+}
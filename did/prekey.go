@@ -0,0 +1,80 @@
+package did
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+
+	"github.com/btcsuite/btcutil/base58"
+	crypto "github.com/wang900115/LCA/crypt"
+)
+
+const (
+	PrekeyServiceID   = "#prekey-1"
+	PrekeyServiceType = "X3DHSignedPrekey"
+)
+
+var (
+	ErrPrekeyMissing   = errors.New("document has no signed prekey")
+	ErrPrekeySignature = errors.New("signed prekey signature is invalid")
+)
+
+// SignedPrekey is the endpoint of the prekey service, an X25519 key for the
+// X3DH agreement signed with the verification key of the document.
+type SignedPrekey struct {
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+	Signature          string `json:"signature"`
+}
+
+// NewPrekeyService signs prekey with keys, returning the service which
+// publishes it in the document of the DID id.
+func NewPrekeyService(id string, keys KeyPair, prekey *ecdh.PublicKey) (ServiceEndpoint, error) {
+	signature, err := keys.SignData(prekey.Bytes())
+	if err != nil {
+		return ServiceEndpoint{}, err
+	}
+	return ServiceEndpoint{
+		ID:   composeID(id, PrekeyServiceID),
+		Type: PrekeyServiceType,
+		ServiceEndpoint: SignedPrekey{
+			PublicKeyMultibase: "z" + base58.Encode(prekey.Bytes()),
+			Signature:          "z" + base58.Encode(signature),
+		},
+	}, nil
+}
+
+// SignedPrekey returns the prekey published by the document, checking its
+// signature.
+func (d *Document) SignedPrekey() (*ecdh.PublicKey, error) {
+	for _, s := range d.Service {
+		if s.Type != PrekeyServiceType {
+			continue
+		}
+		// A parsed document holds the endpoint as a generic map
+		data, err := json.Marshal(s.ServiceEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		var sp SignedPrekey
+		if err := json.Unmarshal(data, &sp); err != nil {
+			return nil, ErrInvalidKey
+		}
+		key, err := decodeMultibase(sp.PublicKeyMultibase, 32)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := decodeMultibase(sp.Signature, 64)
+		if err != nil {
+			return nil, err
+		}
+		edKey, err := d.VerificationKey()
+		if err != nil {
+			return nil, err
+		}
+		if ok, err := crypto.ED25519Verify(edKey, key, signature); err != nil || !ok {
+			return nil, ErrPrekeySignature
+		}
+		return ecdh.X25519().NewPublicKey(key)
+	}
+	return nil, ErrPrekeyMissing
+}
@@ -0,0 +1,80 @@
+package bootstrap
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/wang900115/LCA/p2p/discover"
+	"github.com/wang900115/LCA/p2p/enode"
+)
+
+type discoveryOption struct {
+	ListenAddr         string
+	TCPPort            uint16
+	Bootnodes          []string
+	RefreshInterval    time.Duration
+	RevalidateInterval time.Duration
+}
+
+func defaultDiscoveryOption() discoveryOption {
+	return discoveryOption{
+		ListenAddr:         ":30303",
+		RefreshInterval:    discover.DefaultRefreshInterval,
+		RevalidateInterval: discover.DefaultRevalidateInterval,
+	}
+}
+
+func NewDiscoveryOption(conf *viper.Viper) discoveryOption {
+	defaultOptions := defaultDiscoveryOption()
+	if conf.IsSet("p2p.discovery_addr") {
+		defaultOptions.ListenAddr = conf.GetString("p2p.discovery_addr")
+	}
+	if conf.IsSet("p2p.tcp_port") {
+		defaultOptions.TCPPort = uint16(conf.GetUint("p2p.tcp_port"))
+	}
+	if conf.IsSet("p2p.bootnodes") {
+		defaultOptions.Bootnodes = conf.GetStringSlice("p2p.bootnodes")
+	}
+	if conf.IsSet("p2p.refresh_interval") {
+		defaultOptions.RefreshInterval = conf.GetDuration("p2p.refresh_interval")
+	}
+	if conf.IsSet("p2p.revalidate_interval") {
+		defaultOptions.RevalidateInterval = conf.GetDuration("p2p.revalidate_interval")
+	}
+	return defaultOptions
+}
+
+// NewDiscovery starts peer discovery signing with the node key, seeded by the
+// configured bootnodes.
+func NewDiscovery(option discoveryOption, key discover.Signer) (*discover.UDP, error) {
+	bootnodes := make([]*enode.Node, 0, len(option.Bootnodes))
+	for _, url := range option.Bootnodes {
+		node, err := enode.Parse(url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootnode %q: %w", url, err)
+		}
+		bootnodes = append(bootnodes, node)
+	}
+	addr, err := net.ResolveUDPAddr("udp", option.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := discover.ListenUDP(conn, discover.Config{
+		Key:                key,
+		TCPPort:            option.TCPPort,
+		Bootnodes:          bootnodes,
+		RefreshInterval:    option.RefreshInterval,
+		RevalidateInterval: option.RevalidateInterval,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return udp, nil
+}
@@ -28,6 +28,7 @@ type AppConfig struct {
 	Promethus   promethusOption
 	Casbin      casbinOption
 	Gocron      schedularOption
+	Discovery   discoveryOption
 }
 
 func SetEnvironment(v *viper.Viper, env Environment) (*AppConfig, error) {
@@ -53,6 +54,7 @@ func SetEnvironment(v *viper.Viper, env Environment) (*AppConfig, error) {
 		Promethus:   NewPromethusOption(v),
 		Casbin:      NewCasbinOption(v),
 		Gocron:      NewSchedularOption(v),
+		Discovery:   NewDiscoveryOption(v),
 	}
 
 	return appConfig, nil
@@ -9,9 +9,10 @@ import (
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
+	"github.com/wang900115/LCA/p2p/discover"
 )
 
-func Run(cancelTime time.Duration, srv *http.Server, scheduler gocron.Scheduler) {
+func Run(cancelTime time.Duration, srv *http.Server, scheduler gocron.Scheduler, discovery *discover.UDP) {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
@@ -41,4 +42,7 @@ func Run(cancelTime time.Duration, srv *http.Server, scheduler gocron.Scheduler)
 		log.Fatalf("[SYSTEM] Scheduler forced exited: %s", err.Error())
 	}
 	log.Println("[SYSTEM] Scheduler exited gracefully")
+
+	discovery.Close()
+	log.Println("[SYSTEM] Discovery exited gracefully")
 }
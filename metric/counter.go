@@ -6,6 +6,15 @@ func NewCounter() *Counter {
 	return new(Counter)
 }
 
+// GetOrRegisterCounter returns an existing Counter or constructs and registers
+// a new Counter. A nil registry means DefaultRegistry.
+func GetOrRegisterCounter(name string, r Registry) *Counter {
+	if r == nil {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(name, NewCounter).(*Counter)
+}
+
 type CounterSnapshot int64
 
 func (c CounterSnapshot) Count() int64 {
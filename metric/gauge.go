@@ -12,6 +12,15 @@ func NewGauge() *Gauge {
 	return new(Gauge)
 }
 
+// GetOrRegisterGauge returns an existing Gauge or constructs and registers a
+// new Gauge. A nil registry means DefaultRegistry.
+func GetOrRegisterGauge(name string, r Registry) *Gauge {
+	if r == nil {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(name, NewGauge).(*Gauge)
+}
+
 type Gauge atomic.Int64
 
 func (g *Gauge) Update(value int64) {
@@ -13,6 +13,15 @@ func NewGaugeFloat64() *GaugeFloat64 {
 	return new(GaugeFloat64)
 }
 
+// GetOrRegisterGaugeFloat64 returns an existing GaugeFloat64 or constructs and
+// registers a new GaugeFloat64. A nil registry means DefaultRegistry.
+func GetOrRegisterGaugeFloat64(name string, r Registry) *GaugeFloat64 {
+	if r == nil {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(name, NewGaugeFloat64).(*GaugeFloat64)
+}
+
 type GaugeFloat64 atomic.Uint64
 
 func (g *GaugeFloat64) Snapshot() GaugeFloat64Snapshot {
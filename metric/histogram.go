@@ -23,6 +23,15 @@ func NewHistogram(s Sample) Histogram {
 	return &StandardHistogram{s}
 }
 
+// GetOrRegisterHistogram returns an existing Histogram or constructs and
+// registers a new StandardHistogram over s. A nil registry means DefaultRegistry.
+func GetOrRegisterHistogram(name string, r Registry, s Sample) Histogram {
+	if r == nil {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(name, func() Histogram { return NewHistogram(s) }).(Histogram)
+}
+
 type StandardHistogram struct {
 	sample Sample
 }
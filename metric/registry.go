@@ -2,12 +2,19 @@ package metric
 
 import (
 	"errors"
+	"fmt"
+	"reflect"
 	"sync"
 )
 
-// todo
+// ErrDuplicateMetric is returned by Registry.Register when a metric already
+// exists under the given name.
 var ErrDuplicateMetric = errors.New("duplicate metric")
 
+// DefaultRegistry is the registry used when a nil Registry is passed to the
+// GetOrRegister helpers.
+var DefaultRegistry = NewRegistry()
+
 type Registry interface {
 
 	// Each call the given function for each registered metric.
@@ -32,6 +39,11 @@ type Registry interface {
 	UnRegister(name string)
 }
 
+// NewRegistry creates a new, empty registry.
+func NewRegistry() Registry {
+	return new(StandardRegistry)
+}
+
 type StandardRegistry struct {
 	metrics sync.Map
 }
@@ -47,8 +59,119 @@ func (r *StandardRegistry) Get(name string) interface{} {
 	return value
 }
 
+// GetOrRegister returns the metric registered under name, registering i if
+// there is none. i may be a constructor function, which is only called when
+// the metric is missing. Unsupported metric types are not registered and
+// nil is returned for them.
+func (r *StandardRegistry) GetOrRegister(name string, i interface{}) interface{} {
+	// Fast path without calling the constructor
+	if cached, ok := r.metrics.Load(name); ok {
+		return cached
+	}
+	if v := reflect.ValueOf(i); v.Kind() == reflect.Func {
+		i = v.Call(nil)[0].Interface()
+	}
+	item, _, _ := r.loadOrRegister(name, i)
+	return item
+}
+
+// Register registers i under name, failing with ErrDuplicateMetric if the
+// name is taken. i may be a constructor function.
+func (r *StandardRegistry) Register(name string, i interface{}) error {
+	if _, ok := r.metrics.Load(name); ok {
+		return fmt.Errorf("%w: %v", ErrDuplicateMetric, name)
+	}
+	if v := reflect.ValueOf(i); v.Kind() == reflect.Func {
+		i = v.Call(nil)[0].Interface()
+	}
+	_, loaded, ok := r.loadOrRegister(name, i)
+	if loaded {
+		return fmt.Errorf("%w: %v", ErrDuplicateMetric, name)
+	}
+	if !ok {
+		return fmt.Errorf("unsupported metric type %T: %v", i, name)
+	}
+	return nil
+}
+
+// GetAll returns a snapshot of every registered metric, keyed by name and
+// then by the statistic. Reading a ResettingTimer this way resets it.
+func (r *StandardRegistry) GetAll() map[string]map[string]interface{} {
+	data := make(map[string]map[string]interface{})
+	r.Each(func(name string, i interface{}) {
+		values := make(map[string]interface{})
+		switch metric := i.(type) {
+		case *Counter:
+			values["count"] = metric.Snapshot().Count()
+		case *CounterFloat64:
+			values["count"] = metric.Snapshot().Count()
+		case *Gauge:
+			values["value"] = metric.Snapshot().Value()
+		case *GaugeFloat64:
+			values["value"] = metric.Snapshot().Value()
+		case *GaugeInfo:
+			values["value"] = metric.Snapshot().Value()
+		case *Healthcheck:
+			values["error"] = nil
+			metric.Check()
+			if err := metric.Err(); err != nil {
+				values["error"] = err.Error()
+			}
+		case Histogram:
+			h := metric.Snapshot()
+			ps := h.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999})
+			values["count"] = h.Count()
+			values["min"] = h.Min()
+			values["max"] = h.Max()
+			values["mean"] = h.Mean()
+			values["stddev"] = h.StdDev()
+			values["median"] = ps[0]
+			values["75%"] = ps[1]
+			values["95%"] = ps[2]
+			values["99%"] = ps[3]
+			values["99.9%"] = ps[4]
+		case *ResettingTimer:
+			t := metric.Snapshot()
+			ps := t.Percentiles([]float64{0.5, 0.75, 0.95, 0.99})
+			values["count"] = t.Count()
+			values["mean"] = t.Mean()
+			values["min"] = t.Min()
+			values["max"] = t.Max()
+			values["median"] = ps[0]
+			values["75%"] = ps[1]
+			values["95%"] = ps[2]
+			values["99%"] = ps[3]
+		}
+		data[name] = values
+	})
+	return data
+}
+
+// HealthChecks runs every registered Healthcheck.
+func (r *StandardRegistry) HealthChecks() {
+	r.metrics.Range(func(key, value any) bool {
+		if h, ok := value.(*Healthcheck); ok {
+			h.Check()
+		}
+		return true
+	})
+}
+
+func (r *StandardRegistry) UnRegister(name string) {
+	r.metrics.Delete(name)
+}
+
+// loadOrRegister stores i under name unless a metric is already registered
+// there. It returns the metric under name, whether it was already present and
+// whether i is a supported metric type.
 func (r *StandardRegistry) loadOrRegister(name string, i interface{}) (interface{}, bool, bool) {
-	return nil, false, false
+	switch i.(type) {
+	case *Counter, *CounterFloat64, *Gauge, *GaugeFloat64, *GaugeInfo, *Healthcheck, Histogram, *ResettingTimer:
+	default:
+		return nil, false, false
+	}
+	value, loaded := r.metrics.LoadOrStore(name, i)
+	return value, loaded, true
 }
 
 func (r *StandardRegistry) registered() map[string]interface{} {
@@ -0,0 +1,71 @@
+package metric
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register("foo", NewCounter()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("foo", NewCounter()); !errors.Is(err, ErrDuplicateMetric) {
+		t.Errorf("Register() duplicate error = %v, want %v", err, ErrDuplicateMetric)
+	}
+	if err := r.Register("bar", "not a metric"); err == nil {
+		t.Errorf("Register() of unsupported type succeeded")
+	}
+	if m := r.Get("bar"); m != nil {
+		t.Errorf("Get(bar) = %v, want nil", m)
+	}
+
+	c := GetOrRegisterCounter("foo", r)
+	c.Inc(2)
+	if c != r.Get("foo") {
+		t.Errorf("GetOrRegisterCounter() did not return the registered counter")
+	}
+	GetOrRegisterGauge("gauge", r).Update(7)
+	GetOrRegisterHistogram("histogram", r, NewUniformSample(10)).Update(3)
+	GetOrRegisterResettingTimer("timer", r).Update(5)
+
+	count := 0
+	r.Each(func(string, interface{}) { count++ })
+	if count != 4 {
+		t.Errorf("Each() visited %d metrics, want 4", count)
+	}
+	all := r.GetAll()
+	if v := all["foo"]["count"]; v != int64(2) {
+		t.Errorf("GetAll() counter = %v, want 2", v)
+	}
+	if v := all["gauge"]["value"]; v != int64(7) {
+		t.Errorf("GetAll() gauge = %v, want 7", v)
+	}
+	if v := all["histogram"]["max"]; v != int64(3) {
+		t.Errorf("GetAll() histogram max = %v, want 3", v)
+	}
+	if v := all["timer"]["count"]; v != 1 {
+		t.Errorf("GetAll() timer count = %v, want 1", v)
+	}
+
+	r.UnRegister("foo")
+	if m := r.Get("foo"); m != nil {
+		t.Errorf("Get(foo) after UnRegister() = %v, want nil", m)
+	}
+}
+
+func TestRegistryHealthChecks(t *testing.T) {
+	r := NewRegistry()
+	errUnhealthy := errors.New("unhealthy")
+	h := NewHealthcheck(func(h *Healthcheck) { h.Unhealthy(errUnhealthy) })
+	if err := r.Register("check", h); err != nil {
+		t.Fatal(err)
+	}
+	r.HealthChecks()
+	if h.Err() != errUnhealthy {
+		t.Errorf("Healthcheck.Err() = %v, want %v", h.Err(), errUnhealthy)
+	}
+	if v := r.GetAll()["check"]["error"]; v != errUnhealthy.Error() {
+		t.Errorf("GetAll() healthcheck error = %v, want %v", v, errUnhealthy)
+	}
+}
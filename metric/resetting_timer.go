@@ -20,6 +20,15 @@ func NewResettingTimer() *ResettingTimer {
 	}
 }
 
+// GetOrRegisterResettingTimer returns an existing ResettingTimer or constructs
+// and registers a new ResettingTimer. A nil registry means DefaultRegistry.
+func GetOrRegisterResettingTimer(name string, r Registry) *ResettingTimer {
+	if r == nil {
+		r = DefaultRegistry
+	}
+	return r.GetOrRegister(name, NewResettingTimer).(*ResettingTimer)
+}
+
 // Snapshot returns a snapshot of the current timer and resets its values.
 func (t *ResettingTimer) Snapshot() *ResettingTimerSnapshot {
 	t.mutex.Lock()
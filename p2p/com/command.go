@@ -8,6 +8,8 @@ const (
 	PEERACK        Command = 0x02
 	MESSAGESEND    Command = 0x04
 	MESSAGESENDACK Command = 0x05
+	CHUNK          Command = 0x06
+	CHUNKACK       Command = 0x07
 )
 
 type Message byte
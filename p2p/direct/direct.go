@@ -0,0 +1,569 @@
+// Package direct implements messages between two connected peers, with
+// replay protection and ordered delivery.
+//
+// Every message is signed by its sender and carries the DID of its
+// recipient, a channel and a sequence number counting the messages of the
+// sender to that recipient on the channel. The receiver drops messages whose
+// creation time is outside the freshness window and sequence numbers it has
+// already delivered or buffered, tracked by a window persisted per sender
+// and channel.
+// Messages are delivered in sequence order; when a gap stays open for
+// GapTimeout the receiver asks the sender to resend the missing range.
+//
+// SendPrivate adds end-to-end encryption on top, see SealPrivate.
+package direct
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/pkg/lru"
+	"github.com/wang900115/LCA/store"
+)
+
+// Message codes of the direct protocol
+const (
+	messageMsg = iota // rpc
+	resendMsg         // channel(varbytes) | first(8) | last(8)
+
+	protocolLength
+)
+
+const (
+	protocolName    = "direct"
+	protocolVersion = 1
+
+	// Defaults of the direct config
+	DefaultFreshness    = 5 * time.Minute
+	DefaultGapTimeout   = 2 * time.Second
+	DefaultResendBuffer = 256
+	DefaultMaxPending   = 1024
+	DefaultMaxStreams   = 64
+	DefaultInboxSize    = 256
+
+	// MaxChannelLength bounds the length of a channel name
+	MaxChannelLength = 64
+
+	// Streams without a message for this long are dropped from memory
+	streamIdleTimeout = 10 * time.Minute
+)
+
+var (
+	errMissingDB      = errors.New("direct messaging needs a store")
+	errNoIdentity     = errors.New("direct messaging needs an identity")
+	errNotConnected   = errors.New("peer not connected")
+	errMalformed      = errors.New("malformed direct message")
+	errBadHash        = errors.New("direct message hash mismatch")
+	errWrongRecipient = errors.New("direct message for another recipient")
+	errChannelTooLong = errors.New("direct channel name too long")
+)
+
+// Config configures direct messaging, zero values select the defaults.
+type Config struct {
+	DB       store.KeyValueStore // Sequence numbers and replay windows, required
+	Identity did.IdentifierDID   // Signs sent messages, required
+
+	// Resolve looks up the DID documents of private message recipients which
+	// are not connected, optional.
+	Resolve func(ctx context.Context, id string) (*did.Document, error)
+
+	Freshness    time.Duration // Largest accepted clock difference of a message
+	GapTimeout   time.Duration // Wait before a missing message is re-requested
+	ResendBuffer int           // Sent messages kept per stream for re-requests
+	MaxPending   int           // Out of order messages buffered per sender
+	MaxStreams   int           // Channels a sender can open
+	InboxSize    int
+}
+
+func (c Config) withDefaults() Config {
+	if c.Freshness <= 0 {
+		c.Freshness = DefaultFreshness
+	}
+	if c.GapTimeout <= 0 {
+		c.GapTimeout = DefaultGapTimeout
+	}
+	if c.ResendBuffer <= 0 {
+		c.ResendBuffer = DefaultResendBuffer
+	}
+	if c.MaxPending <= 0 {
+		c.MaxPending = DefaultMaxPending
+	}
+	if c.MaxStreams <= 0 {
+		c.MaxStreams = DefaultMaxStreams
+	}
+	if c.InboxSize <= 0 {
+		c.InboxSize = DefaultInboxSize
+	}
+	return c
+}
+
+// Message is a received direct message.
+type Message struct {
+	From      string // DID of the sender
+	Channel   string
+	Seq       uint64
+	Data      []byte
+	CreatedAt time.Time
+	Private   bool // Data was decrypted from a private envelope
+}
+
+// stream is the receive state of a sender on a channel.
+type stream struct {
+	from      string
+	w         *window
+	active    time.Time // Last message accepted
+	gapSince  time.Time // When the oldest open gap was noticed
+	requested time.Time // Last re-request of the gap
+}
+
+// Direct sends and receives direct messages.
+type Direct struct {
+	config Config
+	db     store.KeyValueStore
+	self   string // DID of the local node
+	seq    sequencer
+	now    func() time.Time
+
+	mu      sync.Mutex
+	streams map[string]*stream
+	pending map[string]int                           // Buffered messages by sender
+	sent    map[string]*lru.BasicLRU[uint64, []byte] // Resend buffers by stream
+
+	peersMu sync.Mutex
+	peers   map[string]*directPeer
+
+	inbox    chan *Message
+	replayed atomic.Uint64 // Messages dropped as replays
+	stale    atomic.Uint64 // Messages dropped as too old or too new
+
+	ctx    context.Context // Cancelled on Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type directPeer struct {
+	id  string
+	doc *did.Document // Verified by the handshake
+	rw  p2p.MsgWriter
+}
+
+// New creates direct messaging and starts its gap detection.
+func New(config Config) (*Direct, error) {
+	if config.DB == nil {
+		return nil, errMissingDB
+	}
+	if config.Identity == nil {
+		return nil, errNoIdentity
+	}
+	config = config.withDefaults()
+	d := &Direct{
+		config:  config,
+		db:      config.DB,
+		self:    config.Identity.Document().ID,
+		seq:     sequencer{db: config.DB},
+		now:     time.Now,
+		streams: make(map[string]*stream),
+		pending: make(map[string]int),
+		sent:    make(map[string]*lru.BasicLRU[uint64, []byte]),
+		peers:   make(map[string]*directPeer),
+		inbox:   make(chan *Message, config.InboxSize),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.wg.Add(1)
+	go d.gapLoop()
+	return d, nil
+}
+
+// Close stops direct messaging.
+func (d *Direct) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// Protocol returns the direct protocol, to be run on every peer.
+func (d *Direct) Protocol() p2p.Protocol {
+	return p2p.Protocol{
+		Name:    protocolName,
+		Version: protocolVersion,
+		Length:  protocolLength,
+		Run:     d.runPeer,
+	}
+}
+
+// Messages returns the channel of received messages, in order per sender
+// and channel.
+func (d *Direct) Messages() <-chan *Message {
+	return d.inbox
+}
+
+// Send sends data to the connected peer to on channel.
+func (d *Direct) Send(to, channel string, data []byte) error {
+	if channel == privateChannel {
+		return errReservedChannel
+	}
+	return d.send(to, channel, data)
+}
+
+func (d *Direct) send(to, channel string, data []byte) error {
+	if len(channel) > MaxChannelLength {
+		return errChannelTooLong
+	}
+	p := d.connected(to)
+	if p == nil {
+		return errNotConnected
+	}
+	rpc, err := d.seal(to, channel, data)
+	if err != nil {
+		return err
+	}
+	return p.send(messageMsg, rpc)
+}
+
+// seal signs the next message of the stream to on channel and keeps it for
+// re-requests.
+func (d *Direct) seal(to, channel string, data []byte) ([]byte, error) {
+	seq, err := d.seq.next(to, channel)
+	if err != nil {
+		return nil, err
+	}
+	payload := network.AppendVarBytes(nil, []byte(to))
+	payload = network.AppendVarBytes(payload, []byte(channel))
+	payload = binary.BigEndian.AppendUint64(payload, seq)
+	msg, err := network.NewMessageFrame(common.PRIVATE, append(payload, data...), nil)
+	if err != nil {
+		return nil, err
+	}
+	rpc, err := network.NewRPCFrame(msg, d.config.Identity)
+	if err != nil {
+		return nil, err
+	}
+	b := rpc.Bytes()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := string(streamKey(nil, to, channel))
+	buf, ok := d.sent[key]
+	if !ok {
+		c := lru.NewBasicLRU[uint64, []byte](d.config.ResendBuffer)
+		buf = &c
+		d.sent[key] = buf
+	}
+	buf.Add(seq, b)
+	return b, nil
+}
+
+func (d *Direct) runPeer(peer p2p.Peer, rw p2p.MsgReadWriter) error {
+	p := &directPeer{id: peer.ID(), doc: peer.Document(), rw: rw}
+	d.peersMu.Lock()
+	d.peers[p.id] = p
+	d.peersMu.Unlock()
+	defer func() {
+		d.peersMu.Lock()
+		if d.peers[p.id] == p {
+			delete(d.peers, p.id)
+		}
+		d.peersMu.Unlock()
+	}()
+
+	for {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			return err
+		}
+		switch msg.Code {
+		case messageMsg:
+			err = d.handleMessage(p, msg.Payload)
+		case resendMsg:
+			err = d.handleResend(p, msg.Payload)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handleMessage checks a message of p and delivers what became in order.
+// A bad signature or recipient ends the connection, replayed and stale
+// messages are dropped.
+func (d *Direct) handleMessage(p *directPeer, b []byte) error {
+	msg, err := d.open(p.id, b)
+	if err != nil {
+		return err
+	}
+	if msg.Channel == privateChannel {
+		from, plaintext, err := d.OpenPrivate(msg.Data)
+		if err != nil {
+			return err
+		}
+		if from != msg.From {
+			return errSenderMismatch
+		}
+		msg.Data, msg.Private = plaintext, true
+	}
+	if diff := d.now().Sub(msg.CreatedAt); diff > d.config.Freshness || diff < -d.config.Freshness {
+		d.stale.Add(1)
+		return nil
+	}
+
+	d.mu.Lock()
+	s, err := d.stream(msg.From, msg.Channel)
+	if err != nil || s == nil {
+		// Without a stream the sender has too many channels
+		d.mu.Unlock()
+		return err
+	}
+	if err := s.w.check(msg.Seq); err != nil {
+		d.mu.Unlock()
+		d.replayed.Add(1)
+		return nil
+	}
+	if d.pending[msg.From] >= d.config.MaxPending && msg.Seq != s.w.next {
+		// Dropped before it counts as seen, the sender can resend it
+		d.mu.Unlock()
+		return nil
+	}
+	ready := s.w.accept(msg)
+	d.addPending(msg.From, 1-len(ready))
+	s.active = time.Now()
+	switch {
+	case len(s.w.pending) == 0:
+		s.gapSince = time.Time{}
+	case len(ready) > 0 || s.gapSince.IsZero():
+		s.gapSince = time.Now()
+	}
+	if len(ready) > 0 {
+		err = d.db.Put(streamKey(windowPrefix, msg.From, msg.Channel), s.w.encode())
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ready {
+		select {
+		case d.inbox <- m:
+		case <-d.ctx.Done():
+			return d.ctx.Err()
+		}
+	}
+	return nil
+}
+
+// open verifies a message sent by from and decodes it.
+func (d *Direct) open(from string, b []byte) (*Message, error) {
+	rpc := new(network.RPCFrame)
+	r := bytes.NewReader(b)
+	if _, err := rpc.Decode(r); err != nil || r.Len() != 0 {
+		return nil, errMalformed
+	}
+	pub, err := did.PublicKeyFromID(from)
+	if err != nil {
+		return nil, err
+	}
+	if err := rpc.Verify(pub); err != nil {
+		return nil, err
+	}
+	frame := new(network.MessageFrame)
+	r = bytes.NewReader(rpc.Payload)
+	if _, err := frame.Decode(r); err != nil || r.Len() != 0 {
+		return nil, errMalformed
+	}
+	if !frame.Verify(nil) {
+		return nil, errBadHash
+	}
+	to, rest, ok := network.SplitVarBytes(frame.Payload)
+	if !ok {
+		return nil, errMalformed
+	}
+	if string(to) != d.self {
+		return nil, errWrongRecipient
+	}
+	channel, rest, ok := network.SplitVarBytes(rest)
+	if !ok {
+		return nil, errMalformed
+	}
+	if len(channel) > MaxChannelLength {
+		return nil, errChannelTooLong
+	}
+	if len(rest) < 8 {
+		return nil, errMalformed
+	}
+	return &Message{
+		From:      from,
+		Channel:   string(channel),
+		Seq:       binary.BigEndian.Uint64(rest),
+		Data:      rest[8:],
+		CreatedAt: time.Unix(0, frame.CreatedAt),
+	}, nil
+}
+
+// stream returns the receive state of from on channel, loading its window
+// from the store. It returns nil if the channel is new and from has
+// MaxStreams channels already. It must be called with d.mu held.
+func (d *Direct) stream(from, channel string) (*stream, error) {
+	key := streamKey(windowPrefix, from, channel)
+	if s, ok := d.streams[string(key)]; ok {
+		return s, nil
+	}
+	w := newWindow(0)
+	b, err := d.db.Get(key)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		// The window of a stream is stored with its first message, so the
+		// stored windows count the channels of from
+		n, err := d.streamCount(from)
+		if err != nil {
+			return nil, err
+		}
+		if n >= d.config.MaxStreams {
+			return nil, nil
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if w, err = decodeWindow(b); err != nil {
+			return nil, err
+		}
+	}
+	s := &stream{from: from, w: w, active: time.Now()}
+	d.streams[string(key)] = s
+	return s, nil
+}
+
+// streamCount returns the number of stored windows of from.
+func (d *Direct) streamCount(from string) (int, error) {
+	it, err := d.db.NewIterator(streamKey(windowPrefix, from, ""), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Release()
+	n := 0
+	for it.Next() {
+		n++
+	}
+	return n, it.Error()
+}
+
+// addPending counts n more messages buffered from the sender from. It must
+// be called with d.mu held.
+func (d *Direct) addPending(from string, n int) {
+	if d.pending[from] += n; d.pending[from] <= 0 {
+		delete(d.pending, from)
+	}
+}
+
+// dropIdle drops the streams which had no message since streamIdleTimeout
+// before now, with their buffered messages. Their windows stay stored, and
+// the dropped messages are accepted again when they are resent.
+func (d *Direct) dropIdle(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, s := range d.streams {
+		if now.Sub(s.active) >= streamIdleTimeout {
+			d.addPending(s.from, -len(s.w.pending))
+			delete(d.streams, key)
+		}
+	}
+}
+
+// handleResend resends the requested messages still in the buffer.
+func (d *Direct) handleResend(p *directPeer, b []byte) error {
+	channel, rest, ok := network.SplitVarBytes(b)
+	if !ok {
+		return errMalformed
+	}
+	if len(rest) != 16 {
+		return errMalformed
+	}
+	first, last := binary.BigEndian.Uint64(rest), binary.BigEndian.Uint64(rest[8:])
+	if last < first || last-first >= uint64(d.config.ResendBuffer) {
+		return errMalformed
+	}
+	var resend [][]byte
+	d.mu.Lock()
+	if buf, ok := d.sent[string(streamKey(nil, p.id, string(channel)))]; ok {
+		for seq := first; seq <= last; seq++ {
+			if rpc, ok := buf.Peek(seq); ok {
+				resend = append(resend, rpc)
+			}
+		}
+	}
+	d.mu.Unlock()
+	for _, rpc := range resend {
+		if err := p.send(messageMsg, rpc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Direct) gapLoop() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.config.GapTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.requestGaps()
+			d.dropIdle(now)
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// requestGaps asks the senders of streams with a gap open for GapTimeout to
+// resend the missing messages.
+func (d *Direct) requestGaps() {
+	type request struct {
+		from, channel string
+		first, last   uint64
+	}
+	var requests []request
+	now := time.Now()
+	d.mu.Lock()
+	for key, s := range d.streams {
+		if len(s.w.pending) == 0 || now.Sub(s.gapSince) < d.config.GapTimeout || now.Sub(s.requested) < d.config.GapTimeout {
+			continue
+		}
+		first := s.w.next
+		last := first + uint64(d.config.ResendBuffer) - 1
+		for seq := range s.w.pending {
+			last = min(last, seq-1)
+		}
+		from, channel, _ := bytes.Cut([]byte(key[len(windowPrefix):]), []byte("/"))
+		requests = append(requests, request{string(from), string(channel), first, last})
+		s.requested = now
+	}
+	d.mu.Unlock()
+
+	for _, r := range requests {
+		p := d.connected(r.from)
+		if p == nil {
+			continue
+		}
+		b := network.AppendVarBytes(nil, []byte(r.channel))
+		b = binary.BigEndian.AppendUint64(b, r.first)
+		p.send(resendMsg, binary.BigEndian.AppendUint64(b, r.last))
+	}
+}
+
+// connected returns the connected peer id, nil if it is not connected.
+func (d *Direct) connected(id string) *directPeer {
+	d.peersMu.Lock()
+	defer d.peersMu.Unlock()
+	return d.peers[id]
+}
+
+func (p *directPeer) send(code uint64, payload []byte) error {
+	return p.rw.WriteMsg(p2p.Msg{Code: code, Payload: payload})
+}
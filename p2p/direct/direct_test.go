@@ -0,0 +1,174 @@
+package direct
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	"github.com/wang900115/LCA/p2p/p2ptest"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+type testNode struct {
+	p2ptest.Node
+	db store.KeyValueStore
+	d  *Direct
+}
+
+func newTestNode(t *testing.T, identity did.IdentifierDID, db store.KeyValueStore, config Config) *testNode {
+	t.Helper()
+	n := p2ptest.NewNode(identity)
+	config.DB, config.Identity = db, n.Identity
+	d, err := New(config)
+	require.NoError(t, err)
+	t.Cleanup(d.Close)
+	return &testNode{Node: n, db: db, d: d}
+}
+
+// connect runs the direct protocol between two nodes over a pipe.
+func connect(t *testing.T, a, b *testNode) {
+	t.Helper()
+	protoA, protoB := []p2p.Protocol{a.d.Protocol()}, []p2p.Protocol{b.d.Protocol()}
+	p2ptest.Connect(t, a.Identity, b.Identity, protoA, protoB).Run(protoA, protoB, nil, nil)
+	assert.Eventually(t, func() bool { return a.d.connected(b.ID()) != nil && b.d.connected(a.ID()) != nil }, p2ptest.Timeout, 10*time.Millisecond)
+}
+
+func TestDirect_InOrder(t *testing.T) {
+	alice := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	bob := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{GapTimeout: 50 * time.Millisecond})
+	connect(t, alice, bob)
+
+	require.NoError(t, alice.d.Send(bob.ID(), "general", []byte("one")))
+	// The second message is lost on the way
+	_, err := alice.d.seal(bob.ID(), "general", []byte("two"))
+	require.NoError(t, err)
+	require.NoError(t, alice.d.Send(bob.ID(), "general", []byte("three")))
+	require.NoError(t, alice.d.Send(bob.ID(), "random", []byte("other")))
+
+	got := map[string][]string{}
+	for range 4 {
+		msg := p2ptest.Receive(t, bob.d.Messages())
+		assert.Equal(t, alice.ID(), msg.From)
+		got[msg.Channel] = append(got[msg.Channel], string(msg.Data))
+	}
+	// The gap was re-requested and filled before three was delivered
+	assert.Equal(t, []string{"one", "two", "three"}, got["general"])
+	assert.Equal(t, []string{"other"}, got["random"])
+	p2ptest.AssertNone(t, bob.d.Messages())
+}
+
+func TestDirect_Replay(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	alice := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	bob := newTestNode(t, nil, db, Config{})
+	connect(t, alice, bob)
+
+	rpc, err := alice.d.seal(bob.ID(), "general", []byte("pay 10"))
+	require.NoError(t, err)
+	p := alice.d.connected(bob.ID())
+	require.NoError(t, p.send(messageMsg, rpc))
+	assert.Equal(t, "pay 10", string(p2ptest.Receive(t, bob.d.Messages()).Data))
+
+	// A captured message is dropped, also by a restarted node
+	require.NoError(t, p.send(messageMsg, rpc))
+	p2ptest.AssertNone(t, bob.d.Messages())
+	assert.Equal(t, uint64(1), bob.d.replayed.Load())
+
+	restarted := newTestNode(t, bob.Identity, db, Config{})
+	connect(t, alice, restarted)
+	require.NoError(t, alice.d.connected(bob.ID()).send(messageMsg, rpc))
+	require.NoError(t, alice.d.Send(bob.ID(), "general", []byte("hello")))
+	msg := p2ptest.Receive(t, restarted.d.Messages())
+	assert.Equal(t, "hello", string(msg.Data))
+	assert.Equal(t, uint64(2), msg.Seq)
+	assert.Equal(t, uint64(1), restarted.d.replayed.Load())
+}
+
+func TestDirect_Freshness(t *testing.T) {
+	alice := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	bob := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{Freshness: time.Minute})
+	bob.d.now = func() time.Time { return time.Now().Add(time.Hour) }
+	connect(t, alice, bob)
+
+	require.NoError(t, alice.d.Send(bob.ID(), "general", []byte("late")))
+	p2ptest.AssertNone(t, bob.d.Messages())
+	assert.Equal(t, uint64(1), bob.d.stale.Load())
+}
+
+func TestDirect_WrongRecipient(t *testing.T) {
+	alice := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	bob := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	carol := did.NewDIDIdentifier(nil).Document().ID
+	connect(t, alice, bob)
+
+	// A message to carol which alice forwards to bob
+	rpc, err := alice.d.seal(carol, "general", []byte("for carol"))
+	require.NoError(t, err)
+	require.NoError(t, alice.d.connected(bob.ID()).send(messageMsg, rpc))
+	assert.Eventually(t, func() bool { return bob.d.connected(alice.ID()) == nil }, 5*time.Second, 10*time.Millisecond)
+	p2ptest.AssertNone(t, bob.d.Messages())
+}
+
+func TestDirect_LongChannel(t *testing.T) {
+	alice := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	bob := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	connect(t, alice, bob)
+
+	channel := strings.Repeat("c", MaxChannelLength+1)
+	assert.ErrorIs(t, alice.d.Send(bob.ID(), channel, []byte("hello")), errChannelTooLong)
+
+	// A peer sending one anyway is disconnected
+	rpc, err := alice.d.seal(bob.ID(), channel, []byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, alice.d.connected(bob.ID()).send(messageMsg, rpc))
+	assert.Eventually(t, func() bool { return bob.d.connected(alice.ID()) == nil }, 5*time.Second, 10*time.Millisecond)
+	p2ptest.AssertNone(t, bob.d.Messages())
+}
+
+func TestDirect_StreamLimits(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	alice := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	bob := newTestNode(t, nil, db, Config{MaxStreams: 2, MaxPending: 1, GapTimeout: time.Hour})
+	connect(t, alice, bob)
+
+	// A third channel is ignored
+	for _, channel := range []string{"a", "b", "c"} {
+		require.NoError(t, alice.d.Send(bob.ID(), channel, []byte("first")))
+	}
+	for range 2 {
+		assert.NotEqual(t, "c", p2ptest.Receive(t, bob.d.Messages()).Channel)
+	}
+	p2ptest.AssertNone(t, bob.d.Messages())
+
+	// Out of order messages are buffered up to MaxPending across channels
+	for _, channel := range []string{"a", "b"} {
+		_, err := alice.d.seal(bob.ID(), channel, []byte("lost"))
+		require.NoError(t, err)
+		require.NoError(t, alice.d.Send(bob.ID(), channel, []byte("later")))
+	}
+	assert.Eventually(t, func() bool {
+		bob.d.mu.Lock()
+		defer bob.d.mu.Unlock()
+		return bob.d.pending[alice.ID()] == 1
+	}, p2ptest.Timeout, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	bob.d.mu.Lock()
+	assert.Equal(t, 1, bob.d.pending[alice.ID()])
+	bob.d.mu.Unlock()
+
+	// Idle streams leave memory with their buffered messages, their windows
+	// stay stored
+	bob.d.dropIdle(time.Now().Add(streamIdleTimeout))
+	bob.d.mu.Lock()
+	assert.Empty(t, bob.d.streams)
+	assert.Empty(t, bob.d.pending)
+	bob.d.mu.Unlock()
+	n, err := bob.d.streamCount(alice.ID())
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
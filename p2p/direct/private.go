@@ -0,0 +1,201 @@
+package direct
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+
+	crypto "github.com/wang900115/LCA/crypt"
+	"github.com/wang900115/LCA/did"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+// A private envelope is a PRIVATE network.MessageFrame whose payload is
+//
+//	to(varbytes) | ephemeral(32) | salt(16) | sealed
+//
+// The message key is derived with crypt.DeriveAESKeyBytes from the X25519 secret
+// of a fresh ephemeral key and the key agreement key of the recipient, bound
+// to the ephemeral key and the Ed25519 key of the recipient. sealed is the
+// AES-GCM encryption, authenticating the header, of
+//
+//	from(varbytes) | signature(64) | plaintext
+//
+// where the sender signs the header, from and the plaintext. Anyone relaying
+// the envelope learns the recipient DID only.
+
+// privateChannel is the stream carrying private envelopes, Send rejects it.
+const privateChannel = "\x00private"
+
+const (
+	ephemeralSize = 32
+	saltSize      = 16
+)
+
+// privateDomain separates the signatures of private envelopes from the other
+// signatures of a DID.
+var privateDomain = []byte("lca/direct/private/v1")
+
+var (
+	errReservedChannel = errors.New("channel reserved for private messages")
+	errUnknownDocument = errors.New("no DID document of the recipient")
+	errNotPrivate      = errors.New("not a private envelope")
+	errSenderMismatch  = errors.New("private envelope of another sender")
+)
+
+// SendPrivate encrypts plaintext for the connected peer to and sends it. The
+// recipient receives it as a Message with Private set.
+func (d *Direct) SendPrivate(ctx context.Context, to string, plaintext []byte) error {
+	envelope, err := d.SealPrivate(ctx, to, plaintext)
+	if err != nil {
+		return err
+	}
+	return d.send(to, privateChannel, envelope)
+}
+
+// SealPrivate encrypts plaintext for to and signs it, returning an envelope
+// which can be handed to a relay. The key agreement key of to comes from the
+// DID document of the connected peer, or from Config.Resolve.
+func (d *Direct) SealPrivate(ctx context.Context, to string, plaintext []byte) ([]byte, error) {
+	doc, err := d.document(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	recipientKey, err := doc.KeyAgreementKey()
+	if err != nil {
+		return nil, err
+	}
+	recipientEd, err := doc.VerificationKey()
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPub, ephemeral, err := crypto.X25519GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := crypto.ComputeX25519SharedKey(ephemeral, recipientKey)
+	if err != nil {
+		return nil, err
+	}
+	key, salt, err := crypto.DeriveAESKeyBytes(shared, ephemeralPub.Bytes(), recipientEd)
+	if err != nil {
+		return nil, err
+	}
+
+	header := network.AppendVarBytes(nil, []byte(to))
+	header = append(header, ephemeralPub.Bytes()...)
+	header = append(header, salt...)
+	signature, err := d.config.Identity.SignMessage(privateSigningData(header, d.self, plaintext))
+	if err != nil {
+		return nil, err
+	}
+	inner := network.AppendVarBytes(nil, []byte(d.self))
+	inner = append(append(inner, signature...), plaintext...)
+	sealed, err := crypto.AESGCMEncrypt(inner, key, header)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := network.NewMessageFrame(common.PRIVATE, append(header, sealed...), nil)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// OpenPrivate decrypts an envelope sealed for the local node and verifies
+// its signature, returning the DID of the sender and the plaintext.
+func (d *Direct) OpenPrivate(envelope []byte) (string, []byte, error) {
+	msg := new(network.MessageFrame)
+	r := bytes.NewReader(envelope)
+	if _, err := msg.Decode(r); err != nil || r.Len() != 0 {
+		return "", nil, errMalformed
+	}
+	if msg.Type != common.PRIVATE {
+		return "", nil, errNotPrivate
+	}
+	if !msg.Verify(nil) {
+		return "", nil, errBadHash
+	}
+	to, rest, ok := network.SplitVarBytes(msg.Payload)
+	if !ok {
+		return "", nil, errMalformed
+	}
+	if string(to) != d.self {
+		return "", nil, errWrongRecipient
+	}
+	if len(rest) < ephemeralSize+saltSize {
+		return "", nil, errMalformed
+	}
+	header := msg.Payload[:len(msg.Payload)-len(rest)+ephemeralSize+saltSize]
+	ephemeral, err := ecdh.X25519().NewPublicKey(rest[:ephemeralSize])
+	if err != nil {
+		return "", nil, err
+	}
+	salt, sealed := rest[ephemeralSize:ephemeralSize+saltSize], rest[ephemeralSize+saltSize:]
+
+	shared, err := d.config.Identity.Keys().SharedSecret(ephemeral)
+	if err != nil {
+		return "", nil, err
+	}
+	self := ed25519.PublicKey(d.config.Identity.Keys().GetEd25519PublicKey())
+	key, err := crypto.DeriveKey(shared, salt, crypto.DeriveAESKeyInfoBytes(ephemeral.Bytes(), self))
+	if err != nil {
+		return "", nil, err
+	}
+	inner, err := crypto.AESGCMDecrypt(sealed, key, header)
+	if err != nil {
+		return "", nil, err
+	}
+
+	from, rest, ok := network.SplitVarBytes(inner)
+	if !ok {
+		return "", nil, errMalformed
+	}
+	if len(rest) < ed25519.SignatureSize {
+		return "", nil, errMalformed
+	}
+	signature, plaintext := rest[:ed25519.SignatureSize], rest[ed25519.SignatureSize:]
+	pub, err := did.PublicKeyFromID(string(from))
+	if err != nil {
+		return "", nil, err
+	}
+	if !ed25519.Verify(pub, privateSigningData(header, string(from), plaintext), signature) {
+		return "", nil, network.ErrRPCSignature
+	}
+	return string(from), plaintext, nil
+}
+
+func privateSigningData(header []byte, from string, plaintext []byte) []byte {
+	b := append([]byte(nil), privateDomain...)
+	b = append(b, header...)
+	b = network.AppendVarBytes(b, []byte(from))
+	return append(b, plaintext...)
+}
+
+// document returns the DID document of id, checking that it belongs to id.
+// KeyAgreementKey checks the signature which binds the key agreement key.
+func (d *Direct) document(ctx context.Context, id string) (*did.Document, error) {
+	var doc *did.Document
+	if p := d.connected(id); p != nil && p.doc != nil {
+		doc = p.doc
+	} else if d.config.Resolve != nil {
+		var err error
+		if doc, err = d.config.Resolve(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	if doc == nil {
+		return nil, errUnknownDocument
+	}
+	if doc.ID != id {
+		return nil, did.ErrIDMismatch
+	}
+	if err := doc.ValidateID(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
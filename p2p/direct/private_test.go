@@ -0,0 +1,89 @@
+package direct
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/p2ptest"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+// resolver resolves the documents of nodes.
+func resolver(nodes ...*testNode) func(context.Context, string) (*did.Document, error) {
+	return func(ctx context.Context, id string) (*did.Document, error) {
+		for _, n := range nodes {
+			if n.ID() == id {
+				return n.Identity.Document(), nil
+			}
+		}
+		return nil, errUnknownDocument
+	}
+}
+
+func TestDirect_SendPrivate(t *testing.T) {
+	alice := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	bob := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	connect(t, alice, bob)
+
+	assert.ErrorIs(t, alice.d.Send(bob.ID(), privateChannel, []byte("x")), errReservedChannel)
+	require.NoError(t, alice.d.SendPrivate(context.Background(), bob.ID(), []byte("secret")))
+	msg := p2ptest.Receive(t, bob.d.Messages())
+	assert.True(t, msg.Private)
+	assert.Equal(t, alice.ID(), msg.From)
+	assert.Equal(t, []byte("secret"), msg.Data)
+}
+
+func TestPrivateEnvelope(t *testing.T) {
+	bob := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	carol := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{})
+	alice := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{Resolve: resolver(bob)})
+	ctx := context.Background()
+
+	plaintext := []byte("meet at noon")
+	envelope, err := alice.d.SealPrivate(ctx, bob.ID(), plaintext)
+	require.NoError(t, err)
+	// A relay sees a private message for bob, nothing of its sender or content
+	assert.Equal(t, byte(common.PRIVATE), envelope[0])
+	assert.True(t, bytes.Contains(envelope, []byte(bob.ID())))
+	assert.False(t, bytes.Contains(envelope, []byte(alice.ID())))
+	assert.False(t, bytes.Contains(envelope, plaintext))
+
+	from, got, err := bob.d.OpenPrivate(envelope)
+	require.NoError(t, err)
+	assert.Equal(t, alice.ID(), from)
+	assert.Equal(t, plaintext, got)
+
+	_, _, err = carol.d.OpenPrivate(envelope)
+	assert.ErrorIs(t, err, errWrongRecipient)
+	tampered := bytes.Clone(envelope)
+	tampered[len(tampered)-40] ^= 0x01
+	_, _, err = bob.d.OpenPrivate(tampered)
+	assert.Error(t, err)
+
+	// Recipients need a document which matches their DID
+	_, err = alice.d.SealPrivate(ctx, carol.ID(), plaintext)
+	assert.ErrorIs(t, err, errUnknownDocument)
+	_, err = bob.d.SealPrivate(ctx, carol.ID(), plaintext)
+	assert.ErrorIs(t, err, errUnknownDocument)
+	mallory := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{
+		Resolve: func(context.Context, string) (*did.Document, error) { return bob.Identity.Document(), nil },
+	})
+	_, err = mallory.d.SealPrivate(ctx, carol.ID(), plaintext)
+	assert.ErrorIs(t, err, did.ErrIDMismatch)
+
+	// A document of bob carrying the key agreement key of mallory
+	swapped := newTestNode(t, nil, memorydb.NewMemoryDBStore(), Config{
+		Resolve: func(context.Context, string) (*did.Document, error) {
+			doc := bob.Identity.Document()
+			doc.VerificationMethod[1] = mallory.Identity.Document().VerificationMethod[1]
+			return doc, nil
+		},
+	})
+	_, err = swapped.d.SealPrivate(ctx, bob.ID(), plaintext)
+	assert.ErrorIs(t, err, did.ErrKeyAgreementSig)
+}
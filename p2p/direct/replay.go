@@ -0,0 +1,115 @@
+package direct
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/wang900115/LCA/store"
+)
+
+var (
+	errReplayed = errors.New("message replayed")
+	errTooOld   = errors.New("message sequence already delivered")
+)
+
+// Store key prefixes of the sequence state. Both are followed by
+// <peer>/<channel>.
+var (
+	windowPrefix = []byte("direct/window/")
+	seqPrefix    = []byte("direct/seq/")
+)
+
+// window is the replay window of a sender on a channel. Every sequence
+// number below next was delivered, pending holds the messages received ahead
+// of it, so a number is new if it is at least next and not pending. next is
+// zero before the first message.
+//
+// Only next is persisted. The pending messages were not delivered, so after a
+// restart their resends are accepted again.
+type window struct {
+	next    uint64
+	pending map[uint64]*Message
+}
+
+func newWindow(next uint64) *window {
+	return &window{next: next, pending: make(map[uint64]*Message)}
+}
+
+// check returns whether seq may be accepted.
+func (w *window) check(seq uint64) error {
+	switch {
+	case seq == 0 || seq < w.next:
+		return errTooOld
+	case w.pending[seq] != nil:
+		return errReplayed
+	}
+	return nil
+}
+
+// accept buffers msg, which passed check, and returns the messages which are
+// now ready for delivery, in order.
+func (w *window) accept(msg *Message) []*Message {
+	if w.next == 0 {
+		// The first message of a stream sets where it starts
+		w.next = msg.Seq
+	}
+	w.pending[msg.Seq] = msg
+	var ready []*Message
+	for m, ok := w.pending[w.next]; ok; m, ok = w.pending[w.next] {
+		ready = append(ready, m)
+		delete(w.pending, w.next)
+		w.next++
+	}
+	return ready
+}
+
+func (w *window) encode() []byte {
+	return binary.BigEndian.AppendUint64(nil, w.next)
+}
+
+func decodeWindow(b []byte) (*window, error) {
+	if len(b) != 8 {
+		return nil, errMalformed
+	}
+	return newWindow(binary.BigEndian.Uint64(b)), nil
+}
+
+// streamKey returns the store key of the stream of peer on channel.
+func streamKey(prefix []byte, peer, channel string) []byte {
+	key := make([]byte, 0, len(prefix)+len(peer)+1+len(channel))
+	key = append(append(key, prefix...), peer...)
+	key = append(key, '/')
+	return append(key, channel...)
+}
+
+// sequencer hands out the outgoing sequence numbers, persisting them so a
+// restart does not reuse one.
+type sequencer struct {
+	mu sync.Mutex
+	db store.KeyValueStore
+}
+
+// next returns the next sequence number of the stream to peer on channel,
+// starting at one.
+func (s *sequencer) next(peer, channel string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := streamKey(seqPrefix, peer, channel)
+	var seq uint64
+	b, err := s.db.Get(key)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return 0, err
+	case len(b) != 8:
+		return 0, errMalformed
+	default:
+		seq = binary.BigEndian.Uint64(b)
+	}
+	seq++
+	if err := s.db.Put(key, binary.BigEndian.AppendUint64(nil, seq)); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
@@ -0,0 +1,80 @@
+package direct
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+// deliver passes the messages seqs through w, returning the delivered ones.
+func deliver(t *testing.T, w *window, seqs ...uint64) []uint64 {
+	t.Helper()
+	var delivered []uint64
+	for _, seq := range seqs {
+		require.NoError(t, w.check(seq), "seq %d", seq)
+		for _, m := range w.accept(&Message{Seq: seq}) {
+			delivered = append(delivered, m.Seq)
+		}
+	}
+	return delivered
+}
+
+func TestWindow(t *testing.T) {
+	w := newWindow(0)
+	assert.ErrorIs(t, w.check(0), errTooOld)
+	assert.Equal(t, []uint64{5}, deliver(t, w, 5), "the first message starts the stream")
+	assert.ErrorIs(t, w.check(5), errTooOld)
+	assert.ErrorIs(t, w.check(3), errTooOld)
+
+	assert.Empty(t, deliver(t, w, 7, 70))
+	assert.ErrorIs(t, w.check(70), errReplayed)
+	assert.Equal(t, []uint64{6, 7}, deliver(t, w, 6))
+	assert.ErrorIs(t, w.check(7), errTooOld)
+
+	got, err := decodeWindow(w.encode())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8), got.next)
+	_, err = decodeWindow([]byte{1})
+	assert.ErrorIs(t, err, errMalformed)
+}
+
+func TestWindow_WideGap(t *testing.T) {
+	w := newWindow(0)
+	deliver(t, w, 1)
+	// Message 2 is lost while 3 to 200 arrive
+	for seq := uint64(3); seq <= 200; seq++ {
+		assert.Empty(t, deliver(t, w, seq))
+	}
+
+	// The buffered messages were not delivered, after a restart their
+	// resends are accepted again
+	w, err := decodeWindow(w.encode())
+	require.NoError(t, err)
+	for seq := uint64(200); seq >= 3; seq-- {
+		assert.Empty(t, deliver(t, w, seq))
+	}
+	delivered := deliver(t, w, 2)
+	assert.Len(t, delivered, 199)
+	assert.Equal(t, uint64(200), delivered[len(delivered)-1])
+	assert.ErrorIs(t, w.check(150), errTooOld)
+}
+
+func TestSequencer(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	s := &sequencer{db: db}
+	for want := uint64(1); want <= 3; want++ {
+		seq, err := s.next("did:key:zbob", "general")
+		require.NoError(t, err)
+		assert.Equal(t, want, seq)
+	}
+	seq, err := s.next("did:key:zbob", "random")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), seq, "streams count separately")
+
+	// A restarted sequencer continues where it stopped
+	seq, err = (&sequencer{db: db}).next("did:key:zbob", "general")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), seq)
+}
@@ -0,0 +1,78 @@
+package discover
+
+import (
+	"github.com/wang900115/LCA/p2p/enode"
+)
+
+// lookup iteratively queries the nodes closest to a target, alpha at a time,
+// until no closer node turns up.
+type lookup struct {
+	tab    *Table
+	target enode.ID
+	result []*enode.Node
+	asked  map[enode.ID]bool
+	seen   map[enode.ID]bool
+}
+
+func newLookup(tab *Table, target enode.ID) *lookup {
+	return &lookup{
+		tab:    tab,
+		target: target,
+		asked:  map[enode.ID]bool{tab.self: true},
+		seen:   map[enode.ID]bool{tab.self: true},
+	}
+}
+
+type lookupReply struct {
+	from  *enode.Node
+	nodes []*enode.Node
+	err   error
+}
+
+// run performs the lookup, returning the closest nodes found.
+func (l *lookup) run() []*enode.Node {
+	for _, n := range l.tab.closest(l.target, bucketSize) {
+		l.seen[n.ID()] = true
+		l.result = append(l.result, n)
+	}
+	if len(l.result) == 0 {
+		for _, n := range l.tab.bootnodes {
+			l.seen[n.ID()] = true
+			l.result = insertClosest(l.result, n, l.target, bucketSize)
+		}
+	}
+
+	replies := make(chan lookupReply, alpha)
+	pending := 0
+	for {
+		for i := 0; i < len(l.result) && pending < alpha; i++ {
+			n := l.result[i]
+			if l.asked[n.ID()] {
+				continue
+			}
+			l.asked[n.ID()] = true
+			pending++
+			go func() {
+				nodes, err := l.tab.net.findnode(n, l.target)
+				replies <- lookupReply{from: n, nodes: nodes, err: err}
+			}()
+		}
+		if pending == 0 {
+			return l.result
+		}
+		reply := <-replies
+		pending--
+		l.tab.findnodeResult(reply.from, reply.err)
+		if reply.err != nil {
+			continue
+		}
+		for _, n := range reply.nodes {
+			if l.seen[n.ID()] {
+				continue
+			}
+			l.seen[n.ID()] = true
+			l.tab.addFoundNode(n)
+			l.result = insertClosest(l.result, n, l.target, bucketSize)
+		}
+	}
+}
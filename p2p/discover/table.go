@@ -0,0 +1,393 @@
+package discover
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	mrand "math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wang900115/LCA/p2p/enode"
+)
+
+const (
+	alpha           = 3  // Parallel findnode requests of a lookup
+	bucketSize      = 16 // Nodes per k-bucket
+	maxReplacements = 10 // Replacement candidates per k-bucket
+
+	// Failed findnode requests in a row after which a node is dropped
+	maxFindnodeFailures = 4
+
+	hashBits = len(enode.ID{}) * 8
+	nBuckets = hashBits // One bucket per log distance 1..256
+
+	// Default intervals of the table maintenance
+	DefaultRefreshInterval    = 30 * time.Minute
+	DefaultRevalidateInterval = 10 * time.Second
+)
+
+// tableNode is a node in the table.
+type tableNode struct {
+	*enode.Node
+	addedAt        time.Time
+	livenessChecks uint // Revalidations the node answered
+}
+
+// bucket holds the nodes at one log distance from the local node, most
+// recently seen first. Nodes which do not fit wait as replacements.
+type bucket struct {
+	entries      []*tableNode
+	replacements []*tableNode
+}
+
+// transport is the network side of the table.
+type transport interface {
+	ping(*enode.Node) error
+	findnode(n *enode.Node, target enode.ID) ([]*enode.Node, error)
+}
+
+// Table is a Kademlia routing table of k-buckets keyed by the log distance of
+// node IDs from the local node. It is kept fresh by a lookup of random
+// targets every refresh interval, and by pinging the least recently seen
+// node of a random bucket every revalidation interval: nodes which do not
+// answer are replaced.
+type Table struct {
+	mu        sync.Mutex
+	buckets   [nBuckets]*bucket
+	self      enode.ID
+	net       transport
+	rand      *mrand.Rand
+	bootnodes []*enode.Node
+	fails     map[enode.ID]int // Failed findnode requests in a row
+
+	refreshInterval    time.Duration
+	revalidateInterval time.Duration
+
+	refreshReq chan chan struct{}
+	initDone   chan struct{}
+	closeReq   chan struct{}
+	closed     chan struct{}
+}
+
+func newTable(net transport, self enode.ID, bootnodes []*enode.Node, refreshInterval, revalidateInterval time.Duration) *Table {
+	var seed [8]byte
+	rand.Read(seed[:])
+	tab := &Table{
+		self:               self,
+		net:                net,
+		rand:               mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))),
+		fails:              make(map[enode.ID]int),
+		refreshInterval:    refreshInterval,
+		revalidateInterval: revalidateInterval,
+		refreshReq:         make(chan chan struct{}),
+		initDone:           make(chan struct{}),
+		closeReq:           make(chan struct{}),
+		closed:             make(chan struct{}),
+	}
+	for _, n := range bootnodes {
+		if n.ID() != self {
+			tab.bootnodes = append(tab.bootnodes, n)
+		}
+	}
+	for i := range tab.buckets {
+		tab.buckets[i] = new(bucket)
+	}
+	return tab
+}
+
+// loop schedules refresh and revalidation until close.
+func (tab *Table) loop() {
+	var (
+		refresh     = time.NewTicker(tab.refreshInterval)
+		revalidate  = time.NewTimer(tab.nextRevalidateTime())
+		refreshDone = make(chan struct{})
+		waiting     = []chan struct{}{tab.initDone}
+	)
+	defer refresh.Stop()
+	defer revalidate.Stop()
+
+	// Start the initial refresh
+	go tab.doRefresh(refreshDone)
+
+loop:
+	for {
+		select {
+		case <-refresh.C:
+			if refreshDone == nil {
+				refreshDone = make(chan struct{})
+				go tab.doRefresh(refreshDone)
+			}
+		case req := <-tab.refreshReq:
+			waiting = append(waiting, req)
+			if refreshDone == nil {
+				refreshDone = make(chan struct{})
+				go tab.doRefresh(refreshDone)
+			}
+		case <-refreshDone:
+			for _, ch := range waiting {
+				close(ch)
+			}
+			waiting, refreshDone = nil, nil
+		case <-revalidate.C:
+			tab.doRevalidate()
+			revalidate.Reset(tab.nextRevalidateTime())
+		case <-tab.closeReq:
+			break loop
+		}
+	}
+	if refreshDone != nil {
+		<-refreshDone
+	}
+	for _, ch := range waiting {
+		close(ch)
+	}
+	close(tab.closed)
+}
+
+// refresh triggers a refresh and returns a channel closed once it finished.
+func (tab *Table) refresh() <-chan struct{} {
+	done := make(chan struct{})
+	select {
+	case tab.refreshReq <- done:
+	case <-tab.closeReq:
+		close(done)
+	}
+	return done
+}
+
+func (tab *Table) close() {
+	close(tab.closeReq)
+	<-tab.closed
+}
+
+// doRefresh seeds the table with the bootnodes and looks up the local node
+// and random targets, filling the buckets along the way.
+func (tab *Table) doRefresh(done chan struct{}) {
+	defer close(done)
+	for _, n := range tab.bootnodes {
+		tab.addFoundNode(n)
+	}
+	lookup := func(target enode.ID) {
+		select {
+		case <-tab.closeReq:
+		default:
+			newLookup(tab, target).run()
+		}
+	}
+	lookup(tab.self)
+	for i := 0; i < 3; i++ {
+		var target enode.ID
+		tab.mu.Lock()
+		tab.rand.Read(target[:])
+		tab.mu.Unlock()
+		lookup(target)
+	}
+}
+
+// doRevalidate pings the least recently seen node of a random bucket. A node
+// which answers moves to the front, otherwise it is replaced.
+func (tab *Table) doRevalidate() {
+	tab.mu.Lock()
+	last, bi := tab.nodeToRevalidate()
+	var node *enode.Node
+	if last != nil {
+		node = last.Node
+	}
+	tab.mu.Unlock()
+	if last == nil {
+		return
+	}
+
+	err := tab.net.ping(node)
+
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	b := tab.buckets[bi]
+	if err == nil {
+		last.livenessChecks++
+		tab.bumpInBucket(b, node)
+		return
+	}
+	tab.replace(b, last)
+}
+
+func (tab *Table) nextRevalidateTime() time.Duration {
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	return time.Duration(tab.rand.Int63n(int64(tab.revalidateInterval)))
+}
+
+// nodeToRevalidate returns the last node of a random non-empty bucket.
+func (tab *Table) nodeToRevalidate() (*tableNode, int) {
+	for _, bi := range tab.rand.Perm(len(tab.buckets)) {
+		b := tab.buckets[bi]
+		if len(b.entries) > 0 {
+			return b.entries[len(b.entries)-1], bi
+		}
+	}
+	return nil, 0
+}
+
+// bucket returns the bucket of id, nil for the local node.
+func (tab *Table) bucket(id enode.ID) *bucket {
+	d := enode.LogDist(tab.self, id)
+	if d == 0 {
+		return nil
+	}
+	return tab.buckets[d-1]
+}
+
+// addFoundNode adds a node learned from another node. It goes into its bucket
+// if there is room, otherwise it becomes a replacement candidate.
+func (tab *Table) addFoundNode(n *enode.Node) {
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	b := tab.bucket(n.ID())
+	if b == nil || contains(b.entries, n.ID()) {
+		return
+	}
+	if len(b.entries) >= bucketSize {
+		tab.addReplacement(b, n)
+		return
+	}
+	b.entries = append(b.entries, &tableNode{Node: n, addedAt: time.Now()})
+	b.replacements = deleteNode(b.replacements, n.ID())
+}
+
+// addVerifiedNode adds a node which just answered, moving it to the front
+// of its bucket.
+func (tab *Table) addVerifiedNode(n *enode.Node) {
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	b := tab.bucket(n.ID())
+	if b == nil || tab.bumpInBucket(b, n) {
+		return
+	}
+	if len(b.entries) >= bucketSize {
+		tab.addReplacement(b, n)
+		return
+	}
+	b.entries = slices.Insert(b.entries, 0, &tableNode{Node: n, addedAt: time.Now()})
+	b.replacements = deleteNode(b.replacements, n.ID())
+}
+
+// bumpInBucket moves n to the front of b, updating its endpoint. It reports
+// whether n was in b.
+func (tab *Table) bumpInBucket(b *bucket, n *enode.Node) bool {
+	for i, e := range b.entries {
+		if e.ID() == n.ID() {
+			e.Node = n
+			copy(b.entries[1:], b.entries[:i])
+			b.entries[0] = e
+			return true
+		}
+	}
+	return false
+}
+
+func (tab *Table) addReplacement(b *bucket, n *enode.Node) {
+	if contains(b.replacements, n.ID()) {
+		return
+	}
+	b.replacements = slices.Insert(b.replacements, 0, &tableNode{Node: n, addedAt: time.Now()})
+	if len(b.replacements) > maxReplacements {
+		b.replacements = b.replacements[:maxReplacements]
+	}
+}
+
+// replace removes last from b, promoting a random replacement.
+func (tab *Table) replace(b *bucket, last *tableNode) {
+	if len(b.entries) == 0 || b.entries[len(b.entries)-1].ID() != last.ID() {
+		// The entry moved or was replaced in the meantime
+		return
+	}
+	b.entries = b.entries[:len(b.entries)-1]
+	if len(b.replacements) == 0 {
+		return
+	}
+	i := tab.rand.Intn(len(b.replacements))
+	r := b.replacements[i]
+	b.replacements = slices.Delete(b.replacements, i, i+1)
+	b.entries = append(b.entries, r)
+}
+
+// findnodeResult records the outcome of a findnode request to n. A node
+// which answered is alive, one failing too often in a row is dropped.
+func (tab *Table) findnodeResult(n *enode.Node, err error) {
+	if err == nil {
+		tab.mu.Lock()
+		delete(tab.fails, n.ID())
+		tab.mu.Unlock()
+		tab.addVerifiedNode(n)
+		return
+	}
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	tab.fails[n.ID()]++
+	if tab.fails[n.ID()] < maxFindnodeFailures {
+		return
+	}
+	delete(tab.fails, n.ID())
+	if b := tab.bucket(n.ID()); b != nil {
+		b.entries = deleteNode(b.entries, n.ID())
+	}
+}
+
+// closest returns the max nodes of the table closest to target.
+func (tab *Table) closest(target enode.ID, max int) []*enode.Node {
+	var nodes []*enode.Node
+	for _, n := range tab.nodes() {
+		nodes = insertClosest(nodes, n, target, max)
+	}
+	return nodes
+}
+
+// nodes returns all nodes in the table.
+func (tab *Table) nodes() []*enode.Node {
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	var nodes []*enode.Node
+	for _, b := range tab.buckets {
+		for _, e := range b.entries {
+			nodes = append(nodes, e.Node)
+		}
+	}
+	return nodes
+}
+
+// len returns the number of nodes in the table.
+func (tab *Table) len() int {
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	n := 0
+	for _, b := range tab.buckets {
+		n += len(b.entries)
+	}
+	return n
+}
+
+// insertClosest inserts n into nodes, which are sorted by distance to target,
+// keeping at most max nodes.
+func insertClosest(nodes []*enode.Node, n *enode.Node, target enode.ID, max int) []*enode.Node {
+	i, found := slices.BinarySearchFunc(nodes, n, func(a, b *enode.Node) int {
+		return enode.DistCmp(target, a.ID(), b.ID())
+	})
+	// Distances are unique, an equal one is the same node
+	if found || i >= max {
+		return nodes
+	}
+	nodes = slices.Insert(nodes, i, n)
+	if len(nodes) > max {
+		nodes = nodes[:max]
+	}
+	return nodes
+}
+
+func contains(nodes []*tableNode, id enode.ID) bool {
+	return slices.ContainsFunc(nodes, func(n *tableNode) bool { return n.ID() == id })
+}
+
+func deleteNode(nodes []*tableNode, id enode.ID) []*tableNode {
+	return slices.DeleteFunc(nodes, func(n *tableNode) bool { return n.ID() == id })
+}
@@ -0,0 +1,116 @@
+package discover
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wang900115/LCA/p2p/enode"
+)
+
+// pingRecorder is a transport answering pings of the nodes marked alive.
+type pingRecorder struct {
+	mu    sync.Mutex
+	alive map[enode.ID]bool
+}
+
+func (r *pingRecorder) ping(n *enode.Node) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.alive[n.ID()] {
+		return errors.New("dead")
+	}
+	return nil
+}
+
+func (r *pingRecorder) findnode(n *enode.Node, target enode.ID) ([]*enode.Node, error) {
+	return nil, errTimeout
+}
+
+// nodeAtDistance returns a node at log distance d from base.
+func nodeAtDistance(base enode.ID, d int, i byte) *enode.Node {
+	id := base
+	pos := len(id) - 1 - (d-1)/8
+	bit := byte(0x01) << ((d - 1) % 8)
+	id[pos] ^= bit
+	// Vary the bits below the distance bit to get distinct nodes
+	if pos == len(id)-1 {
+		id[pos] ^= i & (bit - 1)
+	} else {
+		id[len(id)-1] ^= i
+	}
+	return enode.New(id, netip.MustParseAddr("127.0.0.1"), 30303, 30303)
+}
+
+func newTestTable(tr transport) *Table {
+	return newTable(tr, enode.ID{}, nil, time.Hour, time.Hour)
+}
+
+func TestTable_Buckets(t *testing.T) {
+	tab := newTestTable(&pingRecorder{})
+	assert.Equal(t, 200, enode.LogDist(tab.self, nodeAtDistance(tab.self, 200, 3).ID()))
+	for i := 0; i < bucketSize+5; i++ {
+		tab.addFoundNode(nodeAtDistance(tab.self, 200, byte(i)))
+	}
+	b := tab.bucket(nodeAtDistance(tab.self, 200, 0).ID())
+	assert.Len(t, b.entries, bucketSize)
+	assert.Len(t, b.replacements, 5)
+	assert.Equal(t, bucketSize, tab.len())
+
+	// The local node never enters the table
+	tab.addFoundNode(enode.New(tab.self, netip.MustParseAddr("127.0.0.1"), 1, 1))
+	assert.Equal(t, bucketSize, tab.len())
+
+	// A verified node moves to the front
+	last := b.entries[bucketSize-1].Node
+	tab.addVerifiedNode(last)
+	assert.Equal(t, last.ID(), b.entries[0].ID())
+}
+
+func TestTable_Revalidate(t *testing.T) {
+	tr := &pingRecorder{alive: make(map[enode.ID]bool)}
+	tab := newTestTable(tr)
+	for i := 0; i < bucketSize+1; i++ {
+		tab.addFoundNode(nodeAtDistance(tab.self, 100, byte(i)))
+	}
+	b := tab.bucket(nodeAtDistance(tab.self, 100, 0).ID())
+	replacement := b.replacements[0]
+
+	// A live node moves to the front
+	last := b.entries[bucketSize-1]
+	tr.alive[last.ID()] = true
+	tab.doRevalidate()
+	assert.Equal(t, last.ID(), b.entries[0].ID())
+	assert.Equal(t, uint(1), last.livenessChecks)
+
+	// A dead one is replaced
+	dead := b.entries[bucketSize-1]
+	tab.doRevalidate()
+	assert.Len(t, b.entries, bucketSize)
+	assert.False(t, contains(b.entries, dead.ID()))
+	assert.True(t, contains(b.entries, replacement.ID()))
+	assert.Empty(t, b.replacements)
+}
+
+func TestTable_Closest(t *testing.T) {
+	tab := newTestTable(&pingRecorder{})
+	for d := 1; d <= 256; d += 5 {
+		tab.addFoundNode(nodeAtDistance(tab.self, d, 0))
+	}
+	target := nodeAtDistance(tab.self, 11, 0).ID()
+	closest := tab.closest(target, bucketSize)
+	assert.Len(t, closest, bucketSize)
+	assert.Equal(t, target, closest[0].ID())
+	for i := 1; i < len(closest); i++ {
+		assert.Equal(t, -1, enode.DistCmp(target, closest[i-1].ID(), closest[i].ID()))
+	}
+
+	// Nodes failing findnode too often are dropped
+	for i := 0; i < maxFindnodeFailures; i++ {
+		tab.findnodeResult(closest[0], errTimeout)
+	}
+	assert.NotEqual(t, target, tab.closest(target, 1)[0].ID())
+}
@@ -0,0 +1,456 @@
+// Package discover finds peers with a Kademlia-style protocol over UDP.
+// Nodes are identified by the enode.ID derived from their Ed25519 key, and
+// kept in a routing table of k-buckets by log distance. Nodes talk in
+// PING/PONG/FINDNODE/NEIGHBORS packets; a node only answers FINDNODE once the
+// requester proved its endpoint by answering a PING, so the protocol can not
+// be used to flood a spoofed address.
+package discover
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wang900115/LCA/p2p/enode"
+	"github.com/wang900115/LCA/pkg/lru"
+)
+
+const (
+	// DefaultRespTimeout bounds waiting for a reply
+	DefaultRespTimeout = 500 * time.Millisecond
+
+	// Lifetime of a packet and of an endpoint proof
+	packetExpiration = 20 * time.Second
+	bondExpiration   = 24 * time.Hour
+
+	// Endpoint proofs of pinging nodes in flight at once
+	maxPingBacks = 16
+	// Endpoint proofs kept in each direction
+	maxBonds = 4096
+)
+
+var (
+	errTimeout    = errors.New("RPC timeout")
+	errClosed     = errors.New("socket closed")
+	errMissingKey = errors.New("missing node key")
+)
+
+// Signer holds the key of the local node, did.KeyPair implements it.
+type Signer interface {
+	GetEd25519PublicKey() []byte
+	SignData(data []byte) ([]byte, error)
+}
+
+// UDPConn is a packet connection, *net.UDPConn implements it.
+type UDPConn interface {
+	ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error)
+	WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// Config configures discovery, zero durations select the defaults.
+type Config struct {
+	Key       Signer
+	TCPPort   uint16 // Advertised peer connection port, the UDP port if zero
+	Bootnodes []*enode.Node
+
+	RefreshInterval    time.Duration
+	RevalidateInterval time.Duration
+	RespTimeout        time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = DefaultRefreshInterval
+	}
+	if c.RevalidateInterval <= 0 {
+		c.RevalidateInterval = DefaultRevalidateInterval
+	}
+	if c.RespTimeout <= 0 {
+		c.RespTimeout = DefaultRespTimeout
+	}
+	return c
+}
+
+// UDP is a running discovery node.
+type UDP struct {
+	conn        UDPConn
+	key         Signer
+	self        *enode.Node
+	tab         *Table
+	respTimeout time.Duration
+
+	mu       sync.Mutex
+	matchers []*replyMatcher
+	pongFrom *bonds // Endpoint proofs of remote nodes
+	pingFrom *bonds // Remote nodes which checked our endpoint
+	pingWait map[enode.ID][]chan struct{}
+	pingBack map[enode.ID]struct{} // Nodes being pinged back
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	wg        sync.WaitGroup
+}
+
+// replyMatcher waits for a reply of a type from a node.
+type replyMatcher struct {
+	from     enode.ID
+	addr     netip.AddrPort
+	ptype    byte
+	callback func(p any) bool // Reports whether p is the awaited reply
+	errc     chan error
+}
+
+// ListenUDP starts discovery on conn. The first refresh of the table, seeded
+// by the bootnodes, starts right away.
+func ListenUDP(conn UDPConn, config Config) (*UDP, error) {
+	if config.Key == nil {
+		return nil, errMissingKey
+	}
+	config = config.withDefaults()
+	addr, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	tcp := config.TCPPort
+	if tcp == 0 {
+		tcp = addr.Port()
+	}
+	t := &UDP{
+		conn:        conn,
+		key:         config.Key,
+		self:        enode.New(enode.PubkeyToID(ed25519.PublicKey(config.Key.GetEd25519PublicKey())), addr.Addr(), addr.Port(), tcp),
+		respTimeout: config.RespTimeout,
+		pongFrom:    newBonds(maxBonds),
+		pingFrom:    newBonds(maxBonds),
+		pingWait:    make(map[enode.ID][]chan struct{}),
+		pingBack:    make(map[enode.ID]struct{}),
+		closing:     make(chan struct{}),
+	}
+	t.tab = newTable(t, t.self.ID(), config.Bootnodes, config.RefreshInterval, config.RevalidateInterval)
+	t.wg.Add(2)
+	go t.readLoop()
+	go func() {
+		defer t.wg.Done()
+		t.tab.loop()
+	}()
+	return t, nil
+}
+
+// Self returns the local node.
+func (t *UDP) Self() *enode.Node {
+	return t.self
+}
+
+// Nodes returns the nodes in the routing table.
+func (t *UDP) Nodes() []*enode.Node {
+	return t.tab.nodes()
+}
+
+// Lookup finds the nodes closest to target.
+func (t *UDP) Lookup(target enode.ID) []*enode.Node {
+	return newLookup(t.tab, target).run()
+}
+
+// Ping checks that n is alive.
+func (t *UDP) Ping(n *enode.Node) error {
+	return t.ping(n)
+}
+
+// Close stops discovery and closes the connection.
+func (t *UDP) Close() {
+	t.closeOnce.Do(func() {
+		close(t.closing)
+		t.conn.Close()
+		t.tab.close()
+		t.wg.Wait()
+	})
+}
+
+func (t *UDP) ping(n *enode.Node) error {
+	req := &ping{Expiration: expiration(packetExpiration), TCP: t.self.TCP()}
+	packet, hash, err := encodePacket(t.key, pingPacket, req.encode())
+	if err != nil {
+		return err
+	}
+	rm := t.pending(n.ID(), n.UDPEndpoint(), pongPacket, func(p any) bool {
+		return p.(*pong).ReplyTok == hash
+	})
+	return t.request(rm, packet)
+}
+
+func (t *UDP) findnode(n *enode.Node, target enode.ID) ([]*enode.Node, error) {
+	if err := t.ensureBond(n); err != nil {
+		return nil, err
+	}
+	req := &findnode{Expiration: expiration(packetExpiration), Target: target}
+	packet, _, err := encodePacket(t.key, findnodePacket, req.encode())
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*enode.Node
+	rm := t.pending(n.ID(), n.UDPEndpoint(), neighborsPacket, func(p any) bool {
+		for _, rn := range p.(*neighbors).Nodes {
+			if node := rn.node(); validNode(node) && node.ID() != t.self.ID() {
+				nodes = append(nodes, node)
+			}
+		}
+		return true
+	})
+	err = t.request(rm, packet)
+	return nodes, err
+}
+
+// ensureBond makes sure n checked our endpoint recently, which it requires
+// before answering a findnode. Pinging an unknown node makes it ping back.
+func (t *UDP) ensureBond(n *enode.Node) error {
+	t.mu.Lock()
+	if t.pingFrom.valid(n.ID(), time.Now()) {
+		t.mu.Unlock()
+		return nil
+	}
+	wait := make(chan struct{})
+	t.pingWait[n.ID()] = append(t.pingWait[n.ID()], wait)
+	t.mu.Unlock()
+
+	if err := t.ping(n); err != nil {
+		t.removeWaiter(n.ID(), wait)
+		return err
+	}
+	select {
+	case <-wait:
+	case <-time.After(t.respTimeout):
+		// The node may know us already, try the findnode anyway
+		t.removeWaiter(n.ID(), wait)
+	case <-t.closing:
+		t.removeWaiter(n.ID(), wait)
+		return errClosed
+	}
+	return nil
+}
+
+// removeWaiter drops wait, which is still waiting for a ping of id.
+func (t *UDP) removeWaiter(id enode.ID, wait chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	waiting := slices.DeleteFunc(t.pingWait[id], func(ch chan struct{}) bool { return ch == wait })
+	if len(waiting) == 0 {
+		delete(t.pingWait, id)
+	} else {
+		t.pingWait[id] = waiting
+	}
+}
+
+// pending registers a matcher for a reply.
+func (t *UDP) pending(from enode.ID, addr netip.AddrPort, ptype byte, callback func(any) bool) *replyMatcher {
+	rm := &replyMatcher{from: from, addr: addr, ptype: ptype, callback: callback, errc: make(chan error, 1)}
+	t.mu.Lock()
+	t.matchers = append(t.matchers, rm)
+	t.mu.Unlock()
+	return rm
+}
+
+// request sends packet and waits for the reply rm matches.
+func (t *UDP) request(rm *replyMatcher, packet []byte) error {
+	defer t.removeMatcher(rm)
+	if _, err := t.conn.WriteToUDPAddrPort(packet, rm.addr); err != nil {
+		return err
+	}
+	timeout := time.NewTimer(t.respTimeout)
+	defer timeout.Stop()
+	select {
+	case err := <-rm.errc:
+		return err
+	case <-timeout.C:
+		return errTimeout
+	case <-t.closing:
+		return errClosed
+	}
+}
+
+func (t *UDP) removeMatcher(rm *replyMatcher) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, m := range t.matchers {
+		if m == rm {
+			t.matchers = append(t.matchers[:i], t.matchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// handleReply hands a reply to the matcher waiting for it, reporting whether
+// there was one.
+func (t *UDP) handleReply(from enode.ID, addr netip.AddrPort, ptype byte, p any) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, m := range t.matchers {
+		if m.from == from && m.addr == addr && m.ptype == ptype && m.callback(p) {
+			t.matchers = append(t.matchers[:i], t.matchers[i+1:]...)
+			m.errc <- nil
+			return true
+		}
+	}
+	return false
+}
+
+func (t *UDP) send(to netip.AddrPort, ptype byte, body []byte) {
+	packet, _, err := encodePacket(t.key, ptype, body)
+	if err != nil {
+		return
+	}
+	t.conn.WriteToUDPAddrPort(packet, to)
+}
+
+func (t *UDP) readLoop() {
+	defer t.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := t.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-t.closing:
+				return
+			default:
+			}
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				continue
+			}
+			return
+		}
+		t.handlePacket(netip.AddrPortFrom(from.Addr().Unmap(), from.Port()), buf[:n])
+	}
+}
+
+func (t *UDP) handlePacket(from netip.AddrPort, buf []byte) {
+	ptype, body, fromID, hash, err := decodePacket(buf)
+	if err != nil || fromID == t.self.ID() {
+		return
+	}
+	switch ptype {
+	case pingPacket:
+		req := new(ping)
+		if req.decode(body) != nil || expired(req.Expiration) {
+			return
+		}
+		t.send(from, pongPacket, (&pong{Expiration: expiration(packetExpiration), ReplyTok: hash}).encode())
+		t.handlePing(enode.New(fromID, from.Addr(), from.Port(), req.TCP))
+	case pongPacket:
+		p := new(pong)
+		if p.decode(body) != nil || expired(p.Expiration) {
+			return
+		}
+		if t.handleReply(fromID, from, pongPacket, p) {
+			t.mu.Lock()
+			t.pongFrom.add(fromID, time.Now())
+			t.mu.Unlock()
+		}
+	case findnodePacket:
+		req := new(findnode)
+		if req.decode(body) != nil || expired(req.Expiration) {
+			return
+		}
+		t.mu.Lock()
+		proven := t.pongFrom.valid(fromID, time.Now())
+		t.mu.Unlock()
+		if !proven {
+			// The source address may be spoofed
+			return
+		}
+		resp := &neighbors{Expiration: expiration(packetExpiration)}
+		for _, n := range t.tab.closest(req.Target, bucketSize) {
+			resp.Nodes = append(resp.Nodes, nodeToRPC(n))
+		}
+		t.send(from, neighborsPacket, resp.encode())
+	case neighborsPacket:
+		p := new(neighbors)
+		if p.decode(body) != nil || expired(p.Expiration) {
+			return
+		}
+		t.handleReply(fromID, from, neighborsPacket, p)
+	}
+}
+
+// handlePing records that n checked our endpoint. A node whose endpoint is
+// not proven yet is pinged back before it enters the table, unless it is
+// being pinged back already or too many proofs are in flight.
+func (t *UDP) handlePing(n *enode.Node) {
+	t.mu.Lock()
+	now := time.Now()
+	t.pingFrom.add(n.ID(), now)
+	waiting := t.pingWait[n.ID()]
+	delete(t.pingWait, n.ID())
+	proven := t.pongFrom.valid(n.ID(), now)
+	_, busy := t.pingBack[n.ID()]
+	pingBack := !proven && !busy && len(t.pingBack) < maxPingBacks
+	if pingBack {
+		t.pingBack[n.ID()] = struct{}{}
+	}
+	t.mu.Unlock()
+	for _, ch := range waiting {
+		close(ch)
+	}
+
+	if proven {
+		t.tab.addVerifiedNode(n)
+		return
+	}
+	if !pingBack {
+		return
+	}
+	// Called from readLoop, the wait group can not be at zero yet
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		if t.ping(n) == nil {
+			t.tab.addVerifiedNode(n)
+		}
+		t.mu.Lock()
+		delete(t.pingBack, n.ID())
+		t.mu.Unlock()
+	}()
+}
+
+// bonds are the endpoint proofs of nodes by the time they were made, at
+// most limit of them. Adding a proof drops the expired ones, and the oldest
+// one when the limit is reached.
+type bonds struct {
+	proofs lru.BasicLRU[enode.ID, time.Time]
+}
+
+func newBonds(limit int) *bonds {
+	return &bonds{proofs: lru.NewBasicLRU[enode.ID, time.Time](limit)}
+}
+
+func (b *bonds) add(id enode.ID, now time.Time) {
+	b.proofs.Add(id, now)
+	// Adding moves a proof to the front, the oldest ones are at the back
+	for {
+		_, at, ok := b.proofs.GetOldest()
+		if !ok || now.Sub(at) < bondExpiration {
+			return
+		}
+		b.proofs.RemoveOldest()
+	}
+}
+
+// valid reports whether id has a proof which did not expire at now.
+func (b *bonds) valid(id enode.ID, now time.Time) bool {
+	at, ok := b.proofs.Peek(id)
+	return ok && now.Sub(at) < bondExpiration
+}
+
+func (b *bonds) len() int {
+	return b.proofs.Len()
+}
+
+func validNode(n *enode.Node) bool {
+	ip := n.IP()
+	return ip.IsValid() && !ip.IsMulticast() && !ip.IsUnspecified() && n.UDP() != 0
+}
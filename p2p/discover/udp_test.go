@@ -0,0 +1,183 @@
+package discover
+
+import (
+	"crypto/rand"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p/enode"
+)
+
+// startNode starts a discovery node on a loopback port.
+func startNode(t *testing.T, bootnodes ...*enode.Node) *UDP {
+	t.Helper()
+	key, err := did.NewPeerKeyPair(rand.Reader)
+	require.NoError(t, err)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	node, err := ListenUDP(conn, Config{
+		Key:                key,
+		Bootnodes:          bootnodes,
+		RevalidateInterval: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Cleanup(node.Close)
+	return node
+}
+
+func TestWire(t *testing.T) {
+	key, err := did.NewPeerKeyPair(rand.Reader)
+	require.NoError(t, err)
+	req := &neighbors{Expiration: expiration(time.Minute)}
+	for i := 0; i < bucketSize; i++ {
+		req.Nodes = append(req.Nodes, rpcNode{ID: enode.ID{byte(i)}, IP: netip.MustParseAddr("10.0.0.1"), UDP: 30303, TCP: 30304})
+	}
+	packet, hash, err := encodePacket(key, neighborsPacket, req.encode())
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(packet), maxPacketSize, "a full bucket must fit one packet")
+
+	ptype, body, from, gotHash, err := decodePacket(packet)
+	require.NoError(t, err)
+	assert.Equal(t, byte(neighborsPacket), ptype)
+	assert.Equal(t, hash, gotHash)
+	assert.Equal(t, enode.PubkeyToID(key.GetEd25519PublicKey()), from)
+	got := new(neighbors)
+	require.NoError(t, got.decode(body))
+	assert.Equal(t, req, got)
+
+	packet[len(packet)-1] ^= 0x01
+	_, _, _, _, err = decodePacket(packet)
+	assert.ErrorIs(t, err, errBadSignature)
+}
+
+func TestUDP_PingFindnode(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+	require.NoError(t, a.Ping(b.Self()))
+
+	// Answering the ping made b ping back and learn about a
+	assert.Eventually(t, func() bool {
+		return len(b.Nodes()) == 1 && b.Nodes()[0].ID() == a.Self().ID()
+	}, time.Second, 10*time.Millisecond)
+
+	nodes, err := b.findnode(a.Self(), b.Self().ID())
+	require.NoError(t, err)
+	require.Len(t, nodes, 0, "a must not return b itself")
+	nodes, err = a.findnode(b.Self(), a.Self().ID())
+	require.NoError(t, err)
+	assert.Empty(t, nodes)
+}
+
+func TestUDP_FindnodeRequiresEndpointProof(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+	// a never answered a ping of b, a findnode without bonding is ignored
+	req := &findnode{Expiration: expiration(time.Minute), Target: a.Self().ID()}
+	packet, _, err := encodePacket(a.key, findnodePacket, req.encode())
+	require.NoError(t, err)
+	rm := a.pending(b.Self().ID(), b.Self().UDPEndpoint(), neighborsPacket, func(any) bool { return true })
+	assert.ErrorIs(t, a.request(rm, packet), errTimeout)
+}
+
+func TestUDP_Discovery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts many nodes")
+	}
+	boot := startNode(t)
+	nodes := []*UDP{boot}
+	for i := 0; i < 24; i++ {
+		nodes = append(nodes, startNode(t, boot.Self()))
+	}
+	for _, n := range nodes {
+		<-n.tab.initDone
+	}
+	// A second refresh learns about the nodes which joined later
+	for _, n := range nodes {
+		<-n.tab.refresh()
+	}
+
+	// Every node finds any other without knowing its address
+	for i, n := range nodes {
+		target := nodes[(i+7)%len(nodes)].Self()
+		found := n.Lookup(target.ID())
+		require.NotEmpty(t, found, "node %d found nothing", i)
+		assert.Equal(t, target.ID(), found[0].ID(), "node %d did not find its target", i)
+		assert.Equal(t, target.TCPEndpoint(), found[0].TCPEndpoint())
+		assert.Greater(t, len(n.Nodes()), 1, "node %d has a sparse table", i)
+	}
+}
+
+func TestUDP_PingBackLimit(t *testing.T) {
+	n := startNode(t)
+	// Pings from a socket which never answers the ping back
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Every pinging node leaves a proof, only the newest are kept
+	n.mu.Lock()
+	n.pingFrom = newBonds(maxPingBacks)
+	n.mu.Unlock()
+	var last enode.ID
+	for i := 0; i < 2*maxPingBacks; i++ {
+		key, err := did.NewPeerKeyPair(rand.Reader)
+		require.NoError(t, err)
+		last = enode.PubkeyToID(key.GetEd25519PublicKey())
+		req := &ping{Expiration: expiration(time.Minute), TCP: 30303}
+		// The second ping of a node is not pinged back again
+		for j := 0; j < 2; j++ {
+			packet, _, err := encodePacket(key, pingPacket, req.encode())
+			require.NoError(t, err)
+			_, err = conn.WriteToUDPAddrPort(packet, n.Self().UDPEndpoint())
+			require.NoError(t, err)
+		}
+	}
+	assert.Eventually(t, func() bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.pingFrom.valid(last, time.Now())
+	}, time.Second, 10*time.Millisecond)
+	n.mu.Lock()
+	assert.Equal(t, maxPingBacks, n.pingFrom.len())
+	assert.Len(t, n.pingBack, maxPingBacks)
+	n.mu.Unlock()
+
+	// Close waits for the pings back
+	n.Close()
+	assert.Empty(t, n.pingBack)
+}
+
+func TestBonds(t *testing.T) {
+	b := newBonds(2)
+	now := time.Now()
+	ids := []enode.ID{{1}, {2}, {3}}
+	b.add(ids[0], now.Add(-bondExpiration))
+	assert.False(t, b.valid(ids[0], now))
+	b.add(ids[1], now)
+	assert.Equal(t, 1, b.len(), "the expired proof was dropped")
+
+	b.add(ids[0], now)
+	b.add(ids[2], now)
+	assert.Equal(t, 2, b.len())
+	assert.False(t, b.valid(ids[1], now), "the oldest proof made room")
+	assert.True(t, b.valid(ids[0], now))
+	assert.True(t, b.valid(ids[2], now))
+}
+
+func TestUDP_BondWaiterRemoved(t *testing.T) {
+	n := startNode(t)
+	// A node which never pings back
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	silent := enode.New(enode.ID{1}, addr.Addr(), addr.Port(), addr.Port())
+
+	n.ensureBond(silent)
+	n.mu.Lock()
+	assert.Empty(t, n.pingWait)
+	n.mu.Unlock()
+}
@@ -0,0 +1,189 @@
+package discover
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/wang900115/LCA/p2p/enode"
+)
+
+// Every discovery packet is a datagram of
+//
+//	signature(64) | public key(32) | type(1) | body
+//
+// signed with the Ed25519 key of the sender over type and body. The sender's
+// node ID is derived from the public key, so a packet can not speak for
+// another node. Bodies start with an expiration time in unix seconds, which
+// bounds replays.
+const (
+	pingPacket = iota + 1
+	pongPacket
+	findnodePacket
+	neighborsPacket
+)
+
+const (
+	headSize      = ed25519.SignatureSize + ed25519.PublicKeySize + 1
+	maxPacketSize = 1280
+
+	// id | ip | udp | tcp of a node in a neighbors packet
+	rpcNodeSize = len(enode.ID{}) + 16 + 2 + 2
+)
+
+var (
+	errPacketTooSmall = errors.New("too small")
+	errBadSignature   = errors.New("bad signature")
+	errBadBody        = errors.New("malformed packet body")
+)
+
+type (
+	// ping checks a node is alive and proves the endpoint of the sender.
+	ping struct {
+		Expiration uint64
+		TCP        uint16 // TCP port of the sender
+	}
+	// pong answers a ping, ReplyTok is the hash of the ping packet.
+	pong struct {
+		Expiration uint64
+		ReplyTok   [32]byte
+	}
+	// findnode asks for the nodes closest to Target.
+	findnode struct {
+		Expiration uint64
+		Target     enode.ID
+	}
+	// neighbors answers a findnode.
+	neighbors struct {
+		Expiration uint64
+		Nodes      []rpcNode
+	}
+	rpcNode struct {
+		ID  enode.ID
+		IP  netip.Addr
+		UDP uint16
+		TCP uint16
+	}
+)
+
+func expiration(d time.Duration) uint64 {
+	return uint64(time.Now().Add(d).Unix())
+}
+
+func expired(ts uint64) bool {
+	return time.Unix(int64(ts), 0).Before(time.Now())
+}
+
+func nodeToRPC(n *enode.Node) rpcNode {
+	return rpcNode{ID: n.ID(), IP: n.IP(), UDP: n.UDP(), TCP: n.TCP()}
+}
+
+func (n rpcNode) node() *enode.Node {
+	return enode.New(n.ID, n.IP, n.UDP, n.TCP)
+}
+
+func (p *ping) encode() []byte {
+	b := binary.BigEndian.AppendUint64(nil, p.Expiration)
+	return binary.BigEndian.AppendUint16(b, p.TCP)
+}
+
+func (p *ping) decode(b []byte) error {
+	if len(b) != 10 {
+		return errBadBody
+	}
+	p.Expiration = binary.BigEndian.Uint64(b)
+	p.TCP = binary.BigEndian.Uint16(b[8:])
+	return nil
+}
+
+func (p *pong) encode() []byte {
+	b := binary.BigEndian.AppendUint64(nil, p.Expiration)
+	return append(b, p.ReplyTok[:]...)
+}
+
+func (p *pong) decode(b []byte) error {
+	if len(b) != 8+32 {
+		return errBadBody
+	}
+	p.Expiration = binary.BigEndian.Uint64(b)
+	copy(p.ReplyTok[:], b[8:])
+	return nil
+}
+
+func (p *findnode) encode() []byte {
+	b := binary.BigEndian.AppendUint64(nil, p.Expiration)
+	return append(b, p.Target[:]...)
+}
+
+func (p *findnode) decode(b []byte) error {
+	if len(b) != 8+len(p.Target) {
+		return errBadBody
+	}
+	p.Expiration = binary.BigEndian.Uint64(b)
+	copy(p.Target[:], b[8:])
+	return nil
+}
+
+func (p *neighbors) encode() []byte {
+	b := binary.BigEndian.AppendUint64(nil, p.Expiration)
+	b = append(b, byte(len(p.Nodes)))
+	for _, n := range p.Nodes {
+		ip := n.IP.As16()
+		b = append(b, n.ID[:]...)
+		b = append(b, ip[:]...)
+		b = binary.BigEndian.AppendUint16(b, n.UDP)
+		b = binary.BigEndian.AppendUint16(b, n.TCP)
+	}
+	return b
+}
+
+func (p *neighbors) decode(b []byte) error {
+	if len(b) < 9 || len(b) != 9+int(b[8])*rpcNodeSize {
+		return errBadBody
+	}
+	p.Expiration = binary.BigEndian.Uint64(b)
+	p.Nodes = make([]rpcNode, b[8])
+	b = b[9:]
+	for i := range p.Nodes {
+		n := &p.Nodes[i]
+		copy(n.ID[:], b)
+		n.IP = netip.AddrFrom16([16]byte(b[32:48])).Unmap()
+		n.UDP = binary.BigEndian.Uint16(b[48:])
+		n.TCP = binary.BigEndian.Uint16(b[50:])
+		b = b[rpcNodeSize:]
+	}
+	return nil
+}
+
+// encodePacket signs a packet, returning it and its hash.
+func encodePacket(signer Signer, ptype byte, body []byte) ([]byte, [32]byte, error) {
+	data := append([]byte{ptype}, body...)
+	sig, err := signer.SignData(data)
+	if err != nil {
+		return nil, [32]byte{}, err
+	}
+	packet := make([]byte, 0, headSize+len(body))
+	packet = append(packet, sig...)
+	packet = append(packet, signer.GetEd25519PublicKey()...)
+	packet = append(packet, data...)
+	return packet, sha256.Sum256(packet), nil
+}
+
+// decodePacket checks the signature of a packet, returning its type, body,
+// sender and hash.
+func decodePacket(packet []byte) (byte, []byte, enode.ID, [32]byte, error) {
+	var hash [32]byte
+	if len(packet) < headSize {
+		return 0, nil, enode.ID{}, hash, errPacketTooSmall
+	}
+	sig := packet[:ed25519.SignatureSize]
+	pub := ed25519.PublicKey(packet[ed25519.SignatureSize : ed25519.SignatureSize+ed25519.PublicKeySize])
+	data := packet[headSize-1:]
+	if !ed25519.Verify(pub, data, sig) {
+		return 0, nil, enode.ID{}, hash, errBadSignature
+	}
+	return data[0], data[1:], enode.PubkeyToID(pub), sha256.Sum256(packet), nil
+}
@@ -1,15 +1,23 @@
 package enode
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/bits"
 	"net/netip"
+	"net/url"
+	"strconv"
 	"strings"
 )
 
-var errMissingPrefix = errors.New("missing 'enr:' prefix for base64-encoded record")
+var (
+	errMissingPrefix = errors.New("missing 'enr:' prefix for base64-encoded record")
+	errInvalidScheme = errors.New("invalid URL scheme, want \"enode\"")
+	errInvalidIP     = errors.New("invalid IP address")
+)
 
 type Node struct {
 	id       ID
@@ -19,6 +27,93 @@ type Node struct {
 	tcp      uint16
 }
 
+// New creates a node reachable at ip, listening for discovery on the udp
+// port and for peer connections on the tcp port.
+func New(id ID, ip netip.Addr, udp, tcp uint16) *Node {
+	return &Node{id: id, ip: ip.Unmap(), udp: udp, tcp: tcp}
+}
+
+// ID returns the node identifier.
+func (n *Node) ID() ID {
+	return n.id
+}
+
+// IP returns the IP address of the node.
+func (n *Node) IP() netip.Addr {
+	return n.ip
+}
+
+// UDP returns the discovery port of the node.
+func (n *Node) UDP() uint16 {
+	return n.udp
+}
+
+// TCP returns the peer connection port of the node.
+func (n *Node) TCP() uint16 {
+	return n.tcp
+}
+
+// UDPEndpoint returns the discovery endpoint of the node.
+func (n *Node) UDPEndpoint() netip.AddrPort {
+	return netip.AddrPortFrom(n.ip, n.udp)
+}
+
+// TCPEndpoint returns the peer connection endpoint of the node.
+func (n *Node) TCPEndpoint() netip.AddrPort {
+	return netip.AddrPortFrom(n.ip, n.tcp)
+}
+
+// String returns the URL of the node,
+//
+//	enode://<hex id>@<ip>:<tcp>?discport=<udp>
+//
+// where discport is left out when both ports are the same.
+func (n *Node) String() string {
+	u := url.URL{Scheme: "enode", User: url.User(n.id.String()), Host: n.TCPEndpoint().String()}
+	if n.udp != n.tcp {
+		u.RawQuery = "discport=" + strconv.Itoa(int(n.udp))
+	}
+	return u.String()
+}
+
+// Parse parses a node URL as returned by Node.String.
+func Parse(rawurl string) (*Node, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "enode" {
+		return nil, errInvalidScheme
+	}
+	if u.User == nil {
+		return nil, errors.New("missing node ID")
+	}
+	id, err := ParseID(u.User.Username())
+	if err != nil {
+		return nil, err
+	}
+	ip, err := netip.ParseAddr(u.Hostname())
+	if err != nil || !validIP(ip) {
+		return nil, errInvalidIP
+	}
+	tcp, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	udp := tcp
+	if disc := u.Query().Get("discport"); disc != "" {
+		if udp, err = strconv.ParseUint(disc, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid discport: %w", err)
+		}
+	}
+	return New(id, ip, uint16(udp), uint16(tcp)), nil
+}
+
+// PubkeyToID derives the node ID of an Ed25519 public key.
+func PubkeyToID(pub ed25519.PublicKey) ID {
+	return sha256.Sum256(pub)
+}
+
 func validIP(ip netip.Addr) bool {
 	return ip.IsValid() && !ip.IsMulticast()
 }
@@ -0,0 +1,46 @@
+package enode
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeURL(t *testing.T) {
+	id := HexID("0xab00000000000000000000000000000000000000000000000000000000000001")
+	n := New(id, netip.MustParseAddr("10.0.0.1"), 30301, 30303)
+	assert.Equal(t, "enode://ab00000000000000000000000000000000000000000000000000000000000001@10.0.0.1:30303?discport=30301", n.String())
+
+	parsed, err := Parse(n.String())
+	require.NoError(t, err)
+	assert.Equal(t, n, parsed)
+
+	// Without discport both ports are the same
+	parsed, err = Parse("enode://ab00000000000000000000000000000000000000000000000000000000000001@127.0.0.1:30303")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(30303), parsed.UDP())
+	assert.Equal(t, netip.MustParseAddrPort("127.0.0.1:30303"), parsed.UDPEndpoint())
+
+	for _, bad := range []string{
+		"http://ab00000000000000000000000000000000000000000000000000000000000001@127.0.0.1:30303",
+		"enode://127.0.0.1:30303",
+		"enode://ab@127.0.0.1:30303",
+		"enode://ab00000000000000000000000000000000000000000000000000000000000001@localhost:30303",
+		"enode://ab00000000000000000000000000000000000000000000000000000000000001@127.0.0.1",
+	} {
+		_, err := Parse(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLogDist(t *testing.T) {
+	var a, b ID
+	assert.Equal(t, 0, LogDist(a, b))
+	b[31] = 0x01
+	assert.Equal(t, 1, LogDist(a, b))
+	b[0] = 0x80
+	assert.Equal(t, 256, LogDist(a, b))
+	assert.Equal(t, -1, DistCmp(a, a, b))
+}
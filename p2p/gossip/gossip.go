@@ -0,0 +1,507 @@
+// Package gossip implements a gossipsub-like publish/subscribe layer for
+// public channels. Every joined topic keeps a mesh of peers which forward the
+// messages of the topic to each other; messages are signed by the DID of
+// their publisher and deduplicated by ID.
+package gossip
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	"github.com/wang900115/LCA/pkg/lru"
+)
+
+// Message codes of the gossip protocol
+const (
+	subscribeMsg = iota
+	unsubscribeMsg
+	graftMsg
+	pruneMsg
+	publishMsg
+
+	protocolLength
+)
+
+const (
+	protocolName    = "gossip"
+	protocolVersion = 1
+
+	// Defaults of the gossip config
+	DefaultD                 = 6
+	DefaultDlo               = 4
+	DefaultDhi               = 12
+	DefaultMaxHops           = 8
+	DefaultTTL               = 2 * time.Minute
+	DefaultSeenCacheSize     = 4096
+	DefaultHeartbeatInterval = time.Second
+	DefaultSubscriptionSize  = 256
+
+	// MaxTopicLength bounds the length of a topic name
+	MaxTopicLength = 128
+
+	// Messages dated further ahead of the local clock are dropped
+	maxClockSkew = 30 * time.Second
+	// Subscriptions kept per peer, further ones are ignored
+	maxPeerTopics = 256
+)
+
+var (
+	errNoIdentity    = errors.New("gossip requires an identity")
+	errAlreadyJoined = errors.New("topic already joined")
+	errNotJoined     = errors.New("topic not joined")
+	errClosed        = errors.New("gossip closed")
+	errTopicTooLong  = errors.New("gossip topic name too long")
+)
+
+// Config configures a Gossip router.
+type Config struct {
+	Identity did.IdentifierDID // Signs published messages
+
+	D   int // Desired number of mesh peers per topic
+	Dlo int // Fewer mesh peers are topped up to D by the heartbeat
+	Dhi int // More mesh peers are pruned down to D by the heartbeat
+
+	MaxHops uint8         // Messages are not forwarded further
+	TTL     time.Duration // Older messages are dropped
+
+	SeenCacheSize     int // Number of message IDs remembered for deduplication
+	HeartbeatInterval time.Duration
+	SubscriptionSize  int // Buffered messages per subscription, the rest is dropped
+}
+
+func (c *Config) withDefaults() {
+	if c.D <= 0 {
+		c.D = DefaultD
+	}
+	if c.Dlo <= 0 || c.Dlo > c.D {
+		c.Dlo = min(DefaultDlo, c.D)
+	}
+	if c.Dhi < c.D {
+		c.Dhi = max(DefaultDhi, c.D)
+	}
+	if c.MaxHops == 0 {
+		c.MaxHops = DefaultMaxHops
+	}
+	if c.TTL <= 0 {
+		c.TTL = DefaultTTL
+	}
+	if c.SeenCacheSize <= 0 {
+		c.SeenCacheSize = DefaultSeenCacheSize
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if c.SubscriptionSize <= 0 {
+		c.SubscriptionSize = DefaultSubscriptionSize
+	}
+}
+
+// Gossip routes the messages of public channels between peers.
+type Gossip struct {
+	config Config
+	self   string // DID of the local node
+
+	mu     sync.Mutex
+	peers  map[string]*gossipPeer
+	topics map[string]*topic // Joined topics
+	seen   lru.BasicLRU[[32]byte, struct{}]
+
+	duplicates atomic.Uint64 // Messages received more than once
+	now        func() time.Time
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// gossipPeer is a connected peer speaking the gossip protocol.
+type gossipPeer struct {
+	id     string
+	rw     p2p.MsgWriter
+	topics map[string]struct{} // Topics the peer subscribed to
+}
+
+// topic is a joined topic.
+type topic struct {
+	mesh map[string]*gossipPeer
+	sub  chan *Message
+}
+
+// New creates a Gossip router and starts its heartbeat.
+func New(config Config) (*Gossip, error) {
+	if config.Identity == nil {
+		return nil, errNoIdentity
+	}
+	config.withDefaults()
+	g := &Gossip{
+		config:  config,
+		self:    config.Identity.Document().ID,
+		peers:   make(map[string]*gossipPeer),
+		topics:  make(map[string]*topic),
+		seen:    lru.NewBasicLRU[[32]byte, struct{}](config.SeenCacheSize),
+		now:     time.Now,
+		closing: make(chan struct{}),
+	}
+	g.wg.Add(1)
+	go g.heartbeatLoop()
+	return g, nil
+}
+
+// Protocol returns the gossip protocol, to be run on every peer.
+func (g *Gossip) Protocol() p2p.Protocol {
+	return p2p.Protocol{
+		Name:    protocolName,
+		Version: protocolVersion,
+		Length:  protocolLength,
+		Run:     g.runPeer,
+	}
+}
+
+// Close stops the heartbeat and ends all subscriptions.
+func (g *Gossip) Close() {
+	g.closeOnce.Do(func() {
+		close(g.closing)
+		g.wg.Wait()
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for name, t := range g.topics {
+			close(t.sub)
+			delete(g.topics, name)
+		}
+	})
+}
+
+// Join subscribes to topic, returning the channel its messages are delivered
+// on. The channel is closed by Leave or Close.
+func (g *Gossip) Join(name string) (<-chan *Message, error) {
+	if len(name) > MaxTopicLength {
+		return nil, errTopicTooLong
+	}
+	g.mu.Lock()
+	select {
+	case <-g.closing:
+		g.mu.Unlock()
+		return nil, errClosed
+	default:
+	}
+	if _, ok := g.topics[name]; ok {
+		g.mu.Unlock()
+		return nil, errAlreadyJoined
+	}
+	t := &topic{mesh: make(map[string]*gossipPeer), sub: make(chan *Message, g.config.SubscriptionSize)}
+	g.topics[name] = t
+	peers := g.allPeers()
+	grafts := g.fillMesh(name, t, g.config.D)
+	g.mu.Unlock()
+
+	announce := encodeTopics([]string{name})
+	for _, p := range peers {
+		p.send(subscribeMsg, announce)
+	}
+	for _, p := range grafts {
+		p.send(graftMsg, announce)
+	}
+	return t.sub, nil
+}
+
+// Leave unsubscribes from topic and closes its channel.
+func (g *Gossip) Leave(name string) error {
+	g.mu.Lock()
+	t, ok := g.topics[name]
+	if !ok {
+		g.mu.Unlock()
+		return errNotJoined
+	}
+	delete(g.topics, name)
+	close(t.sub)
+	peers := g.allPeers()
+	g.mu.Unlock()
+
+	announce := encodeTopics([]string{name})
+	for _, p := range peers {
+		if _, ok := t.mesh[p.id]; ok {
+			p.send(pruneMsg, announce)
+		}
+		p.send(unsubscribeMsg, announce)
+	}
+	return nil
+}
+
+// Publish signs data and sends it to the mesh of topic. Topics which are not
+// joined are sent to up to D peers subscribed to them.
+func (g *Gossip) Publish(name string, data []byte) error {
+	if len(name) > MaxTopicLength {
+		return errTopicTooLong
+	}
+	env, err := newEnvelope(g.config.Identity, name, data)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.seen.Add(env.id(), struct{}{})
+	var targets []*gossipPeer
+	if t, ok := g.topics[name]; ok {
+		for _, p := range t.mesh {
+			targets = append(targets, p)
+		}
+	} else {
+		targets = g.subscribers(name, nil)
+		rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+		targets = targets[:min(len(targets), g.config.D)]
+	}
+	g.mu.Unlock()
+
+	payload := env.encode()
+	for _, p := range targets {
+		p.send(publishMsg, payload)
+	}
+	return nil
+}
+
+// runPeer handles a peer until the connection ends or it sends a message
+// with an invalid signature.
+func (g *Gossip) runPeer(peer p2p.Peer, rw p2p.MsgReadWriter) error {
+	p := &gossipPeer{id: peer.ID(), rw: rw, topics: make(map[string]struct{})}
+	g.mu.Lock()
+	g.peers[p.id] = p
+	joined := make([]string, 0, len(g.topics))
+	for name := range g.topics {
+		joined = append(joined, name)
+	}
+	g.mu.Unlock()
+	defer g.removePeer(p)
+
+	if len(joined) > 0 {
+		if err := p.send(subscribeMsg, encodeTopics(joined)); err != nil {
+			return err
+		}
+	}
+	for {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			return err
+		}
+		if err := g.handle(p, msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (g *Gossip) removePeer(p *gossipPeer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.peers[p.id] == p {
+		delete(g.peers, p.id)
+	}
+	for _, t := range g.topics {
+		if t.mesh[p.id] == p {
+			delete(t.mesh, p.id)
+		}
+	}
+}
+
+func (g *Gossip) handle(p *gossipPeer, msg p2p.Msg) error {
+	if msg.Code == publishMsg {
+		return g.handlePublish(p, msg.Payload)
+	}
+	topics, err := decodeTopics(msg.Payload)
+	if err != nil {
+		return err
+	}
+	var grafts, prunes []string
+	g.mu.Lock()
+	for _, name := range topics {
+		t := g.topics[name]
+		switch msg.Code {
+		case subscribeMsg:
+			if _, ok := p.topics[name]; !ok && len(p.topics) >= maxPeerTopics {
+				continue
+			}
+			p.topics[name] = struct{}{}
+			if t != nil && len(t.mesh) < g.config.D {
+				t.mesh[p.id] = p
+				grafts = append(grafts, name)
+			}
+		case unsubscribeMsg:
+			delete(p.topics, name)
+			if t != nil {
+				delete(t.mesh, p.id)
+			}
+		case graftMsg:
+			if t == nil {
+				// Grafts only concern the topics we joined
+				continue
+			}
+			p.topics[name] = struct{}{}
+			if len(t.mesh) >= g.config.Dhi {
+				prunes = append(prunes, name)
+			} else {
+				t.mesh[p.id] = p
+			}
+		case pruneMsg:
+			if t != nil {
+				delete(t.mesh, p.id)
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	if len(grafts) > 0 {
+		p.send(graftMsg, encodeTopics(grafts))
+	}
+	if len(prunes) > 0 {
+		p.send(pruneMsg, encodeTopics(prunes))
+	}
+	return nil
+}
+
+// handlePublish delivers and forwards a message seen for the first time.
+// Messages with a bad signature end the connection, stale ones and those
+// dated in the future are dropped.
+func (g *Gossip) handlePublish(from *gossipPeer, payload []byte) error {
+	env, err := decodeEnvelope(payload)
+	if err != nil {
+		return err
+	}
+	id := env.id()
+	g.mu.Lock()
+	seen := g.seen.Contains(id)
+	g.mu.Unlock()
+	if seen {
+		g.duplicates.Add(1)
+		return nil
+	}
+	if err := env.verify(); err != nil {
+		return err
+	}
+	age := g.now().Sub(env.msg.CreatedAt)
+	if env.hops > g.config.MaxHops || age > g.config.TTL || age < -maxClockSkew {
+		return nil
+	}
+
+	g.mu.Lock()
+	if g.seen.Contains(id) {
+		g.mu.Unlock()
+		g.duplicates.Add(1)
+		return nil
+	}
+	g.seen.Add(id, struct{}{})
+	var targets []*gossipPeer
+	if t, ok := g.topics[env.msg.Topic]; ok {
+		select {
+		case t.sub <- &env.msg:
+		default:
+		}
+		if env.hops < g.config.MaxHops {
+			for _, p := range t.mesh {
+				if p != from {
+					targets = append(targets, p)
+				}
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	if len(targets) > 0 {
+		env.hops++
+		payload := env.encode()
+		for _, p := range targets {
+			p.send(publishMsg, payload)
+		}
+	}
+	return nil
+}
+
+func (g *Gossip) heartbeatLoop() {
+	defer g.wg.Done()
+	ticker := time.NewTicker(g.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.heartbeat()
+		case <-g.closing:
+			return
+		}
+	}
+}
+
+// heartbeat keeps the size of every mesh between Dlo and Dhi.
+func (g *Gossip) heartbeat() {
+	type control struct {
+		peer  *gossipPeer
+		code  uint64
+		topic string
+	}
+	var out []control
+	g.mu.Lock()
+	for name, t := range g.topics {
+		if len(t.mesh) < g.config.Dlo {
+			for _, p := range g.fillMesh(name, t, g.config.D) {
+				out = append(out, control{p, graftMsg, name})
+			}
+		}
+		if len(t.mesh) > g.config.Dhi {
+			mesh := make([]*gossipPeer, 0, len(t.mesh))
+			for _, p := range t.mesh {
+				mesh = append(mesh, p)
+			}
+			rand.Shuffle(len(mesh), func(i, j int) { mesh[i], mesh[j] = mesh[j], mesh[i] })
+			for _, p := range mesh[g.config.D:] {
+				delete(t.mesh, p.id)
+				out = append(out, control{p, pruneMsg, name})
+			}
+		}
+	}
+	g.mu.Unlock()
+
+	for _, c := range out {
+		c.peer.send(c.code, encodeTopics([]string{c.topic}))
+	}
+}
+
+// fillMesh adds random subscribers of topic to its mesh until it has n
+// peers, returning the added peers. It must be called with g.mu held.
+func (g *Gossip) fillMesh(name string, t *topic, n int) []*gossipPeer {
+	candidates := g.subscribers(name, t.mesh)
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	candidates = candidates[:min(len(candidates), max(n-len(t.mesh), 0))]
+	for _, p := range candidates {
+		t.mesh[p.id] = p
+	}
+	return candidates
+}
+
+// subscribers returns the peers subscribed to topic which are not in
+// exclude. It must be called with g.mu held.
+func (g *Gossip) subscribers(name string, exclude map[string]*gossipPeer) []*gossipPeer {
+	var peers []*gossipPeer
+	for id, p := range g.peers {
+		if _, ok := p.topics[name]; !ok {
+			continue
+		}
+		if _, ok := exclude[id]; ok {
+			continue
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// allPeers returns the connected peers. It must be called with g.mu held.
+func (g *Gossip) allPeers() []*gossipPeer {
+	peers := make([]*gossipPeer, 0, len(g.peers))
+	for _, p := range g.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (p *gossipPeer) send(code uint64, payload []byte) error {
+	return p.rw.WriteMsg(p2p.Msg{Code: code, Payload: payload})
+}
@@ -0,0 +1,215 @@
+package gossip
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/p2p/p2ptest"
+)
+
+const testTopic = "channel-1"
+
+type testNode struct {
+	p2ptest.Node
+	g   *Gossip
+	sub <-chan *Message
+}
+
+// newTestNodes creates n gossip nodes which joined testTopic.
+func newTestNodes(t *testing.T, n int, config Config) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		n := p2ptest.NewNode(nil)
+		c := config
+		c.Identity = n.Identity
+		g, err := New(c)
+		require.NoError(t, err)
+		t.Cleanup(g.Close)
+		sub, err := g.Join(testTopic)
+		require.NoError(t, err)
+		nodes[i] = &testNode{Node: n, g: g, sub: sub}
+	}
+	return nodes
+}
+
+// connect runs the gossip protocol between two nodes.
+func connect(t *testing.T, a, b *testNode) {
+	t.Helper()
+	protoA, protoB := []p2p.Protocol{a.g.Protocol()}, []p2p.Protocol{b.g.Protocol()}
+	p2ptest.Connect(t, a.Identity, b.Identity, protoA, protoB).Run(protoA, protoB, nil, nil)
+}
+
+func meshSize(g *Gossip, name string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if t, ok := g.topics[name]; ok {
+		return len(t.mesh)
+	}
+	return 0
+}
+
+// waitMesh waits until every node has want[i] mesh peers.
+func waitMesh(t *testing.T, nodes []*testNode, want []int) {
+	t.Helper()
+	for i, n := range nodes {
+		assert.Eventually(t, func() bool { return meshSize(n.g, testTopic) == want[i] }, 5*time.Second, 10*time.Millisecond, "node %d", i)
+	}
+}
+
+func TestGossip_DeliveryAndDedup(t *testing.T) {
+	// A ring with chords gives every message several paths
+	nodes := newTestNodes(t, 8, Config{})
+	for i := range nodes {
+		connect(t, nodes[i], nodes[(i+1)%len(nodes)])
+	}
+	for i := 0; i < len(nodes)/2; i++ {
+		connect(t, nodes[i], nodes[i+len(nodes)/2])
+	}
+	waitMesh(t, nodes, []int{3, 3, 3, 3, 3, 3, 3, 3})
+
+	require.NoError(t, nodes[0].g.Publish(testTopic, []byte("hello")))
+	for i, n := range nodes[1:] {
+		msg := p2ptest.Receive(t, n.sub)
+		assert.Equal(t, testTopic, msg.Topic, "node %d", i+1)
+		assert.Equal(t, []byte("hello"), msg.Data)
+		assert.Equal(t, nodes[0].ID(), msg.From)
+	}
+	// Every node got the message once, the other copies were dropped
+	var duplicates uint64
+	for _, n := range nodes {
+		p2ptest.AssertNone(t, n.sub)
+		duplicates += n.g.duplicates.Load()
+	}
+	assert.NotZero(t, duplicates)
+}
+
+func TestGossip_MaxHops(t *testing.T) {
+	nodes := newTestNodes(t, 5, Config{MaxHops: 2})
+	for i := 0; i < len(nodes)-1; i++ {
+		connect(t, nodes[i], nodes[i+1])
+	}
+	waitMesh(t, nodes, []int{1, 2, 2, 2, 1})
+
+	require.NoError(t, nodes[0].g.Publish(testTopic, []byte("hops")))
+	for _, n := range nodes[1:4] {
+		assert.Equal(t, []byte("hops"), p2ptest.Receive(t, n.sub).Data)
+	}
+	p2ptest.AssertNone(t, nodes[4].sub)
+}
+
+func TestGossip_Leave(t *testing.T) {
+	nodes := newTestNodes(t, 2, Config{})
+	connect(t, nodes[0], nodes[1])
+	waitMesh(t, nodes, []int{1, 1})
+
+	require.NoError(t, nodes[1].g.Leave(testTopic))
+	_, ok := <-nodes[1].sub
+	assert.False(t, ok, "the subscription is closed")
+	assert.ErrorIs(t, nodes[1].g.Leave(testTopic), errNotJoined)
+	waitMesh(t, nodes[:1], []int{0})
+}
+
+func TestGossip_BadSignature(t *testing.T) {
+	nodes := newTestNodes(t, 1, Config{})
+	forger := did.NewDIDIdentifier(nil)
+	g := nodes[0].g
+	c := p2ptest.Connect(t, nodes[0].Identity, forger, []p2p.Protocol{g.Protocol()}, []p2p.Protocol{g.Protocol()})
+	pg, pf := c.A, c.B
+	done := make(chan error, 1)
+	go func() { done <- p2p.RunProtocols(pg, []p2p.Protocol{g.Protocol()}, nil) }()
+
+	// A message claiming to come from another DID
+	env, err := newEnvelope(forger, testTopic, []byte("forged"))
+	require.NoError(t, err)
+	env.from = did.NewDIDIdentifier(nil).Document().ID
+	pkt, err := network.NewPacketFrameBytes(common.Command(0x10+publishMsg), env.encode())
+	require.NoError(t, err)
+	require.NoError(t, pf.Send(pkt))
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, network.ErrRPCSignature)
+	case <-time.After(5 * time.Second):
+		t.Fatal("forged message was accepted")
+	}
+	p2ptest.AssertNone(t, nodes[0].sub)
+}
+
+func TestGossip_TopicLimits(t *testing.T) {
+	nodes := newTestNodes(t, 1, Config{})
+	g := nodes[0].g
+	long := strings.Repeat("t", MaxTopicLength+1)
+	_, err := g.Join(long)
+	assert.ErrorIs(t, err, errTopicTooLong)
+	assert.ErrorIs(t, g.Publish(long, nil), errTopicTooLong)
+
+	remote := did.NewDIDIdentifier(nil)
+	c := p2ptest.Connect(t, nodes[0].Identity, remote, []p2p.Protocol{g.Protocol()}, []p2p.Protocol{g.Protocol()})
+	done := make(chan error, 1)
+	go func() { done <- p2p.RunProtocols(c.A, []p2p.Protocol{g.Protocol()}, nil) }()
+	send := func(code int, topics ...string) {
+		pkt, err := network.NewPacketFrameBytes(common.Command(0x10+code), encodeTopics(topics))
+		require.NoError(t, err)
+		require.NoError(t, c.B.Send(pkt))
+	}
+
+	// Subscriptions beyond the limit and grafts of topics not joined are
+	// ignored
+	var topics []string
+	for i := range maxPeerTopics + 10 {
+		topics = append(topics, fmt.Sprintf("topic-%d", i))
+	}
+	send(graftMsg, "other")
+	send(subscribeMsg, topics...)
+	peerTopics := func() map[string]struct{} {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if p, ok := g.peers[remote.Document().ID]; ok {
+			return maps.Clone(p.topics)
+		}
+		return nil
+	}
+	assert.Eventually(t, func() bool { return len(peerTopics()) == maxPeerTopics }, 5*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, peerTopics(), "other")
+
+	send(subscribeMsg, long)
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, errTopicTooLong)
+	case <-time.After(5 * time.Second):
+		t.Fatal("an over-long topic was accepted")
+	}
+}
+
+func TestGossip_Freshness(t *testing.T) {
+	for _, tt := range []struct {
+		offset time.Duration // Of the clock of the receiver
+		fresh  bool
+	}{
+		{2 * time.Minute, false},
+		{-time.Minute, false},
+		{-maxClockSkew / 2, true},
+	} {
+		nodes := newTestNodes(t, 2, Config{TTL: time.Minute})
+		nodes[1].g.now = func() time.Time { return time.Now().Add(tt.offset) }
+		connect(t, nodes[0], nodes[1])
+		waitMesh(t, nodes, []int{1, 1})
+
+		require.NoError(t, nodes[0].g.Publish(testTopic, []byte("message")))
+		if tt.fresh {
+			assert.Equal(t, []byte("message"), p2ptest.Receive(t, nodes[1].sub).Data, "offset %v", tt.offset)
+		} else {
+			p2ptest.AssertNone(t, nodes[1].sub)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package gossip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/wang900115/LCA/did"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+// A published message travels as an envelope of
+//
+//	hops(1) | from(varbytes) | rpc
+//
+// where rpc is a network.RPCFrame signed by the publisher, carrying a PUBLIC
+// network.MessageFrame whose payload is topic(varbytes) | data. Only the hop
+// count changes on the way, everything else is covered by the signature of
+// the DID in from.
+
+var (
+	errMalformed  = errors.New("malformed gossip message")
+	errNotPublic  = errors.New("gossip message is not public")
+	errBadHash    = errors.New("gossip message hash mismatch")
+	errFromPrefix = errors.New("gossip sender is not a did:key")
+)
+
+// Message is a message published to a topic.
+type Message struct {
+	Topic     string
+	From      string // DID of the publisher
+	Data      []byte
+	CreatedAt time.Time
+}
+
+type envelope struct {
+	hops uint8
+	from string
+	rpc  *network.RPCFrame
+	msg  Message
+}
+
+// newEnvelope signs data published to topic by identity.
+func newEnvelope(identity did.IdentifierDID, topic string, data []byte) (*envelope, error) {
+	payload := network.AppendVarBytes(nil, []byte(topic))
+	msg, err := network.NewMessageFrame(common.PUBLIC, append(payload, data...), nil)
+	if err != nil {
+		return nil, err
+	}
+	rpc, err := network.NewRPCFrame(msg, identity)
+	if err != nil {
+		return nil, err
+	}
+	from := identity.Document().ID
+	return &envelope{
+		from: from,
+		rpc:  rpc.(*network.RPCFrame),
+		msg:  Message{Topic: topic, From: from, Data: data, CreatedAt: time.Unix(0, msg.(*network.MessageFrame).CreatedAt)},
+	}, nil
+}
+
+// id identifies a message no matter which path it took.
+func (e *envelope) id() [32]byte {
+	return sha256.Sum256(e.rpc.Bytes())
+}
+
+func (e *envelope) encode() []byte {
+	b := network.AppendVarBytes([]byte{e.hops}, []byte(e.from))
+	return append(b, e.rpc.Bytes()...)
+}
+
+// decodeEnvelope parses an envelope without checking its signature.
+func decodeEnvelope(b []byte) (*envelope, error) {
+	if len(b) < 1 {
+		return nil, errMalformed
+	}
+	e := &envelope{hops: b[0]}
+	from, rest, ok := network.SplitVarBytes(b[1:])
+	if !ok {
+		return nil, errMalformed
+	}
+	e.from = string(from)
+	e.rpc = new(network.RPCFrame)
+	r := bytes.NewReader(rest)
+	if _, err := e.rpc.Decode(r); err != nil || r.Len() != 0 {
+		return nil, errMalformed
+	}
+	msg := new(network.MessageFrame)
+	r = bytes.NewReader(e.rpc.Payload)
+	if _, err := msg.Decode(r); err != nil || r.Len() != 0 {
+		return nil, errMalformed
+	}
+	if msg.Type != common.PUBLIC {
+		return nil, errNotPublic
+	}
+	topic, data, ok := network.SplitVarBytes(msg.Payload)
+	if !ok {
+		return nil, errMalformed
+	}
+	if !msg.Verify(nil) {
+		return nil, errBadHash
+	}
+	e.msg = Message{Topic: string(topic), From: e.from, Data: data, CreatedAt: time.Unix(0, msg.CreatedAt)}
+	return e, nil
+}
+
+// verify checks the signature of the publisher.
+func (e *envelope) verify() error {
+	pub, err := did.PublicKeyFromID(e.from)
+	if err != nil {
+		return errFromPrefix
+	}
+	return e.rpc.Verify(pub)
+}
+
+// encodeTopics encodes a topic list of a subscription message.
+func encodeTopics(topics []string) []byte {
+	var b []byte
+	for _, t := range topics {
+		b = network.AppendVarBytes(b, []byte(t))
+	}
+	return b
+}
+
+func decodeTopics(b []byte) ([]string, error) {
+	var topics []string
+	for len(b) > 0 {
+		t, rest, ok := network.SplitVarBytes(b)
+		if !ok {
+			return nil, errMalformed
+		}
+		if len(t) > MaxTopicLength {
+			return nil, errTopicTooLong
+		}
+		topics = append(topics, string(t))
+		b = rest
+	}
+	return topics, nil
+}
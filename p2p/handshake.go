@@ -1,39 +1,313 @@
 package p2p
 
-// import (
-// 	"fmt"
-
-// 	common "github.com/wang900115/LCA/p2p/com"
-// 	"github.com/wang900115/LCA/p2p/network"
-// )
-
-// type HandShakeFunc func(Peer) error
-
-// // NoopHandshakeFunc performs no handshake and immediately returns nil.
-// func NoopHandshakeFunc(peer Peer) error {
-// 	return nil
-// }
-
-// // BasicHandshakeFunc performs a simple handshake by sending a HEARTBEAT
-// // command and expecting a PEERACK or HEARTBEAT response.
-// func BasicHandshakeFunc(peer Peer) error {
-
-// 	pkt, err := network.NewPacket(common.HEARTBEAT, nil)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	if err := peer.Send(pkt); err != nil {
-// 		return err
-// 	}
-// 	pkCh, err := peer.Receive()
-// 	if err != nil {
-// 		return err
-// 	}
-// 	for pk := range pkCh {
-// 		cmd := pk.GetCommand()
-// 		if cmd == common.PEERINFO || cmd == common.PEERACK {
-// 			return nil
-// 		}
-// 	}
-// 	return fmt.Errorf("handshake failed")
-// }
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	crypto "github.com/wang900115/LCA/crypt"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+// The handshake runs on the raw connection before any packet is exchanged.
+// Both sides send at the same time, every message is a frame of
+//
+//	code(1) | size(4) | payload
+//
+// 1. hello: a network.HandShakeContent as JSON carrying the signed DID
+// document, a fresh challenge, the highest spoken version, the signature
+// of the X25519 key agreement key and the capabilities of the sender.
+// 2. auth: the Ed25519 signature over both challenges and both DIDs, which
+// proves the sender holds the key of the document it presented.
+//
+// A side which rejects the other sends a disc frame holding the DiscReason
+// instead of the next message.
+const (
+	handshakeMsg = 0x00
+	discMsg      = 0x01
+	authMsg      = 0x02
+
+	handshakeChallengeSize = 32
+	handshakeMaxSize       = 16 * 1024
+
+	// Bounds sending the disconnect reason, the remote may not be reading
+	discWriteTimeout = time.Second
+)
+
+var (
+	handshakeAuthPrefix = []byte("lca handshake auth")
+	handshakeSessionKey = []byte("lca handshake session")
+
+	errHandshakeTooLarge  = errors.New("handshake message too large")
+	errHandshakeUnexpect  = errors.New("unexpected handshake message")
+	errHandshakeMalformed = errors.New("malformed handshake message")
+	errHandshakeKey       = errors.New("invalid key agreement key signature")
+	errHandshakeAuth      = errors.New("invalid challenge signature")
+	errHandshakeDocument  = errors.New("invalid document signature")
+)
+
+type HandShakeFunc func(Peer) error
+
+// NoopHandshakeFunc performs no handshake and immediately returns nil.
+func NoopHandshakeFunc(peer Peer) error {
+	return nil
+}
+
+// handshakeError is returned by a failed handshake. It matches the
+// DiscReason of the failure with errors.Is and errors.As.
+type handshakeError struct {
+	reason DiscReason
+	err    error
+	remote bool // The remote side rejected the handshake
+}
+
+func (e *handshakeError) Error() string {
+	if e.remote {
+		return fmt.Sprintf("handshake rejected by peer: %v", e.reason)
+	}
+	return fmt.Sprintf("handshake failed: %v: %v", e.reason, e.err)
+}
+
+func (e *handshakeError) Unwrap() []error {
+	if e.err == nil {
+		return []error{e.reason}
+	}
+	return []error{e.reason, e.err}
+}
+
+func newHandshakeError(reason DiscReason, err error) *handshakeError {
+	return &handshakeError{reason: reason, err: err}
+}
+
+// NewDIDHandshake returns a mutual challenge-response handshake presenting
+// identity and checking the remote document with verifier. The capabilities
+// of protocols are announced to the remote side. On success the remote
+// document, the session secret, the negotiated version and the shared
+// capabilities are recorded on the peer. Failures carry a DiscReason which is
+// also sent to the remote side.
+func NewDIDHandshake(identity did.IdentifierDID, verifier did.VerifierDID, protocols ...Protocol) HandShakeFunc {
+	caps := protocolCaps(protocols)
+	return func(peer Peer) error {
+		h := &didHandshake{identity: identity, verifier: verifier, caps: caps, peer: peer}
+		err := h.run()
+		var herr *handshakeError
+		if errors.As(err, &herr) && !herr.remote && herr.reason != DiscNetworkError && herr.reason != DiscReadTimeout {
+			// Best effort, the connection is dropped anyway
+			peer.SetWriteDeadline(time.Now().Add(discWriteTimeout))
+			writeFrame(peer, discMsg, []byte{byte(herr.reason)})
+		}
+		return err
+	}
+}
+
+type didHandshake struct {
+	identity did.IdentifierDID
+	verifier did.VerifierDID
+	caps     []Cap
+	peer     Peer
+}
+
+func (h *didHandshake) run() error {
+	// Send our hello, receive theirs
+	local, err := h.hello()
+	if err != nil {
+		return newHandshakeError(DiscRequested, err)
+	}
+	payload, err := json.Marshal(local)
+	if err != nil {
+		return newHandshakeError(DiscRequested, err)
+	}
+	data, err := h.exchange(handshakeMsg, payload)
+	if err != nil {
+		return err
+	}
+	remote := new(network.HandShakeContent)
+	if err := json.Unmarshal(data, remote); err != nil {
+		return newHandshakeError(DiscProtocolError, err)
+	}
+	if remote.DIDDocument == nil || len(remote.Challenge) != handshakeChallengeSize {
+		return newHandshakeError(DiscProtocolError, errHandshakeMalformed)
+	}
+	version, err := h.peer.ProtocolInfo().NegotiateVersion(remote.Version)
+	if err != nil {
+		return newHandshakeError(DiscIncompatibleVersion, err)
+	}
+	remoteCaps := make([]Cap, len(remote.Caps))
+	for i, s := range remote.Caps {
+		if remoteCaps[i], err = parseCap(s); err != nil {
+			return newHandshakeError(DiscProtocolError, err)
+		}
+	}
+	doc := remote.DIDDocument
+	edKey, shared, err := h.verify(remote)
+	if err != nil {
+		return err
+	}
+	if doc.ID == local.DIDDocument.ID {
+		return newHandshakeError(DiscSelf, nil)
+	}
+
+	// Prove both sides hold the keys of their documents
+	sig, err := h.identity.SignMessage(authData(local.DIDDocument.ID, doc.ID, local.Challenge, remote.Challenge))
+	if err != nil {
+		return newHandshakeError(DiscRequested, err)
+	}
+	data, err = h.exchange(authMsg, sig)
+	if err != nil {
+		return err
+	}
+	ok, err := crypto.ED25519Verify(edKey, authData(doc.ID, local.DIDDocument.ID, remote.Challenge, local.Challenge), data)
+	if err != nil || !ok {
+		return newHandshakeError(DiscInvalidIdentity, errHandshakeAuth)
+	}
+
+	// Every session gets its own secret even though the X25519 keys are static
+	secret, err := crypto.DeriveKey(shared, sessionSalt(local.Challenge, remote.Challenge), handshakeSessionKey)
+	if err != nil {
+		return newHandshakeError(DiscRequested, err)
+	}
+	h.peer.SetDocument(doc)
+	h.peer.SetSecret(secret)
+	h.peer.ProtocolInfo().Version = network.ProtocolVersion(version)
+	h.peer.SetCaps(matchCaps(h.caps, remoteCaps))
+	return nil
+}
+
+// hello builds the local hello message.
+func (h *didHandshake) hello() (*network.HandShakeContent, error) {
+	doc := h.identity.Document()
+	data, err := doc.JSONMarshal()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := h.identity.SignMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	keySignature, err := h.identity.Keys().Shake(nil)
+	if err != nil {
+		return nil, err
+	}
+	challenge := make([]byte, handshakeChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	hello := network.NewHandShakeContent(doc, signature, challenge, string(h.peer.ProtocolInfo().Version), keySignature)
+	for _, c := range h.caps {
+		hello.Caps = append(hello.Caps, c.String())
+	}
+	return hello, nil
+}
+
+// verify checks the identity presented in the remote hello, returning the
+// remote verification key and the X25519 shared secret.
+func (h *didHandshake) verify(remote *network.HandShakeContent) ([]byte, []byte, error) {
+	doc := remote.DIDDocument
+	if err := doc.ValidateID(); err != nil {
+		return nil, nil, newHandshakeError(DiscInvalidIdentity, err)
+	}
+	ok, err := h.verifier.VerifyDocument(doc, remote.Signature)
+	if err != nil {
+		return nil, nil, newHandshakeError(DiscInvalidIdentity, err)
+	}
+	if !ok {
+		return nil, nil, newHandshakeError(DiscInvalidIdentity, errHandshakeDocument)
+	}
+	edKey, err := doc.VerificationKey()
+	if err != nil {
+		return nil, nil, newHandshakeError(DiscInvalidIdentity, err)
+	}
+	xKey, err := doc.KeyAgreementKey()
+	if err != nil {
+		return nil, nil, newHandshakeError(DiscInvalidIdentity, err)
+	}
+	// Unshake reports a bad signature without an error
+	shared, err := h.identity.Keys().Unshake(xKey, remote.KeySignature, edKey)
+	if err != nil || shared == nil {
+		return nil, nil, newHandshakeError(DiscInvalidIdentity, errHandshakeKey)
+	}
+	return edKey, shared, nil
+}
+
+// exchange sends a message while reading the remote one of the same kind.
+// Writing happens concurrently as both sides send before they read.
+func (h *didHandshake) exchange(code byte, payload []byte) ([]byte, error) {
+	werr := make(chan error, 1)
+	go func() { werr <- writeFrame(h.peer, code, payload) }()
+
+	rcode, data, rerr := readFrame(h.peer)
+	werrv := <-werr
+	// A rejection by the remote side explains a failed write best
+	switch {
+	case rerr != nil:
+		return nil, rerr
+	case rcode == discMsg:
+		var reason DiscReason = DiscInvalid
+		if len(data) == 1 {
+			reason = DiscReason(data[0])
+		}
+		return nil, &handshakeError{reason: reason, remote: true}
+	case werrv != nil:
+		return nil, networkError(werrv)
+	case rcode != code:
+		return nil, newHandshakeError(DiscProtocolError, errHandshakeUnexpect)
+	}
+	return data, nil
+}
+
+// authData is the message a side signs to answer the challenge of the other.
+func authData(signer, verifier string, verifierChallenge, signerChallenge []byte) []byte {
+	data := append([]byte{}, handshakeAuthPrefix...)
+	data = append(data, verifierChallenge...)
+	data = append(data, signerChallenge...)
+	data = append(data, signer...)
+	return append(data, verifier...)
+}
+
+// sessionSalt orders both challenges so both sides derive the same secret.
+func sessionSalt(a, b []byte) []byte {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	return append(append([]byte{}, a...), b...)
+}
+
+func writeFrame(w io.Writer, code byte, payload []byte) error {
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = code
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	_, err := w.Write(append(frame, payload...))
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, networkError(err)
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > handshakeMaxSize {
+		return 0, nil, newHandshakeError(DiscProtocolError, errHandshakeTooLarge)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, networkError(err)
+	}
+	return header[0], payload, nil
+}
+
+// networkError wraps a connection failure, telling timeouts apart.
+func networkError(err error) error {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return newHandshakeError(DiscReadTimeout, err)
+	}
+	return newHandshakeError(DiscNetworkError, err)
+}
@@ -0,0 +1,139 @@
+package p2p_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/p2p/node"
+)
+
+// forgedIdentity presents a document claiming another DID, signed with its
+// own key.
+type forgedIdentity struct {
+	did.IdentifierDID
+	id string
+}
+
+func (f forgedIdentity) Document() *did.Document {
+	doc := f.IdentifierDID.Document()
+	doc.ID = f.id
+	return doc
+}
+
+func newPeer(conn net.Conn) p2p.Peer {
+	return node.NewPeer(conn, nil, nil, network.TCPProtocol)
+}
+
+// runHandshakes runs both sides of a handshake over a pipe.
+func runHandshakes(a, b did.IdentifierDID, setup func(pa, pb p2p.Peer)) (p2p.Peer, p2p.Peer, error, error) {
+	c1, c2 := net.Pipe()
+	pa, pb := newPeer(c1), newPeer(c2)
+	if setup != nil {
+		setup(pa, pb)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		err := p2p.NewDIDHandshake(b, did.NewDefaultDIDVerifier())(pb)
+		if err != nil {
+			pb.Close()
+		}
+		errc <- err
+	}()
+	errA := p2p.NewDIDHandshake(a, did.NewDefaultDIDVerifier())(pa)
+	if errA != nil {
+		pa.Close()
+	}
+	errB := <-errc
+	pa.Close()
+	pb.Close()
+	return pa, pb, errA, errB
+}
+
+func TestDIDHandshake(t *testing.T) {
+	a, b := did.NewDIDIdentifier(nil), did.NewDIDIdentifier(nil)
+	pa, pb, errA, errB := runHandshakes(a, b, nil)
+	require.NoError(t, errA)
+	require.NoError(t, errB)
+
+	assert.Equal(t, b.Document().ID, pa.ID())
+	assert.Equal(t, a.Document().ID, pb.ID())
+	assert.Len(t, pa.Secret(), 32)
+	assert.Equal(t, pa.Secret(), pb.Secret())
+
+	// Every session derives a fresh secret
+	pa2, _, errA, errB := runHandshakes(a, b, nil)
+	require.NoError(t, errA)
+	require.NoError(t, errB)
+	assert.NotEqual(t, pa.Secret(), pa2.Secret())
+}
+
+func TestDIDHandshake_Version(t *testing.T) {
+	a, b := did.NewDIDIdentifier(nil), did.NewDIDIdentifier(nil)
+
+	// Peers agree on the lower of both versions
+	pa, pb, errA, errB := runHandshakes(a, b, func(pa, pb p2p.Peer) {
+		pb.ProtocolInfo().Version = "1.0.0"
+	})
+	require.NoError(t, errA)
+	require.NoError(t, errB)
+	assert.Equal(t, network.ProtocolVersion("1.0.0"), pa.ProtocolInfo().Version)
+	assert.Equal(t, network.ProtocolVersion("1.0.0"), pb.ProtocolInfo().Version)
+
+	// An unknown version is rejected, the rejection reaches the other side
+	_, _, errA, errB = runHandshakes(a, b, func(pa, pb p2p.Peer) {
+		pb.ProtocolInfo().Version = "9.0.0"
+	})
+	assert.ErrorIs(t, errA, p2p.DiscIncompatibleVersion)
+	assert.ErrorIs(t, errB, p2p.DiscIncompatibleVersion)
+	assert.Equal(t, p2p.DiscIncompatibleVersion, p2p.DiscReasonForError(errA))
+}
+
+func TestDIDHandshake_Self(t *testing.T) {
+	a := did.NewDIDIdentifier(nil)
+	_, _, errA, errB := runHandshakes(a, a, nil)
+	assert.ErrorIs(t, errA, p2p.DiscSelf)
+	assert.ErrorIs(t, errB, p2p.DiscSelf)
+}
+
+func TestDIDHandshake_ForgedIdentity(t *testing.T) {
+	a := did.NewDIDIdentifier(nil)
+	b := forgedIdentity{IdentifierDID: did.NewDIDIdentifier(nil), id: a.Document().ID}
+	pa, _, errA, errB := runHandshakes(a, b, nil)
+	assert.ErrorIs(t, errA, p2p.DiscInvalidIdentity)
+	assert.ErrorIs(t, errA, did.ErrIDMismatch)
+	// The forger sees its own claimed DID
+	assert.ErrorIs(t, errB, p2p.DiscSelf)
+	assert.Empty(t, pa.ID())
+	assert.Nil(t, pa.Secret())
+}
+
+func TestDIDHandshake_Garbage(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		c2.Write([]byte{0x00, 0xff, 0xff, 0xff, 0xff})
+		// Drain whatever the handshake sends
+		buf := make([]byte, 1024)
+		for {
+			if _, err := c2.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	peer := newPeer(c1)
+	defer peer.Close()
+	err := p2p.NewDIDHandshake(did.NewDIDIdentifier(nil), did.NewDefaultDIDVerifier())(peer)
+	assert.ErrorIs(t, err, p2p.DiscProtocolError)
+
+	// A broken connection is a network error
+	peer.Close()
+	err = p2p.NewDIDHandshake(did.NewDIDIdentifier(nil), did.NewDefaultDIDVerifier())(peer)
+	assert.ErrorIs(t, err, p2p.DiscNetworkError)
+	assert.False(t, errors.Is(err, p2p.DiscProtocolError))
+}
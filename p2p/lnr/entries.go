@@ -0,0 +1,101 @@
+package lnr
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+var errEntrySize = errors.New("invalid value size")
+
+// Entry is a key/value pair which can be stored in a record.
+type Entry interface {
+	LNRKey() string
+	EncodeLNR() []byte
+}
+
+// EntryDecoder is an entry which can be loaded from a record.
+type EntryDecoder interface {
+	Entry
+	DecodeLNR(b []byte) error
+}
+
+type (
+	// ID is the name of the identity scheme, key "id".
+	ID string
+	// IP is the IPv4 or IPv6 address of the node, key "ip".
+	IP netip.Addr
+	// TCP is the port of peer connections, key "tcp".
+	TCP uint16
+	// UDP is the port of discovery, key "udp".
+	UDP uint16
+	// DID is the did:key identifier of the node, key "did".
+	DID string
+	// Ed25519 is the public key of the node, key "ed25519".
+	Ed25519 []byte
+)
+
+func (ID) LNRKey() string      { return "id" }
+func (v ID) EncodeLNR() []byte { return []byte(v) }
+func (v *ID) DecodeLNR(b []byte) error {
+	*v = ID(b)
+	return nil
+}
+
+func (IP) LNRKey() string { return "ip" }
+func (v IP) EncodeLNR() []byte {
+	ip := netip.Addr(v).Unmap()
+	if ip.Is4() {
+		b := ip.As4()
+		return b[:]
+	}
+	b := ip.As16()
+	return b[:]
+}
+func (v *IP) DecodeLNR(b []byte) error {
+	ip, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return errEntrySize
+	}
+	*v = IP(ip)
+	return nil
+}
+
+func (TCP) LNRKey() string      { return "tcp" }
+func (v TCP) EncodeLNR() []byte { return binary.BigEndian.AppendUint16(nil, uint16(v)) }
+func (v *TCP) DecodeLNR(b []byte) error {
+	if len(b) != 2 {
+		return errEntrySize
+	}
+	*v = TCP(binary.BigEndian.Uint16(b))
+	return nil
+}
+
+func (UDP) LNRKey() string      { return "udp" }
+func (v UDP) EncodeLNR() []byte { return binary.BigEndian.AppendUint16(nil, uint16(v)) }
+func (v *UDP) DecodeLNR(b []byte) error {
+	if len(b) != 2 {
+		return errEntrySize
+	}
+	*v = UDP(binary.BigEndian.Uint16(b))
+	return nil
+}
+
+func (DID) LNRKey() string      { return "did" }
+func (v DID) EncodeLNR() []byte { return []byte(v) }
+func (v *DID) DecodeLNR(b []byte) error {
+	*v = DID(b)
+	return nil
+}
+
+func (Ed25519) LNRKey() string      { return "ed25519" }
+func (v Ed25519) EncodeLNR() []byte { return append([]byte(nil), v...) }
+func (v *Ed25519) DecodeLNR(b []byte) error {
+	*v = append(Ed25519(nil), b...)
+	return nil
+}
+
+// IsNotFound reports whether err is a missing key error of Load.
+func IsNotFound(err error) bool {
+	return errors.Is(err, errNotFound)
+}
@@ -1,11 +1,24 @@
+// Package lnr implements signed node records. A record holds the sequence
+// number and the sorted key/value pairs describing a node, signed by the
+// identity scheme named in its "id" pair. Every change to a signed record
+// bumps its sequence number, so the newest version of a node wins.
+//
+// A record encodes as a list of length-prefixed elements
+//
+//	signature | seq | k1 | v1 | k2 | v2 | ...
+//
+// where the signature covers the encoding of the remaining elements.
 package lnr
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
 )
 
-const SizeLimit = 300
+const SizeLimit = 300 // Maximum encoded size of a node record in bytes
 
 var (
 	ErrInvalidSig     = errors.New("invalid signature on node record")
@@ -16,17 +29,231 @@ var (
 	errTooBig         = fmt.Errorf("record bigger than %d bytes", SizeLimit)
 	errEncodeUnsigned = errors.New("can't encode unsigned record")
 	errNotFound       = errors.New("no such key in record")
+	errMalformed      = errors.New("malformed record element")
 )
 
+// IdentityScheme verifies record signatures and derives node addresses.
 type IdentityScheme interface {
 	Verify(r *Record, sig []byte) error
 	NodeAddr(r *Record) []byte
 }
 
+// SchemeMap is a registry of identity schemes by name.
 type SchemeMap map[string]IdentityScheme
 
+// Verify checks sig with the scheme named by the record.
+func (m SchemeMap) Verify(r *Record, sig []byte) error {
+	s := m[r.IdentityScheme()]
+	if s == nil {
+		return ErrInvalidSig
+	}
+	return s.Verify(r, sig)
+}
+
+// NodeAddr returns the node address of the record, nil for unknown schemes.
+func (m SchemeMap) NodeAddr(r *Record) []byte {
+	s := m[r.IdentityScheme()]
+	if s == nil {
+		return nil
+	}
+	return s.NodeAddr(r)
+}
+
+// Record is a node record. The zero value is an empty unsigned record.
 type Record struct {
 	seq       uint64
 	signature []byte
-	raw       []byte
+	raw       []byte // Encoding of the signed record, nil when unsigned
+	pairs     []pair // Sorted by key
+}
+
+type pair struct {
+	k string
+	v []byte
+}
+
+// Seq returns the sequence number.
+func (r *Record) Seq() uint64 {
+	return r.seq
+}
+
+// SetSeq updates the sequence number, which invalidates the signature.
+func (r *Record) SetSeq(s uint64) {
+	r.invalidate()
+	r.seq = s
+}
+
+// Signature returns the signature, nil when the record is unsigned.
+func (r *Record) Signature() []byte {
+	if r.signature == nil {
+		return nil
+	}
+	return append([]byte(nil), r.signature...)
+}
+
+// Signed reports whether the record carries a signature.
+func (r *Record) Signed() bool {
+	return r.signature != nil
+}
+
+// IdentityScheme returns the name of the identity scheme in the "id" pair.
+func (r *Record) IdentityScheme() string {
+	var id ID
+	r.Load(&id)
+	return string(id)
+}
+
+// Load decodes the value of the key of e into e.
+func (r *Record) Load(e EntryDecoder) error {
+	i := sort.Search(len(r.pairs), func(i int) bool { return r.pairs[i].k >= e.LNRKey() })
+	if i == len(r.pairs) || r.pairs[i].k != e.LNRKey() {
+		return fmt.Errorf("%w: %s", errNotFound, e.LNRKey())
+	}
+	if err := e.DecodeLNR(r.pairs[i].v); err != nil {
+		return fmt.Errorf("invalid record value for %s: %w", e.LNRKey(), err)
+	}
+	return nil
+}
+
+// Set adds or updates the pair of e. Changing a signed record drops the
+// signature and bumps the sequence number, the record must be signed again.
+func (r *Record) Set(e Entry) {
+	v := e.EncodeLNR()
+	i := sort.Search(len(r.pairs), func(i int) bool { return r.pairs[i].k >= e.LNRKey() })
+	switch {
+	case i < len(r.pairs) && r.pairs[i].k == e.LNRKey():
+		if bytes.Equal(r.pairs[i].v, v) {
+			return
+		}
+		r.pairs[i].v = v
+	default:
+		r.pairs = append(r.pairs, pair{})
+		copy(r.pairs[i+1:], r.pairs[i:])
+		r.pairs[i] = pair{k: e.LNRKey(), v: v}
+	}
+	if r.signature != nil {
+		r.seq++
+	}
+	r.invalidate()
+}
+
+// Keys returns the keys of the record in order.
+func (r *Record) Keys() []string {
+	keys := make([]string, len(r.pairs))
+	for i, p := range r.pairs {
+		keys[i] = p.k
+	}
+	return keys
+}
+
+// SetSig sets the signature after checking it with s. A nil sig with a nil
+// scheme makes the record unsigned.
+func (r *Record) SetSig(s IdentityScheme, sig []byte) error {
+	if s == nil {
+		if sig != nil {
+			return ErrInvalidSig
+		}
+		r.invalidate()
+		return nil
+	}
+	if err := s.Verify(r, sig); err != nil {
+		return err
+	}
+	raw := r.encode(sig)
+	if len(raw) > SizeLimit {
+		return errTooBig
+	}
+	r.signature = append([]byte(nil), sig...)
+	r.raw = raw
+	return nil
+}
+
+// VerifySignature checks the signature of the record with s.
+func (r *Record) VerifySignature(s IdentityScheme) error {
+	return s.Verify(r, r.signature)
+}
+
+// Encode returns the encoding of a signed record.
+func (r *Record) Encode() ([]byte, error) {
+	if r.raw == nil {
+		return nil, errEncodeUnsigned
+	}
+	return append([]byte(nil), r.raw...), nil
+}
+
+// Decode parses an encoded record into r. The signature is not checked, use
+// VerifySignature for that.
+func (r *Record) Decode(b []byte) error {
+	if len(b) > SizeLimit {
+		return errTooBig
+	}
+	elems, err := splitElements(b)
+	if err != nil {
+		return err
+	}
+	if len(elems) < 2 {
+		return errIncompleteList
+	}
+	if len(elems)%2 != 0 {
+		return errIncompletePair
+	}
+	if len(elems[1]) != 8 {
+		return errMalformed
+	}
+	dec := Record{
+		seq:       binary.BigEndian.Uint64(elems[1]),
+		signature: append([]byte(nil), elems[0]...),
+		raw:       append([]byte(nil), b...),
+	}
+	for i := 2; i < len(elems); i += 2 {
+		k := string(elems[i])
+		if n := len(dec.pairs); n > 0 {
+			if k == dec.pairs[n-1].k {
+				return errDuplicateKey
+			}
+			if k < dec.pairs[n-1].k {
+				return errNotSorted
+			}
+		}
+		dec.pairs = append(dec.pairs, pair{k: k, v: append([]byte(nil), elems[i+1]...)})
+	}
+	*r = dec
+	return nil
+}
+
+// Content returns the signed part of the record.
+func (r *Record) Content() []byte {
+	b := appendElement(nil, binary.BigEndian.AppendUint64(nil, r.seq))
+	for _, p := range r.pairs {
+		b = appendElement(b, []byte(p.k))
+		b = appendElement(b, p.v)
+	}
+	return b
+}
+
+func (r *Record) encode(sig []byte) []byte {
+	return append(appendElement(nil, sig), r.Content()...)
+}
+
+func (r *Record) invalidate() {
+	r.signature = nil
+	r.raw = nil
+}
+
+func appendElement(b, e []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(e)))
+	return append(b, e...)
+}
+
+func splitElements(b []byte) ([][]byte, error) {
+	var elems [][]byte
+	for len(b) > 0 {
+		size, n := binary.Uvarint(b)
+		if n <= 0 || size > uint64(len(b)-n) {
+			return nil, errMalformed
+		}
+		elems = append(elems, b[n:n+int(size)])
+		b = b[n+int(size):]
+	}
+	return elems, nil
 }
@@ -0,0 +1,137 @@
+package lnr
+
+import (
+	"crypto/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p/enode"
+)
+
+func signedRecord(t *testing.T) (*Record, did.KeyPair) {
+	t.Helper()
+	key, err := did.NewPeerKeyPair(rand.Reader)
+	require.NoError(t, err)
+	r := new(Record)
+	r.Set(IP(netip.MustParseAddr("10.0.0.1")))
+	r.Set(UDP(30303))
+	r.Set(TCP(30304))
+	require.NoError(t, SignEd25519(r, key))
+	return r, key
+}
+
+func TestRecord_EncodeDecode(t *testing.T) {
+	r, key := signedRecord(t)
+	assert.Equal(t, []string{"did", "ed25519", "id", "ip", "tcp", "udp"}, r.Keys())
+	b, err := r.Encode()
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(b), SizeLimit)
+
+	dec := new(Record)
+	require.NoError(t, dec.Decode(b))
+	require.NoError(t, dec.VerifySignature(ValidSchemes))
+	assert.Equal(t, SchemeEd25519, dec.IdentityScheme())
+
+	var (
+		ip  IP
+		tcp TCP
+		id  DID
+	)
+	require.NoError(t, dec.Load(&ip))
+	require.NoError(t, dec.Load(&tcp))
+	require.NoError(t, dec.Load(&id))
+	assert.Equal(t, netip.MustParseAddr("10.0.0.1"), netip.Addr(ip))
+	assert.Equal(t, TCP(30304), tcp)
+	assert.Equal(t, key.GenerateID(), string(id))
+	assert.Equal(t, enode.PubkeyToID(key.GetEd25519PublicKey()).Bytes(), ValidSchemes.NodeAddr(dec))
+	assert.True(t, IsNotFound(dec.Load(new(missingEntry))))
+}
+
+// missingEntry is an entry missing from every record.
+type missingEntry []byte
+
+func (missingEntry) LNRKey() string              { return "missing" }
+func (v missingEntry) EncodeLNR() []byte         { return v }
+func (v *missingEntry) DecodeLNR(b []byte) error { return nil }
+
+func TestRecord_SeqBump(t *testing.T) {
+	r, key := signedRecord(t)
+	assert.Equal(t, uint64(0), r.Seq())
+
+	// Setting the same value keeps the signature
+	r.Set(TCP(30304))
+	assert.True(t, r.Signed())
+
+	r.Set(TCP(40404))
+	assert.False(t, r.Signed())
+	assert.Equal(t, uint64(1), r.Seq())
+	_, err := r.Encode()
+	assert.ErrorIs(t, err, errEncodeUnsigned)
+
+	// Further changes before signing use the same sequence number
+	r.Set(UDP(40403))
+	assert.Equal(t, uint64(1), r.Seq())
+	require.NoError(t, SignEd25519(r, key))
+	assert.Equal(t, uint64(1), r.Seq())
+	require.NoError(t, r.VerifySignature(ValidSchemes))
+}
+
+func TestRecord_Invalid(t *testing.T) {
+	r, key := signedRecord(t)
+	b, err := r.Encode()
+	require.NoError(t, err)
+
+	// A modified value breaks the signature
+	tampered := append([]byte(nil), b...)
+	tampered[len(tampered)-1] ^= 0x01
+	dec := new(Record)
+	require.NoError(t, dec.Decode(tampered))
+	assert.ErrorIs(t, dec.VerifySignature(ValidSchemes), ErrInvalidSig)
+
+	// The DID must belong to the signing key
+	other, err := did.NewPeerKeyPair(rand.Reader)
+	require.NoError(t, err)
+	r.Set(DID(other.GenerateID()))
+	sig, err := key.SignData(r.Content())
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.SetSig(Ed25519Scheme{}, sig), errDIDMismatch)
+
+	// Unknown schemes never verify
+	r.Set(ID("v0"))
+	assert.ErrorIs(t, ValidSchemes.Verify(r, sig), ErrInvalidSig)
+}
+
+func TestRecord_DecodeErrors(t *testing.T) {
+	sig := appendElement(nil, make([]byte, 64))
+	seq := appendElement(nil, make([]byte, 8))
+	kv := func(k, v string) []byte {
+		return appendElement(appendElement(nil, []byte(k)), []byte(v))
+	}
+	join := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return b
+	}
+	tests := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"only signature", sig, errIncompleteList},
+		{"incomplete pair", join(sig, seq, appendElement(nil, []byte("ip"))), errIncompletePair},
+		{"not sorted", join(sig, seq, kv("udp", "a"), kv("tcp", "b")), errNotSorted},
+		{"duplicate key", join(sig, seq, kv("ip", "a"), kv("ip", "b")), errDuplicateKey},
+		{"truncated", join(sig, seq)[:70], errMalformed},
+		{"too big", join(sig, seq, kv("k", string(make([]byte, SizeLimit)))), errTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, new(Record).Decode(tt.input), tt.err)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package lnr
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/wang900115/LCA/did"
+)
+
+// SchemeEd25519 is the name of the Ed25519 identity scheme.
+const SchemeEd25519 = "ed25519"
+
+var errDIDMismatch = errors.New("record did does not match its key")
+
+// ValidSchemes holds the identity schemes nodes accept.
+var ValidSchemes = SchemeMap{SchemeEd25519: Ed25519Scheme{}}
+
+// Signer holds the DID key of the local node, did.KeyPair implements it.
+type Signer interface {
+	GetEd25519PublicKey() []byte
+	SignData(data []byte) ([]byte, error)
+}
+
+// Ed25519Scheme signs records with the Ed25519 key of the node's DID. The
+// record carries the public key and the did:key identifier derived from it,
+// so a record can only describe the DID whose key signed it.
+type Ed25519Scheme struct{}
+
+// SignEd25519 sets the identity pairs of key in r and signs it.
+func SignEd25519(r *Record, key Signer) error {
+	pub := key.GetEd25519PublicKey()
+	r.Set(ID(SchemeEd25519))
+	r.Set(Ed25519(pub))
+	r.Set(DID(did.KeyID(pub)))
+	sig, err := key.SignData(r.Content())
+	if err != nil {
+		return err
+	}
+	return r.SetSig(Ed25519Scheme{}, sig)
+}
+
+// Verify checks sig over the record content and the binding of its DID.
+func (Ed25519Scheme) Verify(r *Record, sig []byte) error {
+	var pub Ed25519
+	if err := r.Load(&pub); err != nil {
+		return err
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return ErrInvalidSig
+	}
+	var id DID
+	if err := r.Load(&id); err != nil {
+		return err
+	}
+	if string(id) != did.KeyID(ed25519.PublicKey(pub)) {
+		return errDIDMismatch
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), r.Content(), sig) {
+		return ErrInvalidSig
+	}
+	return nil
+}
+
+// NodeAddr returns the node ID, the SHA-256 hash of the public key.
+func (Ed25519Scheme) NodeAddr(r *Record) []byte {
+	var pub Ed25519
+	if err := r.Load(&pub); err != nil {
+		return nil
+	}
+	h := sha256.Sum256(pub)
+	return h[:]
+}
@@ -0,0 +1,455 @@
+// Package mailbox implements store-and-forward delivery of private messages
+// to peers which are offline. A relay keeps the end-to-end encrypted
+// envelopes deposited for a DID in a key/value store, within a quota and for
+// a limited time. The recipient fetches its mail when it connects to the relay
+// and acknowledges every envelope it received, upon which the relay deletes
+// it and sends a delivery receipt back to the sender as a MESSAGESENDACK.
+//
+// Delivery is at least once: mail whose acknowledgement is lost is fetched
+// again on the next connection.
+package mailbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/store"
+)
+
+// Message codes of the mailbox protocol
+const (
+	depositMsg    = iota // to(varbytes) | envelope
+	depositAckMsg        // id(32) | status(1)
+	fetchMsg             // empty, asks for the mail of the sender
+	mailMsg              // id(32) | stored at(8) | from(varbytes) | envelope
+	ackMsg               // id(32)...
+
+	protocolLength
+)
+
+// Deposit status codes
+const (
+	statusOK = iota
+	statusQuota
+	statusInvalid
+	statusNotRelay
+	statusFailed
+)
+
+const (
+	protocolName    = "mailbox"
+	protocolVersion = 1
+
+	// Defaults of the mailbox config
+	DefaultMaxMessages       = 1000
+	DefaultMaxBytes          = 1 << 20
+	DefaultMaxSenderMessages = 1000
+	DefaultMaxSenderBytes    = 4 << 20
+	DefaultMaxTotalMessages  = 100000
+	DefaultMaxTotalBytes     = 256 << 20
+	DefaultTTL               = 7 * 24 * time.Hour
+	DefaultExpireInterval    = 10 * time.Minute
+	DefaultInboxSize         = 256
+)
+
+var (
+	errQuotaExceeded   = errors.New("mailbox quota exceeded")
+	errInvalidEnvelope = errors.New("invalid mailbox envelope")
+	errNotRelay        = errors.New("peer is not a mailbox relay")
+	errDepositFailed   = errors.New("relay failed to store the envelope")
+	errNotConnected    = errors.New("relay not connected")
+	errMalformed       = errors.New("malformed mailbox message")
+)
+
+var statusErrors = map[byte]error{
+	statusQuota:    errQuotaExceeded,
+	statusInvalid:  errInvalidEnvelope,
+	statusNotRelay: errNotRelay,
+	statusFailed:   errDepositFailed,
+}
+
+// Config configures a Mailbox, zero values select the defaults.
+type Config struct {
+	// DB holds the mail of other peers. A mailbox without a store does not
+	// relay, it only deposits and fetches its own mail.
+	DB                store.KeyValueStore
+	MaxMessages       int // Envelopes held per recipient
+	MaxBytes          int // Envelope bytes held per recipient
+	MaxSenderMessages int // Envelopes held per depositing peer
+	MaxSenderBytes    int // Envelope bytes held per depositing peer
+	MaxTotalMessages  int // Envelopes held in total
+	MaxTotalBytes     int // Envelope bytes held in total
+	TTL               time.Duration
+	ExpireInterval    time.Duration
+	InboxSize         int // Buffered incoming mail
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxMessages <= 0 {
+		c.MaxMessages = DefaultMaxMessages
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = DefaultMaxBytes
+	}
+	if c.MaxSenderMessages <= 0 {
+		c.MaxSenderMessages = DefaultMaxSenderMessages
+	}
+	if c.MaxSenderBytes <= 0 {
+		c.MaxSenderBytes = DefaultMaxSenderBytes
+	}
+	if c.MaxTotalMessages <= 0 {
+		c.MaxTotalMessages = DefaultMaxTotalMessages
+	}
+	if c.MaxTotalBytes <= 0 {
+		c.MaxTotalBytes = DefaultMaxTotalBytes
+	}
+	if c.TTL <= 0 {
+		c.TTL = DefaultTTL
+	}
+	if c.ExpireInterval <= 0 {
+		c.ExpireInterval = DefaultExpireInterval
+	}
+	if c.InboxSize <= 0 {
+		c.InboxSize = DefaultInboxSize
+	}
+	return c
+}
+
+// Mail is an envelope fetched from a relay.
+type Mail struct {
+	ID       [32]byte
+	From     string // DID of the sender
+	Envelope []byte
+	StoredAt time.Time
+}
+
+// Receipt confirms that the envelope ID was delivered to To.
+type Receipt struct {
+	ID [32]byte
+	To string
+}
+
+// Mailbox deposits and fetches mail, and relays the mail of others when it
+// has a store.
+type Mailbox struct {
+	config Config
+	db     store.KeyValueStore
+
+	mu      sync.Mutex // Serializes the store updates
+	total   usage
+	senders map[string]usage // Loaded from the store on first deposit
+	peersMu sync.Mutex
+	peers   map[string]*mailPeer
+	pending map[[32]byte]chan byte // Deposits waiting for their status
+
+	inbox    chan *Mail
+	receipts chan Receipt
+
+	ctx    context.Context // Cancelled on Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type mailPeer struct {
+	peer p2p.Peer
+	rw   p2p.MsgWriter
+}
+
+// New creates a mailbox, starting the expiry of relayed mail.
+func New(config Config) *Mailbox {
+	config = config.withDefaults()
+	m := &Mailbox{
+		config:   config,
+		db:       config.DB,
+		peers:    make(map[string]*mailPeer),
+		pending:  make(map[[32]byte]chan byte),
+		inbox:    make(chan *Mail, config.InboxSize),
+		receipts: make(chan Receipt, config.InboxSize),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	if m.db != nil {
+		m.wg.Add(1)
+		go m.expireLoop()
+	}
+	return m
+}
+
+// Close stops the mailbox.
+func (m *Mailbox) Close() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// Protocol returns the mailbox protocol, to be run on every peer.
+func (m *Mailbox) Protocol() p2p.Protocol {
+	return p2p.Protocol{
+		Name:    protocolName,
+		Version: protocolVersion,
+		Length:  protocolLength,
+		Run:     m.runPeer,
+	}
+}
+
+// Inbox returns the channel of fetched mail.
+func (m *Mailbox) Inbox() <-chan *Mail {
+	return m.inbox
+}
+
+// Receipts returns the channel of delivery receipts of deposited mail.
+// Receipts are dropped when the channel is full.
+func (m *Mailbox) Receipts() <-chan Receipt {
+	return m.receipts
+}
+
+// HandlePacket handles the base packets of the mailbox, the delivery
+// receipts. It fits the base handler of p2p.RunProtocols.
+func (m *Mailbox) HandlePacket(pkt network.Packet) {
+	if pkt.GetCommand() != common.MESSAGESENDACK {
+		return
+	}
+	payload := pkt.GetPayload()
+	if len(payload) < 32 {
+		return
+	}
+	r := Receipt{To: string(payload[32:])}
+	copy(r.ID[:], payload)
+	select {
+	case m.receipts <- r:
+	default:
+	}
+}
+
+// Deposit leaves envelope, an encoded private network.Message encrypted for
+// to, at the connected relay, returning the ID its receipt will carry.
+func (m *Mailbox) Deposit(ctx context.Context, relay, to string, envelope []byte) ([32]byte, error) {
+	id := messageID(envelope)
+	m.peersMu.Lock()
+	p, ok := m.peers[relay]
+	status := make(chan byte, 1)
+	if ok {
+		m.pending[id] = status
+	}
+	m.peersMu.Unlock()
+	if !ok {
+		return id, errNotConnected
+	}
+	defer func() {
+		m.peersMu.Lock()
+		delete(m.pending, id)
+		m.peersMu.Unlock()
+	}()
+
+	payload := network.AppendVarBytes(nil, []byte(to))
+	if err := p.send(depositMsg, append(payload, envelope...)); err != nil {
+		return id, err
+	}
+	select {
+	case s := <-status:
+		return id, statusErrors[s]
+	case <-ctx.Done():
+		return id, ctx.Err()
+	case <-m.ctx.Done():
+		return id, m.ctx.Err()
+	}
+}
+
+// runPeer asks the peer for the local mail, then serves it until the
+// connection ends.
+func (m *Mailbox) runPeer(peer p2p.Peer, rw p2p.MsgReadWriter) error {
+	p := &mailPeer{peer: peer, rw: rw}
+	id := peer.ID()
+	m.peersMu.Lock()
+	m.peers[id] = p
+	m.peersMu.Unlock()
+	defer func() {
+		m.peersMu.Lock()
+		if m.peers[id] == p {
+			delete(m.peers, id)
+		}
+		m.peersMu.Unlock()
+	}()
+
+	if err := p.send(fetchMsg, nil); err != nil {
+		return err
+	}
+	if m.db != nil {
+		receipts, err := m.takeReceipts(id)
+		if err != nil {
+			return err
+		}
+		for _, r := range receipts {
+			if err := p.sendReceipt(r); err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			return err
+		}
+		if err := m.handle(p, msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Mailbox) handle(p *mailPeer, msg p2p.Msg) error {
+	switch msg.Code {
+	case depositMsg:
+		to, envelope, ok := network.SplitVarBytes(msg.Payload)
+		if !ok {
+			return errMalformed
+		}
+		id, status, err := m.deposit(p.peer.ID(), string(to), envelope)
+		if err != nil {
+			return err
+		}
+		return p.send(depositAckMsg, append(id[:], status))
+
+	case depositAckMsg:
+		if len(msg.Payload) != 33 {
+			return errMalformed
+		}
+		var id [32]byte
+		copy(id[:], msg.Payload)
+		m.peersMu.Lock()
+		if status, ok := m.pending[id]; ok {
+			status <- msg.Payload[32]
+			delete(m.pending, id)
+		}
+		m.peersMu.Unlock()
+
+	case fetchMsg:
+		if m.db == nil {
+			return nil
+		}
+		keys, mails, err := func() ([][]byte, []*storedMail, error) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return m.mails(p.peer.ID())
+		}()
+		if err != nil {
+			return err
+		}
+		for i, mail := range mails {
+			id := mailID(keys[i])
+			b := binary.BigEndian.AppendUint64(id[:], uint64(mail.StoredAt.UnixNano()))
+			b = network.AppendVarBytes(b, []byte(mail.From))
+			if err := p.send(mailMsg, append(b, mail.Envelope...)); err != nil {
+				return err
+			}
+		}
+
+	case mailMsg:
+		if len(msg.Payload) < 40 {
+			return errMalformed
+		}
+		mail := &Mail{StoredAt: time.Unix(0, int64(binary.BigEndian.Uint64(msg.Payload[32:40])))}
+		copy(mail.ID[:], msg.Payload)
+		from, envelope, ok := network.SplitVarBytes(msg.Payload[40:])
+		if !ok {
+			return errMalformed
+		}
+		if messageID(envelope) != mail.ID {
+			return errMalformed
+		}
+		mail.From, mail.Envelope = string(from), envelope
+		select {
+		case m.inbox <- mail:
+		case <-m.ctx.Done():
+			return m.ctx.Err()
+		}
+		return p.send(ackMsg, mail.ID[:])
+
+	case ackMsg:
+		if m.db == nil {
+			return nil
+		}
+		if len(msg.Payload)%32 != 0 {
+			return errMalformed
+		}
+		ids := make([][32]byte, len(msg.Payload)/32)
+		for i := range ids {
+			copy(ids[i][:], msg.Payload[i*32:])
+		}
+		return m.acknowledged(p.peer.ID(), ids)
+	}
+	return nil
+}
+
+// deposit stores the envelope a peer left for to.
+func (m *Mailbox) deposit(from, to string, envelope []byte) ([32]byte, byte, error) {
+	id := messageID(envelope)
+	if m.db == nil {
+		return id, statusNotRelay, nil
+	}
+	if _, err := did.PublicKeyFromID(to); err != nil || len(envelope) == 0 || envelope[0] != byte(common.PRIVATE) {
+		return id, statusInvalid, nil
+	}
+	return m.putMail(from, to, envelope)
+}
+
+// acknowledged deletes the mail to received and sends the receipts, keeping
+// them for senders which are offline.
+func (m *Mailbox) acknowledged(to string, ids [][32]byte) error {
+	senders, err := m.takeMail(to, ids)
+	if err != nil {
+		return err
+	}
+	for i, from := range senders {
+		if from == "" {
+			continue
+		}
+		r := Receipt{ID: ids[i], To: to}
+		m.peersMu.Lock()
+		p, ok := m.peers[from]
+		m.peersMu.Unlock()
+		if ok && p.sendReceipt(r) == nil {
+			continue
+		}
+		if err := m.putReceipt(from, to, r.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Mailbox) expireLoop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.config.ExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.expire()
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *mailPeer) send(code uint64, payload []byte) error {
+	return p.rw.WriteMsg(p2p.Msg{Code: code, Payload: payload})
+}
+
+func (p *mailPeer) sendReceipt(r Receipt) error {
+	pkt, err := network.NewPacketFrameBytes(common.MESSAGESENDACK, append(r.ID[:], r.To...))
+	if err != nil {
+		return err
+	}
+	return p.peer.Send(pkt)
+}
+
+// messageID identifies an envelope in receipts.
+func messageID(envelope []byte) [32]byte {
+	return sha256.Sum256(envelope)
+}
@@ -0,0 +1,202 @@
+package mailbox
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/p2p/p2ptest"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+type testNode struct {
+	p2ptest.Node
+	m *Mailbox
+}
+
+func newTestNode(t *testing.T, config Config) *testNode {
+	t.Helper()
+	m := New(config)
+	t.Cleanup(m.Close)
+	return &testNode{Node: p2ptest.NewNode(nil), m: m}
+}
+
+// connect runs the mailbox protocol between two nodes over a pipe, returning
+// a function which disconnects them.
+func connect(t *testing.T, a, b *testNode) func() {
+	t.Helper()
+	protoA, protoB := []p2p.Protocol{a.m.Protocol()}, []p2p.Protocol{b.m.Protocol()}
+	c := p2ptest.Connect(t, a.Identity, b.Identity, protoA, protoB)
+	c.Run(protoA, protoB, a.m.HandlePacket, b.m.HandlePacket)
+	assert.Eventually(t, func() bool { return connected(a.m, b.ID()) && connected(b.m, a.ID()) }, p2ptest.Timeout, 10*time.Millisecond)
+	return c.Close
+}
+
+func connected(m *Mailbox, id string) bool {
+	m.peersMu.Lock()
+	defer m.peersMu.Unlock()
+	_, ok := m.peers[id]
+	return ok
+}
+
+func privateEnvelope(t *testing.T, text string) []byte {
+	t.Helper()
+	msg, err := network.NewMessageContent(common.PRIVATE, []byte(text), []byte("shared"))
+	require.NoError(t, err)
+	return msg.Bytes()
+}
+
+func TestMailbox_StoreAndForward(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	relay := newTestNode(t, Config{DB: db})
+	alice := newTestNode(t, Config{})
+	bob := newTestNode(t, Config{})
+	ctx := context.Background()
+
+	// Alice leaves mail for Bob, who is offline, then goes offline herself
+	disconnect := connect(t, alice, relay)
+	envelope := privateEnvelope(t, "are you there?")
+	id, err := alice.m.Deposit(ctx, relay.ID(), bob.ID(), envelope)
+	require.NoError(t, err)
+	disconnect()
+
+	// Bob fetches and acknowledges it on connect
+	connect(t, bob, relay)
+	mail := p2ptest.Receive(t, bob.m.Inbox())
+	assert.Equal(t, id, mail.ID)
+	assert.Equal(t, alice.ID(), mail.From)
+	assert.Equal(t, envelope, mail.Envelope)
+	// The relay keeps the receipt for Alice
+	assert.Eventually(t, func() bool {
+		has, _ := db.Has(dbKey(receiptPrefix, alice.ID(), id[:]))
+		return has
+	}, p2ptest.Timeout, 10*time.Millisecond)
+	keys, _, err := relay.m.mails(bob.ID())
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	connect(t, alice, relay)
+	assert.Equal(t, Receipt{ID: id, To: bob.ID()}, p2ptest.Receive(t, alice.m.Receipts()))
+	assert.Eventually(t, func() bool {
+		has, _ := db.Has(dbKey(receiptPrefix, alice.ID(), id[:]))
+		return !has
+	}, p2ptest.Timeout, 10*time.Millisecond)
+}
+
+func TestMailbox_OnlineReceipt(t *testing.T) {
+	relay := newTestNode(t, Config{DB: memorydb.NewMemoryDBStore()})
+	alice := newTestNode(t, Config{})
+	bob := newTestNode(t, Config{})
+	connect(t, alice, relay)
+	id, err := alice.m.Deposit(context.Background(), relay.ID(), bob.ID(), privateEnvelope(t, "hi"))
+	require.NoError(t, err)
+
+	connect(t, bob, relay)
+	p2ptest.Receive(t, bob.m.Inbox())
+	assert.Equal(t, id, p2ptest.Receive(t, alice.m.Receipts()).ID)
+}
+
+func TestMailbox_Rejects(t *testing.T) {
+	relay := newTestNode(t, Config{DB: memorydb.NewMemoryDBStore(), MaxMessages: 1})
+	alice := newTestNode(t, Config{})
+	bob := newTestNode(t, Config{})
+	ctx := context.Background()
+	connect(t, alice, relay)
+	connect(t, alice, bob)
+
+	envelope := privateEnvelope(t, "one")
+	_, err := alice.m.Deposit(ctx, relay.ID(), bob.ID(), envelope)
+	require.NoError(t, err)
+	// A retry of the same envelope is no new message
+	_, err = alice.m.Deposit(ctx, relay.ID(), bob.ID(), envelope)
+	require.NoError(t, err)
+	_, err = alice.m.Deposit(ctx, relay.ID(), bob.ID(), nil)
+	assert.ErrorIs(t, err, errInvalidEnvelope)
+	_, err = alice.m.Deposit(ctx, relay.ID(), bob.ID(), privateEnvelope(t, "two"))
+	assert.ErrorIs(t, err, errQuotaExceeded)
+
+	public, err := network.NewMessageContent(common.PUBLIC, []byte("hello"), nil)
+	require.NoError(t, err)
+	_, err = alice.m.Deposit(ctx, relay.ID(), alice.ID(), public.Bytes())
+	assert.ErrorIs(t, err, errInvalidEnvelope)
+	_, err = alice.m.Deposit(ctx, relay.ID(), "bob", privateEnvelope(t, "three"))
+	assert.ErrorIs(t, err, errInvalidEnvelope)
+
+	// Peers without a store do not relay
+	_, err = alice.m.Deposit(ctx, bob.ID(), relay.ID(), privateEnvelope(t, "four"))
+	assert.ErrorIs(t, err, errNotRelay)
+	_, err = alice.m.Deposit(ctx, "did:key:zunknown", bob.ID(), privateEnvelope(t, "five"))
+	assert.ErrorIs(t, err, errNotConnected)
+}
+
+func TestMailbox_SenderAndTotalQuota(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	m := New(Config{DB: db, MaxSenderMessages: 3, MaxTotalMessages: 5})
+	t.Cleanup(m.Close)
+	deposit := func(from string, i int) byte {
+		to := did.NewDIDIdentifier(nil).Document().ID
+		_, status, err := m.deposit(from, to, privateEnvelope(t, fmt.Sprint(from, i)))
+		require.NoError(t, err)
+		return status
+	}
+
+	// Every recipient has room, the depositor does not
+	for i := range 3 {
+		require.Equal(t, byte(statusOK), deposit("did:key:zalice", i))
+	}
+	assert.Equal(t, byte(statusQuota), deposit("did:key:zalice", 3))
+	for i := range 2 {
+		require.Equal(t, byte(statusOK), deposit("did:key:zbob", i))
+	}
+	assert.Equal(t, byte(statusQuota), deposit("did:key:zcarol", 0), "the relay is full")
+
+	// The usage of a restarted relay is loaded from its store
+	m.Close()
+	m = New(Config{DB: db, MaxSenderMessages: 3, MaxTotalMessages: 6})
+	t.Cleanup(m.Close)
+	assert.Equal(t, byte(statusQuota), deposit("did:key:zalice", 4))
+	assert.Equal(t, byte(statusOK), deposit("did:key:zcarol", 0))
+	assert.Equal(t, byte(statusQuota), deposit("did:key:zcarol", 1))
+
+	// Expired mail no longer counts
+	m.config.TTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	require.NoError(t, m.expire())
+	m.config.TTL = DefaultTTL
+	assert.Equal(t, usage{}, m.total)
+	assert.Equal(t, byte(statusOK), deposit("did:key:zalice", 5))
+}
+
+func TestMailbox_Expire(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	m := New(Config{DB: db, TTL: time.Minute})
+	t.Cleanup(m.Close)
+	bob := did.NewDIDIdentifier(nil).Document().ID
+	envelope := privateEnvelope(t, "old")
+
+	_, status, err := m.deposit("did:key:zalice", bob, envelope)
+	require.NoError(t, err)
+	require.Equal(t, byte(statusOK), status)
+	require.NoError(t, m.putReceipt("did:key:zalice", bob, messageID(envelope)))
+	require.NoError(t, m.expire())
+	keys, _, err := m.mails(bob)
+	require.NoError(t, err)
+	assert.Len(t, keys, 1, "fresh mail is kept")
+
+	m.config.TTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	require.NoError(t, m.expire())
+	for _, prefix := range [][]byte{mailPrefix, receiptPrefix} {
+		it, err := db.NewIterator(prefix, nil)
+		require.NoError(t, err)
+		assert.False(t, it.Next(), "%s is empty", prefix)
+		it.Release()
+	}
+}
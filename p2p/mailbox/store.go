@@ -0,0 +1,296 @@
+package mailbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// Store key prefixes of a relay. Mail is kept under
+//
+//	mail/<recipient>/<stored at(8)><id(32)>
+//
+// so the mail of a recipient iterates in arrival order. Receipts which could
+// not be delivered yet wait under receipt/<sender>/<id>.
+var (
+	mailPrefix    = []byte("mail/")
+	receiptPrefix = []byte("receipt/")
+)
+
+// storedMail is a mailbox entry of a relay.
+type storedMail struct {
+	From     string    `json:"from"`
+	Envelope []byte    `json:"envelope"`
+	StoredAt time.Time `json:"stored_at"`
+}
+
+// storedReceipt is a delivery receipt waiting for its sender.
+type storedReceipt struct {
+	To       string    `json:"to"`
+	StoredAt time.Time `json:"stored_at"`
+}
+
+// usage is the mail held in total or for a depositor.
+type usage struct {
+	messages int
+	bytes    int
+}
+
+// loadUsage counts the mail in the store, unless it was counted already.
+func (m *Mailbox) loadUsage() error {
+	if m.senders != nil {
+		return nil
+	}
+	it, err := m.db.NewIterator(mailPrefix, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+	m.total, m.senders = usage{}, make(map[string]usage)
+	for it.Next() {
+		mail := new(storedMail)
+		if json.Unmarshal(it.Value(), mail) == nil {
+			m.count(mail, 1)
+		}
+	}
+	if err := it.Error(); err != nil {
+		m.senders = nil
+		return err
+	}
+	return nil
+}
+
+// count adds a stored mail to the usage, or removes it if n is -1. Before
+// the usage is loaded there is nothing to update.
+func (m *Mailbox) count(mail *storedMail, n int) {
+	if m.senders == nil {
+		return
+	}
+	m.total.messages += n
+	m.total.bytes += n * len(mail.Envelope)
+	u := m.senders[mail.From]
+	u.messages += n
+	u.bytes += n * len(mail.Envelope)
+	if u.messages > 0 {
+		m.senders[mail.From] = u
+	} else {
+		delete(m.senders, mail.From)
+	}
+}
+
+// dbKey returns the store key of name under prefix, followed by suffix.
+func dbKey(prefix []byte, name string, suffix ...[]byte) []byte {
+	key := make([]byte, 0, len(prefix)+len(name)+1+40)
+	key = append(append(append(key, prefix...), name...), '/')
+	for _, s := range suffix {
+		key = append(key, s...)
+	}
+	return key
+}
+
+func mailKey(to string, storedAt time.Time, id [32]byte) []byte {
+	ts := binary.BigEndian.AppendUint64(nil, uint64(storedAt.UnixNano()))
+	return dbKey(mailPrefix, to, ts, id[:])
+}
+
+// mailID returns the message ID at the end of a mail key.
+func mailID(key []byte) (id [32]byte) {
+	copy(id[:], key[len(key)-32:])
+	return id
+}
+
+// mails returns the mail of to in arrival order, deleting expired entries.
+func (m *Mailbox) mails(to string) ([][]byte, []*storedMail, error) {
+	it, err := m.db.NewIterator(dbKey(mailPrefix, to), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.Release()
+	var (
+		keys         [][]byte
+		mails        []*storedMail
+		expired      [][]byte
+		expiredMails []*storedMail
+		now          = time.Now()
+	)
+	for it.Next() {
+		mail := new(storedMail)
+		if err := json.Unmarshal(it.Value(), mail); err != nil {
+			return nil, nil, err
+		}
+		key := bytes.Clone(it.Key())
+		if now.Sub(mail.StoredAt) > m.config.TTL {
+			expired = append(expired, key)
+			expiredMails = append(expiredMails, mail)
+			continue
+		}
+		keys = append(keys, key)
+		mails = append(mails, mail)
+	}
+	if err := it.Error(); err != nil {
+		return nil, nil, err
+	}
+	for i, key := range expired {
+		if err := m.db.Delete(key); err != nil {
+			return nil, nil, err
+		}
+		m.count(expiredMails[i], -1)
+	}
+	return keys, mails, nil
+}
+
+// putMail stores envelope for to unless the mailbox of to, the mail held
+// from the depositor or the relay is full.
+func (m *Mailbox) putMail(from, to string, envelope []byte) ([32]byte, byte, error) {
+	id := messageID(envelope)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadUsage(); err != nil {
+		return id, statusFailed, err
+	}
+	keys, mails, err := m.mails(to)
+	if err != nil {
+		return id, statusFailed, err
+	}
+	size := len(envelope)
+	for i, mail := range mails {
+		if mailID(keys[i]) == id {
+			// Already stored, a retry of the sender
+			return id, statusOK, nil
+		}
+		size += len(mail.Envelope)
+	}
+	if len(mails) >= m.config.MaxMessages || size > m.config.MaxBytes {
+		return id, statusQuota, nil
+	}
+	sender := m.senders[from]
+	if sender.messages >= m.config.MaxSenderMessages || sender.bytes+len(envelope) > m.config.MaxSenderBytes ||
+		m.total.messages >= m.config.MaxTotalMessages || m.total.bytes+len(envelope) > m.config.MaxTotalBytes {
+		return id, statusQuota, nil
+	}
+	mail := &storedMail{From: from, Envelope: envelope, StoredAt: time.Now()}
+	data, err := json.Marshal(mail)
+	if err != nil {
+		return id, statusFailed, err
+	}
+	if err := m.db.Put(mailKey(to, mail.StoredAt, id), data); err != nil {
+		return id, statusFailed, err
+	}
+	m.count(mail, 1)
+	return id, statusOK, nil
+}
+
+// takeMail deletes the acknowledged mail of to, returning its senders.
+func (m *Mailbox) takeMail(to string, ids [][32]byte) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys, mails, err := m.mails(to)
+	if err != nil {
+		return nil, err
+	}
+	senders := make([]string, len(ids))
+	for i, key := range keys {
+		id := mailID(key)
+		for j := range ids {
+			if ids[j] == id && senders[j] == "" {
+				if err := m.db.Delete(key); err != nil {
+					return nil, err
+				}
+				m.count(mails[i], -1)
+				senders[j] = mails[i].From
+			}
+		}
+	}
+	return senders, nil
+}
+
+func (m *Mailbox) putReceipt(from, to string, id [32]byte) error {
+	data, err := json.Marshal(&storedReceipt{To: to, StoredAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return m.db.Put(dbKey(receiptPrefix, from, id[:]), data)
+}
+
+// takeReceipts deletes and returns the waiting receipts of from.
+func (m *Mailbox) takeReceipts(from string) ([]Receipt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := dbKey(receiptPrefix, from)
+	it, err := m.db.NewIterator(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		receipts []Receipt
+		keys     [][]byte
+		now      = time.Now()
+	)
+	for it.Next() {
+		var r storedReceipt
+		if err := json.Unmarshal(it.Value(), &r); err != nil {
+			it.Release()
+			return nil, err
+		}
+		keys = append(keys, bytes.Clone(it.Key()))
+		if now.Sub(r.StoredAt) > m.config.TTL || len(it.Key()) != len(prefix)+32 {
+			continue
+		}
+		var id [32]byte
+		copy(id[:], it.Key()[len(prefix):])
+		receipts = append(receipts, Receipt{ID: id, To: r.To})
+	}
+	err = it.Error()
+	it.Release()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := m.db.Delete(key); err != nil {
+			return nil, err
+		}
+	}
+	return receipts, nil
+}
+
+// expire deletes the mail and receipts older than the TTL.
+func (m *Mailbox) expire() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, prefix := range [][]byte{mailPrefix, receiptPrefix} {
+		it, err := m.db.NewIterator(prefix, nil)
+		if err != nil {
+			return err
+		}
+		var (
+			expired [][]byte
+			mails   []*storedMail // Uncounted for receipts and broken entries
+		)
+		for it.Next() {
+			entry := new(storedMail) // Receipts share its stored_at field
+			if err := json.Unmarshal(it.Value(), entry); err != nil || now.Sub(entry.StoredAt) > m.config.TTL {
+				if err != nil || !bytes.Equal(prefix, mailPrefix) {
+					entry = nil
+				}
+				expired = append(expired, bytes.Clone(it.Key()))
+				mails = append(mails, entry)
+			}
+		}
+		err = it.Error()
+		it.Release()
+		if err != nil {
+			return err
+		}
+		for i, key := range expired {
+			if err := m.db.Delete(key); err != nil {
+				return err
+			}
+			if mails[i] != nil {
+				m.count(mails[i], -1)
+			}
+		}
+	}
+	return nil
+}
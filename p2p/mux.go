@@ -0,0 +1,170 @@
+package p2p
+
+import (
+	"errors"
+	"sync"
+
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+// Commands below baseProtocolLength belong to the base protocol, the
+// commands above are shared by the sub-protocols. Every protocol agreed on in
+// the handshake gets the next Length commands, in the order of the shared
+// capabilities, so both sides assign the same ranges.
+const (
+	baseProtocolLength = 0x10
+	maxCommand         = 0xff
+)
+
+var errMuxClosed = errors.New("protocol multiplexer closed")
+
+// Msg is a message of a sub-protocol, Code is relative to the protocol.
+type Msg struct {
+	Code    uint64
+	Payload []byte
+}
+
+// MsgReader reads messages of a sub-protocol.
+type MsgReader interface {
+	ReadMsg() (Msg, error)
+}
+
+// MsgWriter sends messages of a sub-protocol.
+type MsgWriter interface {
+	WriteMsg(Msg) error
+}
+
+// MsgReadWriter reads and writes messages of a sub-protocol.
+type MsgReadWriter interface {
+	MsgReader
+	MsgWriter
+}
+
+// protoRW is the message stream of a running protocol.
+type protoRW struct {
+	Protocol
+	peer   Peer
+	offset uint64
+	in     chan Msg
+	closed <-chan struct{}
+}
+
+func (rw *protoRW) ReadMsg() (Msg, error) {
+	select {
+	case msg := <-rw.in:
+		return msg, nil
+	case <-rw.closed:
+		return Msg{}, errMuxClosed
+	}
+}
+
+func (rw *protoRW) WriteMsg(msg Msg) error {
+	if msg.Code >= rw.Length {
+		return newPeerError(errInvalidMsgCode, "not handled: %s code %d", rw.cap(), msg.Code)
+	}
+	pkt, err := network.NewPacketFrameBytes(common.Command(rw.offset+msg.Code), msg.Payload)
+	if err != nil {
+		return err
+	}
+	return rw.peer.Send(pkt)
+}
+
+// matchProtocols returns the protocols of the shared capabilities with
+// their command offsets. Protocols which do not fit the command space are
+// left out.
+func matchProtocols(protocols []Protocol, caps []Cap, peer Peer, closed <-chan struct{}) []*protoRW {
+	var (
+		result []*protoRW
+		offset uint64 = baseProtocolLength
+	)
+	for _, c := range caps {
+		for _, p := range protocols {
+			if p.cap() != c {
+				continue
+			}
+			if p.Length > maxCommand+1-offset {
+				break
+			}
+			result = append(result, &protoRW{Protocol: p, peer: peer, offset: offset, in: make(chan Msg), closed: closed})
+			offset += p.Length
+			break
+		}
+	}
+	return result
+}
+
+// RunProtocols runs the protocols agreed on with peer, handing every
+// protocol the messages in its command range. Packets of the base protocol
+// go to base, which may be nil. It consumes the packets of peer until the
+// connection ends, a protocol returns or the peer sends a command no protocol
+// handles, then closes the peer and returns why, as understood by
+// DiscReasonForError.
+func RunProtocols(peer Peer, protocols []Protocol, base func(network.Packet)) error {
+	packets, err := peer.Receive()
+	if err != nil {
+		return err
+	}
+	closed := make(chan struct{})
+	running := matchProtocols(protocols, peer.Caps(), peer, closed)
+
+	var wg sync.WaitGroup
+	errc := make(chan error, len(running))
+	for _, rw := range running {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := rw.Run(peer, rw)
+			if err == nil {
+				err = errProtocolReturned
+			}
+			errc <- err
+		}()
+	}
+
+	err = dispatch(packets, running, base, errc)
+	close(closed)
+	peer.Close()
+	wg.Wait()
+	return err
+}
+
+// dispatch routes packets to the running protocols until one fails.
+func dispatch(packets <-chan network.Packet, running []*protoRW, base func(network.Packet), errc <-chan error) error {
+	for {
+		select {
+		case pkt, ok := <-packets:
+			if !ok {
+				// The read pump stopped
+				return DiscNetworkError
+			}
+			cmd := uint64(pkt.GetCommand())
+			if cmd < baseProtocolLength {
+				if base != nil {
+					base(pkt)
+				}
+				continue
+			}
+			rw := protocolFor(running, cmd)
+			if rw == nil {
+				return newPeerError(errInvalidMsgCode, "%d", cmd)
+			}
+			select {
+			case rw.in <- Msg{Code: cmd - rw.offset, Payload: pkt.GetPayload()}:
+			case err := <-errc:
+				return err
+			}
+		case err := <-errc:
+			return err
+		}
+	}
+}
+
+func protocolFor(running []*protoRW, cmd uint64) *protoRW {
+	for _, rw := range running {
+		if cmd >= rw.offset && cmd < rw.offset+rw.Length {
+			return rw
+		}
+	}
+	return nil
+}
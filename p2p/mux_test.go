@@ -0,0 +1,95 @@
+package p2p_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/p2p/p2ptest"
+)
+
+// echoProtocol answers every message with the same code, tagged with its name.
+func echoProtocol(name string, version uint) p2p.Protocol {
+	return p2p.Protocol{
+		Name:    name,
+		Version: version,
+		Length:  4,
+		Run: func(peer p2p.Peer, rw p2p.MsgReadWriter) error {
+			for {
+				msg, err := rw.ReadMsg()
+				if err != nil {
+					return err
+				}
+				if err := rw.WriteMsg(p2p.Msg{Code: msg.Code, Payload: append([]byte(name+":"), msg.Payload...)}); err != nil {
+					return err
+				}
+			}
+		},
+	}
+}
+
+func TestRunProtocols(t *testing.T) {
+	c := p2ptest.Connect(t, did.NewDIDIdentifier(nil), did.NewDIDIdentifier(nil),
+		[]p2p.Protocol{echoProtocol("chat", 1), echoProtocol("chat", 2), echoProtocol("sync", 1)},
+		[]p2p.Protocol{echoProtocol("chat", 1), echoProtocol("chat", 2), echoProtocol("file", 1)},
+	)
+	pa, pb := c.A, c.B
+	want := []p2p.Cap{{Name: "chat", Version: 2}}
+	assert.Equal(t, want, pa.Caps())
+	assert.Equal(t, want, pb.Caps())
+
+	base := make(chan network.Packet, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- p2p.RunProtocols(pb, []p2p.Protocol{echoProtocol("chat", 1), echoProtocol("chat", 2)}, func(pkt network.Packet) {
+			base <- pkt
+		})
+	}()
+
+	// Code 2 of the first protocol travels as command 0x12
+	pkt, err := network.NewPacketFrameBytes(common.Command(0x12), []byte("hi"))
+	require.NoError(t, err)
+	require.NoError(t, pa.Send(pkt))
+	ch, _ := pa.Receive()
+	select {
+	case reply := <-ch:
+		assert.Equal(t, common.Command(0x12), reply.GetCommand())
+		assert.Equal(t, []byte("chat:hi"), reply.GetPayload())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the protocol reply")
+	}
+
+	// Base packets bypass the protocols
+	pkt, err = network.NewPacketFrameBytes(common.MESSAGESEND, []byte("base"))
+	require.NoError(t, err)
+	require.NoError(t, pa.Send(pkt))
+	select {
+	case got := <-base:
+		assert.Equal(t, []byte("base"), got.GetPayload())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the base packet")
+	}
+
+	// A command outside every range is a protocol error
+	pkt, err = network.NewPacketFrameBytes(common.Command(0x30), nil)
+	require.NoError(t, err)
+	require.NoError(t, pa.Send(pkt))
+	select {
+	case err := <-done:
+		assert.Equal(t, p2p.DiscProtocolError, p2p.DiscReasonForError(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("multiplexer accepted an unknown command")
+	}
+}
+
+func TestRunProtocols_Returned(t *testing.T) {
+	quit := p2p.Protocol{Name: "quit", Version: 1, Length: 1, Run: func(p2p.Peer, p2p.MsgReadWriter) error { return nil }}
+	c := p2ptest.Connect(t, did.NewDIDIdentifier(nil), did.NewDIDIdentifier(nil), []p2p.Protocol{quit}, []p2p.Protocol{quit})
+	err := p2p.RunProtocols(c.B, []p2p.Protocol{quit}, nil)
+	assert.Equal(t, p2p.DiscQuitting, p2p.DiscReasonForError(err))
+}
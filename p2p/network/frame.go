@@ -0,0 +1,458 @@
+package network
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"slices"
+	"time"
+
+	crypto "github.com/wang900115/LCA/crypt"
+	"github.com/wang900115/LCA/did"
+	common "github.com/wang900115/LCA/p2p/com"
+	"golang.org/x/crypto/sha3"
+)
+
+// From protocol v1.1.0 on packets travel as variable-length frames
+//
+//	version(1) | command(1) | size(uvarint) | payload | checksum(8)
+//
+// where the checksum is the CRC64 of everything before it. The payload is
+// only bounded by the max frame size of the reader. v1.0.0 peers keep
+// exchanging the fixed-size PacketContent. RPCFrame and MessageFrame are the
+// variable-length counterparts of RPCContent and MessageContent.
+const (
+	frameVersion1 = 0x01
+
+	DefaultMaxFrameSize = 16 << 20
+
+	// Payload buffers grow by at least this much while reading
+	readChunk = 4 << 10
+)
+
+var (
+	errFrameTooLarge = &decErr{"frame exceeds max frame size"}
+	errFrameVersion  = &decErr{"unknown frame version"}
+)
+
+// UsesFrames reports whether packets exchanged under version are frames.
+func UsesFrames(version ProtocolVersion) bool {
+	return CompareVersion(string(version), string(protocolV2)) >= 0
+}
+
+// PacketFrame is a packet with a variable-length payload.
+type PacketFrame struct {
+	Command  common.Command
+	Payload  []byte
+	CheckSum uint64
+}
+
+// NewPacketFrame creates a frame carrying rpc.
+func NewPacketFrame(command common.Command, rpc RPC) (Packet, error) {
+	if rpc.Len() > DefaultMaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	return newPacketFrame(command, rpc.Bytes()), nil
+}
+
+// NewPacketFrameBytes creates a frame carrying a raw payload, for commands
+// whose payload is not an RPC.
+func NewPacketFrameBytes(command common.Command, payload []byte) (Packet, error) {
+	if len(payload) > DefaultMaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	return newPacketFrame(command, payload), nil
+}
+
+func newPacketFrame(command common.Command, payload []byte) *PacketFrame {
+	p := &PacketFrame{Command: command, Payload: payload}
+	p.CheckSum = crypto.CRC64(p.checksumData())
+	return p
+}
+
+func (p *PacketFrame) GetCommand() common.Command {
+	return p.Command
+}
+
+func (p *PacketFrame) GetPayload() []byte {
+	return p.Payload
+}
+
+func (p *PacketFrame) Encode(w io.Writer) (int, error) {
+	return w.Write(p.Bytes())
+}
+
+// Decode reads one frame of at most DefaultMaxFrameSize bytes from r. Use a
+// FrameReader to decode a stream of frames.
+func (p *PacketFrame) Decode(r io.Reader) (int, error) {
+	cr := &countingReader{Reader: r}
+	var sum [8]byte
+	err := decodeFrame(cr, p, DefaultMaxFrameSize, &sum)
+	return cr.n, err
+}
+
+func (p *PacketFrame) header() []byte {
+	buf := make([]byte, 2, 2+binary.MaxVarintLen64)
+	buf[0] = frameVersion1
+	buf[1] = byte(p.Command)
+	return binary.AppendUvarint(buf, uint64(len(p.Payload)))
+}
+
+func (p *PacketFrame) checksumData() []byte {
+	return append(p.header(), p.Payload...)
+}
+
+func (p *PacketFrame) Bytes() []byte {
+	return binary.BigEndian.AppendUint64(p.checksumData(), p.CheckSum)
+}
+
+func (p *PacketFrame) Check() error {
+	if crypto.CRC64(p.checksumData()) == p.CheckSum {
+		return nil
+	}
+	return ErrPacketChecksum
+}
+
+func (p *PacketFrame) Len() int {
+	return len(p.Bytes())
+}
+
+func (p *PacketFrame) Max() int {
+	return DefaultMaxFrameSize
+}
+
+// frameSource is what decoding the varint header needs.
+type frameSource interface {
+	io.Reader
+	io.ByteReader
+}
+
+// decodeFrame reads a frame into p, reusing the capacity of p.Payload. sum is
+// scratch space for the checksum, so decoding does not allocate.
+func decodeFrame(r frameSource, p *PacketFrame, maxSize int, sum *[8]byte) error {
+	version, err := r.ReadByte()
+	if err != nil {
+		return wrapFieldError(err, "version")
+	}
+	if version != frameVersion1 {
+		return errFrameVersion
+	}
+	command, err := r.ReadByte()
+	if err != nil {
+		return wrapFieldError(err, "command")
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return wrapFieldError(err, "payload length")
+	}
+	if size > uint64(maxSize) {
+		return errFrameTooLarge
+	}
+	p.Command = common.Command(command)
+	if p.Payload, err = readFull(r, p.Payload, int(size)); err != nil {
+		return wrapFieldError(err, "payload")
+	}
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return wrapFieldError(err, "checksum")
+	}
+	p.CheckSum = binary.BigEndian.Uint64(sum[:])
+	return nil
+}
+
+// PacketReader reads packets from a stream. A packet may share memory with
+// the reader until the next ReadPacket.
+type PacketReader interface {
+	ReadPacket() (Packet, error)
+}
+
+// NewPacketReader returns a reader for the packets a peer speaking version
+// sends. maxFrameSize bounds the payload of a frame, zero selects
+// DefaultMaxFrameSize.
+func NewPacketReader(r io.Reader, version ProtocolVersion, maxFrameSize int) PacketReader {
+	if !UsesFrames(version) {
+		return contentReader{r}
+	}
+	return NewFrameReader(r, maxFrameSize)
+}
+
+// WritePacket encodes p to w in the packet format of version, converting
+// between PacketContent and PacketFrame as needed.
+func WritePacket(w io.Writer, p Packet, version ProtocolVersion) (int, error) {
+	if !UsesFrames(version) {
+		if _, ok := p.(*PacketContent); !ok {
+			payload := p.GetPayload()
+			if len(payload) > MaxPacketPayloadSize {
+				return 0, errPacketPayloadExceed
+			}
+			p = newPacketContent(p.GetCommand(), payload)
+		}
+	} else if _, ok := p.(*PacketFrame); !ok {
+		p = newPacketFrame(p.GetCommand(), p.GetPayload())
+	}
+	return p.Encode(w)
+}
+
+type contentReader struct{ r io.Reader }
+
+func (c contentReader) ReadPacket() (Packet, error) {
+	pkt := new(PacketContent)
+	if _, err := pkt.Decode(c.r); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// FrameReader decodes a stream of frames.
+type FrameReader struct {
+	r       *bufio.Reader
+	maxSize int
+	sum     [8]byte
+	buf     []byte // Payloads of ReadPacket, grown to the largest frame
+}
+
+// NewFrameReader returns a reader of the frames on r. maxFrameSize bounds the
+// payload of a frame, zero selects DefaultMaxFrameSize.
+func NewFrameReader(r io.Reader, maxFrameSize int) *FrameReader {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &FrameReader{r: bufio.NewReader(r), maxSize: maxFrameSize}
+}
+
+// ReadFrame decodes the next frame into p. The payload reuses the capacity of
+// p.Payload, so reading into the same packet again does not allocate.
+func (fr *FrameReader) ReadFrame(p *PacketFrame) error {
+	return decodeFrame(fr.r, p, fr.maxSize, &fr.sum)
+}
+
+// ReadPacket decodes the next frame into a new packet. The payload is owned
+// by the reader and valid only until the next ReadPacket, callers keeping it
+// longer must copy it.
+func (fr *FrameReader) ReadPacket() (Packet, error) {
+	pkt := &PacketFrame{Payload: fr.buf}
+	err := fr.ReadFrame(pkt)
+	fr.buf = pkt.Payload[:0]
+	if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// RPCFrame is an RPC with a variable-length sender and payload.
+type RPCFrame struct {
+	From    string
+	Payload []byte
+	Sig     [64]byte
+}
+
+// NewRPCFrame wraps msg in an RPC signed by d.
+func NewRPCFrame(msg Message, d did.IdentifierDID) (RPC, error) {
+	if msg.Len() > DefaultMaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	rpc := &RPCFrame{From: d.Addr(), Payload: msg.Bytes()}
+	signature, err := d.SignMessage(rpc.dataToSign())
+	if err != nil {
+		return nil, err
+	}
+	copy(rpc.Sig[:], signature)
+	return rpc, nil
+}
+
+func (rpc *RPCFrame) Encode(w io.Writer) (int, error) {
+	return w.Write(rpc.Bytes())
+}
+
+func (rpc *RPCFrame) Decode(r io.Reader) (int, error) {
+	cr := &countingReader{Reader: r}
+	from, err := readVarBytes(cr, "from")
+	if err != nil {
+		return cr.n, err
+	}
+	rpc.From = string(from)
+	if rpc.Payload, err = readVarBytes(cr, "payload"); err != nil {
+		return cr.n, err
+	}
+	if _, err := io.ReadFull(cr, rpc.Sig[:]); err != nil {
+		return cr.n, wrapFieldError(err, "signature")
+	}
+	return cr.n, nil
+}
+
+// dataToSign prefixes the sender with its length, so no part of it can be
+// moved into the payload.
+func (rpc *RPCFrame) dataToSign() []byte {
+	b := binary.AppendUvarint(nil, uint64(len(rpc.From)))
+	b = append(b, rpc.From...)
+	return append(b, rpc.Payload...)
+}
+
+func (rpc *RPCFrame) Verify(pub ed25519.PublicKey) error {
+	ok, err := crypto.ED25519Verify(pub, rpc.dataToSign(), rpc.Sig[:])
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	return ErrRPCSignature
+}
+
+func (rpc *RPCFrame) Bytes() []byte {
+	b := AppendVarBytes(nil, []byte(rpc.From))
+	b = AppendVarBytes(b, rpc.Payload)
+	return append(b, rpc.Sig[:]...)
+}
+
+func (rpc *RPCFrame) Len() int {
+	return len(rpc.Bytes())
+}
+
+func (rpc *RPCFrame) Max() int {
+	return DefaultMaxFrameSize
+}
+
+// MessageFrame is a message with a variable-length payload. Unlike
+// MessageContent its encoding includes the hash.
+type MessageFrame struct {
+	Type      common.Message
+	Payload   []byte
+	CreatedAt int64
+	Hash      [32]byte
+}
+
+// NewMessageFrame creates a message authenticated with sharedKey.
+func NewMessageFrame(msgType common.Message, payload []byte, sharedKey []byte) (Message, error) {
+	if len(payload) > DefaultMaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	msg := &MessageFrame{
+		Type:      msgType,
+		Payload:   payload,
+		CreatedAt: time.Now().UTC().UnixNano(),
+	}
+	msg.Hash = msg.computeHash(sharedKey)
+	return msg, nil
+}
+
+func (m *MessageFrame) Encode(w io.Writer) (int, error) {
+	return w.Write(m.Bytes())
+}
+
+func (m *MessageFrame) Decode(r io.Reader) (int, error) {
+	cr := &countingReader{Reader: r}
+	msgType, err := cr.ReadByte()
+	if err != nil {
+		return cr.n, wrapFieldError(err, "type")
+	}
+	m.Type = common.Message(msgType)
+	if m.Payload, err = readVarBytes(cr, "payload"); err != nil {
+		return cr.n, err
+	}
+	var ts [8]byte
+	if _, err := io.ReadFull(cr, ts[:]); err != nil {
+		return cr.n, wrapFieldError(err, "createdAt")
+	}
+	m.CreatedAt = int64(binary.BigEndian.Uint64(ts[:]))
+	if _, err := io.ReadFull(cr, m.Hash[:]); err != nil {
+		return cr.n, wrapFieldError(err, "hash")
+	}
+	return cr.n, nil
+}
+
+func (m *MessageFrame) hashData() []byte {
+	b := AppendVarBytes([]byte{byte(m.Type)}, m.Payload)
+	return binary.BigEndian.AppendUint64(b, uint64(m.CreatedAt))
+}
+
+func (m *MessageFrame) Bytes() []byte {
+	return append(m.hashData(), m.Hash[:]...)
+}
+
+func (m *MessageFrame) Verify(sharedKey []byte) bool {
+	return crypto.HMACVerify(sha3.New256, sharedKey, m.hashData(), m.Hash[:])
+}
+
+func (m *MessageFrame) computeHash(sharedKey []byte) [32]byte {
+	var out [32]byte
+	copy(out[:], crypto.HMACSign(sha3.New256, sharedKey, m.hashData()))
+	return out
+}
+
+func (m *MessageFrame) Len() int {
+	return len(m.Bytes())
+}
+
+func (m *MessageFrame) Max() int {
+	return DefaultMaxFrameSize
+}
+
+// countingReader adds ReadByte to a reader and counts the bytes read.
+type countingReader struct {
+	io.Reader
+	n int
+	b [1]byte
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r, r.b[:]); err != nil {
+		return 0, err
+	}
+	return r.b[0], nil
+}
+
+// AppendVarBytes appends data to b, prefixed with its uvarint length.
+func AppendVarBytes(b, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// SplitVarBytes returns the value at the start of b written by
+// AppendVarBytes and what follows it. ok is false if b is truncated.
+func SplitVarBytes(b []byte) (data, rest []byte, ok bool) {
+	size, n := binary.Uvarint(b)
+	if n <= 0 || size > uint64(len(b)-n) {
+		return nil, nil, false
+	}
+	return b[n : n+int(size)], b[n+int(size):], true
+}
+
+func readVarBytes(r frameSource, field string) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, wrapFieldError(err, field+" length")
+	}
+	if size > DefaultMaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	data, err := readFull(r, nil, int(size))
+	if err != nil {
+		return nil, wrapFieldError(err, field)
+	}
+	return data, nil
+}
+
+// readFull reads size bytes into buf, reusing its capacity. buf grows with
+// the data which arrived rather than to the declared size up front, so a
+// length a peer never sends is not allocated.
+func readFull(r io.Reader, buf []byte, size int) ([]byte, error) {
+	buf = buf[:0]
+	for len(buf) < size {
+		if len(buf) == cap(buf) {
+			buf = slices.Grow(buf, min(size-len(buf), max(cap(buf), readChunk)))
+		}
+		n, err := io.ReadFull(r, buf[len(buf):min(size, cap(buf))])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
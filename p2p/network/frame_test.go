@@ -0,0 +1,158 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	common "github.com/wang900115/LCA/p2p/com"
+)
+
+func TestFrameEncodeDecode(t *testing.T) {
+	// A DID document is far beyond the fixed-size limits
+	d := did.NewDIDIdentifier([]did.ServiceEndpoint{})
+	doc, err := d.Document().JSONMarshal()
+	require.NoError(t, err)
+	msg, err := NewMessageFrame(common.PUBLIC, doc, []byte("SHARED"))
+	require.NoError(t, err)
+	rpc, err := NewRPCFrame(msg, d)
+	require.NoError(t, err)
+	packet, err := NewPacketFrame(common.PEERINFO, rpc)
+	require.NoError(t, err)
+	assert.Greater(t, len(packet.GetPayload()), MaxPacketPayloadSize)
+
+	var buf bytes.Buffer
+	n, err := packet.Encode(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, packet.Len(), n)
+
+	var decoded PacketFrame
+	n, err = decoded.Decode(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, packet.Len(), n)
+	assert.NoError(t, decoded.Check())
+	assert.Equal(t, common.PEERINFO, decoded.GetCommand())
+
+	var decodedRPC RPCFrame
+	n, err = decodedRPC.Decode(bytes.NewReader(decoded.Payload))
+	require.NoError(t, err)
+	assert.Equal(t, rpc.Len(), n)
+	assert.NoError(t, decodedRPC.Verify(d.Keys().GetEd25519PublicKey()))
+
+	var decodedMsg MessageFrame
+	_, err = decodedMsg.Decode(bytes.NewReader(decodedRPC.Payload))
+	require.NoError(t, err)
+	assert.True(t, decodedMsg.Verify([]byte("SHARED")))
+	assert.Equal(t, doc, decodedMsg.Payload)
+
+	decoded.Payload[0] ^= 0xFF
+	assert.Equal(t, ErrPacketChecksum, decoded.Check())
+}
+
+func TestFrameReader(t *testing.T) {
+	var buf bytes.Buffer
+	for _, size := range []int{0, 1, 300, 1 << 20} {
+		_, err := newPacketFrame(common.MESSAGESEND, bytes.Repeat([]byte{0xAB}, size)).Encode(&buf)
+		require.NoError(t, err)
+	}
+	reader := NewFrameReader(&buf, 0)
+	var pkt PacketFrame
+	for _, size := range []int{0, 1, 300, 1 << 20} {
+		require.NoError(t, reader.ReadFrame(&pkt))
+		assert.Len(t, pkt.Payload, size)
+		assert.NoError(t, pkt.Check())
+	}
+
+	// Decoding into the same packet does not allocate
+	frame := newPacketFrame(common.MESSAGESEND, make([]byte, 4096)).Bytes()
+	stream := bytes.NewReader(nil)
+	reader = NewFrameReader(stream, 0)
+	allocs := testing.AllocsPerRun(100, func() {
+		stream.Reset(frame)
+		reader.r.Reset(stream)
+		if err := reader.ReadFrame(&pkt); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestFrameReader_ReadPacket(t *testing.T) {
+	var buf bytes.Buffer
+	for _, size := range []int{300, 1 << 20, 10} {
+		_, err := newPacketFrame(common.MESSAGESEND, bytes.Repeat([]byte{byte(size)}, size)).Encode(&buf)
+		require.NoError(t, err)
+	}
+	reader := NewFrameReader(&buf, 0)
+	first, err := reader.ReadPacket()
+	require.NoError(t, err)
+	large, err := reader.ReadPacket()
+	require.NoError(t, err)
+	small, err := reader.ReadPacket()
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{10}, 10), small.GetPayload())
+	// The buffer grew to the largest frame and is reused after it
+	assert.GreaterOrEqual(t, cap(small.GetPayload()), 1<<20)
+	assert.Same(t, &large.GetPayload()[0], &small.GetPayload()[0])
+	assert.Len(t, first.GetPayload(), 300)
+}
+
+func TestFrameReader_Limits(t *testing.T) {
+	frame := newPacketFrame(common.MESSAGESEND, make([]byte, 1024)).Bytes()
+	var pkt PacketFrame
+	assert.Equal(t, errFrameTooLarge, NewFrameReader(bytes.NewReader(frame), 512).ReadFrame(&pkt))
+	assert.Nil(t, pkt.Payload, "payload allocated before the size check")
+
+	frame[0] = 0x7F
+	assert.Equal(t, errFrameVersion, NewFrameReader(bytes.NewReader(frame), 0).ReadFrame(&pkt))
+
+	// A frame announcing more than it carries is not allocated in full
+	truncated := newPacketFrame(common.MESSAGESEND, make([]byte, 8<<20)).Bytes()[:64]
+	assert.Error(t, NewFrameReader(bytes.NewReader(truncated), 0).ReadFrame(&pkt))
+	assert.Less(t, cap(pkt.Payload), 1<<20)
+}
+
+func TestSplitVarBytes(t *testing.T) {
+	b := AppendVarBytes(AppendVarBytes(nil, []byte("topic")), nil)
+	data, rest, ok := SplitVarBytes(append(b, "tail"...))
+	require.True(t, ok)
+	assert.Equal(t, []byte("topic"), data)
+	data, rest, ok = SplitVarBytes(rest)
+	require.True(t, ok)
+	assert.Empty(t, data)
+	assert.Equal(t, []byte("tail"), rest)
+
+	for _, b := range [][]byte{nil, b[:3], {0xff}} {
+		_, _, ok := SplitVarBytes(b)
+		assert.False(t, ok, "%x", b)
+	}
+}
+
+func TestWritePacket(t *testing.T) {
+	small := newPacketFrame(common.HEARTBEAT, []byte("ping"))
+	large := newPacketFrame(common.HEARTBEAT, make([]byte, MaxPacketPayloadSize+1))
+
+	// v1.0.0 peers get the fixed-size encoding
+	var buf bytes.Buffer
+	_, err := WritePacket(&buf, small, protocolV1)
+	require.NoError(t, err)
+	pkt, err := NewPacketReader(&buf, protocolV1, 0).ReadPacket()
+	require.NoError(t, err)
+	require.IsType(t, &PacketContent{}, pkt)
+	assert.NoError(t, pkt.Check())
+	assert.Equal(t, []byte("ping"), pkt.GetPayload())
+	_, err = WritePacket(&buf, large, protocolV1)
+	assert.Equal(t, errPacketPayloadExceed, err)
+
+	// Newer peers get frames, also for fixed-size packets
+	buf.Reset()
+	_, err = WritePacket(&buf, newPacketContent(common.HEARTBEAT, []byte("ping")), protocolV2)
+	require.NoError(t, err)
+	pkt, err = NewPacketReader(&buf, protocolV2, 0).ReadPacket()
+	require.NoError(t, err)
+	require.IsType(t, &PacketFrame{}, pkt)
+	assert.NoError(t, pkt.Check())
+	assert.Equal(t, []byte("ping"), pkt.GetPayload())
+}
@@ -5,17 +5,20 @@ import (
 )
 
 type HandShakeContent struct {
-	DIDDocument *did.Document `json:"did_document"`
-	Signature   []byte        `json:"signature"` // Signature of the DID Document
-	Challenge   []byte        `json:"challenge"` // Random challenge for replay protection
-	Version     string        `json:"version"`
+	DIDDocument  *did.Document `json:"did_document"`
+	Signature    []byte        `json:"signature"`      // Signature of the DID Document
+	Challenge    []byte        `json:"challenge"`      // Random challenge for replay protection
+	Version      string        `json:"version"`        // Highest protocol version spoken by the sender
+	KeySignature []byte        `json:"key_signature"`  // Signature of the X25519 key agreement key
+	Caps         []string      `json:"caps,omitempty"` // Capabilities of the sender as name/version
 }
 
-func NewHandShakeContent(didDoc *did.Document, signature, challenge []byte, version string) *HandShakeContent {
+func NewHandShakeContent(didDoc *did.Document, signature, challenge []byte, version string, keySignature []byte) *HandShakeContent {
 	return &HandShakeContent{
-		DIDDocument: didDoc,
-		Signature:   signature,
-		Challenge:   challenge,
-		Version:     version,
+		DIDDocument:  didDoc,
+		Signature:    signature,
+		Challenge:    challenge,
+		Version:      version,
+		KeySignature: keySignature,
 	}
 }
@@ -21,12 +21,15 @@ const (
 )
 
 var (
+	// ErrPacketChecksum is returned by Check of a corrupted packet.
+	ErrPacketChecksum = errors.New("packet checksum verification failed")
+
 	errPacketPayloadExceed = &decErr{"packet payload is exceed 200 bytes"}
-	errPacketChecksumFail  = errors.New("packet checksum verification failed")
 )
 
 type Packet interface {
 	GetCommand() common.Command
+	GetPayload() []byte
 	Encode(w io.Writer) (int, error)
 	Decode(r io.Reader) (int, error)
 	Bytes() []byte
@@ -46,23 +49,31 @@ func NewPacket(command common.Command, rpc RPC) (Packet, error) {
 	if rpc.Len() > MaxPacketPayloadSize {
 		return nil, errPacketPayloadExceed
 	}
+	return newPacketContent(command, rpc.Bytes()), nil
+}
+
+func newPacketContent(command common.Command, payload []byte) *PacketContent {
 	var pkt PacketContent
 	pkt.Command = command
-	pkt.PayloadLen = uint16(rpc.Len())
-	copy(pkt.Payload[:], rpc.Bytes())
+	pkt.PayloadLen = uint16(len(payload))
+	copy(pkt.Payload[:], payload)
 	cmdBytes := []byte{byte(pkt.Command)}
 	lenBytes := make([]byte, 2)
 	binary.BigEndian.PutUint16(lenBytes, pkt.PayloadLen)
 	data := append(cmdBytes, lenBytes...)
 	data = append(data, pkt.Payload[:pkt.PayloadLen]...)
 	pkt.CheckSum = crypto.CRC64(data)
-	return &pkt, nil
+	return &pkt
 }
 
 func (p *PacketContent) GetCommand() common.Command {
 	return p.Command
 }
 
+func (p *PacketContent) GetPayload() []byte {
+	return p.Payload[:p.PayloadLen]
+}
+
 func (p *PacketContent) Encode(w io.Writer) (int, error) {
 	n := 0
 	if err := write(w, p.Command); err != nil {
@@ -133,7 +144,7 @@ func (p *PacketContent) Check() error {
 	if crypto.CRC64(data) == p.CheckSum {
 		return nil
 	}
-	return errPacketChecksumFail
+	return ErrPacketChecksum
 }
 
 func (p *PacketContent) Len() int {
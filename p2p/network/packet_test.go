@@ -42,5 +42,5 @@ func TestPacketChecksumFail(t *testing.T) {
 
 	err := packetContent.Check()
 	assert.Error(t, err)
-	assert.Equal(t, errPacketChecksumFail, err)
+	assert.Equal(t, ErrPacketChecksum, err)
 }
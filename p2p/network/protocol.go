@@ -2,11 +2,14 @@ package network
 
 import (
 	"errors"
+	"strconv"
+	"strings"
 )
 
 type Protocol interface {
 	ProtocolInfo() *ProtocolInfo
 	IsVersionSupported(string) (bool, error)
+	NegotiateVersion(string) (string, error)
 	IsPortSupported(int) (bool, error)
 	IsProtocolSupported(string) (bool, error)
 	GetDefaultVersion() string
@@ -77,6 +80,41 @@ func (pi *ProtocolInfo) IsVersionSupported(version string) (bool, error) {
 	return false, ErrProtocolVersionNotSupported
 }
 
+// NegotiateVersion returns the version spoken with a peer whose highest
+// version is remote: the lower of both, provided it is supported.
+func (pi *ProtocolInfo) NegotiateVersion(remote string) (string, error) {
+	if ok, err := pi.IsVersionSupported(remote); !ok {
+		return "", err
+	}
+	local := string(pi.Version)
+	if CompareVersion(remote, local) < 0 {
+		return remote, nil
+	}
+	return local, nil
+}
+
+// CompareVersion compares two dotted version strings numerically, returning
+// -1, 0 or +1. Missing or malformed components count as zero.
+func CompareVersion(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
 // GetDefaultVersion returns the default protocol version
 func (pi *ProtocolInfo) GetDefaultVersion() string {
 	return string(protocolV2)
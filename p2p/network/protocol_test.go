@@ -0,0 +1,24 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	info := NewProtocolInfo(TCPProtocol)
+
+	version, err := info.NegotiateVersion("1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.0", version)
+	version, err = info.NegotiateVersion("1.1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.0", version)
+	_, err = info.NegotiateVersion("2.0.0")
+	assert.ErrorIs(t, err, ErrProtocolVersionNotSupported)
+
+	assert.Equal(t, -1, CompareVersion("1.0.0", "1.1.0"))
+	assert.Equal(t, 1, CompareVersion("1.10.0", "1.9.0"))
+	assert.Equal(t, 0, CompareVersion("1.1", "1.1.0"))
+}
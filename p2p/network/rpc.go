@@ -14,8 +14,10 @@ const (
 )
 
 var (
+	// ErrRPCSignature is returned by Verify of an RPC with a bad signature.
+	ErrRPCSignature = errors.New("rpc payload signature verification failed")
+
 	errRPCPayloadExceed = &decErr{"rpc payload is exceed 50 bytes"}
-	errRPCPayloadVerify = errors.New("rpc payload signature verification failed")
 )
 
 type RPC interface {
@@ -115,7 +117,7 @@ func (rpc *RPCContent) Verify(pub ed25519.PublicKey) error {
 	if ok {
 		return nil
 	}
-	return errRPCPayloadVerify
+	return ErrRPCSignature
 }
 
 func (rpc *RPCContent) Bytes() []byte {
@@ -0,0 +1,174 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+
+	"github.com/wang900115/LCA/metric"
+	"github.com/wang900115/LCA/p2p"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+// A heartbeat is a HEARTBEAT packet of
+//
+//	kind(1) | nonce(8)
+//
+// A ping is answered by a pong carrying the same nonce, the time between
+// them is the round trip time of the connection.
+const (
+	heartbeatPing = 0x00
+	heartbeatPong = 0x01
+
+	heartbeatSize = 1 + 8
+
+	// Defaults of the heartbeat of a peer
+	DefaultHeartbeatInterval   = 15 * time.Second
+	DefaultMaxMissedHeartbeats = 3
+)
+
+// rttTimer collects the heartbeat round trips of all peers.
+var rttTimer = metric.GetOrRegisterResettingTimer("p2p/peer/rtt", nil)
+
+// heartbeat is the liveness state of a peer.
+type heartbeat struct {
+	pings    map[uint64]time.Time // Unanswered pings by nonce
+	rtt      time.Duration
+	lastPong time.Time
+}
+
+// Heartbeat pings the peer every HeartbeatInterval until the connection
+// ends. A peer which leaves MaxMissedHeartbeats pings unanswered is closed
+// with p2p.DiscHeartbeatTimeout.
+func (p *Peer) Heartbeat(ctx context.Context) {
+	interval := p.HeartbeatInterval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	maxMissed := p.MaxMissedHeartbeats
+	if maxMissed <= 0 {
+		maxMissed = DefaultMaxMissedHeartbeats
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.closed:
+			return
+		case <-ctx.Done():
+			return
+		}
+		if p.missedHeartbeats() >= maxMissed {
+			p.setErr(p2p.DiscHeartbeatTimeout)
+			p.Close()
+			return
+		}
+		if err := p.ping(); err != nil {
+			return
+		}
+	}
+}
+
+// Info returns the state of the connection.
+func (p *Peer) Info() *p2p.PeerInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	info := &p2p.PeerInfo{
+		Addr:     p.Addr(),
+		Version:  p.ProtocolInfo().Version,
+		RTT:      p.hb.rtt,
+		LastPong: p.hb.lastPong,
+		Missed:   len(p.hb.pings),
+	}
+	if p.document != nil {
+		info.ID = p.document.ID
+	}
+	for _, c := range p.caps {
+		info.Caps = append(info.Caps, c.String())
+	}
+	return info
+}
+
+// RTT returns the latest heartbeat round trip time, zero until measured.
+func (p *Peer) RTT() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.hb.rtt
+}
+
+func (p *Peer) missedHeartbeats() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.hb.pings)
+}
+
+func (p *Peer) ping() error {
+	var b [8]byte
+	rand.Read(b[:])
+	nonce := binary.BigEndian.Uint64(b[:])
+	p.mu.Lock()
+	if p.hb.pings == nil {
+		p.hb.pings = make(map[uint64]time.Time)
+	}
+	p.hb.pings[nonce] = time.Now()
+	p.mu.Unlock()
+	pkt, err := heartbeatPacket(heartbeatPing, nonce)
+	if err != nil {
+		return err
+	}
+	return p.Send(pkt)
+}
+
+// pong answers a ping without waiting for the write queue, as it runs on
+// ReadPump. With the queue full the pong is dropped, which the remote sees
+// as one missed heartbeat.
+func (p *Peer) pong(nonce uint64) {
+	pkt, err := heartbeatPacket(heartbeatPong, nonce)
+	if err != nil {
+		return
+	}
+	select {
+	case p.Channel.Produce() <- pkt:
+	default:
+	}
+}
+
+func heartbeatPacket(kind byte, nonce uint64) (network.Packet, error) {
+	payload := binary.BigEndian.AppendUint64([]byte{kind}, nonce)
+	return network.NewPacketFrameBytes(common.HEARTBEAT, payload)
+}
+
+// handleHeartbeat answers a ping or records the round trip of a pong.
+// Malformed heartbeats and pongs of unknown nonces are dropped.
+func (p *Peer) handleHeartbeat(pkt network.Packet) {
+	payload := pkt.GetPayload()
+	if len(payload) != heartbeatSize {
+		return
+	}
+	nonce := binary.BigEndian.Uint64(payload[1:])
+	switch payload[0] {
+	case heartbeatPing:
+		p.pong(nonce)
+	case heartbeatPong:
+		now := time.Now()
+		p.mu.Lock()
+		sent, ok := p.hb.pings[nonce]
+		if !ok {
+			p.mu.Unlock()
+			return
+		}
+		// An answer also covers the pings sent before
+		for n, ts := range p.hb.pings {
+			if !ts.After(sent) {
+				delete(p.hb.pings, n)
+			}
+		}
+		p.hb.rtt = now.Sub(sent)
+		p.hb.lastPong = now
+		p.mu.Unlock()
+		rttTimer.Update(now.Sub(sent))
+	}
+}
@@ -0,0 +1,130 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wang900115/LCA/p2p"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+// startPeer runs the pumps and the heartbeat of p until ctx is cancelled.
+func startPeer(ctx context.Context, p *Peer) {
+	go p.ReadPump(ctx)
+	go p.WritePump(ctx)
+	go p.Heartbeat(ctx)
+}
+
+func TestHeartbeatRTT(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	p1, p2 := newTestPeer(c1), newTestPeer(c2)
+	p1.HeartbeatInterval = 10 * time.Millisecond
+	p2.HeartbeatInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startPeer(ctx, p1)
+	startPeer(ctx, p2)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p1.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for a heartbeat round trip")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	info := p1.Info()
+	if info.RTT <= 0 || info.LastPong.IsZero() {
+		t.Errorf("Expected a measured RTT, got %+v", info)
+	}
+	if info.Addr != c1.RemoteAddr().String() {
+		t.Errorf("Expected address %s, got %s", c1.RemoteAddr(), info.Addr)
+	}
+
+	// Heartbeats are answered by the pumps, they never reach the application
+	ch, _ := p2.Receive()
+	select {
+	case pkt := <-ch:
+		t.Errorf("Unexpected packet %v", pkt.GetCommand())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	// The remote side reads everything but never answers
+	go io.Copy(io.Discard, c2)
+
+	p := newTestPeer(c1)
+	p.HeartbeatInterval = 10 * time.Millisecond
+	p.MaxMissedHeartbeats = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.WritePump(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		p.Heartbeat(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat kept a half-open connection")
+	}
+	if !errors.Is(p.Err(), p2p.DiscHeartbeatTimeout) {
+		t.Errorf("Expected heartbeat timeout, got %v", p.Err())
+	}
+	if missed := p.Info().Missed; missed != 2 {
+		t.Errorf("Expected 2 missed heartbeats, got %d", missed)
+	}
+}
+
+func TestHeartbeatPongQueueFull(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	p := newTestPeer(c1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Without a WritePump the write queue stays full
+	go p.ReadPump(ctx)
+	for full := false; !full; {
+		select {
+		case p.Channel.Produce() <- nil:
+		default:
+			full = true
+		}
+	}
+
+	// Pings are not answered, but do not stall the packets behind them
+	version := p.ProtocolInfo().Version
+	msg, err := network.NewPacketFrameBytes(common.MESSAGESEND, []byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for nonce := range uint64(3) {
+			ping, _ := heartbeatPacket(heartbeatPing, nonce)
+			network.WritePacket(c2, ping, version)
+		}
+		network.WritePacket(c2, msg, version)
+	}()
+	ch, _ := p.Receive()
+	select {
+	case pkt := <-ch:
+		if string(pkt.GetPayload()) != "after" {
+			t.Errorf("Expected the message after the pings, got %q", pkt.GetPayload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a ping blocked ReadPump")
+	}
+}
@@ -1,128 +1,288 @@
 package node
 
-// import (
-// 	"context"
-// 	"errors"
-// 	"io"
-// 	"net"
-
-// 	"github.com/wang900115/LCA/did"
-// 	"github.com/wang900115/LCA/p2p"
-// 	"github.com/wang900115/LCA/p2p/network"
-// )
-
-// // Peer represents a peer in the P2P network.
-// type Peer struct {
-// 	net.Conn
-// 	Identifier did.IdentifierDID
-// 	Verifier   did.VerifierDID
-// 	Protocol   network.Protocol
-// 	Transport  network.Packet
-// 	Channel    *channel
-// 	Meta       map[string]string
-// }
-
-// // NewPeer creates a new peer instance.
-// func NewPeer(conn net.Conn, services []did.ServiceEndpoint, verifierConfig did.VerifierConfig, transport network.TransportProtocol, inBoundLi, outBoundLi int) p2p.Peer {
-// 	identifier := did.NewDIDIdentifier(services)
-// 	verifier := did.NewDIDVerifier(verifierConfig)
-// 	protocol := network.NewProtocolInfo(transport)
-// 	inCh := make(chan network.Packet, 1024)
-// 	outCh := make(chan network.Packet, 1024)
-// 	channel := NewChannel(inCh, outCh)
-
-// 	return &Peer{
-// 		Conn:       conn,
-// 		Identifier: identifier,
-// 		Verifier:   verifier,
-// 		Channel:    channel,
-// 		Protocol:   protocol,
-// 		Meta:       map[string]string{},
-// 	}
-// }
-
-// // Addr returns the peer address
-// func (p *Peer) Addr() string {
-// 	return p.Identifier.Addr()
-// }
-
-// // ID returns the unique identifier of the peer.
-// func (p *Peer) ID() string {
-// 	return p.Identifier.Document().ID
-// }
-
-// // Document returns the DID document of the peer.
-// func (p *Peer) Document() *did.Document {
-// 	return p.Identifier.Document()
-// }
-
-// // Protocol returns the protocol information of the peer.
-// func (p *Peer) ProtocolInfo() *network.ProtocolInfo {
-// 	return p.Protocol.ProtocolInfo()
-// }
-
-// // SendPacket sends a packet to the peer.
-// func (p *Peer) Send(packet network.Packet) error {
-// 	p.Channel.Produce() <- packet
-// 	return nil
-// }
-
-// // ReceivePacket returns a channel to receive packets from the peer.
-// func (p *Peer) Receive() (<-chan network.Packet, error) {
-// 	return p.Channel.Consume(), nil
-// }
-
-// // ReadPump pumps packets from the peer connection to the channel.
-// func (p *Peer) ReadPump(ctx context.Context) {
-// 	defer func() {
-// 		err := p.Conn.Close()
-// 		if err != nil {
-// 			panic(err)
-// 		}
-// 	}()
-
-// 	for {
-// 		select {
-// 		case <-ctx.Done():
-// 			return
-// 		default:
-// 			var pkt network.PacketContent
-// 			_, err := pkt.Decode(p.Conn)
-// 			if err != nil {
-// 				if errors.Is(err, io.EOF) {
-// 					return
-// 				}
-// 				return
-// 			}
-// 			select {
-// 			case p.Channel.In() <- &pkt:
-// 			case <-ctx.Done():
-// 				return
-// 			}
-// 		}
-// 	}
-// }
-
-// // WritePump pumps packets from the channel to the peer connection.
-// func (p *Peer) WritePump(ctx context.Context) {
-// 	defer func() {
-// 		err := p.Conn.Close()
-// 		if err != nil {
-// 			panic(err)
-// 		}
-// 	}()
-// 	for {
-// 		select {
-// 		case packet, ok := <-p.Channel.Out():
-// 			if !ok {
-// 				return
-// 			}
-// 			_, err := packet.Encode(p.Conn)
-// 			if err != nil {
-// 				return
-// 			}
-// 		case <-ctx.Done():
-// 			return
-// 		}
-// 	}
-// }
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+var (
+	// ErrPeerClosed is returned when sending to a peer whose connection was closed.
+	ErrPeerClosed = errors.New("peer connection closed")
+
+	errNoSessionIdentity = errors.New("session secret without peer identities")
+)
+
+// Peer represents a peer in the P2P network.
+type Peer struct {
+	net.Conn
+	Identifier did.IdentifierDID // Local identity used towards the peer
+	Verifier   did.VerifierDID
+	Protocol   network.Protocol
+	Channel    *channel
+	Meta       map[string]string
+	Session    p2p.SessionConfig // Framing of the encrypted session
+
+	// MaxPacketSize bounds the payload of a received packet frame,
+	// network.DefaultMaxFrameSize if zero.
+	MaxPacketSize int
+
+	// HeartbeatInterval and MaxMissedHeartbeats tune the liveness check,
+	// zero values select the defaults.
+	HeartbeatInterval   time.Duration
+	MaxMissedHeartbeats int
+
+	mu        sync.RWMutex
+	document  *did.Document // Remote identity, set by the handshake
+	secret    []byte        // Session secret, set by the handshake
+	caps      []p2p.Cap     // Shared capabilities, set by the handshake
+	readErr   error         // Error which stopped the read pump
+	hb        heartbeat
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	rwOnce sync.Once
+	rw     net.Conn // Connection the pumps use, encrypted after a handshake
+	rwErr  error
+}
+
+// NewPeer creates a new peer instance on top of conn. identifier is the local
+// identity presented to the peer and verifier checks the remote one.
+func NewPeer(conn net.Conn, identifier did.IdentifierDID, verifier did.VerifierDID, transport network.TransportProtocol) p2p.Peer {
+	inCh := make(chan network.Packet, 1024)
+	outCh := make(chan network.Packet, 1024)
+
+	return &Peer{
+		Conn:       conn,
+		Identifier: identifier,
+		Verifier:   verifier,
+		Channel:    NewChannel(inCh, outCh),
+		Protocol:   network.NewProtocolInfo(transport),
+		Meta:       map[string]string{},
+		closed:     make(chan struct{}),
+	}
+}
+
+// Addr returns the remote address of the peer connection.
+func (p *Peer) Addr() string {
+	if p.Conn == nil {
+		return ""
+	}
+	return p.Conn.RemoteAddr().String()
+}
+
+// ID returns the DID of the remote peer, empty if it is not identified yet.
+func (p *Peer) ID() string {
+	if doc := p.Document(); doc != nil {
+		return doc.ID
+	}
+	return ""
+}
+
+// Document returns the DID document of the remote peer.
+func (p *Peer) Document() *did.Document {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.document
+}
+
+// SetDocument records the verified DID document of the remote peer.
+func (p *Peer) SetDocument(doc *did.Document) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.document = doc
+}
+
+// Caps returns the capabilities shared with the peer.
+func (p *Peer) Caps() []p2p.Cap {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.caps
+}
+
+// SetCaps records the capabilities shared with the peer.
+func (p *Peer) SetCaps(caps []p2p.Cap) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.caps = caps
+}
+
+// Secret returns the session secret shared with the peer.
+func (p *Peer) Secret() []byte {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.secret
+}
+
+// SetSecret records the session secret shared with the peer.
+func (p *Peer) SetSecret(secret []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.secret = secret
+}
+
+// Err returns the error which ended the connection, nil while the peer is
+// connected or when it was closed locally.
+func (p *Peer) Err() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.readErr
+}
+
+func (p *Peer) setErr(err error) {
+	select {
+	case <-p.closed:
+		// Reading failed because the peer was closed
+		return
+	default:
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readErr = err
+}
+
+// Protocol returns the protocol information of the peer.
+func (p *Peer) ProtocolInfo() *network.ProtocolInfo {
+	return p.Protocol.ProtocolInfo()
+}
+
+// SendPacket sends a packet to the peer.
+func (p *Peer) Send(packet network.Packet) error {
+	select {
+	case <-p.closed:
+		return ErrPeerClosed
+	default:
+	}
+	select {
+	case p.Channel.Produce() <- packet:
+		return nil
+	case <-p.closed:
+		return ErrPeerClosed
+	}
+}
+
+// ReceivePacket returns a channel to receive packets from the peer. The
+// channel is closed once the read pump stops.
+func (p *Peer) Receive() (<-chan network.Packet, error) {
+	return p.Channel.Consume(), nil
+}
+
+// Close closes the peer connection. It is safe to call multiple times, only
+// the first call reports the error of closing the connection.
+func (p *Peer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		if p.Conn != nil {
+			p.closeErr = p.Conn.Close()
+		}
+	})
+	return p.closeErr
+}
+
+// readWriter returns the connection the pumps exchange packets on. Once a
+// handshake agreed on a session secret, packets travel in an encrypted
+// p2p.Session.
+func (p *Peer) readWriter() (net.Conn, error) {
+	p.rwOnce.Do(func() {
+		secret := p.Secret()
+		if secret == nil {
+			p.rw = p.Conn
+			return
+		}
+		doc := p.Document()
+		if doc == nil || p.Identifier == nil {
+			p.rwErr = errNoSessionIdentity
+			return
+		}
+		remotePub, err := doc.VerificationKey()
+		if err != nil {
+			p.rwErr = err
+			return
+		}
+		localPub := p.Identifier.Keys().GetEd25519PublicKey()
+		p.rw = p2p.NewSession(p.Conn, secret, localPub, remotePub, p.Session)
+	})
+	return p.rw, p.rwErr
+}
+
+// ReadPump pumps packets from the peer connection to the channel until the
+// connection fails or ctx is cancelled. A packet failing its checksum ends
+// the connection. Heartbeats are handled here and never reach the channel.
+func (p *Peer) ReadPump(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() { p.Close() })
+	defer func() {
+		stop()
+		p.Close()
+		close(p.Channel.readCh)
+	}()
+
+	rw, err := p.readWriter()
+	if err != nil {
+		p.setErr(err)
+		return
+	}
+	// The handshake has settled the version, v1.0.0 peers send fixed-size packets
+	reader := network.NewPacketReader(rw, p.ProtocolInfo().Version, p.MaxPacketSize)
+	for {
+		pkt, err := reader.ReadPacket()
+		if err == nil {
+			err = pkt.Check()
+		}
+		if err != nil {
+			p.setErr(err)
+			return
+		}
+		if pkt.GetCommand() == common.HEARTBEAT {
+			p.handleHeartbeat(pkt)
+			continue
+		}
+		// A frame payload belongs to the reader until the next ReadPacket
+		if frame, ok := pkt.(*network.PacketFrame); ok {
+			frame.Payload = bytes.Clone(frame.Payload)
+		}
+		select {
+		case p.Channel.In() <- pkt:
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// WritePump pumps packets from the channel to the peer connection until the
+// connection fails or ctx is cancelled.
+func (p *Peer) WritePump(ctx context.Context) {
+	defer p.Close()
+	rw, err := p.readWriter()
+	if err != nil {
+		return
+	}
+	version := p.ProtocolInfo().Version
+	var buf bytes.Buffer
+	for {
+		select {
+		case packet := <-p.Channel.Out():
+			// Encode into a buffer first, so a packet is written (and sealed)
+			// in one piece
+			buf.Reset()
+			if _, err := network.WritePacket(&buf, packet, version); err != nil {
+				return
+			}
+			if _, err := rw.Write(buf.Bytes()); err != nil {
+				return
+			}
+		case <-p.closed:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -1,87 +1,207 @@
 package node
 
-// import (
-// 	"context"
-// 	"net"
-// 	"testing"
-// 	"time"
-
-// 	"github.com/wang900115/LCA/did"
-// 	common "github.com/wang900115/LCA/p2p/com"
-// 	"github.com/wang900115/LCA/p2p/network"
-// )
-
-// func TestPeer(t *testing.T) {
-// 	// Create a new peer instance
-// 	peer := NewPeer(nil, nil, did.VerifierConfig{}, network.TCPProtocol, 0, 0)
-// 	// Test the peer's ID
-// 	if peer.ID() == "" {
-// 		t.Error("Expected peer ID to be non-empty")
-// 	}
-// 	// Test the peer's document
-// 	if peer.Document() == nil {
-// 		t.Error("Expected peer document to be non-nil")
-// 	}
-// 	// Test the peer's protocol information
-// 	if peer.ProtocolInfo() == nil {
-// 		t.Error("Expected peer protocol information to be non-nil")
-// 	}
-// }
-
-// func TestConnPeer(t *testing.T) {
-// 	c1, c2 := net.Pipe()
-// 	defer c1.Close()
-// 	defer c2.Close()
-
-// 	peer := NewPeer(c1, nil, did.VerifierConfig{}, network.TCPProtocol, 1, 1)
-// 	if peer.Addr() != c1.RemoteAddr().String() && peer.Addr() == c1.LocalAddr().String() {
-// 		t.Errorf("Expected peer address to be %s, got %s", c1.RemoteAddr().String(), peer.Addr())
-// 	}
-// 	peer2 := NewPeer(c2, nil, did.VerifierConfig{}, network.TCPProtocol, 1, 1)
-// 	if peer2.Addr() != c2.RemoteAddr().String() && peer2.Addr() == c2.LocalAddr().String() {
-// 		t.Errorf("Expected peer address to be %s, got %s", c2.RemoteAddr().String(), peer2.Addr())
-// 	}
-// }
-
-// func TestPeerPumps(t *testing.T) {
-// 	c1, c2 := net.Pipe()
-// 	defer c1.Close()
-// 	defer c2.Close()
-
-// 	p1 := NewPeer(c1, nil, did.VerifierConfig{}, network.TCPProtocol, 0, 0)
-// 	p2 := NewPeer(c2, nil, did.VerifierConfig{}, network.TCPProtocol, 0, 0)
-
-// 	ctx, cancel := context.WithCancel(context.Background())
-// 	defer cancel()
-
-// 	go p1.ReadPump(ctx)
-// 	go p1.WritePump(ctx)
-// 	go p2.ReadPump(ctx)
-// 	go p2.WritePump(ctx)
-
-// 	msg, err := network.NewMessageContent(common.PUBLIC, []byte("hello"), nil)
-// 	if err != nil {
-// 		t.Fatalf("failed to create message: %v", err)
-// 	}
-// 	testDID := did.NewDIDIdentifier(nil)
-// 	rpc, err := network.NewRPCContent(msg, testDID)
-// 	if err != nil {
-// 		t.Fatalf("failed to create rpc: %v", err)
-// 	}
-// 	pkt, err := network.NewPacket(common.MESSAGESEND, rpc)
-// 	if err != nil {
-// 		t.Fatalf("failed to create packet: %v", err)
-// 	}
-// 	if err := p1.Send(pkt); err != nil {
-// 		t.Fatalf("send failed: %v", err)
-// 	}
-// 	ch, _ := p2.Receive()
-// 	select {
-// 	case received := <-ch:
-// 		if received.GetCommand() != common.MESSAGESEND {
-// 			t.Fatalf("unexpected command: %v", received.GetCommand())
-// 		}
-// 	case <-time.After(10 * time.Second):
-// 		t.Fatal("timeout waiting for packet")
-// 	}
-// }
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wang900115/LCA/did"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+func newTestPeer(conn net.Conn) *Peer {
+	return NewPeer(conn, did.NewDIDIdentifier(nil), did.NewDefaultDIDVerifier(), network.TCPProtocol).(*Peer)
+}
+
+func TestPeer(t *testing.T) {
+	peer := newTestPeer(nil)
+	// The remote identity is unknown until a handshake set it
+	if peer.ID() != "" || peer.Document() != nil {
+		t.Error("Expected unidentified peer")
+	}
+	if peer.ProtocolInfo() == nil {
+		t.Error("Expected peer protocol information to be non-nil")
+	}
+	doc := did.NewDIDIdentifier(nil).Document()
+	peer.SetDocument(doc)
+	if peer.ID() != doc.ID {
+		t.Errorf("Expected peer ID %s, got %s", doc.ID, peer.ID())
+	}
+}
+
+func TestConnPeer(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	peer := newTestPeer(c1)
+	if peer.Addr() != c1.RemoteAddr().String() {
+		t.Errorf("Expected peer address to be %s, got %s", c1.RemoteAddr().String(), peer.Addr())
+	}
+}
+
+func TestPeerPumps(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	p1 := newTestPeer(c1)
+	p2 := newTestPeer(c2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go p1.ReadPump(ctx)
+	go p1.WritePump(ctx)
+	go p2.ReadPump(ctx)
+	go p2.WritePump(ctx)
+
+	msg, err := network.NewMessageContent(common.PUBLIC, []byte("hello"), nil)
+	if err != nil {
+		t.Fatalf("failed to create message: %v", err)
+	}
+	testDID := did.NewDIDIdentifier(nil)
+	rpc, err := network.NewRPCContent(msg, testDID)
+	if err != nil {
+		t.Fatalf("failed to create rpc: %v", err)
+	}
+	pkt, err := network.NewPacket(common.MESSAGESEND, rpc)
+	if err != nil {
+		t.Fatalf("failed to create packet: %v", err)
+	}
+	if err := p1.Send(pkt); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	ch, _ := p2.Receive()
+	select {
+	case received := <-ch:
+		if received.GetCommand() != common.MESSAGESEND {
+			t.Fatalf("unexpected command: %v", received.GetCommand())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for packet")
+	}
+
+	// Cancelling the context stops the pumps and closes the connection
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("unexpected packet after cancel")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for read pump to stop")
+	}
+	if err := p2.Send(pkt); !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("expected ErrPeerClosed, got %v", err)
+	}
+	if err := p2.Close(); err != nil {
+		t.Fatalf("repeated close failed: %v", err)
+	}
+}
+
+func TestPeerPumpsVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version network.ProtocolVersion
+		packet  func(t *testing.T) network.Packet
+	}{
+		{"1.0.0", fixedPacket},
+		{"1.1.0", largePacket},
+	} {
+		c1, c2 := net.Pipe()
+		p1, p2 := newTestPeer(c1), newTestPeer(c2)
+		p1.ProtocolInfo().Version = tc.version
+		p2.ProtocolInfo().Version = tc.version
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go p1.WritePump(ctx)
+		go p2.ReadPump(ctx)
+
+		pkt := tc.packet(t)
+		if err := p1.Send(pkt); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+		ch, _ := p2.Receive()
+		select {
+		case received := <-ch:
+			if received.Check() != nil || !bytes.Equal(received.GetPayload(), pkt.GetPayload()) {
+				t.Errorf("version %s: packet changed in transit", tc.version)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("version %s: timeout waiting for packet", tc.version)
+		}
+		cancel()
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestPeerChecksumFailure(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	p := newTestPeer(c2)
+	done := make(chan struct{})
+	go func() {
+		p.ReadPump(context.Background())
+		close(done)
+	}()
+
+	pkt := largePacket(t).(*network.PacketFrame)
+	pkt.CheckSum++
+	go c1.Write(pkt.Bytes())
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("read pump kept a corrupted connection")
+	}
+	if !errors.Is(p.Err(), network.ErrPacketChecksum) {
+		t.Errorf("expected checksum error, got %v", p.Err())
+	}
+
+	// Closing locally is no error
+	c3, c4 := net.Pipe()
+	defer c3.Close()
+	q := newTestPeer(c4)
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	q.ReadPump(ctx)
+	if q.Err() != nil {
+		t.Errorf("expected no error after a local close, got %v", q.Err())
+	}
+}
+
+func fixedPacket(t *testing.T) network.Packet {
+	msg, err := network.NewMessageContent(common.PUBLIC, []byte("hello"), nil)
+	if err != nil {
+		t.Fatalf("failed to create message: %v", err)
+	}
+	rpc, err := network.NewRPCContent(msg, did.NewDIDIdentifier(nil))
+	if err != nil {
+		t.Fatalf("failed to create rpc: %v", err)
+	}
+	pkt, err := network.NewPacket(common.MESSAGESEND, rpc)
+	if err != nil {
+		t.Fatalf("failed to create packet: %v", err)
+	}
+	return pkt
+}
+
+func largePacket(t *testing.T) network.Packet {
+	msg, err := network.NewMessageFrame(common.PUBLIC, make([]byte, 1<<20), nil)
+	if err != nil {
+		t.Fatalf("failed to create message: %v", err)
+	}
+	rpc, err := network.NewRPCFrame(msg, did.NewDIDIdentifier(nil))
+	if err != nil {
+		t.Fatalf("failed to create rpc: %v", err)
+	}
+	pkt, err := network.NewPacketFrame(common.MESSAGESEND, rpc)
+	if err != nil {
+		t.Fatalf("failed to create packet: %v", err)
+	}
+	return pkt
+}
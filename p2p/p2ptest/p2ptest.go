@@ -0,0 +1,125 @@
+// Package p2ptest connects peers over in-memory pipes, so sub-protocols can
+// be tested without a transport.
+package p2ptest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/p2p/node"
+)
+
+// Timeout bounds waiting for something which is expected to happen.
+const Timeout = 5 * time.Second
+
+// Node is the identity of a node taking part in a test.
+type Node struct {
+	Identity did.IdentifierDID
+}
+
+// NewNode creates a node with a fresh identity, or with identity if it is
+// not nil.
+func NewNode(identity did.IdentifierDID) Node {
+	if identity == nil {
+		identity = did.NewDIDIdentifier(nil)
+	}
+	return Node{Identity: identity}
+}
+
+// ID returns the DID of the node.
+func (n Node) ID() string {
+	return n.Identity.Document().ID
+}
+
+// Conn is a connection between two peers. A is the side of the first
+// identity passed to Connect, B the other.
+type Conn struct {
+	A, B p2p.Peer
+
+	cancel    context.CancelFunc
+	running   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Connect runs the DID handshake between a and b over a pipe, offering
+// protoA and protoB, and starts the packet pumps of both peers. The peers
+// are disconnected when the test ends.
+func Connect(t testing.TB, a, b did.IdentifierDID, protoA, protoB []p2p.Protocol) *Conn {
+	t.Helper()
+	verifier := did.NewDefaultDIDVerifier()
+	c1, c2 := net.Pipe()
+	// The pumps need the local identity to open the session
+	pa := node.NewPeer(c1, a, verifier, network.TCPProtocol)
+	pb := node.NewPeer(c2, b, verifier, network.TCPProtocol)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- p2p.NewDIDHandshake(b, verifier, protoB...)(pb)
+	}()
+	require.NoError(t, p2p.NewDIDHandshake(a, verifier, protoA...)(pa))
+	require.NoError(t, <-errc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{A: pa, B: pb, cancel: cancel}
+	t.Cleanup(c.Close)
+	for _, p := range []p2p.Peer{pa, pb} {
+		go p.ReadPump(ctx)
+		go p.WritePump(ctx)
+	}
+	return c
+}
+
+// Run runs protoA on A and protoB on B until the connection ends. baseA and
+// baseB handle the packets outside every protocol, they may be nil.
+func (c *Conn) Run(protoA, protoB []p2p.Protocol, baseA, baseB func(network.Packet)) {
+	c.running.Add(2)
+	go func() {
+		defer c.running.Done()
+		p2p.RunProtocols(c.A, protoA, baseA)
+	}()
+	go func() {
+		defer c.running.Done()
+		p2p.RunProtocols(c.B, protoB, baseB)
+	}()
+}
+
+// Close disconnects the peers and waits until the protocols started by Run
+// returned.
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.A.Close()
+		c.B.Close()
+		c.running.Wait()
+	})
+}
+
+// Receive returns the next value of ch, failing the test if none arrives in
+// time.
+func Receive[T any](t testing.TB, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(Timeout):
+		t.Fatal("timeout waiting for a value")
+		var zero T
+		return zero
+	}
+}
+
+// AssertNone fails the test if ch yields a value within a short wait.
+func AssertNone[T any](t testing.TB, ch <-chan T) {
+	t.Helper()
+	select {
+	case v := <-ch:
+		t.Fatalf("unexpected value %+v", v)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -56,6 +56,7 @@ const (
 	DiscUnexpectedIdentity
 	DiscSelf
 	DiscReadTimeout
+	DiscHeartbeatTimeout
 	DiscSubprotocolError = DiscReason(0x10)
 
 	DiscInvalid = 0xff
@@ -74,6 +75,7 @@ var discReason2String = map[DiscReason]string{
 	DiscUnexpectedIdentity:  "unexpected identity",
 	DiscSelf:                "connected to self",
 	DiscReadTimeout:         "read timeout",
+	DiscHeartbeatTimeout:    "heartbeat timeout",
 	DiscSubprotocolError:    "subprotocol error",
 	DiscInvalid:             "invalid reason",
 }
@@ -89,15 +91,18 @@ func (d DiscReason) Error() string {
 	return d.String()
 }
 
-func discReansonForError(err error) DiscReason {
-	if reason, ok := err.(DiscReason); ok {
+// DiscReasonForError returns the disconnect reason for an error which ended a
+// connection.
+func DiscReasonForError(err error) DiscReason {
+	var reason DiscReason
+	if errors.As(err, &reason) {
 		return reason
 	}
 	if errors.Is(err, errProtocolReturned) {
 		return DiscQuitting
 	}
-	peerError, ok := err.(*peerError)
-	if ok {
+	var peerError *peerError
+	if errors.As(err, &peerError) {
 		switch peerError.code {
 		case errInvalidMsgCode, errInvalidMsg:
 			return DiscProtocolError
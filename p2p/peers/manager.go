@@ -0,0 +1,630 @@
+// Package peers manages the peers of a transport. The manager keeps a table
+// of known peers, dials them until the target number of outbound connections
+// is reached and redials lost ones with exponential backoff. Peers are scored
+// on protocol violations; a peer whose score drops too low has its DID and IP
+// banned for a while. Known peers and bans are kept in a key/value store, so
+// they survive restarts.
+package peers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wang900115/LCA/p2p"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/store"
+)
+
+const (
+	// Defaults of a manager
+	DefaultMaxOutbound  = 8
+	DefaultDialTimeout  = 10 * time.Second
+	DefaultMinBackoff   = time.Second
+	DefaultMaxBackoff   = 5 * time.Minute
+	DefaultBanThreshold = 100
+	DefaultBanDuration  = time.Hour
+
+	// Interval of the dial loop when nothing triggers it earlier
+	dialInterval = time.Second
+
+	// Peers scored at once, the stalest score is dropped beyond that
+	maxScores = 4096
+	// Bans held at once, the ban expiring first is dropped beyond that
+	maxBans = 4096
+)
+
+// Penalties of the violations, subtracted from the score of a peer
+const (
+	checksumPenalty  = 20
+	protocolPenalty  = 20
+	signaturePenalty = 50
+	timeoutPenalty   = 10
+)
+
+var (
+	errInvalidAddr = errors.New("invalid peer address")
+	errMissingDB   = errors.New("peer manager needs a store")
+)
+
+// Store key prefixes of the peer table
+var (
+	peerPrefix = []byte("peer/")
+	banPrefix  = []byte("ban/")
+)
+
+// Dialer connects to peers, p2p.Transport implements it.
+type Dialer interface {
+	Dial(ctx context.Context, addr string) error
+}
+
+// Config tunes a manager, zero values select the defaults.
+type Config struct {
+	DB           store.KeyValueStore // Persistent peer table, required
+	MaxOutbound  int                 // Outbound connections to keep
+	DialTimeout  time.Duration
+	MinBackoff   time.Duration // First redial delay of a failing peer
+	MaxBackoff   time.Duration // Longest redial delay
+	BanThreshold int           // Negative score at which a peer is banned
+	BanDuration  time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxOutbound <= 0 {
+		c.MaxOutbound = DefaultMaxOutbound
+	}
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = DefaultDialTimeout
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = DefaultMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = max(DefaultMaxBackoff, c.MinBackoff)
+	}
+	if c.BanThreshold <= 0 {
+		c.BanThreshold = DefaultBanThreshold
+	}
+	if c.BanDuration <= 0 {
+		c.BanDuration = DefaultBanDuration
+	}
+	return c
+}
+
+// knownPeer is an entry of the peer table.
+type knownPeer struct {
+	Addr     string    `json:"addr"`
+	ID       string    `json:"id,omitempty"` // DID, once connected
+	Fails    int       `json:"fails"`        // Failed dials in a row
+	NextDial time.Time `json:"next_dial"`
+	LastSeen time.Time `json:"last_seen,omitempty"`
+
+	dialing   bool
+	connected bool
+}
+
+// ban rejects a DID or IP until it expires.
+type ban struct {
+	Reason p2p.DiscReason `json:"reason"`
+	Until  time.Time      `json:"until"`
+}
+
+// banError rejects a banned peer, matching its DiscReason with errors.Is.
+type banError struct {
+	key    string
+	reason p2p.DiscReason
+}
+
+func (e *banError) Error() string { return "peer " + e.key + " banned: " + e.reason.String() }
+
+func (e *banError) Unwrap() error { return e.reason }
+
+// score is the sum of the penalties of a peer. It is forgotten once the peer
+// went without violations for the ban duration.
+type score struct {
+	value   int
+	updated time.Time
+}
+
+type connectedPeer struct {
+	peer     p2p.Peer
+	outBound bool
+}
+
+// Manager keeps a transport connected to a target number of peers.
+type Manager struct {
+	config Config
+	db     store.KeyValueStore
+
+	mu        sync.Mutex
+	known     map[string]*knownPeer // By dial address
+	bans      map[string]ban        // By DID or IP
+	scores    map[string]score      // By DID, or IP of unidentified peers
+	connected map[string]connectedPeer
+
+	trigger chan struct{}
+	ctx     context.Context // Cancelled on Close, aborts running dials
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewManager loads the peer table from config.DB. The manager dials nothing
+// until Start.
+func NewManager(config Config) (*Manager, error) {
+	if config.DB == nil {
+		return nil, errMissingDB
+	}
+	m := &Manager{
+		config:    config.withDefaults(),
+		db:        config.DB,
+		known:     make(map[string]*knownPeer),
+		bans:      make(map[string]ban),
+		scores:    make(map[string]score),
+		connected: make(map[string]connectedPeer),
+		trigger:   make(chan struct{}, 1),
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m, nil
+}
+
+// Start dials known peers through d until Close.
+func (m *Manager) Start(d Dialer) {
+	m.wg.Add(1)
+	go m.loop(d)
+}
+
+// Close stops dialing and waits for running dials. Connected peers stay
+// connected, they belong to the transport.
+func (m *Manager) Close() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// AddPeer adds addr, an ip:port pair, to the peer table. It is dialed when
+// outbound connections are missing.
+func (m *Manager) AddPeer(addr string) error {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidAddr, err)
+	}
+	addr = ap.String()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.known[addr]; ok {
+		return nil
+	}
+	kp := &knownPeer{Addr: addr}
+	m.known[addr] = kp
+	m.wake()
+	return m.storePeer(kp)
+}
+
+// RemovePeer drops addr from the peer table.
+func (m *Manager) RemovePeer(addr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.known, addr)
+	return m.db.Delete(dbKey(peerPrefix, addr))
+}
+
+// Known returns the addresses in the peer table.
+func (m *Manager) Known() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addrs := make([]string, 0, len(m.known))
+	for addr := range m.known {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Outbound returns the number of connected outbound peers.
+func (m *Manager) Outbound() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.outbound()
+}
+
+// Score returns the score of a peer by DID, or IP for peers which did not
+// identify, zero for a peer without recent violations.
+func (m *Manager) Score(key string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.score(key, time.Now()).value
+}
+
+// Report scores a protocol violation of peer: checksum failures, bad
+// signatures and timeouts lower the score, other errors are ignored. A peer
+// reaching the ban threshold is banned and disconnected.
+func (m *Manager) Report(peer p2p.Peer, err error) {
+	reason, penalty := violation(err)
+	if penalty == 0 {
+		return
+	}
+	key := scoreKey(peer)
+	if key == "" {
+		return
+	}
+	now := time.Now()
+	m.mu.Lock()
+	sc := m.score(key, now)
+	sc.value -= penalty
+	sc.updated = now
+	if sc.value > -m.config.BanThreshold {
+		m.setScore(key, sc)
+		m.mu.Unlock()
+		return
+	}
+	delete(m.scores, key)
+	until := time.Now().Add(m.config.BanDuration)
+	m.ban(key, reason, until)
+	if ip := peerIP(peer); ip != "" {
+		m.ban(ip, reason, until)
+	}
+	m.mu.Unlock()
+	peer.Close()
+}
+
+// Ban rejects a DID or IP for d, disconnecting the peers it matches.
+func (m *Manager) Ban(key string, reason p2p.DiscReason, d time.Duration) error {
+	m.mu.Lock()
+	err := m.ban(key, reason, time.Now().Add(d))
+	var matched []p2p.Peer
+	for k, cp := range m.connected {
+		if k == key || peerIP(cp.peer) == key {
+			matched = append(matched, cp.peer)
+		}
+	}
+	m.mu.Unlock()
+	for _, peer := range matched {
+		peer.Close()
+	}
+	return err
+}
+
+// Banned reports whether a DID or IP is banned and why.
+func (m *Manager) Banned(key string) (p2p.DiscReason, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.banned(key)
+}
+
+// AdmitPeer rejects peers whose DID or IP is banned. It implements
+// p2p.PeerObserver.
+func (m *Manager) AdmitPeer(peer p2p.Peer, outBound bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range []string{peer.ID(), peerIP(peer)} {
+		if key == "" {
+			continue
+		}
+		if reason, ok := m.banned(key); ok {
+			return &banError{key: key, reason: reason}
+		}
+	}
+	return nil
+}
+
+// PeerConnected tracks a registered peer. It implements p2p.PeerObserver.
+func (m *Manager) PeerConnected(peer p2p.Peer, outBound bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connected[peerKey(peer)] = connectedPeer{peer: peer, outBound: outBound}
+	if kp := m.known[peer.Addr()]; kp != nil && outBound {
+		kp.ID = peer.ID()
+		kp.Fails = 0
+		kp.LastSeen = time.Now()
+		kp.connected = true
+		m.storePeer(kp)
+	}
+}
+
+// PeerDisconnected scores the error which ended a connection and schedules
+// the redial of a lost outbound peer. It implements p2p.PeerObserver.
+func (m *Manager) PeerDisconnected(peer p2p.Peer, outBound bool, err error) {
+	m.Report(peer, err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := peerKey(peer)
+	if cp, ok := m.connected[key]; ok && cp.peer == peer {
+		delete(m.connected, key)
+	}
+	if kp := m.known[peer.Addr()]; kp != nil && outBound && kp.connected {
+		kp.connected = false
+		kp.LastSeen = time.Now()
+		kp.NextDial = time.Now().Add(m.config.MinBackoff)
+		m.storePeer(kp)
+	}
+	m.wake()
+}
+
+func (m *Manager) loop(d Dialer) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(dialInterval)
+	defer ticker.Stop()
+	for {
+		for _, kp := range m.dialCandidates() {
+			m.wg.Add(1)
+			go m.dial(d, kp)
+		}
+		select {
+		case <-ticker.C:
+		case <-m.trigger:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// dialCandidates returns the known peers to dial now, marking them dialing.
+func (m *Manager) dialCandidates() []*knownPeer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	need := m.config.MaxOutbound - m.outbound()
+	now := time.Now()
+	var dial []*knownPeer
+	for _, kp := range m.known {
+		if kp.dialing {
+			need--
+		}
+	}
+	for _, kp := range m.known {
+		if need <= 0 {
+			break
+		}
+		if kp.dialing || kp.connected || kp.NextDial.After(now) || m.isConnected(kp) {
+			continue
+		}
+		if _, ok := m.banned(kp.ID); ok && kp.ID != "" {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(kp.Addr); err == nil {
+			if _, ok := m.banned(host); ok {
+				continue
+			}
+		}
+		kp.dialing = true
+		dial = append(dial, kp)
+		need--
+	}
+	return dial
+}
+
+func (m *Manager) dial(d Dialer, kp *knownPeer) {
+	defer m.wg.Done()
+	ctx, cancel := context.WithTimeout(m.ctx, m.config.DialTimeout)
+	err := d.Dial(ctx, kp.Addr)
+	cancel()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kp.dialing = false
+	if err == nil {
+		return
+	}
+	kp.Fails++
+	kp.NextDial = time.Now().Add(m.backoff(kp.Fails))
+	m.storePeer(kp)
+}
+
+// backoff returns the redial delay after fails failed dials.
+func (m *Manager) backoff(fails int) time.Duration {
+	d := m.config.MinBackoff
+	for i := 1; i < fails && d < m.config.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, m.config.MaxBackoff)
+}
+
+func (m *Manager) wake() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Manager) outbound() int {
+	n := 0
+	for _, cp := range m.connected {
+		if cp.outBound {
+			n++
+		}
+	}
+	return n
+}
+
+// isConnected reports whether the DID of kp is connected in any direction.
+func (m *Manager) isConnected(kp *knownPeer) bool {
+	if kp.ID == "" {
+		return false
+	}
+	_, ok := m.connected[kp.ID]
+	return ok
+}
+
+// ban stores a ban, making room by dropping expired bans or else the ban
+// expiring first. m.mu must be held.
+func (m *Manager) ban(key string, reason p2p.DiscReason, until time.Time) error {
+	if _, ok := m.bans[key]; !ok && len(m.bans) >= maxBans {
+		m.dropBans(time.Now(), maxBans-1)
+	}
+	b := ban{Reason: reason, Until: until}
+	m.bans[key] = b
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return m.db.Put(dbKey(banPrefix, key), data)
+}
+
+// banned reports whether key is banned, dropping an expired ban.
+func (m *Manager) banned(key string) (p2p.DiscReason, bool) {
+	b, ok := m.bans[key]
+	if !ok {
+		return 0, false
+	}
+	if time.Now().After(b.Until) {
+		m.unban(key)
+		return 0, false
+	}
+	return b.Reason, true
+}
+
+// dropBans drops the expired bans, then the bans expiring first until at
+// most limit are left. m.mu must be held.
+func (m *Manager) dropBans(now time.Time, limit int) {
+	for key, b := range m.bans {
+		if now.After(b.Until) {
+			m.unban(key)
+		}
+	}
+	for len(m.bans) > limit {
+		var first string
+		for key, b := range m.bans {
+			if first == "" || b.Until.Before(m.bans[first].Until) {
+				first = key
+			}
+		}
+		m.unban(first)
+	}
+}
+
+func (m *Manager) unban(key string) {
+	delete(m.bans, key)
+	m.db.Delete(dbKey(banPrefix, key))
+}
+
+func (m *Manager) storePeer(kp *knownPeer) error {
+	data, err := json.Marshal(kp)
+	if err != nil {
+		return err
+	}
+	return m.db.Put(dbKey(peerPrefix, kp.Addr), data)
+}
+
+// load reads the peer table, dropping expired bans.
+func (m *Manager) load() error {
+	it, err := m.db.NewIterator(peerPrefix, nil)
+	if err != nil {
+		return err
+	}
+	for it.Next() {
+		kp := new(knownPeer)
+		if err := json.Unmarshal(it.Value(), kp); err != nil {
+			it.Release()
+			return err
+		}
+		m.known[kp.Addr] = kp
+	}
+	err = it.Error()
+	it.Release()
+	if err != nil {
+		return err
+	}
+
+	it, err = m.db.NewIterator(banPrefix, nil)
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+	for it.Next() {
+		var b ban
+		if err := json.Unmarshal(it.Value(), &b); err != nil {
+			return err
+		}
+		m.bans[string(it.Key()[len(banPrefix):])] = b
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	m.dropBans(time.Now(), maxBans)
+	return nil
+}
+
+// dbKey returns the store key of name under prefix.
+func dbKey(prefix []byte, name string) []byte {
+	key := make([]byte, 0, len(prefix)+len(name))
+	return append(append(key, prefix...), name...)
+}
+
+// violation returns the disconnect reason and penalty of err, zero for
+// errors which are no protocol violation.
+func violation(err error) (p2p.DiscReason, int) {
+	switch {
+	case err == nil:
+		return 0, 0
+	case errors.Is(err, network.ErrPacketChecksum):
+		return p2p.DiscProtocolError, checksumPenalty
+	case errors.Is(err, network.ErrRPCSignature), errors.Is(err, p2p.DiscInvalidIdentity):
+		return p2p.DiscInvalidIdentity, signaturePenalty
+	case errors.Is(err, p2p.DiscReadTimeout), errors.Is(err, p2p.DiscHeartbeatTimeout),
+		errors.Is(err, os.ErrDeadlineExceeded):
+		return p2p.DiscReadTimeout, timeoutPenalty
+	case p2p.DiscReasonForError(err) == p2p.DiscProtocolError:
+		return p2p.DiscProtocolError, protocolPenalty
+	}
+	return 0, 0
+}
+
+// score returns the current score under key, m.mu must be held.
+func (m *Manager) score(key string, now time.Time) score {
+	sc := m.scores[key]
+	if now.Sub(sc.updated) >= m.config.BanDuration {
+		return score{}
+	}
+	return sc
+}
+
+// setScore stores a score, making room by dropping expired scores or else
+// the stalest one. m.mu must be held.
+func (m *Manager) setScore(key string, sc score) {
+	if _, ok := m.scores[key]; !ok && len(m.scores) >= maxScores {
+		var stalest string
+		for k, old := range m.scores {
+			if sc.updated.Sub(old.updated) >= m.config.BanDuration {
+				delete(m.scores, k)
+			} else if stalest == "" || old.updated.Before(m.scores[stalest].updated) {
+				stalest = k
+			}
+		}
+		if len(m.scores) >= maxScores {
+			delete(m.scores, stalest)
+		}
+	}
+	m.scores[key] = sc
+}
+
+// peerKey returns the key a connected peer is tracked under.
+func peerKey(peer p2p.Peer) string {
+	if id := peer.ID(); id != "" {
+		return id
+	}
+	return peer.Addr()
+}
+
+// scoreKey returns the key a peer is scored under. A peer which did not
+// identify is scored by IP, as it gets a new port on every connection.
+func scoreKey(peer p2p.Peer) string {
+	if id := peer.ID(); id != "" {
+		return id
+	}
+	return peerIP(peer)
+}
+
+// peerIP returns the IP of the remote address of peer.
+func peerIP(peer p2p.Peer) string {
+	host, _, err := net.SplitHostPort(peer.Addr())
+	if err != nil {
+		return ""
+	}
+	return host
+}
@@ -0,0 +1,219 @@
+package peers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/p2p"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/p2p/transport"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+// testPeer is a connected peer, only its identity is used.
+type testPeer struct {
+	p2p.Peer
+	id, addr string
+	closed   bool
+}
+
+func (p *testPeer) ID() string   { return p.id }
+func (p *testPeer) Addr() string { return p.addr }
+func (p *testPeer) Close() error {
+	p.closed = true
+	return nil
+}
+
+// failDialer fails every dial, counting them.
+type failDialer struct {
+	mu    sync.Mutex
+	dials int
+}
+
+func (d *failDialer) Dial(ctx context.Context, addr string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	return errors.New("connection refused")
+}
+
+func (d *failDialer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+func newTestManager(t *testing.T, db store.KeyValueStore, config Config) *Manager {
+	t.Helper()
+	config.DB = db
+	m, err := NewManager(config)
+	require.NoError(t, err)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestManager_Persist(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	m := newTestManager(t, db, Config{})
+	require.NoError(t, m.AddPeer("10.0.0.1:3000"))
+	assert.ErrorIs(t, m.AddPeer("localhost:3000"), errInvalidAddr)
+	require.NoError(t, m.Ban("did:key:zbad", p2p.DiscProtocolError, time.Hour))
+	require.NoError(t, m.Ban("10.0.0.2", p2p.DiscProtocolError, -time.Second))
+
+	// A restarted manager finds the table in the store
+	m = newTestManager(t, db, Config{})
+	assert.Equal(t, []string{"10.0.0.1:3000"}, m.Known())
+	reason, ok := m.Banned("did:key:zbad")
+	assert.True(t, ok)
+	assert.Equal(t, p2p.DiscProtocolError, reason)
+	_, ok = m.Banned("10.0.0.2")
+	assert.False(t, ok, "expired bans are dropped")
+	has, err := db.Has(dbKey(banPrefix, "10.0.0.2"))
+	require.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestManager_BanLimit(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	m := newTestManager(t, db, Config{})
+	require.NoError(t, m.Ban("10.0.0.1", p2p.DiscProtocolError, -time.Second))
+	require.NoError(t, m.Ban("10.0.0.2", p2p.DiscProtocolError, time.Minute))
+	for i := range maxBans - 2 {
+		require.NoError(t, m.Ban(fmt.Sprintf("did:key:z%d", i), p2p.DiscProtocolError, time.Hour))
+	}
+
+	// The expired ban makes room first, then the ban expiring first
+	require.NoError(t, m.Ban("did:key:znew", p2p.DiscProtocolError, time.Hour))
+	has, err := db.Has(dbKey(banPrefix, "10.0.0.1"))
+	require.NoError(t, err)
+	assert.False(t, has)
+	_, ok := m.Banned("10.0.0.2")
+	assert.True(t, ok)
+	require.NoError(t, m.Ban("did:key:zlast", p2p.DiscProtocolError, time.Hour))
+	_, ok = m.Banned("10.0.0.2")
+	assert.False(t, ok)
+	has, err = db.Has(dbKey(banPrefix, "10.0.0.2"))
+	require.NoError(t, err)
+	assert.False(t, has)
+	assert.Len(t, m.bans, maxBans)
+	_, ok = m.Banned("did:key:zlast")
+	assert.True(t, ok)
+}
+
+func TestManager_ScoreBan(t *testing.T) {
+	m := newTestManager(t, memorydb.NewMemoryDBStore(), Config{})
+	peer := &testPeer{id: "did:key:zpeer", addr: "10.0.0.3:4000"}
+
+	// Errors which are no violation do not count
+	m.Report(peer, errors.New("EOF"))
+	m.Report(peer, nil)
+	assert.Zero(t, m.Score(peer.id))
+
+	m.Report(peer, fmt.Errorf("read: %w", network.ErrPacketChecksum))
+	m.Report(peer, p2p.DiscReadTimeout)
+	assert.Equal(t, -checksumPenalty-timeoutPenalty, m.Score(peer.id))
+	require.NoError(t, m.AdmitPeer(peer, false))
+
+	for !peer.closed {
+		m.Report(peer, network.ErrRPCSignature)
+	}
+	for _, key := range []string{"did:key:zpeer", "10.0.0.3"} {
+		reason, ok := m.Banned(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, p2p.DiscInvalidIdentity, reason)
+	}
+	// Both the DID and the IP are rejected
+	err := m.AdmitPeer(&testPeer{id: "did:key:zpeer", addr: "10.0.0.4:1"}, true)
+	assert.ErrorIs(t, err, p2p.DiscInvalidIdentity)
+	err = m.AdmitPeer(&testPeer{addr: "10.0.0.3:5000"}, false)
+	assert.ErrorIs(t, err, p2p.DiscInvalidIdentity)
+}
+
+func TestManager_ScoreUnidentified(t *testing.T) {
+	m := newTestManager(t, memorydb.NewMemoryDBStore(), Config{BanDuration: time.Hour})
+
+	// Handshake timeouts from new ports add up under the IP
+	var peer *testPeer
+	for port := 5000; peer == nil || !peer.closed; port++ {
+		peer = &testPeer{addr: fmt.Sprintf("10.0.0.5:%d", port)}
+		m.Report(peer, p2p.DiscReadTimeout)
+	}
+	reason, ok := m.Banned("10.0.0.5")
+	assert.True(t, ok)
+	assert.Equal(t, p2p.DiscReadTimeout, reason)
+
+	// Old scores are forgotten
+	m.Report(&testPeer{addr: "10.0.0.6:5000"}, p2p.DiscReadTimeout)
+	m.mu.Lock()
+	sc := m.scores["10.0.0.6"]
+	sc.updated = sc.updated.Add(-time.Hour)
+	m.scores["10.0.0.6"] = sc
+	m.mu.Unlock()
+	assert.Zero(t, m.Score("10.0.0.6"))
+
+	// The score table stays bounded
+	for i := 0; i < maxScores+10; i++ {
+		m.Report(&testPeer{id: fmt.Sprintf("did:key:z%d", i)}, p2p.DiscReadTimeout)
+	}
+	m.mu.Lock()
+	assert.Len(t, m.scores, maxScores)
+	_, ok = m.scores["10.0.0.6"]
+	m.mu.Unlock()
+	assert.False(t, ok, "the stale score is dropped first")
+	assert.Equal(t, -timeoutPenalty, m.Score(fmt.Sprintf("did:key:z%d", maxScores+9)))
+}
+
+func TestManager_Backoff(t *testing.T) {
+	m := newTestManager(t, memorydb.NewMemoryDBStore(), Config{MinBackoff: time.Second, MaxBackoff: 5 * time.Second})
+	for fails, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		assert.Equal(t, want, m.backoff(fails), "fails %d", fails)
+	}
+
+	m = newTestManager(t, memorydb.NewMemoryDBStore(), Config{MinBackoff: time.Hour})
+	d := new(failDialer)
+	require.NoError(t, m.AddPeer("127.0.0.1:1"))
+	m.Start(d)
+	assert.Eventually(t, func() bool { return d.count() == 1 }, time.Second, 10*time.Millisecond)
+
+	// The failed peer waits for its backoff
+	time.Sleep(2 * dialInterval)
+	assert.Equal(t, 1, d.count())
+	m.mu.Lock()
+	kp := m.known["127.0.0.1:1"]
+	assert.Equal(t, 1, kp.Fails)
+	assert.True(t, kp.NextDial.After(time.Now().Add(time.Hour-time.Minute)))
+	m.mu.Unlock()
+}
+
+func TestManager_Transport(t *testing.T) {
+	server := transport.NewTCPTransport(transport.TCPTransportOpts{ListenAddr: "127.0.0.1:0", InBoundLi: 5, OutBoundLi: 5})
+	require.NoError(t, server.Listen(context.Background()))
+	t.Cleanup(func() { server.Close() })
+
+	m := newTestManager(t, memorydb.NewMemoryDBStore(), Config{MaxOutbound: 1, MinBackoff: 10 * time.Millisecond})
+	client := transport.NewTCPTransport(transport.TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5, Observer: m})
+	t.Cleanup(func() { client.Close() })
+	require.NoError(t, m.AddPeer(server.Addr()))
+	m.Start(client)
+	assert.Eventually(t, func() bool { return m.Outbound() == 1 }, time.Second, 10*time.Millisecond)
+
+	// A lost peer is redialed
+	for _, peer := range server.(*transport.TCPTransport).Peers() {
+		peer.Close()
+	}
+	assert.Eventually(t, func() bool { return m.Outbound() == 0 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return m.Outbound() == 1 }, 3*time.Second, 10*time.Millisecond)
+
+	// Banning the IP disconnects the peer, which is not redialed
+	require.NoError(t, m.Ban("127.0.0.1", p2p.DiscUselessPeer, time.Hour))
+	assert.Eventually(t, func() bool { return m.Outbound() == 0 }, time.Second, 10*time.Millisecond)
+	time.Sleep(2 * dialInterval)
+	assert.Zero(t, m.Outbound())
+}
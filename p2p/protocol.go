@@ -3,20 +3,28 @@ package p2p
 import (
 	"cmp"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
 )
 
+// Protocol is a sub-protocol running over a peer connection. Its message
+// codes 0..Length-1 are multiplexed with the other protocols of the peer.
 type Protocol struct {
 	Name     string
 	Version  uint
-	Length   uint64
+	Length   uint64 // Number of message codes used by the protocol
 	NodeInfo func() interface{}
+	// Run handles a peer speaking the protocol, it should read messages from
+	// rw until an error occurs. Returning ends the connection.
+	Run func(peer Peer, rw MsgReadWriter) error
 }
 
 func (p Protocol) cap() Cap {
 	return Cap{Name: p.Name, Version: p.Version}
 }
 
+// Cap is a capability, a protocol name and version, announced by a peer.
 type Cap struct {
 	Name    string
 	Version uint
@@ -32,3 +40,44 @@ func (c Cap) Cmp(other Cap) int {
 	}
 	return strings.Compare(c.Name, other.Name)
 }
+
+// parseCap parses the name/version form of a capability.
+func parseCap(s string) (Cap, error) {
+	i := strings.LastIndexByte(s, '/')
+	if i <= 0 {
+		return Cap{}, fmt.Errorf("invalid capability %q", s)
+	}
+	version, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil {
+		return Cap{}, fmt.Errorf("invalid capability %q: %w", s, err)
+	}
+	return Cap{Name: s[:i], Version: uint(version)}, nil
+}
+
+// protocolCaps returns the capabilities of protocols.
+func protocolCaps(protocols []Protocol) []Cap {
+	caps := make([]Cap, len(protocols))
+	for i, p := range protocols {
+		caps[i] = p.cap()
+	}
+	return caps
+}
+
+// matchCaps returns, sorted by name, the highest version of every protocol
+// both sides support.
+func matchCaps(local, remote []Cap) []Cap {
+	best := make(map[string]Cap)
+	for _, l := range local {
+		for _, r := range remote {
+			if l == r && (best[l.Name].Name == "" || l.Version > best[l.Name].Version) {
+				best[l.Name] = l
+			}
+		}
+	}
+	shared := make([]Cap, 0, len(best))
+	for _, c := range best {
+		shared = append(shared, c)
+	}
+	slices.SortFunc(shared, Cap.Cmp)
+	return shared
+}
@@ -0,0 +1,45 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCap(t *testing.T) {
+	c, err := parseCap("chat/2")
+	require.NoError(t, err)
+	assert.Equal(t, Cap{Name: "chat", Version: 2}, c)
+	assert.Equal(t, "chat/2", c.String())
+
+	for _, s := range []string{"", "chat", "/2", "chat/x", "chat/-1"} {
+		_, err := parseCap(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestMatchCaps(t *testing.T) {
+	local := []Cap{{"sync", 1}, {"chat", 1}, {"chat", 2}, {"file", 1}}
+	remote := []Cap{{"chat", 2}, {"chat", 1}, {"file", 2}, {"sync", 1}}
+	assert.Equal(t, []Cap{{"chat", 2}, {"sync", 1}}, matchCaps(local, remote))
+	assert.Empty(t, matchCaps(local, nil))
+}
+
+func TestMatchProtocols(t *testing.T) {
+	protocols := []Protocol{
+		{Name: "chat", Version: 1, Length: 4},
+		{Name: "chat", Version: 2, Length: 5},
+		{Name: "huge", Version: 1, Length: 250},
+		{Name: "sync", Version: 1, Length: 3},
+	}
+	running := matchProtocols(protocols, []Cap{{"chat", 2}, {"huge", 1}, {"sync", 1}}, nil, nil)
+	require.Len(t, running, 2, "a protocol exceeding the command space is left out")
+	assert.Equal(t, Cap{"chat", 2}, running[0].cap())
+	assert.Equal(t, uint64(baseProtocolLength), running[0].offset)
+	assert.Equal(t, Cap{"sync", 1}, running[1].cap())
+	assert.Equal(t, uint64(baseProtocolLength+5), running[1].offset)
+
+	assert.Same(t, running[1], protocolFor(running, baseProtocolLength+7))
+	assert.Nil(t, protocolFor(running, baseProtocolLength+8))
+}
@@ -0,0 +1,431 @@
+// Package ratchet gives long-lived private conversations forward secrecy and
+// post-compromise security. A conversation starts with an X3DH-like
+// agreement: the initiator combines its key agreement key and a fresh
+// ephemeral key with the key agreement key and the signed prekey the
+// responder publishes as a service of its DID document. The resulting secret
+// seeds a double ratchet session, which derives a new key for every message
+// and a new ratchet key every round trip. Sessions are persisted in a
+// key/value store.
+//
+// A message is
+//
+//	initial(0) | ephemeral(32) | prekey(32) | ratchet message
+//	normal(1)  | ratchet message
+//
+// the initiator sends initial messages until the first reply arrives. When
+// both peers start a session at once, the session of the peer with the lower
+// DID is kept. An initial message is never accepted twice. It replaces a
+// session in which both peers replied only if it is for the current prekey
+// and decrypts, as sent by a peer which lost its state.
+// Messages carry no sender; the caller passes the DID it got the message
+// from, as authenticated by the transport, to Decrypt.
+package ratchet
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+
+	crypto "github.com/wang900115/LCA/crypt"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/store"
+)
+
+const (
+	initialMsg = 0x00
+	normalMsg  = 0x01
+
+	// DefaultMaxSkip is the default limit of skipped message keys kept per
+	// session.
+	DefaultMaxSkip = 1000
+)
+
+var (
+	errMissingDB      = errors.New("ratchet needs a store")
+	errNoIdentity     = errors.New("ratchet needs an identity")
+	errNoResolver     = errors.New("ratchet needs a document resolver")
+	errNoSession      = errors.New("no ratchet session with the peer")
+	errUnknownPrekey  = errors.New("message for an unknown prekey")
+	errInvalidMessage = errors.New("invalid ratchet message")
+	errSessionExists  = errors.New("initial message for an established session")
+	errReplayed       = errors.New("initial message replayed")
+	errConcurrent     = errors.New("peer started a session concurrently")
+)
+
+// Store keys of the ratchet state
+var (
+	prekeysKey    = []byte("ratchet/prekeys")
+	sessionPrefix = []byte("ratchet/session/")
+)
+
+// Config configures a Manager.
+type Config struct {
+	DB       store.KeyValueStore // Prekeys and sessions, required
+	Identity did.IdentifierDID   // Required
+	// Resolve looks up the DID documents of peers, required
+	Resolve func(ctx context.Context, id string) (*did.Document, error)
+	MaxSkip int
+}
+
+// prekeys are the private signed prekeys. The previous one is kept after a
+// rotation for initial messages which are still on the way.
+type prekeys struct {
+	Current  []byte `json:"current"`
+	Previous []byte `json:"previous,omitempty"`
+}
+
+// Manager encrypts and decrypts the messages of the ratchet sessions of the
+// local node.
+type Manager struct {
+	config Config
+	db     store.KeyValueStore
+	self   string
+
+	mu       sync.Mutex
+	prekeys  prekeys
+	sessions map[string]*session
+}
+
+// NewManager loads the prekeys and publishes the signed prekey in the
+// document of the identity, generating it on first use.
+func NewManager(config Config) (*Manager, error) {
+	switch {
+	case config.DB == nil:
+		return nil, errMissingDB
+	case config.Identity == nil:
+		return nil, errNoIdentity
+	case config.Resolve == nil:
+		return nil, errNoResolver
+	}
+	if config.MaxSkip <= 0 {
+		config.MaxSkip = DefaultMaxSkip
+	}
+	m := &Manager{
+		config:   config,
+		db:       config.DB,
+		self:     config.Identity.Document().ID,
+		sessions: make(map[string]*session),
+	}
+	data, err := m.db.Get(prekeysKey)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return m, m.RotatePrekey()
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m.prekeys); err != nil {
+		return nil, err
+	}
+	return m, m.publish()
+}
+
+// RotatePrekey replaces the signed prekey. Initial messages to the previous
+// prekey are still accepted until the next rotation.
+func (m *Manager) RotatePrekey() error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := prekeys{Current: key.Bytes(), Previous: m.prekeys.Current}
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	if err := m.db.Put(prekeysKey, data); err != nil {
+		return err
+	}
+	m.prekeys = next
+	return m.publish()
+}
+
+// currentPrekey reports whether spk is the public key of the current prekey.
+func (m *Manager) currentPrekey(spk []byte) bool {
+	key, err := ecdh.X25519().NewPrivateKey(m.prekeys.Current)
+	return err == nil && bytes.Equal(key.PublicKey().Bytes(), spk)
+}
+
+func (m *Manager) publish() error {
+	key, err := ecdh.X25519().NewPrivateKey(m.prekeys.Current)
+	if err != nil {
+		return err
+	}
+	service, err := did.NewPrekeyService(m.self, m.config.Identity.Keys(), key.PublicKey())
+	if err != nil {
+		return err
+	}
+	m.config.Identity.SetService(service)
+	return nil
+}
+
+// Encrypt encrypts plaintext for the peer to, starting a session with the
+// signed prekey in its DID document if there is none.
+func (m *Manager) Encrypt(ctx context.Context, to string, plaintext []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.session(to)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		if s, err = m.initiate(ctx, to); err != nil {
+			return nil, err
+		}
+	}
+	next := s.clone()
+	body, err := next.encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.save(to, next); err != nil {
+		return nil, err
+	}
+	if next.Initial != nil {
+		return append(append([]byte{initialMsg}, next.Initial...), body...), nil
+	}
+	return append([]byte{normalMsg}, body...), nil
+}
+
+// Decrypt decrypts a message of the peer from, starting a session if it is
+// an initial message.
+func (m *Manager) Decrypt(ctx context.Context, from string, msg []byte) ([]byte, error) {
+	if len(msg) < 1 {
+		return nil, errInvalidMessage
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, err := m.session(from)
+	if err != nil {
+		return nil, err
+	}
+	body := msg[1:]
+	switch msg[0] {
+	case initialMsg:
+		if len(body) < 2*keySize {
+			return nil, errInvalidMessage
+		}
+		ek, spk := body[:keySize], body[keySize:2*keySize]
+		body = body[2*keySize:]
+		switch {
+		case s != nil && bytes.Equal(s.InitEK, ek):
+			// Another message of the session the peer started
+		case s != nil && s.seen(ek):
+			return nil, errReplayed
+		case s != nil && s.Replied && !m.currentPrekey(spk):
+			// A peer which lost an established session starts over with the
+			// current prekey. The new session only replaces this one once
+			// its message decrypts.
+			return nil, errSessionExists
+		case s != nil && s.Initial != nil && m.self < from:
+			// Both sides started a session, the peer switches to ours
+			return nil, errConcurrent
+		default:
+			// A new session the peer started
+			if s, err = m.respond(ctx, from, ek, spk, s); err != nil {
+				return nil, err
+			}
+		}
+	case normalMsg:
+		if s == nil {
+			return nil, errNoSession
+		}
+	default:
+		return nil, errInvalidMessage
+	}
+
+	plaintext, next, err := s.decrypt(body)
+	if err != nil {
+		return nil, err
+	}
+	// The peer replied, it has the session. A normal message also tells the
+	// responder that the initiator got its reply.
+	next.Initial = nil
+	next.Replied = next.Replied || msg[0] == normalMsg
+	if err := m.save(from, next); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// initiate runs the initiator side of X3DH with the published keys of to.
+// It must be called with m.mu held.
+func (m *Manager) initiate(ctx context.Context, to string) (*session, error) {
+	doc, err := m.document(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	spk, err := doc.SignedPrekey()
+	if err != nil {
+		return nil, err
+	}
+	ik, err := doc.KeyAgreementKey()
+	if err != nil {
+		return nil, err
+	}
+	ek, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dh1, err := m.config.Identity.Keys().SharedSecret(spk)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := crypto.ComputeX25519SharedKey(ek, ik)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := crypto.ComputeX25519SharedKey(ek, spk)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := crypto.X3DHSecret(dh1, dh2, dh3)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newInitiator(sk, spk, associatedData(m.self, to), m.config.MaxSkip)
+	if err != nil {
+		return nil, err
+	}
+	s.Initial = append(ek.PublicKey().Bytes(), spk.Bytes()...)
+	return s, nil
+}
+
+// respond runs the responder side of X3DH for an initial message of from,
+// replacing the session prev if it is not nil. It must be called with m.mu
+// held.
+func (m *Manager) respond(ctx context.Context, from string, ekBytes, spkBytes []byte, prev *session) (*session, error) {
+	var (
+		prekey *ecdh.PrivateKey
+		valid  [][]byte // Public keys of the prekeys still accepted
+	)
+	for _, b := range [][]byte{m.prekeys.Current, m.prekeys.Previous} {
+		if b == nil {
+			continue
+		}
+		key, err := ecdh.X25519().NewPrivateKey(b)
+		if err != nil {
+			return nil, err
+		}
+		valid = append(valid, key.PublicKey().Bytes())
+		if bytes.Equal(key.PublicKey().Bytes(), spkBytes) {
+			prekey = key
+		}
+	}
+	if prekey == nil {
+		return nil, errUnknownPrekey
+	}
+	doc, err := m.document(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	ik, err := doc.KeyAgreementKey()
+	if err != nil {
+		return nil, err
+	}
+	ek, err := ecdh.X25519().NewPublicKey(ekBytes)
+	if err != nil {
+		return nil, err
+	}
+	dh1, err := crypto.ComputeX25519SharedKey(prekey, ik)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := m.config.Identity.Keys().SharedSecret(ek)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := crypto.ComputeX25519SharedKey(prekey, ek)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := crypto.X3DHSecret(dh1, dh2, dh3)
+	if err != nil {
+		return nil, err
+	}
+	s := newResponder(sk, prekey, associatedData(from, m.self), m.config.MaxSkip)
+	s.InitEK = bytes.Clone(ekBytes)
+	// Initial messages to a prekey which was rotated out can not be replayed
+	// any more, only the others are remembered
+	if prev != nil {
+		for _, k := range prev.Seen {
+			if slices.ContainsFunc(valid, func(b []byte) bool { return bytes.Equal(b, k.SPK) }) {
+				s.Seen = append(s.Seen, k)
+			}
+		}
+	}
+	s.Seen = append(s.Seen, initialKeys{EK: s.InitEK, SPK: bytes.Clone(spkBytes)})
+	return s, nil
+}
+
+// document resolves the DID document of id, checking that it belongs to id.
+// KeyAgreementKey checks the signature which binds the key agreement key.
+func (m *Manager) document(ctx context.Context, id string) (*did.Document, error) {
+	doc, err := m.config.Resolve(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if doc.ID != id {
+		return nil, did.ErrIDMismatch
+	}
+	if err := doc.ValidateID(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// session returns the session with peer, nil if there is none. It must be
+// called with m.mu held.
+func (m *Manager) session(peer string) (*session, error) {
+	if s, ok := m.sessions[peer]; ok {
+		return s, nil
+	}
+	data, err := m.db.Get(sessionKey(peer))
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	s := new(session)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.Skipped == nil {
+		s.Skipped = make(map[string][]byte)
+	}
+	m.sessions[peer] = s
+	return s, nil
+}
+
+// save persists the session with peer. It must be called with m.mu held.
+func (m *Manager) save(peer string, s *session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := m.db.Put(sessionKey(peer), data); err != nil {
+		return err
+	}
+	m.sessions[peer] = s
+	return nil
+}
+
+func sessionKey(peer string) []byte {
+	key := make([]byte, 0, len(sessionPrefix)+len(peer))
+	return append(append(key, sessionPrefix...), peer...)
+}
+
+// associatedData binds a session to the DIDs of its initiator and responder.
+func associatedData(initiator, responder string) []byte {
+	ad := binary.AppendUvarint(nil, uint64(len(initiator)))
+	ad = append(ad, initiator...)
+	ad = binary.AppendUvarint(ad, uint64(len(responder)))
+	return append(ad, responder...)
+}
@@ -0,0 +1,295 @@
+package ratchet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+// directory resolves the current documents of the identities it holds.
+type directory map[string]did.IdentifierDID
+
+func (d directory) resolve(ctx context.Context, id string) (*did.Document, error) {
+	if identity, ok := d[id]; ok {
+		return identity.Document(), nil
+	}
+	return nil, errors.New("unknown DID")
+}
+
+type testNode struct {
+	id string
+	m  *Manager
+	db store.KeyValueStore
+}
+
+func newTestNode(t *testing.T, dir directory, identity did.IdentifierDID, db store.KeyValueStore) *testNode {
+	t.Helper()
+	if identity == nil {
+		identity = did.NewDIDIdentifier(nil)
+	}
+	if db == nil {
+		db = memorydb.NewMemoryDBStore()
+	}
+	id := identity.Document().ID
+	dir[id] = identity
+	m, err := NewManager(Config{DB: db, Identity: identity, Resolve: dir.resolve})
+	require.NoError(t, err)
+	return &testNode{id: id, m: m, db: db}
+}
+
+func send(t *testing.T, from, to *testNode, text string) []byte {
+	t.Helper()
+	msg, err := from.m.Encrypt(context.Background(), to.id, []byte(text))
+	require.NoError(t, err)
+	return msg
+}
+
+func open(t *testing.T, to, from *testNode, msg []byte, want string) {
+	t.Helper()
+	got, err := to.m.Decrypt(context.Background(), from.id, msg)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+}
+
+// body returns the ratchet message of msg.
+func body(msg []byte) []byte {
+	if msg[0] == initialMsg {
+		return msg[1+2*keySize:]
+	}
+	return msg[1:]
+}
+
+func TestRatchet_Conversation(t *testing.T) {
+	dir := directory{}
+	alice, bob := newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil)
+	ctx := context.Background()
+
+	_, err := bob.m.Encrypt(ctx, "did:key:zunknown", []byte("hi"))
+	assert.Error(t, err)
+	_, err = bob.m.Decrypt(ctx, alice.id, append([]byte{normalMsg}, make([]byte, headerSize)...))
+	assert.ErrorIs(t, err, errNoSession)
+
+	// Alice keeps sending initial messages until Bob replied
+	m1, m2 := send(t, alice, bob, "one"), send(t, alice, bob, "two")
+	assert.Equal(t, byte(initialMsg), m1[0])
+	assert.Equal(t, byte(initialMsg), m2[0])
+	open(t, bob, alice, m2, "two")
+	open(t, bob, alice, m1, "one")
+	open(t, alice, bob, send(t, bob, alice, "three"), "three")
+	m4 := send(t, alice, bob, "four")
+	assert.Equal(t, byte(normalMsg), m4[0])
+
+	// Out of order within and across chains
+	m5 := send(t, alice, bob, "five")
+	open(t, bob, alice, m5, "five")
+	open(t, bob, alice, m4, "four")
+
+	// Every message key is used once
+	_, err = bob.m.Decrypt(ctx, alice.id, m4)
+	assert.Error(t, err)
+	// A session is bound to both DIDs
+	carol, dave := newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil)
+	msg := send(t, alice, dave, "six")
+	_, err = dave.m.Decrypt(ctx, carol.id, msg)
+	assert.Error(t, err)
+	open(t, dave, alice, msg, "six")
+}
+
+func TestRatchet_Tampered(t *testing.T) {
+	dir := directory{}
+	alice, bob := newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil)
+	open(t, bob, alice, send(t, alice, bob, "hello"), "hello")
+
+	msg := send(t, bob, alice, "reply")
+	for _, i := range []int{1, 1 + keySize, len(msg) - 1} {
+		tampered := bytes.Clone(msg)
+		tampered[i] ^= 0x01
+		_, err := alice.m.Decrypt(context.Background(), bob.id, tampered)
+		assert.Error(t, err, "byte %d", i)
+	}
+	// The forged messages left the session intact
+	open(t, alice, bob, msg, "reply")
+}
+
+func TestRatchet_PostCompromise(t *testing.T) {
+	dir := directory{}
+	alice, bob := newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil)
+	open(t, bob, alice, send(t, alice, bob, "hello"), "hello")
+
+	// An attacker copies the state of Bob and follows the messages to him
+	stolen := bob.m.sessions[alice.id].clone()
+	follow := func(msg []byte) error {
+		plaintext, next, err := stolen.decrypt(body(msg))
+		if err == nil {
+			stolen = next
+			assert.NotEmpty(t, plaintext)
+		}
+		return err
+	}
+	for _, text := range []string{"still exposed", "exposed too"} {
+		msg := send(t, alice, bob, text)
+		require.NoError(t, follow(msg))
+		open(t, bob, alice, msg, text)
+		// The reply of Bob uses the ratchet key the attacker stole
+		open(t, alice, bob, send(t, bob, alice, "ack"), "ack")
+	}
+
+	// Bob's ratchet key generated after the theft locks the attacker out
+	msg := send(t, alice, bob, "safe again")
+	assert.Error(t, follow(msg))
+	open(t, bob, alice, msg, "safe again")
+}
+
+func TestRatchet_SkippedEviction(t *testing.T) {
+	dir := directory{}
+	alice, bob := newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil)
+	bob.m.config.MaxSkip = 4
+	open(t, bob, alice, send(t, alice, bob, "hello"), "hello")
+	open(t, alice, bob, send(t, bob, alice, "reply"), "reply")
+
+	// Lost messages keep piling up over the life of the session
+	var late []byte
+	for i := range 3 {
+		for range 3 {
+			late = send(t, alice, bob, "lost")
+		}
+		open(t, bob, alice, send(t, alice, bob, "arrived"), "arrived")
+		assert.LessOrEqual(t, len(bob.m.sessions[alice.id].Skipped), 4, "round %d", i)
+	}
+	assert.Len(t, bob.m.sessions[alice.id].Order, len(bob.m.sessions[alice.id].Skipped))
+	// The newest skipped keys are kept
+	open(t, bob, alice, late, "lost")
+
+	// A single message may not skip more than MaxSkip keys
+	for range 5 {
+		send(t, alice, bob, "lost")
+	}
+	_, err := bob.m.Decrypt(context.Background(), alice.id, send(t, alice, bob, "too far"))
+	assert.ErrorIs(t, err, errTooManySkipped)
+}
+
+func TestRatchet_Simultaneous(t *testing.T) {
+	dir := directory{}
+	low, high := newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil)
+	if high.id < low.id {
+		low, high = high, low
+	}
+	ctx := context.Background()
+
+	// Both start a session before the message of the other arrived
+	fromLow, fromHigh := send(t, low, high, "from low"), send(t, high, low, "from high")
+	_, err := low.m.Decrypt(ctx, high.id, fromHigh)
+	assert.ErrorIs(t, err, errConcurrent)
+	open(t, high, low, fromLow, "from low")
+	// Both use the session of the lower DID now
+	open(t, low, high, send(t, high, low, "again"), "again")
+	open(t, high, low, send(t, low, high, "agreed"), "agreed")
+}
+
+func TestRatchet_InitialReplaces(t *testing.T) {
+	dir := directory{}
+	alice, bob := newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil)
+	ctx := context.Background()
+	restart := func() {
+		// Alice loses her session with Bob
+		delete(alice.m.sessions, bob.id)
+		require.NoError(t, alice.db.Delete(sessionKey(bob.id)))
+	}
+
+	// A session Alice restarted before Bob replied replaces the first one,
+	// which can not be brought back by replaying its initial message
+	first := send(t, alice, bob, "first")
+	open(t, bob, alice, first, "first")
+	restart()
+	open(t, bob, alice, send(t, alice, bob, "second"), "second")
+	_, err := bob.m.Decrypt(ctx, alice.id, first)
+	assert.ErrorIs(t, err, errReplayed)
+	open(t, alice, bob, send(t, bob, alice, "reply"), "reply")
+	open(t, bob, alice, send(t, alice, bob, "confirmed"), "confirmed")
+
+	// Once both replied only an initial message which decrypts replaces
+	// the session
+	restart()
+	established := bob.m.sessions[alice.id]
+	forged := send(t, alice, bob, "third")
+	forged[len(forged)-1] ^= 0x01
+	_, err = bob.m.Decrypt(ctx, alice.id, forged)
+	assert.Error(t, err)
+	assert.Same(t, established, bob.m.sessions[alice.id])
+	open(t, bob, alice, send(t, alice, bob, "fourth"), "fourth")
+	open(t, alice, bob, send(t, bob, alice, "welcome back"), "welcome back")
+	open(t, bob, alice, send(t, alice, bob, "thanks"), "thanks")
+	_, err = bob.m.Decrypt(ctx, alice.id, first)
+	assert.ErrorIs(t, err, errReplayed)
+
+	// and only with the current prekey
+	stale := dir[bob.id].Document()
+	require.NoError(t, bob.m.RotatePrekey())
+	restart()
+	alice.m.config.Resolve = func(ctx context.Context, id string) (*did.Document, error) { return stale, nil }
+	_, err = bob.m.Decrypt(ctx, alice.id, send(t, alice, bob, "old prekey"))
+	assert.ErrorIs(t, err, errSessionExists)
+	assert.True(t, bob.m.sessions[alice.id].Replied)
+}
+
+func TestRatchet_Persist(t *testing.T) {
+	dir := directory{}
+	alice, bob := newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil)
+	open(t, bob, alice, send(t, alice, bob, "hello"), "hello")
+	prekey, err := dir[bob.id].Document().SignedPrekey()
+	require.NoError(t, err)
+
+	// A restarted node keeps its prekey and sessions
+	bob = newTestNode(t, dir, dir[bob.id], bob.db)
+	again, err := dir[bob.id].Document().SignedPrekey()
+	require.NoError(t, err)
+	assert.Equal(t, prekey.Bytes(), again.Bytes())
+	open(t, alice, bob, send(t, bob, alice, "back"), "back")
+	open(t, bob, alice, send(t, alice, bob, "welcome"), "welcome")
+}
+
+func TestRatchet_RotatePrekey(t *testing.T) {
+	dir := directory{}
+	bob := newTestNode(t, dir, nil, nil)
+	stale := dir[bob.id].Document()
+	alice := newTestNode(t, dir, nil, nil)
+	alice.m.config.Resolve = func(ctx context.Context, id string) (*did.Document, error) {
+		if id == bob.id {
+			return stale, nil
+		}
+		return dir.resolve(ctx, id)
+	}
+
+	// Alice still has the document from before the rotation
+	require.NoError(t, bob.m.RotatePrekey())
+	open(t, bob, alice, send(t, alice, bob, "hello"), "hello")
+
+	carol := newTestNode(t, dir, nil, nil)
+	carol.m.config.Resolve = alice.m.config.Resolve
+	msg := send(t, carol, bob, "late")
+	require.NoError(t, bob.m.RotatePrekey())
+	_, err := bob.m.Decrypt(context.Background(), carol.id, msg)
+	assert.ErrorIs(t, err, errUnknownPrekey)
+}
+
+func TestRatchet_SwappedKeyAgreementKey(t *testing.T) {
+	dir := directory{}
+	alice, bob, mallory := newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil), newTestNode(t, dir, nil, nil)
+	// A resolver handing out the document of bob with the key of mallory
+	alice.m.config.Resolve = func(ctx context.Context, id string) (*did.Document, error) {
+		doc, err := dir.resolve(ctx, id)
+		if err == nil && id == bob.id {
+			doc.VerificationMethod[1] = dir[mallory.id].Document().VerificationMethod[1]
+		}
+		return doc, err
+	}
+	_, err := alice.m.Encrypt(context.Background(), bob.id, []byte("hello"))
+	assert.ErrorIs(t, err, did.ErrKeyAgreementSig)
+}
@@ -0,0 +1,250 @@
+package ratchet
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	crypto "github.com/wang900115/LCA/crypt"
+)
+
+// A ratchet message is
+//
+//	dh(32) | pn(4) | n(4) | ciphertext
+//
+// dh is the current ratchet key of the sender, pn the length of its previous
+// sending chain and n the number of the message in the current chain. The
+// header is authenticated with the associated data of the session.
+const (
+	keySize    = 32
+	headerSize = keySize + 4 + 4
+)
+
+var (
+	errNoSendingChain = errors.New("session can not send before it received a message")
+	errTooManySkipped = errors.New("too many skipped messages")
+	errShortMessage   = errors.New("ratchet message too short")
+)
+
+// session is the double ratchet state of a conversation with one peer. It is
+// persisted as JSON after every message.
+type session struct {
+	AD      []byte            `json:"ad"`       // Associated data binding both DIDs
+	DHs     []byte            `json:"dhs"`      // Private ratchet key
+	DHr     []byte            `json:"dhr"`      // Ratchet key of the peer
+	RK      []byte            `json:"rk"`       // Root key
+	CKs     []byte            `json:"cks"`      // Sending chain key
+	CKr     []byte            `json:"ckr"`      // Receiving chain key
+	Ns      uint32            `json:"ns"`       // Messages sent in the sending chain
+	Nr      uint32            `json:"nr"`       // Messages received in the receiving chain
+	PN      uint32            `json:"pn"`       // Length of the previous sending chain
+	Skipped map[string][]byte `json:"skipped"`  // Message keys of skipped messages
+	Order   []string          `json:"order"`    // Keys of Skipped, oldest first
+	Initial []byte            `json:"initial"`  // X3DH header sent until the peer replied
+	InitEK  []byte            `json:"init_ek"`  // Ephemeral key of the initiator, responder side
+	Seen    []initialKeys     `json:"seen"`     // Initial messages accepted, responder side
+	Replied bool              `json:"replied"`  // Both sides are known to have the session
+	MaxSkip int               `json:"max_skip"` // Limit of skipped message keys
+}
+
+// initialKeys identifies an initial message by the ephemeral key of the
+// initiator and the signed prekey it was sent to.
+type initialKeys struct {
+	EK  []byte `json:"ek"`
+	SPK []byte `json:"spk"`
+}
+
+// newInitiator starts the session of the side which ran X3DH, sending to the
+// signed prekey of the peer.
+func newInitiator(sk []byte, peerPrekey *ecdh.PublicKey, ad []byte, maxSkip int) (*session, error) {
+	dhs, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := crypto.ComputeX25519SharedKey(dhs, peerPrekey)
+	if err != nil {
+		return nil, err
+	}
+	rk, cks, err := crypto.KDFRoot(sk, dh)
+	if err != nil {
+		return nil, err
+	}
+	return &session{
+		AD:      ad,
+		DHs:     dhs.Bytes(),
+		DHr:     peerPrekey.Bytes(),
+		RK:      rk,
+		CKs:     cks,
+		Skipped: make(map[string][]byte),
+		MaxSkip: maxSkip,
+	}, nil
+}
+
+// newResponder starts the session of the side whose signed prekey was used,
+// which sends once it received the first message.
+func newResponder(sk []byte, prekey *ecdh.PrivateKey, ad []byte, maxSkip int) *session {
+	return &session{
+		AD:      ad,
+		DHs:     prekey.Bytes(),
+		RK:      sk,
+		Skipped: make(map[string][]byte),
+		MaxSkip: maxSkip,
+	}
+}
+
+func (s *session) clone() *session {
+	c := *s
+	c.Skipped = maps.Clone(s.Skipped)
+	c.Order = slices.Clone(s.Order)
+	c.Seen = slices.Clone(s.Seen)
+	return &c
+}
+
+func (s *session) encrypt(plaintext []byte) ([]byte, error) {
+	if s.CKs == nil {
+		return nil, errNoSendingChain
+	}
+	dhs, err := ecdh.X25519().NewPrivateKey(s.DHs)
+	if err != nil {
+		return nil, err
+	}
+	var mk []byte
+	s.CKs, mk = crypto.KDFChain(s.CKs)
+	header := append(dhs.PublicKey().Bytes(), make([]byte, 8)...)
+	binary.BigEndian.PutUint32(header[keySize:], s.PN)
+	binary.BigEndian.PutUint32(header[keySize+4:], s.Ns)
+	s.Ns++
+	ciphertext, err := crypto.AESGCMEncrypt(plaintext, mk, s.associated(header))
+	if err != nil {
+		return nil, err
+	}
+	return append(header, ciphertext...), nil
+}
+
+// decrypt opens a message, returning the plaintext and the state after it.
+// s is left untouched, so a forged message can not corrupt the session.
+func (s *session) decrypt(msg []byte) ([]byte, *session, error) {
+	if len(msg) < headerSize {
+		return nil, nil, errShortMessage
+	}
+	header, ciphertext := msg[:headerSize], msg[headerSize:]
+	dh := header[:keySize]
+	pn := binary.BigEndian.Uint32(header[keySize:])
+	n := binary.BigEndian.Uint32(header[keySize+4:])
+
+	next := s.clone()
+	if mk, ok := next.Skipped[skippedKey(dh, n)]; ok {
+		next.forget(skippedKey(dh, n))
+		plaintext, err := crypto.AESGCMDecrypt(ciphertext, mk, next.associated(header))
+		if err != nil {
+			return nil, nil, err
+		}
+		return plaintext, next, nil
+	}
+	if !bytes.Equal(dh, next.DHr) {
+		if err := next.skip(pn); err != nil {
+			return nil, nil, err
+		}
+		if err := next.dhRatchet(dh); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := next.skip(n); err != nil {
+		return nil, nil, err
+	}
+	var mk []byte
+	next.CKr, mk = crypto.KDFChain(next.CKr)
+	next.Nr++
+	plaintext, err := crypto.AESGCMDecrypt(ciphertext, mk, next.associated(header))
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, next, nil
+}
+
+// skip keeps the message keys of the receiving chain up to until, for
+// messages which arrive out of order. A message may skip at most MaxSkip
+// keys; when more are kept, the oldest are dropped, as their messages are
+// most likely lost.
+func (s *session) skip(until uint32) error {
+	if s.CKr == nil {
+		return nil
+	}
+	if until < s.Nr {
+		return nil
+	}
+	if int(until-s.Nr) > s.MaxSkip {
+		return errTooManySkipped
+	}
+	for s.Nr < until {
+		var mk []byte
+		s.CKr, mk = crypto.KDFChain(s.CKr)
+		key := skippedKey(s.DHr, s.Nr)
+		s.Skipped[key] = mk
+		s.Order = append(s.Order, key)
+		s.Nr++
+	}
+	for len(s.Order) > s.MaxSkip {
+		delete(s.Skipped, s.Order[0])
+		s.Order = s.Order[1:]
+	}
+	return nil
+}
+
+// forget drops the skipped message key of key once its message arrived.
+func (s *session) forget(key string) {
+	delete(s.Skipped, key)
+	if i := slices.Index(s.Order, key); i >= 0 {
+		s.Order = slices.Delete(s.Order, i, i+1)
+	}
+}
+
+// dhRatchet moves to the new ratchet key of the peer, starting a receiving
+// chain for it and a sending chain with a fresh key of our own.
+func (s *session) dhRatchet(dh []byte) error {
+	peer, err := ecdh.X25519().NewPublicKey(dh)
+	if err != nil {
+		return err
+	}
+	dhs, err := ecdh.X25519().NewPrivateKey(s.DHs)
+	if err != nil {
+		return err
+	}
+	s.PN, s.Ns, s.Nr = s.Ns, 0, 0
+	s.DHr = bytes.Clone(dh)
+	out, err := crypto.ComputeX25519SharedKey(dhs, peer)
+	if err != nil {
+		return err
+	}
+	if s.RK, s.CKr, err = crypto.KDFRoot(s.RK, out); err != nil {
+		return err
+	}
+	if dhs, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return err
+	}
+	s.DHs = dhs.Bytes()
+	if out, err = crypto.ComputeX25519SharedKey(dhs, peer); err != nil {
+		return err
+	}
+	s.RK, s.CKs, err = crypto.KDFRoot(s.RK, out)
+	return err
+}
+
+func (s *session) associated(header []byte) []byte {
+	return append(bytes.Clone(s.AD), header...)
+}
+
+func skippedKey(dh []byte, n uint32) string {
+	return fmt.Sprintf("%x/%d", dh, n)
+}
+
+// seen reports whether an initial message with the ephemeral key ek was
+// accepted before.
+func (s *session) seen(ek []byte) bool {
+	return slices.ContainsFunc(s.Seen, func(k initialKeys) bool { return bytes.Equal(k.EK, ek) })
+}
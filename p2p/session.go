@@ -0,0 +1,257 @@
+package p2p
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	crypto "github.com/wang900115/LCA/crypt"
+)
+
+// After the handshake every byte on the connection travels in an AES-GCM
+// frame:
+//
+//	kind(1) | size(4) | sealed body
+//
+// The header is authenticated as additional data. Each direction has its own
+// key, derived by the sender with crypt.DeriveAESKey from the session secret
+// and announced by a key frame carrying the HKDF salt. Nonces are a counter
+// per key which both sides track, so a dropped, replayed or reordered frame
+// fails authentication. The sender switches to a fresh key after a number of
+// bytes or frames. Key frames are sealed with the current key, the first one
+// with a bootstrap key derived from the secret alone.
+const (
+	frameData = 0x00
+	frameKey  = 0x01
+
+	frameHeaderSize = 5
+
+	// Default limits of a session
+	DefaultMaxFrameSize  = 64 * 1024
+	DefaultRekeyBytes    = 1 << 30
+	DefaultRekeyMessages = 1 << 20
+)
+
+var (
+	sessionBootstrapInfo = []byte("lca session bootstrap")
+
+	errSessionAuth      = newPeerError(errInvalidMsg, "session frame authentication failed")
+	errSessionFrameSize = newPeerError(errInvalidMsg, "session frame too large")
+	errSessionFrameKind = newPeerError(errInvalidMsg, "invalid session frame kind")
+	errSessionNoKey     = newPeerError(errInvalidMsg, "session data before key")
+)
+
+// SessionConfig tunes the framing of a session, zero values select the
+// defaults.
+type SessionConfig struct {
+	MaxFrameSize  int    // Largest plaintext carried by one frame
+	RekeyBytes    uint64 // Plaintext bytes sent before switching keys
+	RekeyMessages uint64 // Frames sent before switching keys
+}
+
+func (c SessionConfig) withDefaults() SessionConfig {
+	if c.MaxFrameSize <= 0 {
+		c.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if c.RekeyBytes == 0 {
+		c.RekeyBytes = DefaultRekeyBytes
+	}
+	if c.RekeyMessages == 0 {
+		c.RekeyMessages = DefaultRekeyMessages
+	}
+	return c
+}
+
+// sessionKey is the state of one direction under one key.
+type sessionKey struct {
+	aead  cipher.AEAD
+	seq   uint64 // Nonce of the next frame
+	bytes uint64 // Plaintext bytes under this key
+}
+
+func newSessionKey(key []byte) (*sessionKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionKey{aead: aead}, nil
+}
+
+// nonce returns the nonce of the next frame and advances the counter.
+func (k *sessionKey) nonce() []byte {
+	nonce := make([]byte, k.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], k.seq)
+	k.seq++
+	return nonce
+}
+
+// Session is an encrypted connection to a peer. Every Write is sent as one
+// or more frames, Read returns the plaintext of the received frames.
+type Session struct {
+	net.Conn
+	config    SessionConfig
+	secret    []byte
+	localPub  ed25519.PublicKey
+	remotePub ed25519.PublicKey
+
+	wmu  sync.Mutex
+	wkey *sessionKey // nil until the first key was announced
+
+	rmu  sync.Mutex
+	rkey *sessionKey // nil until the first key frame arrived
+	rbuf []byte      // Unread plaintext of the last data frame
+	body []byte      // Frame buffer reused across reads, rbuf points into it
+}
+
+// NewSession wraps conn in encrypted framing keyed by the session secret the
+// handshake established. localPub and remotePub are the Ed25519 keys of both
+// sides, binding each key to its direction.
+func NewSession(conn net.Conn, secret []byte, localPub, remotePub ed25519.PublicKey, config SessionConfig) *Session {
+	return &Session{
+		Conn:      conn,
+		config:    config.withDefaults(),
+		secret:    secret,
+		localPub:  localPub,
+		remotePub: remotePub,
+	}
+}
+
+// Write seals p into frames and writes them to the connection.
+func (s *Session) Write(p []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	n := 0
+	for len(p) > 0 {
+		if s.wkey == nil || s.wkey.bytes >= s.config.RekeyBytes || s.wkey.seq >= s.config.RekeyMessages {
+			if err := s.rekey(); err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if len(chunk) > s.config.MaxFrameSize {
+			chunk = chunk[:s.config.MaxFrameSize]
+		}
+		if err := s.writeFrame(s.wkey, frameData, chunk); err != nil {
+			return n, err
+		}
+		s.wkey.bytes += uint64(len(chunk))
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// rekey announces a fresh sending key and switches to it.
+func (s *Session) rekey() error {
+	key, salt, err := crypto.DeriveAESKey(s.secret, s.localPub, s.remotePub)
+	if err != nil {
+		return err
+	}
+	next, err := newSessionKey(key)
+	if err != nil {
+		return err
+	}
+	current := s.wkey
+	if current == nil {
+		if current, err = s.bootstrapKey(s.localPub, s.remotePub); err != nil {
+			return err
+		}
+	}
+	if err := s.writeFrame(current, frameKey, salt); err != nil {
+		return err
+	}
+	s.wkey = next
+	return nil
+}
+
+func (s *Session) writeFrame(key *sessionKey, kind byte, plain []byte) error {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(plain)+key.aead.Overhead())
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(plain)+key.aead.Overhead()))
+	frame = key.aead.Seal(frame, key.nonce(), plain, frame[:frameHeaderSize])
+	_, err := s.Conn.Write(frame)
+	return err
+}
+
+// Read reads plaintext from the received data frames.
+func (s *Session) Read(p []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	for len(s.rbuf) == 0 {
+		if err := s.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.rbuf)
+	s.rbuf = s.rbuf[n:]
+	return n, nil
+}
+
+// readFrame reads and opens the next frame, installing announced keys.
+func (s *Session) readFrame() error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(s.Conn, header[:]); err != nil {
+		return err
+	}
+	key := s.rkey
+	if key == nil {
+		var err error
+		if key, err = s.bootstrapKey(s.remotePub, s.localPub); err != nil {
+			return err
+		}
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > uint32(s.config.MaxFrameSize+key.aead.Overhead()) {
+		return errSessionFrameSize
+	}
+	if uint32(cap(s.body)) < size {
+		s.body = make([]byte, size)
+	}
+	body := s.body[:size]
+	if _, err := io.ReadFull(s.Conn, body); err != nil {
+		return err
+	}
+	plain, err := key.aead.Open(body[:0], key.nonce(), body, header[:])
+	if err != nil {
+		return errSessionAuth
+	}
+	switch header[0] {
+	case frameKey:
+		next, err := crypto.DeriveKey(s.secret, plain, crypto.DeriveAESKeyInfo(s.remotePub, s.localPub))
+		if err != nil {
+			return err
+		}
+		if s.rkey, err = newSessionKey(next); err != nil {
+			return err
+		}
+	case frameData:
+		if s.rkey == nil {
+			return errSessionNoKey
+		}
+		s.rbuf = plain
+	default:
+		return errSessionFrameKind
+	}
+	return nil
+}
+
+// bootstrapKey returns the key sealing the first key frame from sender to
+// receiver.
+func (s *Session) bootstrapKey(sender, receiver ed25519.PublicKey) (*sessionKey, error) {
+	info := append(append([]byte{}, sessionBootstrapInfo...), crypto.DeriveAESKeyInfo(sender, receiver)...)
+	key, err := crypto.DeriveKey(s.secret, nil, info)
+	if err != nil {
+		return nil, err
+	}
+	return newSessionKey(key)
+}
@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bufConn is a connection writing to and reading from a buffer.
+type bufConn struct {
+	net.Conn
+	buf *bytes.Buffer
+}
+
+func (c bufConn) Read(p []byte) (int, error)  { return c.buf.Read(p) }
+func (c bufConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+// newSessionPair returns a sending and a receiving session over one buffer.
+func newSessionPair(t *testing.T, config SessionConfig) (*Session, *Session, *bytes.Buffer) {
+	t.Helper()
+	secret := bytes.Repeat([]byte{0x42}, 32)
+	alice, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	bob, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	wire := new(bytes.Buffer)
+	conn := bufConn{buf: wire}
+	return NewSession(conn, secret, alice, bob, config), NewSession(conn, secret, bob, alice, config), wire
+}
+
+// frameKinds parses the kinds of the frames on the wire.
+func frameKinds(wire []byte) []byte {
+	var kinds []byte
+	for len(wire) >= frameHeaderSize {
+		kinds = append(kinds, wire[0])
+		wire = wire[frameHeaderSize+int(uint32(wire[1])<<24|uint32(wire[2])<<16|uint32(wire[3])<<8|uint32(wire[4])):]
+	}
+	return kinds
+}
+
+func TestSession(t *testing.T) {
+	send, recv, wire := newSessionPair(t, SessionConfig{MaxFrameSize: 16, RekeyMessages: 3})
+
+	msg := bytes.Repeat([]byte("message "), 7)
+	n, err := send.Write(msg)
+	require.NoError(t, err)
+	assert.Equal(t, len(msg), n)
+	assert.False(t, bytes.Contains(wire.Bytes(), []byte("message")), "plaintext on the wire")
+	// 56 bytes in 16 byte frames: a key frame, three data frames, a rekey and
+	// the last data frame
+	assert.Equal(t, []byte{frameKey, frameData, frameData, frameData, frameKey, frameData}, frameKinds(wire.Bytes()))
+
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(recv, got)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+}
+
+func TestSession_RekeyBytes(t *testing.T) {
+	send, recv, wire := newSessionPair(t, SessionConfig{RekeyBytes: 10})
+
+	for i := 0; i < 3; i++ {
+		_, err := send.Write([]byte("0123456789"))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []byte{frameKey, frameData, frameKey, frameData, frameKey, frameData}, frameKinds(wire.Bytes()))
+	got, err := io.ReadAll(io.LimitReader(recv, 30))
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("0123456789"), 3), got)
+}
+
+func TestSession_Tampered(t *testing.T) {
+	send, recv, wire := newSessionPair(t, SessionConfig{})
+	_, err := send.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	wire.Bytes()[wire.Len()-1] ^= 0x01
+	_, err = recv.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, errSessionAuth)
+	assert.Equal(t, DiscProtocolError, DiscReasonForError(err))
+}
+
+func TestSession_Replay(t *testing.T) {
+	send, recv, wire := newSessionPair(t, SessionConfig{})
+	_, err := send.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// Append the data frame a second time
+	frames := wire.Bytes()
+	keyFrame := frameHeaderSize + int(frames[4])
+	wire.Write(append([]byte{}, frames[keyFrame:]...))
+
+	buf := make([]byte, 16)
+	n, err := recv.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+	_, err = recv.Read(buf)
+	assert.ErrorIs(t, err, errSessionAuth)
+}
+
+func TestSession_Direction(t *testing.T) {
+	send, _, wire := newSessionPair(t, SessionConfig{})
+	_, err := send.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// A session with the same secret but the roles swapped can not read it
+	wrong := NewSession(bufConn{buf: wire}, send.secret, send.localPub, send.remotePub, SessionConfig{})
+	_, err = wrong.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, errSessionAuth)
+}
+
+func TestSession_FrameSize(t *testing.T) {
+	send, _, wire := newSessionPair(t, SessionConfig{MaxFrameSize: 1024})
+	_, err := send.Write(make([]byte, 1024))
+	require.NoError(t, err)
+
+	small := NewSession(bufConn{buf: wire}, send.secret, send.remotePub, send.localPub, SessionConfig{MaxFrameSize: 512})
+	_, err = small.Read(make([]byte, 1024))
+	assert.ErrorIs(t, err, errSessionFrameSize)
+}
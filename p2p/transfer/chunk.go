@@ -0,0 +1,80 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"errors"
+
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+// A transfer travels as CHUNK packets with the payload
+//
+//	id(16) | index(4) | total(4) | hash(32) | data
+//
+// where hash is the SHA-256 of the whole transfer. The receiver answers every
+// chunk, including duplicates, with a CHUNKACK packet of
+//
+//	id(16) | index(4)
+const (
+	chunkHeaderSize = 16 + 4 + 4 + 32
+	ackSize         = 16 + 4
+)
+
+var (
+	errChunkMalformed = errors.New("malformed chunk")
+	errAckMalformed   = errors.New("malformed chunk ack")
+)
+
+// ID identifies a transfer.
+type ID [16]byte
+
+type chunk struct {
+	id    ID
+	index uint32
+	total uint32
+	hash  [32]byte
+	data  []byte
+}
+
+func (c *chunk) packet() (network.Packet, error) {
+	payload := make([]byte, chunkHeaderSize, chunkHeaderSize+len(c.data))
+	copy(payload, c.id[:])
+	binary.BigEndian.PutUint32(payload[16:], c.index)
+	binary.BigEndian.PutUint32(payload[20:], c.total)
+	copy(payload[24:], c.hash[:])
+	return network.NewPacketFrameBytes(common.CHUNK, append(payload, c.data...))
+}
+
+func decodeChunk(payload []byte) (*chunk, error) {
+	if len(payload) < chunkHeaderSize {
+		return nil, errChunkMalformed
+	}
+	c := &chunk{
+		index: binary.BigEndian.Uint32(payload[16:]),
+		total: binary.BigEndian.Uint32(payload[20:]),
+		data:  payload[chunkHeaderSize:],
+	}
+	copy(c.id[:], payload)
+	copy(c.hash[:], payload[24:])
+	if c.total == 0 || c.index >= c.total {
+		return nil, errChunkMalformed
+	}
+	return c, nil
+}
+
+func ackPacket(id ID, index uint32) (network.Packet, error) {
+	payload := make([]byte, ackSize)
+	copy(payload, id[:])
+	binary.BigEndian.PutUint32(payload[16:], index)
+	return network.NewPacketFrameBytes(common.CHUNKACK, payload)
+}
+
+func decodeAck(payload []byte) (ID, uint32, error) {
+	var id ID
+	if len(payload) != ackSize {
+		return id, 0, errAckMalformed
+	}
+	copy(id[:], payload)
+	return id, binary.BigEndian.Uint32(payload[16:]), nil
+}
@@ -0,0 +1,417 @@
+// Package transfer moves payloads too large for a single packet between
+// peers. A payload is split into numbered chunks which the receiver
+// reassembles in any order and checks against the hash of the whole
+// transfer. Chunks stay pending until acknowledged, so a transfer survives a
+// reconnect by resending what is missing.
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/pkg/lru"
+)
+
+const (
+	// Default limits of a manager
+	DefaultChunkSize   = 256 * 1024
+	DefaultTimeout     = 30 * time.Second
+	DefaultMaxSize     = 256 << 20
+	DefaultMaxIncoming = 16
+
+	// Completed transfers remembered to acknowledge resent chunks
+	completedCacheSize = 1024
+)
+
+var (
+	ErrTimeout = errors.New("transfer timed out")
+	ErrClosed  = errors.New("transfer manager closed")
+
+	errEmptyPayload      = errors.New("empty transfer payload")
+	errTooLarge          = errors.New("transfer exceeds max size")
+	errTooManyTransfers  = errors.New("too many incoming transfers from peer")
+	errHashMismatch      = errors.New("transfer hash mismatch")
+	errInconsistentChunk = errors.New("chunk does not match its transfer")
+	errUnexpectedCommand = errors.New("not a transfer packet")
+)
+
+// Peer is the side of a transfer, p2p.Peer implements it.
+type Peer interface {
+	ID() string
+	Addr() string
+	Send(network.Packet) error
+}
+
+// peerKey returns the key transfers with a peer are tracked under, which
+// stays the same across reconnects of an identified peer.
+func peerKey(peer Peer) string {
+	if id := peer.ID(); id != "" {
+		return id
+	}
+	return peer.Addr()
+}
+
+// Config tunes a manager, zero values select the defaults. Peers are expected
+// to use the same chunk size, an incoming transfer may not have more chunks
+// than MaxSize takes at ChunkSize.
+type Config struct {
+	ChunkSize   int           // Largest data carried by one chunk
+	Timeout     time.Duration // Inactivity after which a transfer is dropped
+	MaxSize     int           // Largest payload sent or accepted
+	MaxIncoming int           // Incoming transfers reassembled per peer at once
+}
+
+func (c Config) withDefaults() Config {
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = DefaultChunkSize
+	}
+	if c.ChunkSize > network.DefaultMaxFrameSize-chunkHeaderSize {
+		c.ChunkSize = network.DefaultMaxFrameSize - chunkHeaderSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = DefaultMaxSize
+	}
+	if c.MaxIncoming <= 0 {
+		c.MaxIncoming = DefaultMaxIncoming
+	}
+	return c
+}
+
+// maxChunks is the most chunks an incoming transfer may have.
+func (c Config) maxChunks() int64 {
+	return int64((c.MaxSize + c.ChunkSize - 1) / c.ChunkSize)
+}
+
+type transferKey struct {
+	peer string
+	id   ID
+}
+
+// Transfer is an outgoing transfer.
+type Transfer struct {
+	ID ID
+
+	key        transferKey
+	hash       [32]byte
+	chunks     [][]byte
+	acked      []bool
+	pending    int
+	lastActive time.Time
+	timer      *time.Timer
+	done       chan struct{}
+	err        error
+}
+
+// Done returns a channel which is closed once the transfer completed or
+// failed.
+func (t *Transfer) Done() <-chan struct{} {
+	return t.done
+}
+
+// Err returns nil once every chunk was acknowledged, ErrTimeout or ErrClosed
+// when the transfer failed. It is only meaningful after Done is closed.
+func (t *Transfer) Err() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the transfer completed or failed, or ctx is done.
+func (t *Transfer) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// incoming is a transfer being reassembled.
+type incoming struct {
+	hash       [32]byte
+	chunks     [][]byte
+	have       []bool
+	received   int
+	size       int
+	lastActive time.Time
+	timer      *time.Timer
+}
+
+// Manager sends and reassembles the transfers with all peers.
+type Manager struct {
+	config Config
+
+	mu        sync.Mutex
+	outgoing  map[transferKey]*Transfer
+	incoming  map[transferKey]*incoming
+	perPeer   map[string]int // Incoming transfers per peer
+	completed lru.BasicLRU[transferKey, struct{}]
+	closed    bool
+}
+
+// NewManager creates a transfer manager.
+func NewManager(config Config) *Manager {
+	return &Manager{
+		config:    config.withDefaults(),
+		outgoing:  make(map[transferKey]*Transfer),
+		incoming:  make(map[transferKey]*incoming),
+		perPeer:   make(map[string]int),
+		completed: lru.NewBasicLRU[transferKey, struct{}](completedCacheSize),
+	}
+}
+
+// Send starts transferring payload to peer. Chunks the peer could not take
+// stay pending until Resume is called with the reconnected peer or the
+// transfer times out.
+func (m *Manager) Send(peer Peer, payload []byte) (*Transfer, error) {
+	if len(payload) == 0 {
+		return nil, errEmptyPayload
+	}
+	if len(payload) > m.config.MaxSize {
+		return nil, errTooLarge
+	}
+	t := &Transfer{
+		hash:       sha256.Sum256(payload),
+		lastActive: time.Now(),
+		done:       make(chan struct{}),
+	}
+	if _, err := rand.Read(t.ID[:]); err != nil {
+		return nil, err
+	}
+	t.key = transferKey{peer: peerKey(peer), id: t.ID}
+	for len(payload) > 0 {
+		n := min(len(payload), m.config.ChunkSize)
+		t.chunks = append(t.chunks, payload[:n])
+		payload = payload[n:]
+	}
+	t.acked = make([]bool, len(t.chunks))
+	t.pending = len(t.chunks)
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	m.outgoing[t.key] = t
+	t.timer = time.AfterFunc(m.config.Timeout, func() { m.expireOutgoing(t) })
+	m.mu.Unlock()
+
+	m.sendChunks(peer, t)
+	return t, nil
+}
+
+// Resume resends the unacknowledged chunks of all transfers to peer, which
+// usually just reconnected.
+func (m *Manager) Resume(peer Peer) {
+	key := peerKey(peer)
+	m.mu.Lock()
+	var transfers []*Transfer
+	for k, t := range m.outgoing {
+		if k.peer == key {
+			t.lastActive = time.Now()
+			transfers = append(transfers, t)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, t := range transfers {
+		m.sendChunks(peer, t)
+	}
+}
+
+// sendChunks sends the unacknowledged chunks of t, stopping at the first
+// chunk the peer does not take.
+func (m *Manager) sendChunks(peer Peer, t *Transfer) {
+	for index, data := range t.chunks {
+		m.mu.Lock()
+		acked := t.acked[index]
+		m.mu.Unlock()
+		if acked {
+			continue
+		}
+		c := &chunk{id: t.ID, index: uint32(index), total: uint32(len(t.chunks)), hash: t.hash, data: data}
+		pkt, err := c.packet()
+		if err != nil {
+			return
+		}
+		if err := peer.Send(pkt); err != nil {
+			return
+		}
+	}
+}
+
+// Handle processes a CHUNK or CHUNKACK packet received from peer. It returns
+// the payload of a transfer once its last chunk arrived, along with the error
+// of acknowledging that chunk if any.
+func (m *Manager) Handle(peer Peer, pkt network.Packet) ([]byte, error) {
+	switch pkt.GetCommand() {
+	case common.CHUNK:
+		c, err := decodeChunk(pkt.GetPayload())
+		if err != nil {
+			return nil, err
+		}
+		payload, err := m.receive(transferKey{peer: peerKey(peer), id: c.id}, c)
+		if err != nil {
+			return nil, err
+		}
+		ack, err := ackPacket(c.id, c.index)
+		if err != nil {
+			return nil, err
+		}
+		return payload, peer.Send(ack)
+	case common.CHUNKACK:
+		id, index, err := decodeAck(pkt.GetPayload())
+		if err != nil {
+			return nil, err
+		}
+		m.ack(transferKey{peer: peerKey(peer), id: id}, index)
+		return nil, nil
+	default:
+		return nil, errUnexpectedCommand
+	}
+}
+
+// receive stores a chunk, returning the payload once the transfer is complete.
+func (m *Manager) receive(key transferKey, c *chunk) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	// The sender resends chunks whose acknowledgement it missed
+	if m.completed.Contains(key) {
+		return nil, nil
+	}
+	in := m.incoming[key]
+	if in == nil {
+		if int64(c.total) > m.config.maxChunks() {
+			return nil, errTooLarge
+		}
+		if m.perPeer[key.peer] >= m.config.MaxIncoming {
+			return nil, errTooManyTransfers
+		}
+		in = &incoming{
+			hash:   c.hash,
+			chunks: make([][]byte, c.total),
+			have:   make([]bool, c.total),
+		}
+		in.timer = time.AfterFunc(m.config.Timeout, func() { m.expireIncoming(key, in) })
+		m.incoming[key] = in
+		m.perPeer[key.peer]++
+	}
+	if int(c.total) != len(in.chunks) || c.hash != in.hash {
+		return nil, errInconsistentChunk
+	}
+	in.lastActive = time.Now()
+	if in.have[c.index] {
+		return nil, nil
+	}
+	if in.size+len(c.data) > m.config.MaxSize {
+		m.dropIncoming(key, in)
+		return nil, errTooLarge
+	}
+	in.chunks[c.index] = c.data
+	in.have[c.index] = true
+	in.size += len(c.data)
+	in.received++
+	if in.received < len(in.chunks) {
+		return nil, nil
+	}
+
+	m.dropIncoming(key, in)
+	payload := bytes.Join(in.chunks, nil)
+	if sha256.Sum256(payload) != in.hash {
+		return nil, errHashMismatch
+	}
+	m.completed.Add(key, struct{}{})
+	return payload, nil
+}
+
+// ack marks a chunk of an outgoing transfer as received.
+func (m *Manager) ack(key transferKey, index uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.outgoing[key]
+	if t == nil || int(index) >= len(t.acked) || t.acked[index] {
+		return
+	}
+	t.acked[index] = true
+	t.lastActive = time.Now()
+	if t.pending--; t.pending == 0 {
+		m.finish(t, nil)
+	}
+}
+
+// finish completes an outgoing transfer, m.mu must be held.
+func (m *Manager) finish(t *Transfer, err error) {
+	delete(m.outgoing, t.key)
+	t.timer.Stop()
+	t.err = err
+	close(t.done)
+}
+
+// dropIncoming forgets an incoming transfer, m.mu must be held.
+func (m *Manager) dropIncoming(key transferKey, in *incoming) {
+	delete(m.incoming, key)
+	if m.perPeer[key.peer]--; m.perPeer[key.peer] == 0 {
+		delete(m.perPeer, key.peer)
+	}
+	in.timer.Stop()
+}
+
+func (m *Manager) expireOutgoing(t *Transfer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.outgoing[t.key] != t {
+		return
+	}
+	// Progress was made since the timer was armed
+	if idle := time.Since(t.lastActive); idle < m.config.Timeout {
+		t.timer.Reset(m.config.Timeout - idle)
+		return
+	}
+	m.finish(t, ErrTimeout)
+}
+
+func (m *Manager) expireIncoming(key transferKey, in *incoming) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.incoming[key] != in {
+		return
+	}
+	if idle := time.Since(in.lastActive); idle < m.config.Timeout {
+		in.timer.Reset(m.config.Timeout - idle)
+		return
+	}
+	m.dropIncoming(key, in)
+}
+
+// Close fails all outgoing transfers with ErrClosed and drops the incoming
+// ones.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	for _, t := range m.outgoing {
+		m.finish(t, ErrClosed)
+	}
+	for key, in := range m.incoming {
+		m.dropIncoming(key, in)
+	}
+}
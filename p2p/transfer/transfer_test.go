@@ -0,0 +1,227 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"math"
+	mrand "math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+)
+
+// testPeer records the packets sent to it.
+type testPeer struct {
+	id string
+
+	mu    sync.Mutex
+	sent  []network.Packet
+	limit int // Packets taken before failing, unlimited if zero
+}
+
+func (p *testPeer) ID() string   { return p.id }
+func (p *testPeer) Addr() string { return "" }
+
+func (p *testPeer) Send(pkt network.Packet) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.limit > 0 && len(p.sent) >= p.limit {
+		return errors.New("peer gone")
+	}
+	p.sent = append(p.sent, pkt)
+	return nil
+}
+
+// take returns and forgets the sent packets.
+func (p *testPeer) take() []network.Packet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sent := p.sent
+	p.sent = nil
+	return sent
+}
+
+func randomPayload(t *testing.T, size int) []byte {
+	payload := make([]byte, size)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+	return payload
+}
+
+// deliver hands packets to m as received from peer, returning the completed
+// payloads.
+func deliver(t *testing.T, m *Manager, peer Peer, packets []network.Packet) [][]byte {
+	var payloads [][]byte
+	for _, pkt := range packets {
+		payload, err := m.Handle(peer, pkt)
+		require.NoError(t, err)
+		if payload != nil {
+			payloads = append(payloads, payload)
+		}
+	}
+	return payloads
+}
+
+func TestTransfer(t *testing.T) {
+	sender, receiver := NewManager(Config{ChunkSize: 1000}), NewManager(Config{ChunkSize: 1000})
+	defer sender.Close()
+	defer receiver.Close()
+	toReceiver, toSender := &testPeer{id: "receiver"}, &testPeer{id: "sender"}
+
+	payload := randomPayload(t, 10500)
+	transfer, err := sender.Send(toReceiver, payload)
+	require.NoError(t, err)
+	chunks := toReceiver.take()
+	require.Len(t, chunks, 11)
+	for _, c := range chunks {
+		assert.Equal(t, common.CHUNK, c.GetCommand())
+	}
+
+	// Chunks arrive in any order
+	mrand.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+	payloads := deliver(t, receiver, toSender, chunks)
+	require.Len(t, payloads, 1)
+	assert.Equal(t, payload, payloads[0])
+
+	acks := toSender.take()
+	require.Len(t, acks, 11)
+	deliver(t, sender, toReceiver, acks)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, transfer.Wait(ctx))
+}
+
+func TestTransfer_Resume(t *testing.T) {
+	sender, receiver := NewManager(Config{ChunkSize: 100}), NewManager(Config{ChunkSize: 100})
+	defer sender.Close()
+	defer receiver.Close()
+	toSender := &testPeer{id: "sender"}
+
+	// The connection drops after four chunks
+	payload := randomPayload(t, 1000)
+	transfer, err := sender.Send(&testPeer{id: "receiver", limit: 4}, payload)
+	require.NoError(t, err)
+
+	first := &testPeer{id: "receiver"}
+	sender.Resume(first)
+	assert.Len(t, first.take(), 10, "nothing acknowledged yet")
+
+	reconnected := &testPeer{id: "receiver", limit: 4}
+	sender.Resume(reconnected)
+	assert.Empty(t, deliver(t, receiver, toSender, reconnected.take()))
+	deliver(t, sender, reconnected, toSender.take())
+
+	// Only the missing chunks are sent again
+	again := &testPeer{id: "receiver"}
+	sender.Resume(again)
+	resent := again.take()
+	assert.Len(t, resent, 6)
+	payloads := deliver(t, receiver, toSender, resent)
+	require.Len(t, payloads, 1)
+	assert.Equal(t, payload, payloads[0])
+
+	// A chunk resent after completion is acknowledged but not delivered twice
+	assert.Empty(t, deliver(t, receiver, toSender, resent[:1]))
+	deliver(t, sender, again, toSender.take())
+	select {
+	case <-transfer.Done():
+		assert.NoError(t, transfer.Err())
+	case <-time.After(time.Second):
+		t.Fatal("transfer not completed")
+	}
+}
+
+func TestTransfer_Timeout(t *testing.T) {
+	sender := NewManager(Config{ChunkSize: 100, Timeout: 50 * time.Millisecond})
+	receiver := NewManager(Config{ChunkSize: 100, Timeout: 50 * time.Millisecond})
+	defer sender.Close()
+	defer receiver.Close()
+	toReceiver := &testPeer{id: "receiver"}
+
+	transfer, err := sender.Send(toReceiver, randomPayload(t, 1000))
+	require.NoError(t, err)
+	deliver(t, receiver, &testPeer{id: "sender"}, toReceiver.take()[:5])
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.ErrorIs(t, transfer.Wait(ctx), ErrTimeout)
+	assert.Eventually(t, func() bool {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return len(receiver.incoming) == 0
+	}, time.Second, 10*time.Millisecond, "partial transfer not dropped")
+}
+
+func TestTransfer_Invalid(t *testing.T) {
+	receiver := NewManager(Config{MaxSize: 1000, ChunkSize: 100})
+	defer receiver.Close()
+	from := &testPeer{id: "sender"}
+
+	c := &chunk{total: 2, data: []byte("data")}
+	pkt, err := c.packet()
+	require.NoError(t, err)
+	_, err = receiver.Handle(from, pkt)
+	require.NoError(t, err)
+
+	// The second chunk claims another transfer hash
+	c.index, c.hash[0] = 1, 0xFF
+	pkt, err = c.packet()
+	require.NoError(t, err)
+	_, err = receiver.Handle(from, pkt)
+	assert.ErrorIs(t, err, errInconsistentChunk)
+
+	// Both chunks agree, but not with their content
+	c.hash[0] = 0
+	pkt, err = c.packet()
+	require.NoError(t, err)
+	_, err = receiver.Handle(from, pkt)
+	assert.ErrorIs(t, err, errHashMismatch)
+
+	// More chunks than the max size takes, before anything is allocated
+	for _, total := range []uint32{11, math.MaxUint32} {
+		c = &chunk{id: ID{1}, total: total}
+		pkt, err = c.packet()
+		require.NoError(t, err)
+		_, err = receiver.Handle(from, pkt)
+		assert.ErrorIs(t, err, errTooLarge)
+	}
+
+	pkt, err = network.NewPacketFrameBytes(common.CHUNK, bytes.Repeat([]byte{0}, 10))
+	require.NoError(t, err)
+	_, err = receiver.Handle(from, pkt)
+	assert.ErrorIs(t, err, errChunkMalformed)
+}
+
+func TestTransfer_MaxIncoming(t *testing.T) {
+	receiver := NewManager(Config{MaxIncoming: 2})
+	defer receiver.Close()
+	from, other := &testPeer{id: "sender"}, &testPeer{id: "other"}
+
+	start := func(peer Peer, id byte) error {
+		c := &chunk{id: ID{id}, total: 2, data: []byte("data")}
+		pkt, err := c.packet()
+		require.NoError(t, err)
+		_, err = receiver.Handle(peer, pkt)
+		return err
+	}
+	require.NoError(t, start(from, 1))
+	require.NoError(t, start(from, 2))
+	assert.ErrorIs(t, start(from, 3), errTooManyTransfers)
+	// The limit is per peer
+	require.NoError(t, start(other, 3))
+
+	// A finished transfer frees its slot
+	c := &chunk{id: ID{1}, index: 1, total: 2, data: []byte("data")}
+	pkt, err := c.packet()
+	require.NoError(t, err)
+	_, err = receiver.Handle(from, pkt)
+	assert.ErrorIs(t, err, errHashMismatch)
+	require.NoError(t, start(from, 3))
+}
@@ -2,6 +2,11 @@ package p2p
 
 import (
 	"context"
+	"net"
+	"time"
+
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p/network"
 )
 
 // p2p.Transport interface represents handles the communication between the nodes in the network
@@ -11,22 +16,64 @@ type Transport interface {
 	Listen(context.Context) error
 	Dial(context.Context, string) error
 	Close() error
-	// AddOutPeer(Peer) error
-	// AddInPeer(Peer) error
-	// RemoveOutPeer(Peer)
-	// RemoveInPeer(Peer)
-	// Peers() map[string]Peer
 }
 
-// p2p.Peer interface represents a peer in the network
-// type Peer interface {
-// 	net.Conn
-// 	Addr() string
-// 	ID() string
-// 	Document() *did.Document
-// 	ProtocolInfo() *network.ProtocolInfo
-// 	Send(network.Packet) error
-// 	Receive() (<-chan network.Packet, error)
-// 	ReadPump(context.Context)
-// 	WritePump(context.Context)
-// }
+// PeerObserver follows the peers of a transport, a peer manager implements it.
+type PeerObserver interface {
+	// AdmitPeer is asked before and after the handshake of a connection, a
+	// non-nil error rejects the peer.
+	AdmitPeer(peer Peer, outBound bool) error
+	// PeerConnected is called once a peer is registered.
+	PeerConnected(peer Peer, outBound bool)
+	// PeerDisconnected is called when a connection ends, err is why it ended
+	// or failed the handshake. Handshakes aborted by the dialer or by closing
+	// the transport are not reported.
+	PeerDisconnected(peer Peer, outBound bool, err error)
+}
+
+// p2p.Peer interface represents a remote peer in the network
+type Peer interface {
+	net.Conn
+	// Addr returns the remote network address of the peer.
+	Addr() string
+	// ID returns the DID of the remote peer, empty until a handshake identified it.
+	ID() string
+	// Document returns the DID document of the remote peer, nil until a
+	// handshake identified it.
+	Document() *did.Document
+	// SetDocument records the verified DID document of the remote peer.
+	SetDocument(*did.Document)
+	// Caps returns the capabilities shared with the remote peer, agreed on by
+	// the handshake.
+	Caps() []Cap
+	// SetCaps records the capabilities agreed on by the handshake.
+	SetCaps([]Cap)
+	// Secret returns the session secret agreed on by the handshake.
+	Secret() []byte
+	// SetSecret records the session secret agreed on by the handshake.
+	SetSecret([]byte)
+	// Err returns the error which ended the connection, nil while connected
+	// or when the peer was closed locally.
+	Err() error
+	ProtocolInfo() *network.ProtocolInfo
+	// Info returns the state of the connection, including its heartbeat RTT.
+	Info() *PeerInfo
+	Send(network.Packet) error
+	Receive() (<-chan network.Packet, error)
+	ReadPump(context.Context)
+	WritePump(context.Context)
+	// Heartbeat pings the peer until the connection ends, closing it with
+	// DiscHeartbeatTimeout when too many pings go unanswered.
+	Heartbeat(context.Context)
+}
+
+// PeerInfo describes a connected peer.
+type PeerInfo struct {
+	ID       string                  `json:"id"`
+	Addr     string                  `json:"addr"`
+	Version  network.ProtocolVersion `json:"version"`
+	Caps     []string                `json:"caps,omitempty"`
+	RTT      time.Duration           `json:"rtt"`       // Latest heartbeat round trip, zero until measured
+	LastPong time.Time               `json:"last_pong"` // When the peer last answered a heartbeat
+	Missed   int                     `json:"missed"`    // Heartbeats waiting for an answer
+}
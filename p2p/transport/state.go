@@ -1,143 +1,166 @@
 package transport
 
-// import (
-// 	"sync"
-// 	"sync/atomic"
-
-// 	"github.com/wang900115/LCA/p2p"
-// )
-
-// type stateError struct{ msg string }
-
-// func (e *stateError) Error() string { return e.msg }
-
-// var (
-// 	errExceedOutBoundLimit      = &stateError{"exceed outbound peer limit"}
-// 	errExceedInBoundLimit       = &stateError{"exceed inbound peer limit"}
-// 	errPeerNotFoundInboundKeys  = &stateError{"peer not found in inbound keys"}
-// 	errPeerNotFoundOutboundKeys = &stateError{"peer not found in outbound keys"}
-// )
-
-// type state struct {
-// 	mu sync.RWMutex
-
-// 	outBoundCnt  atomic.Int32
-// 	inBoundCnt   atomic.Int32
-// 	handshakeCnt atomic.Int32
-
-// 	outBoundLi    int
-// 	inBoundLi     int
-// 	outBoundPeers map[string]p2p.Peer
-// 	inBoundPeers  map[string]p2p.Peer
-// 	outKeys       map[string][]byte
-// 	inKeys        map[string][]byte
-// }
-
-// func NewState(outBoundLimit, inBoundLimit int) *state {
-// 	return &state{
-// 		outBoundLi:    outBoundLimit,
-// 		inBoundLi:     inBoundLimit,
-// 		outBoundPeers: make(map[string]p2p.Peer),
-// 		inBoundPeers:  make(map[string]p2p.Peer),
-// 	}
-// }
-
-// // Count returns the current counts of outBound, inBound, and handshake peers.
-// func (s *state) Count() (outBound, inBound, handshake int) {
-// 	return int(s.outBoundCnt.Load()), int(s.inBoundCnt.Load()), int(s.handshakeCnt.Load())
-// }
-
-// // Limit returns the limits for outBound and inBound peers.
-// func (s *state) Limit() (outBoundLi, inBoundLi int) {
-// 	return s.outBoundLi, s.inBoundLi
-// }
-
-// // OutPeers returns the map of outbound peers.
-// func (s *state) OutPeers() map[string]p2p.Peer {
-// 	return s.outBoundPeers
-// }
-
-// // InPeers returns the map of inbound peers.
-// func (s *state) InPeers() map[string]p2p.Peer {
-// 	return s.inBoundPeers
-// }
-
-// // Increment / Decrement counters using atomic operations
-// func (s *state) IncOutBound()  { s.outBoundCnt.Add(1) }
-// func (s *state) DecOutBound()  { s.outBoundCnt.Add(-1) }
-// func (s *state) IncInBound()   { s.inBoundCnt.Add(1) }
-// func (s *state) DecInBound()   { s.inBoundCnt.Add(-1) }
-// func (s *state) IncHandShake() { s.handshakeCnt.Add(1) }
-// func (s *state) DecHandShake() { s.handshakeCnt.Add(-1) }
-
-// // AddOutPeer adds a peer to the outbound peer map.
-// func (s *state) AddOutPeer(peer p2p.Peer) error {
-// 	s.mu.Lock()
-// 	defer s.mu.Unlock()
-// 	if int(s.outBoundCnt.Load()) > s.outBoundLi {
-// 		return errExceedOutBoundLimit
-// 	}
-// 	s.outBoundPeers[peer.Addr()] = peer
-// 	return nil
-// }
-
-// // RemoveOutPeer removes a peer from the outbound peer map.
-// func (s *state) RemoveOutPeer(peer p2p.Peer) {
-// 	s.mu.Lock()
-// 	defer s.mu.Unlock()
-// 	delete(s.outBoundPeers, peer.Addr())
-// }
-
-// // AddInPeer adds a peer to the inbound peer map.
-// func (s *state) AddInPeer(peer p2p.Peer) error {
-// 	s.mu.Lock()
-// 	defer s.mu.Unlock()
-// 	if int(s.inBoundCnt.Load()) > s.inBoundLi {
-// 		return errExceedInBoundLimit
-// 	}
-// 	s.inBoundPeers[peer.Addr()] = peer
-// 	return nil
-// }
-
-// // RemoveInPeer removes a peer from the inbound peer map.
-// func (s *state) RemoveInPeer(peer p2p.Peer) {
-// 	s.mu.Lock()
-// 	defer s.mu.Unlock()
-// 	delete(s.inBoundPeers, peer.Addr())
-// }
-
-// // SetOutKey sets the outbound encryption key for a given peer address.
-// func (s *state) SetOutKey(addr string, key []byte) {
-// 	s.mu.Lock()
-// 	defer s.mu.Unlock()
-// 	s.outKeys[addr] = key
-// }
-
-// // SetInKey sets the inbound encryption key for a given peer address.
-// func (s *state) SetInKey(addr string, key []byte) {
-// 	s.mu.Lock()
-// 	defer s.mu.Unlock()
-// 	s.inKeys[addr] = key
-// }
-
-// // GetOutKey retrieves the outbound encryption key for a given peer address.
-// func (s *state) GetOutKey(addr string) ([]byte, error) {
-// 	s.mu.RLock()
-// 	defer s.mu.RUnlock()
-// 	key, exist := s.outKeys[addr]
-// 	if !exist {
-// 		return nil, errPeerNotFoundOutboundKeys
-// 	}
-// 	return key, nil
-// }
-
-// // GetInKey retrieves the inbound encryption key for a given peer address.
-// func (s *state) GetInKey(addr string) ([]byte, error) {
-// 	s.mu.RLock()
-// 	defer s.mu.RUnlock()
-// 	key, exist := s.inKeys[addr]
-// 	if !exist {
-// 		return nil, errPeerNotFoundInboundKeys
-// 	}
-// 	return key, nil
-// }
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/wang900115/LCA/p2p"
+)
+
+// stateError is a rejected peer, matching its DiscReason with errors.Is.
+type stateError struct {
+	msg    string
+	reason p2p.DiscReason
+}
+
+func (e *stateError) Error() string { return e.msg }
+
+func (e *stateError) Unwrap() error { return e.reason }
+
+var (
+	errExceedOutBoundLimit = &stateError{"exceed outbound peer limit", p2p.DiscTooManyPeers}
+	errExceedInBoundLimit  = &stateError{"exceed inbound peer limit", p2p.DiscTooManyPeers}
+	errAlreadyConnected    = &stateError{"peer already connected", p2p.DiscAlreadyConnected}
+)
+
+// state tracks the connected peers of a transport. Peers are keyed by their
+// DID, so a second connection to an already connected node is rejected no
+// matter which address or direction it comes from. Peers which were not
+// identified by a handshake fall back to their remote address.
+type state struct {
+	mu sync.RWMutex
+
+	handshakeCnt atomic.Int32
+
+	outBoundLi    int
+	inBoundLi     int
+	outBoundPeers map[string]p2p.Peer
+	inBoundPeers  map[string]p2p.Peer
+}
+
+func NewState(outBoundLimit, inBoundLimit int) *state {
+	return &state{
+		outBoundLi:    outBoundLimit,
+		inBoundLi:     inBoundLimit,
+		outBoundPeers: make(map[string]p2p.Peer),
+		inBoundPeers:  make(map[string]p2p.Peer),
+	}
+}
+
+// peerKey returns the key a peer is tracked under.
+func peerKey(peer p2p.Peer) string {
+	if id := peer.ID(); id != "" {
+		return id
+	}
+	return peer.Addr()
+}
+
+// Count returns the current counts of outBound, inBound, and handshake peers.
+func (s *state) Count() (outBound, inBound, handshake int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.outBoundPeers), len(s.inBoundPeers), int(s.handshakeCnt.Load())
+}
+
+// Limit returns the limits for outBound and inBound peers.
+func (s *state) Limit() (outBoundLi, inBoundLi int) {
+	return s.outBoundLi, s.inBoundLi
+}
+
+// OutPeers returns a copy of the outbound peer map.
+func (s *state) OutPeers() map[string]p2p.Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyPeers(s.outBoundPeers)
+}
+
+// InPeers returns a copy of the inbound peer map.
+func (s *state) InPeers() map[string]p2p.Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyPeers(s.inBoundPeers)
+}
+
+// Increment / Decrement the number of running handshakes
+func (s *state) IncHandShake() { s.handshakeCnt.Add(1) }
+func (s *state) DecHandShake() { s.handshakeCnt.Add(-1) }
+
+// HasPeer reports whether a peer is connected under key in either direction.
+func (s *state) HasPeer(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hasPeer(key)
+}
+
+func (s *state) hasPeer(key string) bool {
+	_, out := s.outBoundPeers[key]
+	_, in := s.inBoundPeers[key]
+	return out || in
+}
+
+// OutBoundFull reports whether the outbound limit is reached.
+func (s *state) OutBoundFull() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.outBoundPeers) >= s.outBoundLi
+}
+
+// InBoundFull reports whether the inbound limit is reached.
+func (s *state) InBoundFull() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.inBoundPeers) >= s.inBoundLi
+}
+
+// AddOutPeer adds a peer to the outbound peer map.
+func (s *state) AddOutPeer(peer p2p.Peer) error {
+	return s.addPeer(s.outBoundPeers, s.outBoundLi, peer, errExceedOutBoundLimit)
+}
+
+// RemoveOutPeer removes a peer from the outbound peer map.
+func (s *state) RemoveOutPeer(peer p2p.Peer) {
+	s.removePeer(s.outBoundPeers, peer)
+}
+
+// AddInPeer adds a peer to the inbound peer map.
+func (s *state) AddInPeer(peer p2p.Peer) error {
+	return s.addPeer(s.inBoundPeers, s.inBoundLi, peer, errExceedInBoundLimit)
+}
+
+// RemoveInPeer removes a peer from the inbound peer map.
+func (s *state) RemoveInPeer(peer p2p.Peer) {
+	s.removePeer(s.inBoundPeers, peer)
+}
+
+func (s *state) addPeer(peers map[string]p2p.Peer, limit int, peer p2p.Peer, errLimit error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := peerKey(peer)
+	if s.hasPeer(key) {
+		return errAlreadyConnected
+	}
+	if len(peers) >= limit {
+		return errLimit
+	}
+	peers[key] = peer
+	return nil
+}
+
+// removePeer only removes the given peer, not another connection which
+// happens to be tracked under the same key.
+func (s *state) removePeer(peers map[string]p2p.Peer, peer p2p.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := peerKey(peer)
+	if peers[key] == peer {
+		delete(peers, key)
+	}
+}
+
+func copyPeers(peers map[string]p2p.Peer) map[string]p2p.Peer {
+	cpy := make(map[string]p2p.Peer, len(peers))
+	for key, p := range peers {
+		cpy[key] = p
+	}
+	return cpy
+}
@@ -1,176 +1,363 @@
 package transport
 
-// import (
-// 	"context"
-// 	"errors"
-// 	"fmt"
-// 	"net"
-// 	"sync"
-
-// 	"github.com/wang900115/LCA/did"
-// 	"github.com/wang900115/LCA/p2p"
-// 	"github.com/wang900115/LCA/p2p/network"
-// 	"github.com/wang900115/LCA/p2p/node"
-// )
-
-// // TCPTransportOpts holds configuration options for the TCPTransport.
-// type TCPTransportOpts struct {
-// 	ListenAddr string
-// 	HandShake  func(p2p.Peer) error
-// 	InBoundLi  int
-// 	OutBoundLi int
-// }
-
-// // TCPTransport implements a TCP-based transport layer for P2P communication.
-// type TCPTransport struct {
-// 	TCPTransportOpts
-// 	listener net.Listener
-// 	State    *state
-// }
-
-// // NewTCPTransport creates a new TCPTransport with the given options.
-// func NewTCPTransport(opts TCPTransportOpts) p2p.Transport {
-// 	return &TCPTransport{
-// 		TCPTransportOpts: opts,
-// 		State:            NewState(opts.OutBoundLi, opts.InBoundLi),
-// 	}
-// }
-
-// // Addr is dial caller address
-// func (t *TCPTransport) Addr() string {
-// 	if t.listener != nil {
-// 		return t.listener.Addr().String()
-// 	}
-// 	return t.ListenAddr
-// }
-
-// // Close shuts down the TCP listener.
-// func (t *TCPTransport) Close() error {
-// 	return t.listener.Close()
-// }
-
-// // Dial connects to a remote TCP address and starts handling the connection.
-// func (t *TCPTransport) Dial(ctx context.Context, addr string) error {
-// 	conn, err := net.Dial("tcp", addr)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	go t.handleConn(ctx, did.VerifierConfig{}, conn, true)
-// 	return nil
-// }
-
-// // Listen starts the TCP listener and begins accepting incoming connections.
-// func (t *TCPTransport) Listen(ctx context.Context) error {
-// 	var err error
-// 	t.listener, err = net.Listen("tcp", t.ListenAddr)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	go t.startAcceptLoop(ctx)
-// 	return nil
-// }
-
-// // startAcceptLoop continuously accepts incoming connections.
-// func (t *TCPTransport) startAcceptLoop(ctx context.Context) {
-// 	for {
-// 		conn, err := t.listener.Accept()
-// 		if errors.Is(err, net.ErrClosed) {
-// 			return
-// 		}
-// 		if err != nil {
-// 			fmt.Printf("TCP accept error: %s\n", err)
-// 		}
-// 		go t.handleConn(ctx, did.VerifierConfig{}, conn, false)
-// 	}
-// }
-
-// // handleConn performs the handshake and processes incoming packets for a connection.
-// func (t *TCPTransport) handleConn(ctx context.Context, config did.VerifierConfig, conn net.Conn, outBound bool) {
-// 	if t.hasPeer(conn.RemoteAddr().String()) {
-// 		return
-// 	}
-// 	peer := node.NewPeer(conn, nil, config, network.TCPProtocol, 5, 5)
-// 	if t.HandShake != nil {
-// 		if err := t.HandShake(peer); err != nil {
-// 			peer.Close()
-// 			return
-// 		}
-// 	}
-// 	if outBound {
-// 		if err := t.AddOutPeer(peer); err != nil {
-// 			peer.Close()
-// 			return
-// 		}
-// 	} else {
-// 		if err := t.AddInPeer(peer); err != nil {
-// 			peer.Close()
-// 			return
-// 		}
-// 	}
-// 	go func() {
-// 		var wg sync.WaitGroup
-// 		wg.Add(2)
-// 		go func() { defer wg.Done(); peer.ReadPump(ctx) }()
-// 		go func() { defer wg.Done(); peer.WritePump(ctx) }()
-// 		wg.Wait()
-// 		if outBound {
-// 			t.RemoveOutPeer(peer)
-// 		} else {
-// 			t.RemoveInPeer(peer)
-// 		}
-// 		peer.Close()
-// 	}()
-// }
-
-// // Add peer to the outbound peer map.
-// func (t *TCPTransport) AddOutPeer(peer p2p.Peer) error {
-// 	err := t.State.AddOutPeer(peer)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	t.State.IncOutBound()
-// 	return nil
-// }
-
-// // Add peer to the inbound peer map.
-// func (t *TCPTransport) AddInPeer(peer p2p.Peer) error {
-// 	err := t.State.AddInPeer(peer)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	t.State.IncInBound()
-// 	return nil
-// }
-
-// // Remove peer from the outbound peer map.
-// func (t *TCPTransport) RemoveOutPeer(peer p2p.Peer) {
-// 	t.State.RemoveOutPeer(peer)
-// 	t.State.DecOutBound()
-// }
-
-// // Remove peer from the inbound peer map.
-// func (t *TCPTransport) RemoveInPeer(peer p2p.Peer) {
-// 	t.State.RemoveInPeer(peer)
-// 	t.State.DecInBound()
-// }
-
-// // Including IN/OUT bounds peer
-// func (t *TCPTransport) Peers() map[string]p2p.Peer {
-// 	combined := make(map[string]p2p.Peer)
-
-// 	for addr, p := range t.State.OutPeers() {
-// 		combined[addr] = p
-// 	}
-// 	for addr, p := range t.State.InPeers() {
-// 		combined[addr] = p
-// 	}
-// 	return combined
-// }
-
-// // Existing peer in peerstable
-// func (t *TCPTransport) hasPeer(addr string) bool {
-// 	if _, exist := t.Peers()[addr]; exist {
-// 		return true
-// 	}
-// 	return false
-// }
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/p2p/node"
+)
+
+const (
+	defaultHandShakeTimeout = 5 * time.Second
+
+	// Delay before accepting again after a temporary accept error
+	acceptRetryDelay = 50 * time.Millisecond
+)
+
+var (
+	ErrTransportClosed  = errors.New("transport closed")
+	errAlreadyListening = errors.New("transport already listening")
+	errHandshakeAborted = errors.New("handshake aborted")
+)
+
+// TCPTransportOpts holds configuration options for the TCPTransport.
+type TCPTransportOpts struct {
+	ListenAddr string
+	// HandShake authenticates new connections, usually p2p.NewDIDHandshake
+	// with Identity and Verifier. Connections are not authenticated when nil.
+	HandShake p2p.HandShakeFunc
+	// Identity is the local identity presented to peers, a new one is
+	// generated when nil.
+	Identity did.IdentifierDID
+	// Verifier checks the identity of remote peers, defaults to
+	// did.NewDefaultDIDVerifier.
+	Verifier did.VerifierDID
+	// HandShakeTimeout bounds the handshake of every connection, defaults to
+	// 5 seconds.
+	HandShakeTimeout time.Duration
+	// HeartbeatInterval and MaxMissedHeartbeats tune the liveness check of
+	// every peer, zero values select the node defaults.
+	HeartbeatInterval   time.Duration
+	MaxMissedHeartbeats int
+	// Observer is told about connecting and disconnecting peers and may
+	// reject them, usually a peer manager.
+	Observer   p2p.PeerObserver
+	InBoundLi  int
+	OutBoundLi int
+}
+
+// TCPTransport implements a TCP-based transport layer for P2P communication.
+type TCPTransport struct {
+	TCPTransportOpts
+	State *state
+
+	mu       sync.Mutex // Protects listener and closed
+	listener net.Listener
+	closed   bool
+
+	ctx    context.Context // Lifetime of the peers, cancelled on Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewTCPTransport creates a new TCPTransport with the given options.
+func NewTCPTransport(opts TCPTransportOpts) p2p.Transport {
+	if opts.Identity == nil {
+		opts.Identity = did.NewDIDIdentifier(nil)
+	}
+	if opts.Verifier == nil {
+		opts.Verifier = did.NewDefaultDIDVerifier()
+	}
+	if opts.HandShakeTimeout <= 0 {
+		opts.HandShakeTimeout = defaultHandShakeTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TCPTransport{
+		TCPTransportOpts: opts,
+		State:            NewState(opts.OutBoundLi, opts.InBoundLi),
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+}
+
+// Addr returns the address the transport listens on, or the configured
+// address before Listen.
+func (t *TCPTransport) Addr() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.listener != nil {
+		return t.listener.Addr().String()
+	}
+	return t.ListenAddr
+}
+
+// Close stops the listener, disconnects every peer and waits until all
+// connection goroutines returned. Closing twice is a no-op.
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	listener := t.listener
+	t.mu.Unlock()
+
+	t.cancel()
+	var err error
+	if listener != nil {
+		if cerr := listener.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+			err = cerr
+		}
+	}
+	for _, peer := range t.Peers() {
+		peer.Close()
+	}
+	t.wg.Wait()
+	return err
+}
+
+// Dial connects to a remote TCP address, runs the handshake and registers
+// the peer as outbound. ctx bounds the dial and the handshake; once
+// connected the peer lives until it disconnects or the transport is closed.
+func (t *TCPTransport) Dial(ctx context.Context, addr string) error {
+	if t.isClosed() {
+		return ErrTransportClosed
+	}
+	// Avoid connecting at all if the connection would be rejected anyway
+	if t.State.OutBoundFull() {
+		return errExceedOutBoundLimit
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return t.handleConn(ctx, conn, true)
+}
+
+// Listen starts the TCP listener and begins accepting incoming connections.
+// Accepting stops when ctx is cancelled or the transport is closed.
+func (t *TCPTransport) Listen(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return ErrTransportClosed
+	}
+	if t.listener != nil {
+		return errAlreadyListening
+	}
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", t.ListenAddr)
+	if err != nil {
+		return err
+	}
+	t.listener = listener
+	t.wg.Add(1)
+	go t.startAcceptLoop(ctx, listener)
+	return nil
+}
+
+// startAcceptLoop continuously accepts incoming connections.
+func (t *TCPTransport) startAcceptLoop(ctx context.Context, listener net.Listener) {
+	defer t.wg.Done()
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+				return
+			}
+			select {
+			case <-time.After(acceptRetryDelay):
+				continue
+			case <-ctx.Done():
+				return
+			case <-t.ctx.Done():
+				return
+			}
+		}
+		// Drop the connection before the handshake if there is no room
+		if t.State.InBoundFull() {
+			conn.Close()
+			continue
+		}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.handleConn(ctx, conn, false)
+		}()
+	}
+}
+
+// handleConn performs the handshake on a new connection and registers the
+// peer. On success the packet pumps and the heartbeat run in the background
+// until the peer disconnects.
+func (t *TCPTransport) handleConn(ctx context.Context, conn net.Conn, outBound bool) error {
+	peer := node.NewPeer(conn, t.Identity, t.Verifier, network.TCPProtocol).(*node.Peer)
+	peer.HeartbeatInterval = t.HeartbeatInterval
+	peer.MaxMissedHeartbeats = t.MaxMissedHeartbeats
+	if err := t.admit(peer, outBound); err != nil {
+		peer.Close()
+		return err
+	}
+	if err := t.handshake(ctx, peer); err != nil {
+		peer.Close()
+		// An aborted handshake is no fault of the peer
+		if t.Observer != nil && !errors.Is(err, errHandshakeAborted) {
+			t.Observer.PeerDisconnected(peer, outBound, err)
+		}
+		return err
+	}
+	// Check again now that the peer is identified
+	err := t.admit(peer, outBound)
+	if err == nil {
+		if outBound {
+			err = t.AddOutPeer(peer)
+		} else {
+			err = t.AddInPeer(peer)
+		}
+	}
+	if err != nil {
+		peer.Close()
+		return err
+	}
+	// Register the pumps with the wait group, unless Close already started
+	// waiting on it
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		t.removePeer(peer, outBound)
+		peer.Close()
+		return ErrTransportClosed
+	}
+	t.wg.Add(1)
+	t.mu.Unlock()
+	if t.Observer != nil {
+		t.Observer.PeerConnected(peer, outBound)
+	}
+
+	go func() {
+		defer t.wg.Done()
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() { defer wg.Done(); peer.ReadPump(t.ctx) }()
+		go func() { defer wg.Done(); peer.WritePump(t.ctx) }()
+		go func() { defer wg.Done(); peer.Heartbeat(t.ctx) }()
+		wg.Wait()
+		t.removePeer(peer, outBound)
+		peer.Close()
+		if t.Observer != nil {
+			t.Observer.PeerDisconnected(peer, outBound, peer.Err())
+		}
+	}()
+	return nil
+}
+
+// admit asks the observer whether to accept peer.
+func (t *TCPTransport) admit(peer p2p.Peer, outBound bool) error {
+	if t.Observer == nil {
+		return nil
+	}
+	return t.Observer.AdmitPeer(peer, outBound)
+}
+
+// handshake runs the configured handshake, aborting it through the
+// connection deadline once ctx is done, the timeout expired or the
+// transport is closed.
+func (t *TCPTransport) handshake(ctx context.Context, peer p2p.Peer) error {
+	if t.HandShake == nil {
+		return nil
+	}
+	t.State.IncHandShake()
+	defer t.State.DecHandShake()
+
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, t.HandShakeTimeout)
+	defer cancel()
+	stopClose := context.AfterFunc(t.ctx, cancel)
+	defer stopClose()
+
+	// Expire the connection from the context, so an aborted handshake always
+	// finds ctx done
+	stop := context.AfterFunc(ctx, func() { peer.SetDeadline(time.Unix(1, 0)) })
+	err := t.HandShake(peer)
+	stop()
+	if err != nil {
+		// Report why the handshake was cut short instead of the i/o timeout
+		switch {
+		case t.ctx.Err() != nil:
+			return fmt.Errorf("%w: %w", errHandshakeAborted, ErrTransportClosed)
+		case parent.Err() != nil:
+			return fmt.Errorf("%w: %w", errHandshakeAborted, context.Cause(parent))
+		case ctx.Err() != nil:
+			return fmt.Errorf("%w: %w", p2p.DiscReadTimeout, context.Cause(ctx))
+		}
+		return err
+	}
+	return peer.SetDeadline(time.Time{})
+}
+
+// Add peer to the outbound peer map.
+func (t *TCPTransport) AddOutPeer(peer p2p.Peer) error {
+	return t.State.AddOutPeer(peer)
+}
+
+// Add peer to the inbound peer map.
+func (t *TCPTransport) AddInPeer(peer p2p.Peer) error {
+	return t.State.AddInPeer(peer)
+}
+
+// Remove peer from the outbound peer map.
+func (t *TCPTransport) RemoveOutPeer(peer p2p.Peer) {
+	t.State.RemoveOutPeer(peer)
+}
+
+// Remove peer from the inbound peer map.
+func (t *TCPTransport) RemoveInPeer(peer p2p.Peer) {
+	t.State.RemoveInPeer(peer)
+}
+
+func (t *TCPTransport) removePeer(peer p2p.Peer, outBound bool) {
+	if outBound {
+		t.RemoveOutPeer(peer)
+	} else {
+		t.RemoveInPeer(peer)
+	}
+}
+
+// Including IN/OUT bounds peer, keyed by DID
+func (t *TCPTransport) Peers() map[string]p2p.Peer {
+	combined := t.State.OutPeers()
+	for key, p := range t.State.InPeers() {
+		combined[key] = p
+	}
+	return combined
+}
+
+// PeersInfo returns the state of every connected peer, sorted by DID.
+func (t *TCPTransport) PeersInfo() []*p2p.PeerInfo {
+	peers := t.Peers()
+	infos := make([]*p2p.PeerInfo, 0, len(peers))
+	for _, peer := range peers {
+		infos = append(infos, peer.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func (t *TCPTransport) isClosed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
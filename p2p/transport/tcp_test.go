@@ -1,350 +1,514 @@
 package transport
 
-// import (
-// 	"context"
-// 	"errors"
-// 	"net"
-// 	"sync"
-// 	"testing"
-// 	"time"
-
-// 	"github.com/wang900115/LCA/did"
-// 	"github.com/wang900115/LCA/p2p"
-// 	"github.com/wang900115/LCA/p2p/network"
-// 	"github.com/wang900115/LCA/p2p/node"
-// )
-
-// var sameConfig = did.VerifierConfig{}
-
-// func TestNewTCPTransport(t *testing.T) {
-// 	opts := TCPTransportOpts{
-// 		ListenAddr: ":0",
-// 		HandShake:  nil,
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-
-// 	transport := NewTCPTransport(opts)
-// 	tcpTransport := transport.(*TCPTransport)
-
-// 	if tcpTransport.ListenAddr != opts.ListenAddr {
-// 		t.Errorf("Expected ListenAddr %s, got %s", opts.ListenAddr, tcpTransport.ListenAddr)
-// 	}
-// 	if tcpTransport.State == nil {
-// 		t.Error("Expected State to be initialized")
-// 	}
-// }
-
-// func TestTCPTransport_Addr(t *testing.T) {
-// 	opts := TCPTransportOpts{
-// 		ListenAddr: "localhost:8080",
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-
-// 	transport := NewTCPTransport(opts).(*TCPTransport)
-
-// 	if transport.Addr() != "localhost:8080" {
-// 		t.Errorf("Expected address localhost:8080, got %s", transport.Addr())
-// 	}
-// }
-
-// func TestTCPTransport_ListenAndClose(t *testing.T) {
-// 	opts := TCPTransportOpts{
-// 		ListenAddr: ":0",
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-
-// 	transport := NewTCPTransport(opts).(*TCPTransport)
-// 	ctx := context.Background()
-
-// 	// Test Listen
-// 	err := transport.Listen(ctx)
-// 	if err != nil {
-// 		t.Fatalf("Failed to start listening: %v", err)
-// 	}
-
-// 	if transport.listener == nil {
-// 		t.Error("Expected listener to be set")
-// 	}
-
-// 	// Test Close
-// 	err = transport.Close()
-// 	if err != nil {
-// 		t.Errorf("Failed to close transport: %v", err)
-// 	}
-// }
-
-// func TestTCPTransport_Dial(t *testing.T) {
-// 	// Setup server transport
-// 	serverOpts := TCPTransportOpts{
-// 		ListenAddr: ":0",
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-// 	serverTransport := NewTCPTransport(serverOpts).(*TCPTransport)
-// 	ctx := context.Background()
-
-// 	err := serverTransport.Listen(ctx)
-// 	if err != nil {
-// 		t.Fatalf("Failed to start server: %v", err)
-// 	}
-// 	defer serverTransport.Close()
-
-// 	serverAddr := serverTransport.listener.Addr().String()
-
-// 	// Setup client transport
-// 	clientOpts := TCPTransportOpts{
-// 		ListenAddr: ":0",
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-// 	clientTransport := NewTCPTransport(clientOpts).(*TCPTransport)
-
-// 	// Test Dial
-// 	err = clientTransport.Dial(ctx, serverAddr)
-// 	if err != nil {
-// 		t.Errorf("Failed to dial: %v", err)
-// 	}
-
-// 	// Give some time for connection handling
-// 	time.Sleep(100 * time.Millisecond)
-// }
-
-// func TestTCPTransport_HandShake(t *testing.T) {
-// 	handshakeCalled := false
-// 	handshakeFunc := func(peer p2p.Peer) error {
-// 		handshakeCalled = true
-// 		return nil
-// 	}
-
-// 	// Setup server transport with handshake
-// 	serverOpts := TCPTransportOpts{
-// 		ListenAddr: ":0",
-// 		HandShake:  handshakeFunc,
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-// 	serverTransport := NewTCPTransport(serverOpts).(*TCPTransport)
-// 	ctx := context.Background()
-
-// 	err := serverTransport.Listen(ctx)
-// 	if err != nil {
-// 		t.Fatalf("Failed to start server: %v", err)
-// 	}
-// 	defer serverTransport.Close()
-
-// 	serverAddr := serverTransport.listener.Addr().String()
-
-// 	// Setup client transport
-// 	clientOpts := TCPTransportOpts{
-// 		ListenAddr: ":0",
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-// 	clientTransport := NewTCPTransport(clientOpts).(*TCPTransport)
-
-// 	// Dial to trigger handshake
-// 	err = clientTransport.Dial(ctx, serverAddr)
-// 	if err != nil {
-// 		t.Errorf("Failed to dial: %v", err)
-// 	}
-
-// 	// Give some time for handshake
-// 	time.Sleep(100 * time.Millisecond)
-
-// 	if !handshakeCalled {
-// 		t.Error("Expected handshake to be called")
-// 	}
-// }
-
-// func TestTCPTransport_PeerManagement(t *testing.T) {
-// 	opts := TCPTransportOpts{
-// 		ListenAddr: ":0",
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-// 	transport := NewTCPTransport(opts).(*TCPTransport)
-
-// 	// Create mock connections with different addresses
-// 	// Start two listeners to get different addresses
-// 	l1, err := net.Listen("tcp", ":0")
-// 	if err != nil {
-// 		t.Fatalf("Failed to create listener 1: %v", err)
-// 	}
-// 	defer l1.Close()
-
-// 	l2, err := net.Listen("tcp", ":0")
-// 	if err != nil {
-// 		t.Fatalf("Failed to create listener 2: %v", err)
-// 	}
-// 	defer l2.Close()
-
-// 	// Create connections to these listeners
-// 	c1, err := net.Dial("tcp", l1.Addr().String())
-// 	if err != nil {
-// 		t.Fatalf("Failed to dial listener 1: %v", err)
-// 	}
-// 	defer c1.Close()
-
-// 	c2, err := net.Dial("tcp", l2.Addr().String())
-// 	if err != nil {
-// 		t.Fatalf("Failed to dial listener 2: %v", err)
-// 	}
-// 	defer c2.Close()
-
-// 	peer1 := node.NewPeer(c1, nil, did.VerifierConfig{}, network.TCPProtocol, 1, 1)
-// 	peer2 := node.NewPeer(c2, nil, did.VerifierConfig{}, network.TCPProtocol, 1, 1)
-
-// 	// Test AddOutPeer
-// 	err = transport.AddOutPeer(peer1)
-// 	if err != nil {
-// 		t.Errorf("Failed to add outbound peer: %v", err)
-// 	}
-
-// 	// Test AddInPeer
-// 	err = transport.AddInPeer(peer2)
-// 	if err != nil {
-// 		t.Errorf("Failed to add inbound peer: %v", err)
-// 	}
-
-// 	// Test Peers()
-// 	peers := transport.Peers()
-// 	if len(peers) != 2 {
-// 		t.Errorf("Expected 2 peers, got %d", len(peers))
-// 	}
-
-// 	// Test hasPeer
-// 	if !transport.hasPeer(peer1.Addr()) {
-// 		t.Error("Expected to find peer1")
-// 	}
-// 	if !transport.hasPeer(peer2.Addr()) {
-// 		t.Error("Expected to find peer2")
-// 	}
-
-// 	// Test RemoveOutPeer
-// 	transport.RemoveOutPeer(peer1)
-// 	if transport.hasPeer(peer1.Addr()) {
-// 		t.Error("Expected peer1 to be removed")
-// 	}
-
-// 	// Test RemoveInPeer
-// 	transport.RemoveInPeer(peer2)
-// 	if transport.hasPeer(peer2.Addr()) {
-// 		t.Error("Expected peer2 to be removed")
-// 	}
-
-// 	// Test Peers() after removal
-// 	peers = transport.Peers()
-// 	if len(peers) != 0 {
-// 		t.Errorf("Expected 0 peers after removal, got %d", len(peers))
-// 	}
-// }
-
-// func TestTCPTransport_HandleConn(t *testing.T) {
-// 	opts := TCPTransportOpts{
-// 		ListenAddr: ":0",
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-// 	transport := NewTCPTransport(opts).(*TCPTransport)
-// 	ctx, cancel := context.WithCancel(context.Background())
-// 	defer cancel()
-
-// 	// Create mock connection
-// 	c1, c2 := net.Pipe()
-// 	defer c2.Close()
-
-// 	// Handle outbound connection
-// 	var wg sync.WaitGroup
-// 	wg.Add(1)
-// 	go func() {
-// 		defer wg.Done()
-// 		transport.handleConn(ctx, sameConfig, c1, true)
-// 	}()
-
-// 	// Give some time for connection handling
-// 	time.Sleep(100 * time.Millisecond)
-
-// 	// Check if peer was added
-// 	peers := transport.Peers()
-// 	if len(peers) != 1 {
-// 		t.Errorf("Expected 1 peer, got %d", len(peers))
-// 	}
-
-// 	// Close connection to trigger cleanup
-// 	c1.Close()
-// 	cancel()
-// 	wg.Wait()
-
-// 	// Give some time for cleanup
-// 	time.Sleep(100 * time.Millisecond)
-
-// 	// Check if peer was removed
-// 	peers = transport.Peers()
-// 	if len(peers) != 0 {
-// 		t.Errorf("Expected 0 peers after cleanup, got %d", len(peers))
-// 	}
-// }
-
-// // func TestTCPTransport_DuplicatePeer(t *testing.T) {
-// // 	opts := TCPTransportOpts{
-// // 		ListenAddr: ":0",
-// // 		InBoundLi:  5,
-// // 		OutBoundLi: 5,
-// // 	}
-// // 	transport := NewTCPTransport(opts).(*TCPTransport)
-// // 	ctx := context.Background()
-
-// // 	// Create mock connections with same remote address
-// // 	c1, c2 := net.Pipe()
-// // 	defer c1.Close()
-// // 	defer c2.Close()
-// // 	// Add first peer
-// // 	peer1 := node.NewPeer(c1, nil, sameConfig, network.TCPProtocol, 1, 1)
-// // 	_ = transport.AddOutPeer(peer1)
-
-// // 	// Try to handle connection with same remote address
-// // 	// This should return early due to hasPeer check
-// // 	transport.handleConn(ctx, &sameConfig, c2, false)
-
-// // 	// Should still have only 1 peer
-// // 	peers := transport.Peers()
-// // 	t.Logf("Peers count: %+v", peers)
-// // 	if len(peers) != 1 {
-// // 		t.Errorf("Expected 1 peer (duplicate should be ignored), got %d", len(peers))
-// // 	}
-// // }
-
-// func TestTCPTransport_FailedHandshake(t *testing.T) {
-// 	handshakeError := errors.New("handshake failed")
-// 	handshakeFunc := func(peer p2p.Peer) error {
-// 		return handshakeError
-// 	}
-
-// 	opts := TCPTransportOpts{
-// 		ListenAddr: ":0",
-// 		HandShake:  handshakeFunc,
-// 		InBoundLi:  5,
-// 		OutBoundLi: 5,
-// 	}
-// 	transport := NewTCPTransport(opts).(*TCPTransport)
-// 	ctx := context.Background()
-
-// 	// Create mock connection
-// 	c1, c2 := net.Pipe()
-// 	defer c2.Close()
-
-// 	// Handle connection - should fail at handshake
-// 	transport.handleConn(ctx, sameConfig, c1, true)
-
-// 	// Give some time for processing
-// 	time.Sleep(100 * time.Millisecond)
-
-// 	// Should have no peers due to failed handshake
-// 	peers := transport.Peers()
-// 	if len(peers) != 0 {
-// 		t.Errorf("Expected 0 peers due to failed handshake, got %d", len(peers))
-// 	}
-// }
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wang900115/LCA/did"
+	"github.com/wang900115/LCA/p2p"
+	common "github.com/wang900115/LCA/p2p/com"
+	"github.com/wang900115/LCA/p2p/network"
+	"github.com/wang900115/LCA/p2p/node"
+)
+
+func newTestTransport(t *testing.T, opts TCPTransportOpts) *TCPTransport {
+	t.Helper()
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = "127.0.0.1:0"
+	}
+	transport := NewTCPTransport(opts).(*TCPTransport)
+	t.Cleanup(func() { transport.Close() })
+	return transport
+}
+
+func newTestPeer(conn net.Conn) p2p.Peer {
+	return node.NewPeer(conn, did.NewDIDIdentifier(nil), did.NewDefaultDIDVerifier(), network.TCPProtocol)
+}
+
+// waitFor polls cond until it holds or the timeout expires.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNewTCPTransport(t *testing.T) {
+	opts := TCPTransportOpts{
+		ListenAddr: ":0",
+		HandShake:  nil,
+		InBoundLi:  5,
+		OutBoundLi: 5,
+	}
+
+	transport := NewTCPTransport(opts)
+	tcpTransport := transport.(*TCPTransport)
+
+	if tcpTransport.ListenAddr != opts.ListenAddr {
+		t.Errorf("Expected ListenAddr %s, got %s", opts.ListenAddr, tcpTransport.ListenAddr)
+	}
+	if tcpTransport.State == nil {
+		t.Error("Expected State to be initialized")
+	}
+	if tcpTransport.Identity == nil || tcpTransport.Verifier == nil {
+		t.Error("Expected default identity and verifier")
+	}
+}
+
+func TestTCPTransport_Addr(t *testing.T) {
+	transport := newTestTransport(t, TCPTransportOpts{
+		ListenAddr: "localhost:8080",
+		InBoundLi:  5,
+		OutBoundLi: 5,
+	})
+
+	if transport.Addr() != "localhost:8080" {
+		t.Errorf("Expected address localhost:8080, got %s", transport.Addr())
+	}
+}
+
+func TestTCPTransport_ListenAndClose(t *testing.T) {
+	transport := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5})
+	ctx := context.Background()
+
+	if err := transport.Listen(ctx); err != nil {
+		t.Fatalf("Failed to start listening: %v", err)
+	}
+	if transport.Addr() == transport.ListenAddr {
+		t.Error("Expected Addr to report the bound address")
+	}
+	if err := transport.Listen(ctx); !errors.Is(err, errAlreadyListening) {
+		t.Errorf("Expected errAlreadyListening, got %v", err)
+	}
+	addr := transport.Addr()
+
+	if err := transport.Close(); err != nil {
+		t.Errorf("Failed to close transport: %v", err)
+	}
+	if err := transport.Close(); err != nil {
+		t.Errorf("Failed to close transport twice: %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Expected listener to be closed")
+	}
+	if err := transport.Dial(ctx, addr); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("Expected ErrTransportClosed, got %v", err)
+	}
+}
+
+func TestTCPTransport_ListenContext(t *testing.T) {
+	transport := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := transport.Listen(ctx); err != nil {
+		t.Fatalf("Failed to start listening: %v", err)
+	}
+	addr := transport.Addr()
+	cancel()
+	// Cancelling the listen context stops accepting connections
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		return false
+	})
+}
+
+func TestTCPTransport_Dial(t *testing.T) {
+	server := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5})
+	ctx := context.Background()
+	if err := server.Listen(ctx); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5})
+
+	if err := client.Dial(ctx, server.Addr()); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	waitFor(t, func() bool {
+		_, in, _ := server.State.Count()
+		return in == 1
+	})
+	if out, _, _ := client.State.Count(); out != 1 {
+		t.Errorf("Expected 1 outbound peer, got %d", out)
+	}
+
+	// Closing the server disconnects the client
+	if err := server.Close(); err != nil {
+		t.Fatalf("Failed to close server: %v", err)
+	}
+	waitFor(t, func() bool { return len(client.Peers()) == 0 })
+}
+
+func TestTCPTransport_PeersInfo(t *testing.T) {
+	opts := TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5, HeartbeatInterval: 10 * time.Millisecond}
+	server := newTestTransport(t, opts)
+	if err := server.Listen(context.Background()); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := newTestTransport(t, opts)
+	if err := client.Dial(context.Background(), server.Addr()); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	waitFor(t, func() bool {
+		infos := client.PeersInfo()
+		return len(infos) == 1 && infos[0].RTT > 0
+	})
+	if info := client.PeersInfo()[0]; info.Addr != server.Addr() {
+		t.Errorf("Expected peer address %s, got %s", server.Addr(), info.Addr)
+	}
+}
+
+func TestTCPTransport_DialContext(t *testing.T) {
+	// A peer which never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client := newTestTransport(t, TCPTransportOpts{
+		InBoundLi:  5,
+		OutBoundLi: 5,
+		HandShake: func(peer p2p.Peer) error {
+			_, err := peer.Read(make([]byte, 1))
+			return err
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Dial(ctx, listener.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if len(client.Peers()) != 0 {
+		t.Error("Expected no peers after aborted handshake")
+	}
+}
+
+// disconnects records the errors a transport reports to its observer.
+type disconnects struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (d *disconnects) AdmitPeer(peer p2p.Peer, outBound bool) error { return nil }
+
+func (d *disconnects) PeerConnected(peer p2p.Peer, outBound bool) {}
+
+func (d *disconnects) PeerDisconnected(peer p2p.Peer, outBound bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errs = append(d.errs, err)
+}
+
+func (d *disconnects) get() []error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]error(nil), d.errs...)
+}
+
+func TestTCPTransport_HandShakeAborted(t *testing.T) {
+	// A peer which never answers the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	observer := new(disconnects)
+	client := newTestTransport(t, TCPTransportOpts{
+		InBoundLi:        5,
+		OutBoundLi:       5,
+		HandShakeTimeout: 50 * time.Millisecond,
+		HandShake: func(peer p2p.Peer) error {
+			_, err := peer.Read(make([]byte, 1))
+			return err
+		},
+		Observer: observer,
+	})
+
+	// The peer missing the handshake timeout is reported
+	err = client.Dial(context.Background(), listener.Addr().String())
+	if !errors.Is(err, p2p.DiscReadTimeout) {
+		t.Fatalf("Expected DiscReadTimeout, got %v", err)
+	}
+	if errs := observer.get(); len(errs) != 1 || !errors.Is(errs[0], p2p.DiscReadTimeout) {
+		t.Fatalf("Expected a reported timeout, got %v", errs)
+	}
+
+	// Giving up on the dial is not the fault of the peer
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = client.Dial(ctx, listener.Addr().String())
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, p2p.DiscReadTimeout) {
+		t.Fatalf("Expected an aborted handshake, got %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- client.Dial(context.Background(), listener.Addr().String()) }()
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+	if err := <-done; errors.Is(err, p2p.DiscReadTimeout) {
+		t.Fatalf("Expected an aborted handshake, got %v", err)
+	}
+	if errs := observer.get(); len(errs) != 1 {
+		t.Errorf("Expected aborted handshakes to go unreported, got %v", errs)
+	}
+}
+
+func TestTCPTransport_HandShake(t *testing.T) {
+	var handshakes atomic.Int32
+	handshakeFunc := func(peer p2p.Peer) error {
+		handshakes.Add(1)
+		return nil
+	}
+	server := newTestTransport(t, TCPTransportOpts{HandShake: handshakeFunc, InBoundLi: 5, OutBoundLi: 5})
+	ctx := context.Background()
+	if err := server.Listen(ctx); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := newTestTransport(t, TCPTransportOpts{HandShake: handshakeFunc, InBoundLi: 5, OutBoundLi: 5})
+
+	if err := client.Dial(ctx, server.Addr()); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	waitFor(t, func() bool { return handshakes.Load() == 2 })
+}
+
+func TestTCPTransport_InBoundLimit(t *testing.T) {
+	server := newTestTransport(t, TCPTransportOpts{InBoundLi: 1, OutBoundLi: 5})
+	ctx := context.Background()
+	if err := server.Listen(ctx); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	first := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5})
+	if err := first.Dial(ctx, server.Addr()); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	waitFor(t, func() bool { return len(server.Peers()) == 1 })
+
+	// The server drops the second connection, which the client notices
+	second := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5})
+	if err := second.Dial(ctx, server.Addr()); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	waitFor(t, func() bool { return len(second.Peers()) == 0 })
+	if _, in, _ := server.State.Count(); in != 1 {
+		t.Errorf("Expected 1 inbound peer, got %d", in)
+	}
+}
+
+func TestTCPTransport_OutBoundLimit(t *testing.T) {
+	server := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5})
+	ctx := context.Background()
+	if err := server.Listen(ctx); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 1})
+	if err := client.Dial(ctx, server.Addr()); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	if err := client.Dial(ctx, server.Addr()); !errors.Is(err, errExceedOutBoundLimit) {
+		t.Errorf("Expected errExceedOutBoundLimit, got %v", err)
+	}
+}
+
+func TestTCPTransport_DuplicateDID(t *testing.T) {
+	// Every connection identifies as the same remote node
+	remote := did.NewDIDIdentifier(nil).Document()
+	identify := func(peer p2p.Peer) error {
+		peer.SetDocument(remote)
+		return nil
+	}
+	server := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5})
+	ctx := context.Background()
+	if err := server.Listen(ctx); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	client := newTestTransport(t, TCPTransportOpts{HandShake: identify, InBoundLi: 5, OutBoundLi: 5})
+
+	if err := client.Dial(ctx, server.Addr()); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	// A second connection from a different local port is still a duplicate
+	if err := client.Dial(ctx, server.Addr()); !errors.Is(err, errAlreadyConnected) {
+		t.Errorf("Expected errAlreadyConnected, got %v", err)
+	}
+	peers := client.Peers()
+	if len(peers) != 1 || peers[remote.ID] == nil {
+		t.Errorf("Expected a single peer keyed by DID, got %v", peers)
+	}
+	if !client.State.HasPeer(remote.ID) {
+		t.Error("Expected to find peer by DID")
+	}
+}
+
+func TestTCPTransport_PeerManagement(t *testing.T) {
+	transport := newTestTransport(t, TCPTransportOpts{InBoundLi: 1, OutBoundLi: 1})
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	peer1 := newTestPeer(c1)
+	peer1.SetDocument(did.NewDIDIdentifier(nil).Document())
+	peer2 := newTestPeer(c2)
+	peer2.SetDocument(did.NewDIDIdentifier(nil).Document())
+
+	if err := transport.AddOutPeer(peer1); err != nil {
+		t.Errorf("Failed to add outbound peer: %v", err)
+	}
+	if err := transport.AddInPeer(peer2); err != nil {
+		t.Errorf("Failed to add inbound peer: %v", err)
+	}
+	if err := transport.AddInPeer(peer1); !errors.Is(err, errAlreadyConnected) {
+		t.Errorf("Expected errAlreadyConnected, got %v", err)
+	}
+	extra := newTestPeer(nil)
+	extra.SetDocument(did.NewDIDIdentifier(nil).Document())
+	if err := transport.AddOutPeer(extra); !errors.Is(err, errExceedOutBoundLimit) {
+		t.Errorf("Expected errExceedOutBoundLimit, got %v", err)
+	}
+	if err := transport.AddInPeer(extra); !errors.Is(err, errExceedInBoundLimit) {
+		t.Errorf("Expected errExceedInBoundLimit, got %v", err)
+	}
+
+	peers := transport.Peers()
+	if len(peers) != 2 {
+		t.Errorf("Expected 2 peers, got %d", len(peers))
+	}
+	if !transport.State.HasPeer(peer1.ID()) {
+		t.Error("Expected to find peer1")
+	}
+	if !transport.State.HasPeer(peer2.ID()) {
+		t.Error("Expected to find peer2")
+	}
+
+	transport.RemoveOutPeer(peer1)
+	if transport.State.HasPeer(peer1.ID()) {
+		t.Error("Expected peer1 to be removed")
+	}
+	transport.RemoveInPeer(peer2)
+	if transport.State.HasPeer(peer2.ID()) {
+		t.Error("Expected peer2 to be removed")
+	}
+	if peers = transport.Peers(); len(peers) != 0 {
+		t.Errorf("Expected 0 peers after removal, got %d", len(peers))
+	}
+}
+
+func TestTCPTransport_HandleConn(t *testing.T) {
+	transport := newTestTransport(t, TCPTransportOpts{InBoundLi: 5, OutBoundLi: 5})
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	if err := transport.handleConn(context.Background(), c1, true); err != nil {
+		t.Fatalf("Failed to handle connection: %v", err)
+	}
+	if peers := transport.Peers(); len(peers) != 1 {
+		t.Errorf("Expected 1 peer, got %d", len(peers))
+	}
+
+	// Closing the remote end triggers the cleanup
+	c2.Close()
+	waitFor(t, func() bool { return len(transport.Peers()) == 0 })
+}
+
+func TestTCPTransport_FailedHandshake(t *testing.T) {
+	handshakeError := errors.New("handshake failed")
+	transport := newTestTransport(t, TCPTransportOpts{
+		HandShake:  func(peer p2p.Peer) error { return handshakeError },
+		InBoundLi:  5,
+		OutBoundLi: 5,
+	})
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	if err := transport.handleConn(context.Background(), c1, true); !errors.Is(err, handshakeError) {
+		t.Errorf("Expected handshake error, got %v", err)
+	}
+	if peers := transport.Peers(); len(peers) != 0 {
+		t.Errorf("Expected 0 peers due to failed handshake, got %d", len(peers))
+	}
+	// The connection was closed
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected connection to be closed")
+	}
+}
+
+func newDIDTransport(t *testing.T) *TCPTransport {
+	identity := did.NewDIDIdentifier(nil)
+	verifier := did.NewDefaultDIDVerifier()
+	return newTestTransport(t, TCPTransportOpts{
+		Identity:   identity,
+		Verifier:   verifier,
+		HandShake:  p2p.NewDIDHandshake(identity, verifier),
+		InBoundLi:  5,
+		OutBoundLi: 5,
+	})
+}
+
+func TestTCPTransport_DIDHandshake(t *testing.T) {
+	server, client := newDIDTransport(t), newDIDTransport(t)
+	ctx := context.Background()
+	if err := server.Listen(ctx); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+
+	if err := client.Dial(ctx, server.Addr()); err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	serverID, clientID := server.Identity.Document().ID, client.Identity.Document().ID
+	waitFor(t, func() bool { return server.State.HasPeer(clientID) })
+	if !client.State.HasPeer(serverID) {
+		t.Error("Expected client to know the server DID")
+	}
+	if secret := client.Peers()[serverID].Secret(); len(secret) != 32 {
+		t.Errorf("Expected session secret, got %x", secret)
+	}
+
+	// Packets travel over the encrypted session
+	msg, err := network.NewMessageContent(common.PUBLIC, []byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc, err := network.NewRPCContent(msg, client.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := network.NewPacket(common.MESSAGESEND, rpc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Peers()[serverID].Send(pkt); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	ch, _ := server.Peers()[clientID].Receive()
+	select {
+	case received := <-ch:
+		if received.GetCommand() != common.MESSAGESEND || received.Check() != nil {
+			t.Errorf("Unexpected packet %v", received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for packet")
+	}
+
+	// Dialing the same node again, or ourselves, is rejected
+	if err := client.Dial(ctx, server.Addr()); p2p.DiscReasonForError(err) != p2p.DiscAlreadyConnected {
+		t.Errorf("Expected DiscAlreadyConnected, got %v", err)
+	}
+	if err := server.Dial(ctx, server.Addr()); p2p.DiscReasonForError(err) != p2p.DiscSelf {
+		t.Errorf("Expected DiscSelf, got %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package store
 
+// Batch is a write-only database that commits changes to its host database
+// when Write is called. A batch cannot be used concurrently.
 type Batch interface {
 	KeyValueWriter
 	KeyValueRanger
@@ -13,8 +15,12 @@ type Batch interface {
 	Replay(w KeyValueWriter) error
 }
 
+// Batcher wraps the NewBatch method of a backing data store.
 type Batcher interface {
+	// NewBatch creates a write-only database that buffers changes to its host db
+	// until a final write is called.
 	NewBatch() Batch
+	// NewBatchWithSize creates a write-only database batch with pre-allocated buffer.
 	NewBatchWithSize(size int) Batch
 }
 
@@ -0,0 +1,675 @@
+// Package cryptdb implements a store.KeyValueStore decorator which encrypts
+// values at rest with AES-GCM and can hide keys behind an HMAC.
+//
+// Every stored value is laid out as
+//
+//	version(1) | nonce(12) | ciphertext | tag(16)
+//
+// where version names the master key the value was sealed with. The stored
+// key is authenticated along with the value, so values cannot be swapped
+// between keys. Master keys can be rotated by adding a new version, making it
+// the active one and running Reencrypt in the background.
+package cryptdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	crypto "github.com/wang900115/LCA/crypt"
+	"github.com/wang900115/LCA/store"
+)
+
+// Ensure CryptDBStore implements store.KeyValueStore interface
+var _ store.KeyValueStore = (*CryptDBStore)(nil)
+
+const (
+	// minMasterKeySize is the shortest master key accepted.
+	minMasterKeySize = 16
+
+	// reencryptBatchSize is the number of values Reencrypt rewrites per batch.
+	reencryptBatchSize = 256
+)
+
+var (
+	// HKDF info strings separating the keys derived from one master key.
+	valueKeyInfo = []byte("lca cryptdb value key")
+	macKeyInfo   = []byte("lca cryptdb key mac")
+
+	errNoMasterKey       = errors.New("cryptdb: no master key for the active version")
+	errShortMasterKey    = fmt.Errorf("cryptdb: master keys must be at least %d bytes", minMasterKeySize)
+	errUnknownKeyVersion = errors.New("unknown key version")
+	errMalformedValue    = errors.New("malformed value")
+)
+
+// IntegrityError is returned when a stored value fails authentication, was
+// sealed with an unknown key version or does not decode. It matches
+// store.ErrCorrupted with errors.Is.
+type IntegrityError struct {
+	Key     []byte // Key the value was stored under, as seen by the underlying store
+	Version byte   // Key version recorded in the value
+	Err     error  // Underlying failure
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("cryptdb: integrity check failed for key %x (version %d): %v", e.Key, e.Version, e.Err)
+}
+
+func (e *IntegrityError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports store.ErrCorrupted as a match, so callers not interested in the
+// details can treat integrity failures like any other corruption.
+func (e *IntegrityError) Is(target error) bool {
+	return target == store.ErrCorrupted
+}
+
+// Config holds the key material of an encrypted store.
+type Config struct {
+	// Keys holds the master keys by version. Values can be read as long as
+	// the master key they were written with is present.
+	Keys map[byte][]byte
+	// Version selects the master key new values are encrypted with.
+	Version byte
+	// KeySecret, when set, stores every key as its HMAC-SHA256 instead of in
+	// plain. It cannot be rotated, since that would move every entry. Ranged
+	// operations and iterators then have to read the whole underlying store.
+	KeySecret []byte
+}
+
+// CryptDBStore encrypts the values, and optionally hashes the keys, of an
+// underlying key-value store.
+type CryptDBStore struct {
+	db      store.KeyValueStore
+	keys    map[byte][]byte // Value keys derived from the master keys, by version
+	version byte            // Version new values are encrypted with
+	macKey  []byte          // Key hashing secret, nil when keys are stored in plain
+
+	// lock is held for reading by every write and exclusively while Reencrypt
+	// commits, so a rewrite never clobbers a concurrent update.
+	lock sync.RWMutex
+}
+
+// NewCryptDBStore wraps db so that every value is encrypted before it reaches
+// it. The wrapper takes ownership of db and closes it on Close. Every entry of
+// db is expected to be written through the wrapper, use a store.NewTable to
+// share a database with plaintext data.
+func NewCryptDBStore(db store.KeyValueStore, config Config) (*CryptDBStore, error) {
+	if _, ok := config.Keys[config.Version]; !ok {
+		return nil, errNoMasterKey
+	}
+	c := &CryptDBStore{
+		db:      db,
+		keys:    make(map[byte][]byte, len(config.Keys)),
+		version: config.Version,
+	}
+	for version, master := range config.Keys {
+		if len(master) < minMasterKeySize {
+			return nil, errShortMasterKey
+		}
+		key, err := crypto.DeriveKey(master, nil, valueKeyInfo)
+		if err != nil {
+			return nil, err
+		}
+		c.keys[version] = key
+	}
+	if config.KeySecret != nil {
+		if len(config.KeySecret) < minMasterKeySize {
+			return nil, errShortMasterKey
+		}
+		key, err := crypto.DeriveKey(config.KeySecret, nil, macKeyInfo)
+		if err != nil {
+			return nil, err
+		}
+		c.macKey = key
+	}
+	return c, nil
+}
+
+// Has checks if the given key exists in the store.
+func (db *CryptDBStore) Has(key []byte) (bool, error) {
+	return db.db.Has(db.storedKey(key))
+}
+
+// Get retrieves and decrypts the value associated with the given key.
+func (db *CryptDBStore) Get(key []byte) ([]byte, error) {
+	stored := db.storedKey(key)
+	raw, err := db.db.Get(stored)
+	if err != nil {
+		return nil, err
+	}
+	_, value, err := db.decrypt(stored, raw)
+	return value, err
+}
+
+// Put encrypts the value and stores it under the given key.
+func (db *CryptDBStore) Put(key []byte, value []byte) error {
+	stored := db.storedKey(key)
+	raw, err := db.encrypt(stored, key, value)
+	if err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.db.Put(stored, raw)
+}
+
+// Delete removes the key-value pair associated with the given key.
+func (db *CryptDBStore) Delete(key []byte) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.db.Delete(db.storedKey(key))
+}
+
+// InsertRange overwrites every existing key within [startKey, endKey) with the
+// given value. Each key gets its own ciphertext, so the range is resolved and
+// written as a single batch.
+func (db *CryptDBStore) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	b := db.NewBatch()
+	if err := b.InsertRange(startKey, endKey, value); err != nil {
+		return err
+	}
+	return b.Write()
+}
+
+// DeleteRange removes all keys within [startKey, endKey). A nil endKey means
+// the range is unbounded.
+func (db *CryptDBStore) DeleteRange(startKey []byte, endKey []byte) error {
+	if db.macKey == nil {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+		return db.db.DeleteRange(startKey, endKey)
+	}
+	b := db.NewBatch()
+	if err := b.DeleteRange(startKey, endKey); err != nil {
+		return err
+	}
+	return b.Write()
+}
+
+// Stat returns the statistics of the underlying store.
+func (db *CryptDBStore) Stat() (map[string]interface{}, error) {
+	return db.db.Stat()
+}
+
+// Sync flushes the underlying store.
+func (db *CryptDBStore) Sync() error {
+	return db.db.Sync()
+}
+
+// Compact flattens the underlying store for the given key range. Hashed keys
+// have no locality, so the whole store is compacted in that case.
+func (db *CryptDBStore) Compact(startKey []byte, endKey []byte) error {
+	if db.macKey != nil {
+		return db.db.Compact(nil, nil)
+	}
+	return db.db.Compact(startKey, endKey)
+}
+
+// NewBatch creates a write-only batch that encrypts values as they are added.
+func (db *CryptDBStore) NewBatch() store.Batch {
+	return &batch{db: db, b: db.db.NewBatch()}
+}
+
+// NewBatchWithSize creates a write-only batch with a pre-allocated buffer.
+func (db *CryptDBStore) NewBatchWithSize(size int) store.Batch {
+	return &batch{db: db, b: db.db.NewBatchWithSize(size)}
+}
+
+// NewIterator creates an iterator over the keys with the given prefix,
+// starting at prefix+start, decrypting values as it goes. With hashed keys
+// the matching entries are collected and sorted up front.
+func (db *CryptDBStore) NewIterator(prefix []byte, start []byte) (store.Iterator, error) {
+	if db.macKey != nil {
+		entries, err := db.scan(prefix, start, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &sliceIterator{entries: entries, index: -1}, nil
+	}
+	it, err := db.db.NewIterator(prefix, start)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{db: db, it: it}, nil
+}
+
+// NewSnapshot creates a snapshot of the underlying store which decrypts the
+// values read through it.
+func (db *CryptDBStore) NewSnapshot() (store.Snapshot, error) {
+	snap, err := db.db.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{db: db, snap: snap}, nil
+}
+
+// Close closes the underlying store.
+func (db *CryptDBStore) Close() error {
+	return db.db.Close()
+}
+
+// Reencrypt rewrites every value that was not sealed with the active key
+// version and returns how many were rewritten. It is meant to run in the
+// background after a key rotation; it can be interrupted through ctx and
+// restarted at any time, and never overwrites values written concurrently.
+func (db *CryptDBStore) Reencrypt(ctx context.Context) (int, error) {
+	it, err := db.db.NewIterator(nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Release()
+
+	var (
+		rewritten int
+		stale     []entry
+	)
+	for it.Next() {
+		raw := it.Value()
+		if len(raw) > 0 && raw[0] == db.version {
+			continue
+		}
+		stale = append(stale, entry{key: bytes.Clone(it.Key()), value: bytes.Clone(raw)})
+		if len(stale) < reencryptBatchSize {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+		n, err := db.rewrite(stale)
+		rewritten += n
+		if err != nil {
+			return rewritten, err
+		}
+		stale = stale[:0]
+	}
+	if err := it.Error(); err != nil {
+		return rewritten, err
+	}
+	if err := ctx.Err(); err != nil {
+		return rewritten, err
+	}
+	n, err := db.rewrite(stale)
+	return rewritten + n, err
+}
+
+// rewrite re-encrypts the given stored entries with the active key version,
+// skipping the ones that changed since they were read.
+func (db *CryptDBStore) rewrite(stale []entry) (int, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	b := db.db.NewBatch()
+	var n int
+	for _, e := range stale {
+		current, err := db.db.Get(e.key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(current, e.value) {
+			continue
+		}
+		plain, err := db.open(e.key, current)
+		if err != nil {
+			return 0, err
+		}
+		raw, err := db.seal(e.key, plain)
+		if err != nil {
+			return 0, err
+		}
+		if err := b.Put(e.key, raw); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := b.Write(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// storedKey returns the key an entry is stored under in the underlying store.
+func (db *CryptDBStore) storedKey(key []byte) []byte {
+	if db.macKey == nil {
+		return key
+	}
+	return crypto.HMACSign(sha256.New, db.macKey, key)
+}
+
+// encrypt seals value for storage under stored. With hashed keys the original
+// key is sealed along with the value, so iterators can recover it.
+func (db *CryptDBStore) encrypt(stored, key, value []byte) ([]byte, error) {
+	plain := value
+	if db.macKey != nil {
+		plain = binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(key)+len(value)), uint64(len(key)))
+		plain = append(append(plain, key...), value...)
+	}
+	return db.seal(stored, plain)
+}
+
+// decrypt opens a value stored under stored, returning the original key and
+// value. The key is only recovered when keys are hashed, otherwise it is stored.
+func (db *CryptDBStore) decrypt(stored, raw []byte) ([]byte, []byte, error) {
+	plain, err := db.open(stored, raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if db.macKey == nil {
+		return stored, plain, nil
+	}
+	size, n := binary.Uvarint(plain)
+	if n <= 0 || uint64(len(plain)-n) < size {
+		return nil, nil, &IntegrityError{Key: stored, Version: raw[0], Err: errMalformedValue}
+	}
+	return plain[n : n+int(size)], plain[n+int(size):], nil
+}
+
+// seal encrypts plain with the active key version, authenticating stored.
+func (db *CryptDBStore) seal(stored, plain []byte) ([]byte, error) {
+	sealed, err := crypto.AESGCMEncrypt(plain, db.keys[db.version], stored)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{db.version}, sealed...), nil
+}
+
+// open authenticates and decrypts a raw stored value.
+func (db *CryptDBStore) open(stored, raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, &IntegrityError{Key: stored, Err: errMalformedValue}
+	}
+	key, ok := db.keys[raw[0]]
+	if !ok {
+		return nil, &IntegrityError{Key: stored, Version: raw[0], Err: errUnknownKeyVersion}
+	}
+	plain, err := crypto.AESGCMDecrypt(raw[1:], key, stored)
+	if err != nil {
+		return nil, &IntegrityError{Key: stored, Version: raw[0], Err: err}
+	}
+	return plain, nil
+}
+
+// entry is a key-value pair read from the store.
+type entry struct {
+	key   []byte
+	value []byte
+}
+
+// scan decrypts every entry with the given prefix whose key lies within
+// [prefix+start, end), in key order. A nil end means the range is unbounded.
+// With hashed keys the whole underlying store has to be read.
+func (db *CryptDBStore) scan(prefix, start, end []byte) ([]entry, error) {
+	var it store.Iterator
+	var err error
+	if db.macKey == nil {
+		it, err = db.db.NewIterator(prefix, start)
+	} else {
+		it, err = db.db.NewIterator(nil, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+
+	first := append(bytes.Clone(prefix), start...)
+	var entries []entry
+	for it.Next() {
+		key, value, err := db.decrypt(it.Key(), it.Value())
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(key, prefix) || bytes.Compare(key, first) < 0 {
+			continue
+		}
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			if db.macKey == nil {
+				break
+			}
+			continue
+		}
+		entries = append(entries, entry{key: bytes.Clone(key), value: value})
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	if db.macKey != nil {
+		sort.Slice(entries, func(i, j int) bool {
+			return bytes.Compare(entries[i].key, entries[j].key) < 0
+		})
+	}
+	return entries, nil
+}
+
+// keyvalue is a plaintext batch operation, kept around for Replay.
+type keyvalue struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// batch encrypts values as they are added and commits them to the underlying
+// store on Write. A batch cannot be used concurrently.
+type batch struct {
+	db     *CryptDBStore
+	b      store.Batch
+	writes []keyvalue
+}
+
+// Put encrypts the value and inserts it into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	stored := b.db.storedKey(key)
+	raw, err := b.db.encrypt(stored, key, value)
+	if err != nil {
+		return err
+	}
+	if err := b.b.Put(stored, raw); err != nil {
+		return err
+	}
+	b.writes = append(b.writes, keyvalue{key: bytes.Clone(key), value: bytes.Clone(value)})
+	return nil
+}
+
+// Delete inserts a key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	if err := b.b.Delete(b.db.storedKey(key)); err != nil {
+		return err
+	}
+	b.writes = append(b.writes, keyvalue{key: bytes.Clone(key), delete: true})
+	return nil
+}
+
+// InsertRange queues an overwrite of every key currently stored within
+// [startKey, endKey). The affected keys are resolved when the call is made.
+func (b *batch) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	entries, err := b.db.scan(nil, startKey, endKey)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := b.Put(e.key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRange queues the removal of every key currently stored or already
+// queued within [startKey, endKey). The stored keys are resolved when the
+// call is made.
+func (b *batch) DeleteRange(startKey []byte, endKey []byte) error {
+	entries, err := b.db.scan(nil, startKey, endKey)
+	if err != nil {
+		return err
+	}
+	for _, kv := range b.writes {
+		if !kv.delete && bytes.Compare(kv.key, startKey) >= 0 && (endKey == nil || bytes.Compare(kv.key, endKey) < 0) {
+			entries = append(entries, entry{key: kv.key})
+		}
+	}
+	for _, e := range entries {
+		if err := b.Delete(e.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValueSize retrieves the amount of encrypted data queued up for writing.
+func (b *batch) ValueSize() int {
+	return b.b.ValueSize()
+}
+
+// Write flushes any accumulated data to the underlying store.
+func (b *batch) Write() error {
+	b.db.lock.RLock()
+	defer b.db.lock.RUnlock()
+	return b.b.Write()
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() error {
+	b.writes = b.writes[:0]
+	return b.b.Reset()
+}
+
+// Replay replays the plaintext batch contents.
+func (b *batch) Replay(w store.KeyValueWriter) error {
+	for _, kv := range b.writes {
+		if kv.delete {
+			if err := w.Delete(kv.key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.Put(kv.key, kv.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iterator decrypts the values of an underlying iterator over plain keys.
+// A value failing authentication stops the iteration and is reported by Error.
+type iterator struct {
+	db    *CryptDBStore
+	it    store.Iterator
+	value []byte
+	valid bool
+	err   error
+}
+
+// Next moves the iterator to the next key/value pair.
+func (it *iterator) Next() bool {
+	it.valid, it.value = false, nil
+	if it.err != nil || !it.it.Next() {
+		return false
+	}
+	_, it.value, it.err = it.db.decrypt(it.it.Key(), it.it.Value())
+	it.valid = it.err == nil
+	return it.valid
+}
+
+// Error returns any accumulated error.
+func (it *iterator) Error() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.it.Error()
+}
+
+// Key returns the key of the current key/value pair, or nil if done.
+func (it *iterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.it.Key()
+}
+
+// Value returns the decrypted value of the current key/value pair, or nil if done.
+func (it *iterator) Value() []byte {
+	return it.value
+}
+
+// Release releases associated resources.
+func (it *iterator) Release() {
+	it.it.Release()
+	it.valid, it.value = false, nil
+}
+
+// sliceIterator walks over entries collected and sorted up front, used when
+// the underlying key order says nothing about the original keys.
+type sliceIterator struct {
+	entries []entry
+	index   int
+}
+
+// Next moves the iterator to the next key/value pair.
+func (it *sliceIterator) Next() bool {
+	if it.index >= len(it.entries) {
+		return false
+	}
+	it.index++
+	return it.index < len(it.entries)
+}
+
+// Error returns any accumulated error. The entries were decrypted up front,
+// so iteration itself cannot fail.
+func (it *sliceIterator) Error() error {
+	return nil
+}
+
+// Key returns the key of the current key/value pair, or nil if done.
+func (it *sliceIterator) Key() []byte {
+	if it.index < 0 || it.index >= len(it.entries) {
+		return nil
+	}
+	return it.entries[it.index].key
+}
+
+// Value returns the value of the current key/value pair, or nil if done.
+func (it *sliceIterator) Value() []byte {
+	if it.index < 0 || it.index >= len(it.entries) {
+		return nil
+	}
+	return it.entries[it.index].value
+}
+
+// Release releases associated resources.
+func (it *sliceIterator) Release() {
+	it.index, it.entries = -1, nil
+}
+
+// snapshot decrypts the values read from an underlying snapshot.
+type snapshot struct {
+	db   *CryptDBStore
+	snap store.Snapshot
+}
+
+// Has retrieves if a key was present when the snapshot was taken.
+func (s *snapshot) Has(key []byte) (bool, error) {
+	return s.snap.Has(s.db.storedKey(key))
+}
+
+// Get retrieves and decrypts the value a key held when the snapshot was taken.
+func (s *snapshot) Get(key []byte) ([]byte, error) {
+	stored := s.db.storedKey(key)
+	raw, err := s.snap.Get(stored)
+	if err != nil {
+		return nil, err
+	}
+	_, value, err := s.db.decrypt(stored, raw)
+	return value, err
+}
+
+// Release releases the underlying snapshot.
+func (s *snapshot) Release() {
+	s.snap.Release()
+}
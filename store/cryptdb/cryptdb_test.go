@@ -0,0 +1,179 @@
+package cryptdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/dbtest"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+var (
+	testKey1   = bytes.Repeat([]byte{1}, 32)
+	testKey2   = bytes.Repeat([]byte{2}, 32)
+	testSecret = bytes.Repeat([]byte{3}, 32)
+)
+
+func newTestStore(t *testing.T, db store.KeyValueStore, config Config) *CryptDBStore {
+	t.Helper()
+	c, err := NewCryptDBStore(db, config)
+	require.NoError(t, err)
+	return c
+}
+
+func TestCryptDB_Suite(t *testing.T) {
+	t.Run("PlainKeys", func(t *testing.T) {
+		dbtest.TestDatabaseSuite(t, func() store.KeyValueStore {
+			return newTestStore(t, memorydb.NewMemoryDBStore(), Config{Keys: map[byte][]byte{1: testKey1}, Version: 1})
+		})
+	})
+	t.Run("HashedKeys", func(t *testing.T) {
+		dbtest.TestDatabaseSuite(t, func() store.KeyValueStore {
+			return newTestStore(t, memorydb.NewMemoryDBStore(), Config{Keys: map[byte][]byte{1: testKey1}, Version: 1, KeySecret: testSecret})
+		})
+	})
+}
+
+func TestCryptDB_Config(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	_, err := NewCryptDBStore(db, Config{Keys: map[byte][]byte{1: testKey1}, Version: 2})
+	assert.ErrorIs(t, err, errNoMasterKey)
+	_, err = NewCryptDBStore(db, Config{Keys: map[byte][]byte{1: []byte("short")}, Version: 1})
+	assert.ErrorIs(t, err, errShortMasterKey)
+	_, err = NewCryptDBStore(db, Config{Keys: map[byte][]byte{1: testKey1}, Version: 1, KeySecret: []byte("short")})
+	assert.ErrorIs(t, err, errShortMasterKey)
+}
+
+func TestCryptDB_AtRest(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	c := newTestStore(t, db, Config{Keys: map[byte][]byte{1: testKey1}, Version: 1, KeySecret: testSecret})
+	defer c.Close()
+
+	require.NoError(t, c.Put([]byte("did:lca:alice"), []byte("private key material")))
+
+	it, err := db.NewIterator(nil, nil)
+	require.NoError(t, err)
+	defer it.Release()
+	require.True(t, it.Next())
+	assert.NotContains(t, string(it.Key()), "alice")
+	assert.NotContains(t, string(it.Value()), "private")
+	assert.Equal(t, byte(1), it.Value()[0])
+	assert.False(t, it.Next())
+}
+
+func TestCryptDB_Integrity(t *testing.T) {
+	for _, secret := range [][]byte{nil, testSecret} {
+		t.Run(fmt.Sprintf("hashed=%v", secret != nil), func(t *testing.T) {
+			db := memorydb.NewMemoryDBStore()
+			c := newTestStore(t, db, Config{Keys: map[byte][]byte{1: testKey1}, Version: 1, KeySecret: secret})
+			defer c.Close()
+
+			require.NoError(t, c.Put([]byte("a"), []byte("value a")))
+			require.NoError(t, c.Put([]byte("b"), []byte("value b")))
+
+			// Swap the stored values, each is still a valid ciphertext on its own
+			a, b := c.storedKey([]byte("a")), c.storedKey([]byte("b"))
+			rawA, err := db.Get(a)
+			require.NoError(t, err)
+			rawB, err := db.Get(b)
+			require.NoError(t, err)
+			require.NoError(t, db.Put(a, rawB))
+
+			_, err = c.Get([]byte("a"))
+			var ierr *IntegrityError
+			require.True(t, errors.As(err, &ierr))
+			assert.Equal(t, a, ierr.Key)
+			assert.ErrorIs(t, err, store.ErrCorrupted)
+
+			// Flip a bit of the ciphertext
+			rawA[len(rawA)-1] ^= 1
+			require.NoError(t, db.Put(a, rawA))
+			_, err = c.Get([]byte("a"))
+			assert.ErrorIs(t, err, store.ErrCorrupted)
+
+			// Unknown key versions are integrity failures as well
+			rawA[0] = 9
+			require.NoError(t, db.Put(a, rawA))
+			_, err = c.Get([]byte("a"))
+			assert.ErrorIs(t, err, errUnknownKeyVersion)
+			assert.ErrorIs(t, err, store.ErrCorrupted)
+
+			it, err := c.NewIterator(nil, nil)
+			if err == nil {
+				for it.Next() {
+				}
+				err = it.Error()
+				it.Release()
+			}
+			assert.ErrorIs(t, err, store.ErrCorrupted)
+		})
+	}
+}
+
+func TestCryptDB_Reencrypt(t *testing.T) {
+	for _, secret := range [][]byte{nil, testSecret} {
+		t.Run(fmt.Sprintf("hashed=%v", secret != nil), func(t *testing.T) {
+			db := memorydb.NewMemoryDBStore()
+			old := newTestStore(t, db, Config{Keys: map[byte][]byte{1: testKey1}, Version: 1, KeySecret: secret})
+			const items = reencryptBatchSize + 10
+			for i := 0; i < items; i++ {
+				require.NoError(t, old.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i))))
+			}
+
+			// Rotate to a new master key, keeping the old one around for reading
+			c := newTestStore(t, db, Config{Keys: map[byte][]byte{1: testKey1, 2: testKey2}, Version: 2, KeySecret: secret})
+			defer c.Close()
+			require.NoError(t, c.Put([]byte("key-0000"), []byte("updated")))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := c.Reencrypt(ctx)
+			assert.ErrorIs(t, err, context.Canceled)
+
+			n, err := c.Reencrypt(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, items-1, n)
+			n, err = c.Reencrypt(context.Background())
+			require.NoError(t, err)
+			assert.Zero(t, n)
+
+			// Everything is readable without the old master key now
+			rotated := newTestStore(t, db, Config{Keys: map[byte][]byte{2: testKey2}, Version: 2, KeySecret: secret})
+			value, err := rotated.Get([]byte("key-0000"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("updated"), value)
+			for i := 1; i < items; i++ {
+				value, err := rotated.Get([]byte(fmt.Sprintf("key-%04d", i)))
+				require.NoError(t, err)
+				assert.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+			}
+		})
+	}
+}
+
+func TestCryptDB_ReencryptSkipsConcurrentWrites(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	old := newTestStore(t, db, Config{Keys: map[byte][]byte{1: testKey1}, Version: 1})
+	require.NoError(t, old.Put([]byte("key"), []byte("stale")))
+	raw, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+
+	c := newTestStore(t, db, Config{Keys: map[byte][]byte{1: testKey1, 2: testKey2}, Version: 2})
+	defer c.Close()
+
+	// The value changes between being read and being rewritten
+	require.NoError(t, old.Put([]byte("key"), []byte("fresh")))
+	n, err := c.rewrite([]entry{{key: []byte("key"), value: raw}})
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	value, err := c.Get([]byte("key"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("fresh"), value)
+}
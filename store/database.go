@@ -26,6 +26,21 @@ type KeyValueRanger interface {
 	DeleteRange(startKey []byte, endKey []byte) error
 }
 
+// Common Stat keys shared by the backends. Engines add their own
+// entries next to these when they have more to report.
+const (
+	// StatLevelSizes holds the bytes stored per LSM level as []int64.
+	StatLevelSizes = "level_sizes"
+	// StatLevelFiles holds the number of table files per LSM level as []int64.
+	StatLevelFiles = "level_files"
+	// StatMemTableSize holds the bytes buffered in memtables as int64.
+	StatMemTableSize = "memtable_size"
+	// StatCompactionDebt holds the estimated bytes left to compact as int64.
+	StatCompactionDebt = "compaction_debt"
+	// StatDiskSize holds the total bytes used on disk as int64.
+	StatDiskSize = "disk_size"
+)
+
 // KeyValueStater defines methods for retrieving statistics about the key-value store.
 type KeyValueStater interface {
 	// Stat returns statistics about the key-value store.
@@ -53,6 +68,7 @@ type KeyValueStore interface {
 	KeyValueSyncer
 	Batcher
 	Iteratee
+	Snapshotter
 	Compactor
 	io.Closer
 }
@@ -0,0 +1,683 @@
+// Package dbtest holds the conformance suite every store.KeyValueStore
+// backend is expected to pass.
+package dbtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/wang900115/LCA/store"
+)
+
+// TestDatabaseSuite runs a suite of tests against a KeyValueStore database
+// implementation. New is called once per sub test and must return an empty store.
+func TestDatabaseSuite(t *testing.T, New func() store.KeyValueStore) {
+	t.Run("KeyValueOperations", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		key := []byte("foo")
+		if err := db.Put(key, []byte("bar")); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+		if ok, err := db.Has(key); err != nil || !ok {
+			t.Fatalf("Has() = %v, %v, want true, nil", ok, err)
+		}
+		got, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		if !bytes.Equal(got, []byte("bar")) {
+			t.Fatalf("Get() = %q, want %q", got, "bar")
+		}
+		if err := db.Delete(key); err != nil {
+			t.Fatalf("Delete() error = %v", err)
+		}
+		if _, err := db.Get(key); !errors.Is(err, store.ErrNotFound) {
+			t.Fatalf("Get() after Delete() error = %v, want %v", err, store.ErrNotFound)
+		}
+		if ok, err := db.Has(key); err != nil || ok {
+			t.Fatalf("Has() after Delete() = %v, %v, want false, nil", ok, err)
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		db := New()
+		key := []byte("foo")
+		if err := db.Put(key, []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		b := db.NewBatch()
+		b.Put([]byte("baz"), nil)
+		if err := db.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+
+		if _, err := db.Get(key); !errors.Is(err, store.ErrClosed) {
+			t.Errorf("Get() error = %v, want %v", err, store.ErrClosed)
+		}
+		if _, err := db.Has(key); !errors.Is(err, store.ErrClosed) {
+			t.Errorf("Has() error = %v, want %v", err, store.ErrClosed)
+		}
+		if err := db.Put(key, nil); !errors.Is(err, store.ErrClosed) {
+			t.Errorf("Put() error = %v, want %v", err, store.ErrClosed)
+		}
+		if err := db.Delete(key); !errors.Is(err, store.ErrClosed) {
+			t.Errorf("Delete() error = %v, want %v", err, store.ErrClosed)
+		}
+		if err := b.Write(); !errors.Is(err, store.ErrClosed) {
+			t.Errorf("Batch.Write() error = %v, want %v", err, store.ErrClosed)
+		}
+		if _, err := db.NewSnapshot(); !errors.Is(err, store.ErrClosed) {
+			t.Errorf("NewSnapshot() error = %v, want %v", err, store.ErrClosed)
+		}
+		if it, err := db.NewIterator(nil, nil); err == nil {
+			for it.Next() {
+			}
+			err = it.Error()
+			it.Release()
+			if !errors.Is(err, store.ErrClosed) {
+				t.Errorf("Iterator.Error() = %v, want %v", err, store.ErrClosed)
+			}
+		} else if !errors.Is(err, store.ErrClosed) {
+			t.Errorf("NewIterator() error = %v, want %v", err, store.ErrClosed)
+		}
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		initial := map[string]string{"k1": "v1", "k2": "v2", "k3": "v3"}
+		for k, v := range initial {
+			if err := db.Put([]byte(k), []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		snap, err := db.NewSnapshot()
+		if err != nil {
+			t.Fatalf("NewSnapshot() error = %v", err)
+		}
+		defer snap.Release()
+
+		// Mutate the store through every write path, one of them concurrently
+		// with the snapshot reads below
+		done := make(chan error)
+		go func() {
+			for i := 0; i < 100; i++ {
+				if err := db.Put([]byte("k1"), []byte(fmt.Sprintf("v1-%d", i))); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+		if err := db.Delete([]byte("k2")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put([]byte("k4"), []byte("v4")); err != nil {
+			t.Fatal(err)
+		}
+		b := db.NewBatch()
+		b.Put([]byte("k3"), []byte("batched"))
+		b.Put([]byte("k5"), []byte("batched"))
+		if err := b.Write(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteRange([]byte("k3"), []byte("k4")); err != nil {
+			t.Fatal(err)
+		}
+		check := func() {
+			for k, v := range initial {
+				if got, err := snap.Get([]byte(k)); err != nil || !bytes.Equal(got, []byte(v)) {
+					t.Errorf("Snapshot.Get(%s) = %q, %v, want %q, nil", k, got, err, v)
+				}
+				if ok, err := snap.Has([]byte(k)); err != nil || !ok {
+					t.Errorf("Snapshot.Has(%s) = %v, %v, want true, nil", k, ok, err)
+				}
+			}
+			for _, k := range []string{"k4", "k5"} {
+				if _, err := snap.Get([]byte(k)); !errors.Is(err, store.ErrNotFound) {
+					t.Errorf("Snapshot.Get(%s) error = %v, want %v", k, err, store.ErrNotFound)
+				}
+				if ok, err := snap.Has([]byte(k)); err != nil || ok {
+					t.Errorf("Snapshot.Has(%s) = %v, %v, want false, nil", k, ok, err)
+				}
+			}
+		}
+		check()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		check()
+
+		// The live store moved on
+		if got, err := db.Get([]byte("k1")); err != nil || !bytes.Equal(got, []byte("v1-99")) {
+			t.Errorf("Get(k1) = %q, %v, want %q, nil", got, err, "v1-99")
+		}
+		if ok, _ := db.Has([]byte("k2")); ok {
+			t.Errorf("Has(k2) = true after Delete()")
+		}
+
+		snap.Release()
+		snap.Release()
+		if _, err := snap.Get([]byte("k1")); !errors.Is(err, store.ErrClosed) {
+			t.Errorf("Get() after Release() error = %v, want %v", err, store.ErrClosed)
+		}
+		if _, err := snap.Has([]byte("k1")); !errors.Is(err, store.ErrClosed) {
+			t.Errorf("Has() after Release() error = %v, want %v", err, store.ErrClosed)
+		}
+	})
+
+	t.Run("Iterator", func(t *testing.T) {
+		tests := []struct {
+			content map[string]string
+			prefix  string
+			start   string
+			order   []string
+		}{
+			// Empty databases should be iterable
+			{map[string]string{}, "", "", nil},
+			{map[string]string{}, "non-existent-prefix", "", nil},
+
+			// Single-item databases should be iterable
+			{map[string]string{"key": "val"}, "", "", []string{"key"}},
+			{map[string]string{"key": "val"}, "k", "", []string{"key"}},
+			{map[string]string{"key": "val"}, "l", "", nil},
+
+			// Multi-item databases should be fully iterable
+			{
+				map[string]string{"k1": "v1", "k5": "v5", "k2": "v2", "k4": "v4", "k3": "v3"},
+				"", "",
+				[]string{"k1", "k2", "k3", "k4", "k5"},
+			},
+			{
+				map[string]string{"k1": "v1", "k5": "v5", "k2": "v2", "k4": "v4", "k3": "v3"},
+				"k", "",
+				[]string{"k1", "k2", "k3", "k4", "k5"},
+			},
+			{
+				map[string]string{"k1": "v1", "k5": "v5", "k2": "v2", "k4": "v4", "k3": "v3"},
+				"l", "",
+				nil,
+			},
+			// Multi-item databases should be prefix-iterable
+			{
+				map[string]string{
+					"ka1": "va1", "ka5": "va5", "ka2": "va2", "ka4": "va4", "ka3": "va3",
+					"kb1": "vb1", "kb5": "vb5", "kb2": "vb2", "kb4": "vb4", "kb3": "vb3",
+				},
+				"ka", "",
+				[]string{"ka1", "ka2", "ka3", "ka4", "ka5"},
+			},
+			{
+				map[string]string{
+					"ka1": "va1", "ka5": "va5", "ka2": "va2", "ka4": "va4", "ka3": "va3",
+					"kb1": "vb1", "kb5": "vb5", "kb2": "vb2", "kb4": "vb4", "kb3": "vb3",
+				},
+				"kc", "",
+				nil,
+			},
+			// Multi-item databases should be prefix-iterable with start position
+			{
+				map[string]string{
+					"ka1": "va1", "ka5": "va5", "ka2": "va2", "ka4": "va4", "ka3": "va3",
+					"kb1": "vb1", "kb5": "vb5", "kb2": "vb2", "kb4": "vb4", "kb3": "vb3",
+				},
+				"ka", "3",
+				[]string{"ka3", "ka4", "ka5"},
+			},
+			{
+				map[string]string{
+					"ka1": "va1", "ka5": "va5", "ka2": "va2", "ka4": "va4", "ka3": "va3",
+					"kb1": "vb1", "kb5": "vb5", "kb2": "vb2", "kb4": "vb4", "kb3": "vb3",
+				},
+				"ka", "8",
+				nil,
+			},
+		}
+		for i, tt := range tests {
+			// Create the key-value data store
+			db := New()
+			for key, val := range tt.content {
+				if err := db.Put([]byte(key), []byte(val)); err != nil {
+					t.Fatalf("test %d: failed to insert item %s:%s into database: %v", i, key, val, err)
+				}
+			}
+			// Iterate over the database with the given configs and verify the results
+			it, err := db.NewIterator([]byte(tt.prefix), []byte(tt.start))
+			if err != nil {
+				t.Fatalf("test %d: NewIterator() error = %v", i, err)
+			}
+			idx := 0
+			for it.Next() {
+				if len(tt.order) <= idx {
+					t.Errorf("test %d: prefix=%q more items than expected: checking idx=%d (key %q), expecting len=%d", i, tt.prefix, idx, it.Key(), len(tt.order))
+					break
+				}
+				if !bytes.Equal(it.Key(), []byte(tt.order[idx])) {
+					t.Errorf("test %d: item %d: key mismatch: have %s, want %s", i, idx, string(it.Key()), tt.order[idx])
+				}
+				if !bytes.Equal(it.Value(), []byte(tt.content[tt.order[idx]])) {
+					t.Errorf("test %d: item %d: value mismatch: have %s, want %s", i, idx, string(it.Value()), tt.content[tt.order[idx]])
+				}
+				idx++
+			}
+			if err := it.Error(); err != nil {
+				t.Errorf("test %d: iteration failed: %v", i, err)
+			}
+			if idx != len(tt.order) {
+				t.Errorf("test %d: iteration terminated prematurely: have %d, want %d", i, idx, len(tt.order))
+			}
+			it.Release()
+			db.Close()
+		}
+	})
+
+	t.Run("IteratorWith", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		keys := []string{"1", "2", "3", "4", "6", "10", "11", "12", "20", "21", "22"}
+		slices.Sort(keys) // 1, 10, 11, etc
+
+		for _, k := range keys {
+			if err := db.Put([]byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		{
+			it, _ := db.NewIterator(nil, nil)
+			got, want := iterateKeys(it), keys
+			if !slices.Equal(got, want) {
+				t.Errorf("Iterator: got: %s; want: %s", got, want)
+			}
+		}
+
+		{
+			it, _ := db.NewIterator([]byte("1"), nil)
+			got, want := iterateKeys(it), []string{"1", "10", "11", "12"}
+			if !slices.Equal(got, want) {
+				t.Errorf("IteratorWith(1,nil): got: %s; want: %s", got, want)
+			}
+		}
+
+		{
+			it, _ := db.NewIterator([]byte("5"), nil)
+			got, want := iterateKeys(it), []string{}
+			if !slices.Equal(got, want) {
+				t.Errorf("IteratorWith(5,nil): got: %s; want: %s", got, want)
+			}
+		}
+
+		{
+			it, _ := db.NewIterator(nil, []byte("2"))
+			got, want := iterateKeys(it), []string{"2", "20", "21", "22", "3", "4", "6"}
+			if !slices.Equal(got, want) {
+				t.Errorf("IteratorWith(nil,2): got: %s; want: %s", got, want)
+			}
+		}
+
+		{
+			it, _ := db.NewIterator(nil, []byte("5"))
+			got, want := iterateKeys(it), []string{"6"}
+			if !slices.Equal(got, want) {
+				t.Errorf("IteratorWith(nil,5): got: %s; want: %s", got, want)
+			}
+		}
+	})
+
+	t.Run("IteratorSnapshot", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		for _, k := range []string{"1", "2", "3"} {
+			if err := db.Put([]byte(k), []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		it, err := db.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Release()
+
+		// Writes after the iterator was created must not be visible through it
+		db.Put([]byte("0"), []byte("new"))
+		db.Put([]byte("2"), []byte("new"))
+		db.Delete([]byte("3"))
+
+		var got []string
+		for it.Next() {
+			got = append(got, string(it.Key())+"="+string(it.Value()))
+		}
+		if want := []string{"1=old", "2=old", "3=old"}; !slices.Equal(got, want) {
+			t.Errorf("got: %s; want: %s", got, want)
+		}
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		b := db.NewBatch()
+		for _, k := range []string{"1", "2", "3", "4"} {
+			if err := b.Put([]byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if has, err := db.Has([]byte("1")); err == nil && has {
+			t.Fatalf("Has() = true before batch Write()")
+		}
+
+		if err := b.Write(); err != nil {
+			t.Fatal(err)
+		}
+
+		{
+			it, _ := db.NewIterator(nil, nil)
+			if got, want := iterateKeys(it), []string{"1", "2", "3", "4"}; !slices.Equal(got, want) {
+				t.Errorf("got: %s; want: %s", got, want)
+			}
+		}
+
+		if err := b.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if b.ValueSize() != 0 {
+			t.Errorf("ValueSize() after Reset() = %d, want 0", b.ValueSize())
+		}
+
+		// Mix writes and deletes in batch
+		b.Put([]byte("5"), nil)
+		b.Delete([]byte("1"))
+		b.Put([]byte("6"), nil)
+
+		b.Delete([]byte("3")) // delete then put
+		b.Put([]byte("3"), nil)
+
+		b.Put([]byte("7"), nil) // put then delete
+		b.Delete([]byte("7"))
+
+		if err := b.Write(); err != nil {
+			t.Fatal(err)
+		}
+
+		{
+			it, _ := db.NewIterator(nil, nil)
+			if got, want := iterateKeys(it), []string{"2", "3", "4", "5", "6"}; !slices.Equal(got, want) {
+				t.Errorf("got: %s; want: %s", got, want)
+			}
+		}
+	})
+
+	t.Run("BatchReplay", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		want := []string{"1", "2", "3", "4"}
+		b := db.NewBatch()
+		for _, k := range want {
+			if err := b.Put([]byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		b2 := db.NewBatch()
+		if err := b.Replay(b2); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b2.Replay(db); err != nil {
+			t.Fatal(err)
+		}
+
+		it, _ := db.NewIterator(nil, nil)
+		if got := iterateKeys(it); !slices.Equal(got, want) {
+			t.Errorf("got: %s; want: %s", got, want)
+		}
+	})
+
+	t.Run("BatchValueSize", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		b := db.NewBatchWithSize(64)
+		b.Put([]byte("key"), []byte("value"))
+		if b.ValueSize() == 0 {
+			t.Fatalf("ValueSize() = 0 after Put()")
+		}
+	})
+
+	t.Run("DeleteRange", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		addRange := func(start, stop int) {
+			for i := start; i <= stop; i++ {
+				db.Put([]byte(fmt.Sprintf("%d", i)), nil)
+			}
+		}
+
+		checkRange := func(start, stop int, exp bool) {
+			for i := start; i <= stop; i++ {
+				_, err := db.Get([]byte(fmt.Sprintf("%d", i)))
+				if exp && err != nil {
+					t.Fatalf("key %d: Get() error = %v, want present", i, err)
+				}
+				if !exp && err == nil {
+					t.Fatalf("key %d: Get() succeeded, want deleted", i)
+				}
+			}
+		}
+
+		addRange(1, 9)
+		db.DeleteRange([]byte("9"), []byte("1"))
+		checkRange(1, 9, true)
+		db.DeleteRange([]byte("5"), []byte("5"))
+		checkRange(1, 9, true)
+		db.DeleteRange([]byte("5"), []byte("50"))
+		checkRange(1, 4, true)
+		checkRange(5, 5, false)
+		checkRange(6, 9, true)
+		db.DeleteRange([]byte(""), []byte("a"))
+		checkRange(1, 9, false)
+
+		addRange(1, 999)
+		db.DeleteRange([]byte("12345"), []byte("54321"))
+		checkRange(1, 1, true)
+		checkRange(2, 5, false)
+		checkRange(6, 12, true)
+		checkRange(13, 54, false)
+		checkRange(55, 123, true)
+		checkRange(124, 543, false)
+		checkRange(544, 999, true)
+
+		addRange(1, 999)
+		db.DeleteRange([]byte("3"), []byte("7"))
+		checkRange(1, 2, true)
+		checkRange(3, 6, false)
+		checkRange(7, 29, true)
+		checkRange(30, 69, false)
+		checkRange(70, 299, true)
+		checkRange(300, 699, false)
+		checkRange(700, 999, true)
+
+		// Keys sorting after any fixed sentinel are in range too
+		high := append(bytes.Repeat([]byte{0xff}, 32), "more"...)
+		db.Put(high, nil)
+		db.DeleteRange([]byte(""), nil)
+		checkRange(1, 999, false)
+		if has, _ := db.Has(high); has {
+			t.Fatalf("Has() = true for %x after unbounded DeleteRange()", high)
+		}
+	})
+
+	t.Run("BatchDeleteRange", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		high := string(bytes.Repeat([]byte{0xff}, 40))
+		for _, k := range []string{"1", "2", high} {
+			if err := db.Put([]byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Range deletions apply in order with the other batch operations
+		b := db.NewBatch()
+		b.Put([]byte("3"), nil)
+		b.DeleteRange([]byte(""), []byte("4"))
+		b.Put([]byte("2"), nil)
+		b.Put([]byte(high+"\x00"), nil)
+		b.DeleteRange([]byte("5"), nil)
+		b.Put([]byte("6"), nil)
+
+		if has, err := db.Has([]byte("1")); err != nil || !has {
+			t.Fatalf("Has() = %v, %v before batch Write(), want true", has, err)
+		}
+		if err := b.Write(); err != nil {
+			t.Fatal(err)
+		}
+		it, _ := db.NewIterator(nil, nil)
+		if got, want := iterateKeys(it), []string{"2", "6"}; !slices.Equal(got, want) {
+			t.Errorf("got: %s; want: %s", got, want)
+		}
+	})
+
+	t.Run("InsertRange", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		for _, k := range []string{"a", "b", "c", "d"} {
+			if err := db.Put([]byte(k), []byte("old")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.InsertRange([]byte("b"), []byte("d"), []byte("new")); err != nil {
+			t.Fatalf("InsertRange() error = %v", err)
+		}
+		for k, want := range map[string]string{"a": "old", "b": "new", "c": "new", "d": "old"} {
+			got, err := db.Get([]byte(k))
+			if err != nil {
+				t.Fatalf("Get(%s) error = %v", k, err)
+			}
+			if string(got) != want {
+				t.Errorf("Get(%s) = %s, want %s", k, got, want)
+			}
+		}
+	})
+
+	t.Run("StatSyncCompact", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			db.Put([]byte(fmt.Sprintf("key-%03d", i)), bytes.Repeat([]byte{byte(i)}, 64))
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatalf("Sync() error = %v", err)
+		}
+		high := append(bytes.Repeat([]byte{0xff}, 32), "more"...)
+		db.Put(high, nil)
+		if err := db.Compact(nil, nil); err != nil {
+			t.Fatalf("Compact(nil, nil) error = %v", err)
+		}
+		if err := db.Compact([]byte("key-010"), []byte("key-050")); err != nil {
+			t.Fatalf("Compact() error = %v", err)
+		}
+		stats, err := db.Stat()
+		if err != nil {
+			t.Fatalf("Stat() error = %v", err)
+		}
+		if stats == nil {
+			t.Fatalf("Stat() returned nil map")
+		}
+		// Compaction must never lose data
+		for i := 0; i < 100; i++ {
+			if _, err := db.Get([]byte(fmt.Sprintf("key-%03d", i))); err != nil {
+				t.Fatalf("Get() after Compact() error = %v", err)
+			}
+		}
+		if _, err := db.Get(high); err != nil {
+			t.Fatalf("Get() after Compact() error = %v", err)
+		}
+	})
+}
+
+// iterateKeys iterates the keys and returns them as a slice of strings. The
+// iterator is released once exhausted; a failed iteration yields nil.
+func iterateKeys(it store.Iterator) []string {
+	defer it.Release()
+
+	keys := []string{}
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	if it.Error() != nil {
+		return nil
+	}
+	return keys
+}
+
+// TestReadOnlySuite checks the read-only mode of a disk backed store. New opens
+// the store at path for writing, NewReadOnly opens it in read-only mode.
+func TestReadOnlySuite(t *testing.T, New, NewReadOnly func(path string) (store.KeyValueStore, error)) {
+	t.Run("Missing", func(t *testing.T) {
+		if db, err := NewReadOnly(filepath.Join(t.TempDir(), "missing")); err == nil {
+			db.Close()
+			t.Fatalf("NewReadOnly() on missing store succeeded")
+		}
+	})
+
+	t.Run("RejectsWrites", func(t *testing.T) {
+		path := t.TempDir()
+		db, err := New(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put([]byte("key"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = NewReadOnly(path)
+		if err != nil {
+			t.Fatalf("NewReadOnly() error = %v", err)
+		}
+		defer db.Close()
+
+		if got, err := db.Get([]byte("key")); err != nil || !bytes.Equal(got, []byte("value")) {
+			t.Errorf("Get() = %q, %v, want %q, nil", got, err, "value")
+		}
+		it, err := db.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := iterateKeys(it), []string{"key"}; !slices.Equal(got, want) {
+			t.Errorf("got: %s; want: %s", got, want)
+		}
+		if err := db.Put([]byte("other"), nil); !errors.Is(err, store.ErrReadOnly) {
+			t.Errorf("Put() error = %v, want %v", err, store.ErrReadOnly)
+		}
+		if err := db.Delete([]byte("key")); !errors.Is(err, store.ErrReadOnly) {
+			t.Errorf("Delete() error = %v, want %v", err, store.ErrReadOnly)
+		}
+		b := db.NewBatch()
+		b.Put([]byte("other"), nil)
+		if err := b.Write(); !errors.Is(err, store.ErrReadOnly) {
+			t.Errorf("Batch.Write() error = %v, want %v", err, store.ErrReadOnly)
+		}
+		if _, err := db.Get([]byte("other")); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("Get() of rejected write error = %v, want %v", err, store.ErrNotFound)
+		}
+	})
+}
@@ -0,0 +1,21 @@
+package store
+
+import "errors"
+
+// Errors shared by every backend. Backends return these values, or errors
+// wrapping them, in place of their engine specific errors, so callers can
+// check for them with errors.Is regardless of the store in use.
+var (
+	// ErrNotFound is returned when the requested key or item does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrClosed is returned when the store is accessed after it was closed.
+	ErrClosed = errors.New("store closed")
+
+	// ErrReadOnly is returned when a write is attempted on a store opened in
+	// read-only mode.
+	ErrReadOnly = errors.New("store is read-only")
+
+	// ErrCorrupted is returned when the persisted data fails a consistency check.
+	ErrCorrupted = errors.New("store corrupted")
+)
@@ -0,0 +1,89 @@
+package freezer
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+
+	"github.com/wang900115/LCA/store"
+)
+
+// freezerBatch is the write operation passed to ModifyAncients. It buffers the
+// appended items per table until the batch is committed.
+type freezerBatch struct {
+	tables map[string]*tableBatch
+}
+
+// Ensure freezerBatch implements store.AncientWriterOp interface
+var _ store.AncientWriterOp = (*freezerBatch)(nil)
+
+func newFreezerBatch(f *Freezer) *freezerBatch {
+	batch := &freezerBatch{tables: make(map[string]*tableBatch, len(f.tables))}
+	for kind, table := range f.tables {
+		batch.tables[kind] = &tableBatch{t: table}
+	}
+	return batch
+}
+
+// reset drops all buffered items.
+func (batch *freezerBatch) reset() {
+	for _, tb := range batch.tables {
+		tb.reset()
+	}
+}
+
+// Append encodes item and adds it to the given table. Byte slices are stored
+// as they are, values implementing encoding.BinaryMarshaler are stored in their
+// binary form and anything else is stored as JSON.
+func (batch *freezerBatch) Append(kind string, num uint64, item interface{}) error {
+	blob, err := encodeItem(item)
+	if err != nil {
+		return fmt.Errorf("freezer table %s: item %d: %w", kind, num, err)
+	}
+	return batch.AppendRaw(kind, num, blob)
+}
+
+// AppendRaw adds an item of the given kind to the batch.
+func (batch *freezerBatch) AppendRaw(kind string, num uint64, item []byte) error {
+	tb, ok := batch.tables[kind]
+	if !ok {
+		return errUnknownTable
+	}
+	return tb.appendRaw(num, item)
+}
+
+// commit writes the buffered items of all tables and returns the new number of
+// items together with the number of bytes written. head is the number of items
+// before the batch, which every table must have moved past by the same amount.
+func (batch *freezerBatch) commit(head uint64) (item uint64, writeSize int64, err error) {
+	item = head
+	for _, tb := range batch.tables {
+		if err := tb.commit(); err != nil {
+			return 0, 0, err
+		}
+		writeSize += tb.totalBytes
+	}
+	first := true
+	for kind, tb := range batch.tables {
+		if first {
+			item, first = tb.curItem, false
+			continue
+		}
+		if tb.curItem != item {
+			return 0, 0, fmt.Errorf("freezer table %s is at item %d, want %d", kind, tb.curItem, item)
+		}
+	}
+	return item, writeSize, nil
+}
+
+// encodeItem converts an item passed to Append into its stored form.
+func encodeItem(item interface{}) ([]byte, error) {
+	switch v := item.(type) {
+	case []byte:
+		return v, nil
+	case encoding.BinaryMarshaler:
+		return v.MarshalBinary()
+	default:
+		return json.Marshal(v)
+	}
+}
@@ -0,0 +1,84 @@
+package freezer
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression selects how the items of a freezer table are stored on disk.
+type Compression uint8
+
+const (
+	// NoCompression stores items as they are appended.
+	NoCompression Compression = iota
+	// SnappyCompression stores every item snappy block encoded.
+	SnappyCompression
+	// ZstdCompression stores every item as a zstd frame.
+	ZstdCompression
+)
+
+var (
+	// zstdEncoder and zstdDecoder are shared by every table, both are safe for
+	// concurrent use through EncodeAll and DecodeAll.
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// String implements fmt.Stringer.
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case ZstdCompression:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// prefix is the leading letter of the file extensions used by tables of this
+// compression type. Keeping them apart means reopening a table with another
+// compression starts a new table instead of misreading the old one.
+func (c Compression) prefix() string {
+	switch c {
+	case SnappyCompression:
+		return "s"
+	case ZstdCompression:
+		return "z"
+	default:
+		return "r"
+	}
+}
+
+// valid reports whether c is a known compression type.
+func (c Compression) valid() bool {
+	return c <= ZstdCompression
+}
+
+// compress encodes a single item for storage.
+func (c Compression) compress(blob []byte) []byte {
+	switch c {
+	case SnappyCompression:
+		return snappy.Encode(nil, blob)
+	case ZstdCompression:
+		return zstdEncoder.EncodeAll(blob, nil)
+	default:
+		return blob
+	}
+}
+
+// decompress decodes a single item read from storage.
+func (c Compression) decompress(blob []byte) ([]byte, error) {
+	switch c {
+	case SnappyCompression:
+		return snappy.Decode(nil, blob)
+	case ZstdCompression:
+		return zstdDecoder.DecodeAll(blob, nil)
+	default:
+		return blob, nil
+	}
+}
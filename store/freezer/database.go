@@ -0,0 +1,41 @@
+package freezer
+
+import (
+	"errors"
+
+	"github.com/wang900115/LCA/store"
+)
+
+// Ensure freezerdb implements store.Database interface
+var _ store.Database = (*freezerdb)(nil)
+
+// freezerdb is a database wrapper that enables freezer data retrievals. Recent
+// data is served by the key-value store, immutable history by the freezer.
+type freezerdb struct {
+	store.KeyValueStore
+	store.AncientStore
+}
+
+// NewDatabase creates a store.Database that routes key-value operations to kv
+// and ancient operations to ancient. Closing it closes both.
+func NewDatabase(kv store.KeyValueStore, ancient store.AncientStore) store.Database {
+	return &freezerdb{
+		KeyValueStore: kv,
+		AncientStore:  ancient,
+	}
+}
+
+// NewDatabaseWithFreezer opens a freezer in datadir and combines it with kv.
+func NewDatabaseWithFreezer(kv store.KeyValueStore, datadir string, maxTableSize uint32, tables map[string]Compression) (store.Database, error) {
+	ancient, err := NewFreezer(datadir, maxTableSize, tables)
+	if err != nil {
+		return nil, err
+	}
+	return NewDatabase(kv, ancient), nil
+}
+
+// Close implements io.Closer, closing both the fast key-value store as well as
+// the slow ancient tables.
+func (db *freezerdb) Close() error {
+	return errors.Join(db.AncientStore.Close(), db.KeyValueStore.Close())
+}
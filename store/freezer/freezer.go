@@ -0,0 +1,301 @@
+// Package freezer implements store.AncientStore as a set of append-only,
+// file-backed tables, one per kind of data. It is meant for immutable history,
+// such as old channel messages and node records, that no longer needs to live
+// in the key-value store.
+package freezer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wang900115/LCA/store"
+)
+
+var (
+	// errUnknownTable is returned if the user attempts to read from a table that
+	// is not tracked by the freezer.
+	errUnknownTable = errors.New("unknown table")
+
+	// errOutOrderInsertion is returned if the user attempts to inject out-of-order
+	// binary blobs into the freezer.
+	errOutOrderInsertion = errors.New("the append operation is out-order")
+
+	// errOutOfBounds is returned if the item requested is not contained within the
+	// freezer table.
+	errOutOfBounds = fmt.Errorf("%w: out of bounds", store.ErrNotFound)
+
+	// errItemTooLarge is returned if an item does not fit in a single data file.
+	errItemTooLarge = errors.New("item too large")
+
+	// errTruncateBelowTail is returned if a head truncation would remove items
+	// that were already removed from the tail.
+	errTruncateBelowTail = errors.New("truncation below tail")
+
+	// errTruncateAboveHead is returned if a tail truncation would remove items
+	// that were never appended.
+	errTruncateAboveHead = errors.New("truncation above head")
+)
+
+// defaultMaxTableSize is the maximum size of a single data file, used when the
+// freezer is created without a limit.
+const defaultMaxTableSize = 2 * 1000 * 1000 * 1000
+
+// Ensure Freezer implements store.AncientStore interface
+var _ store.AncientStore = (*Freezer)(nil)
+
+// Freezer is an append-only database to store immutable ordered data into flat
+// files. Every table holds one kind of data and all tables grow in lockstep:
+// item n of every kind is appended in the same ModifyAncients call.
+type Freezer struct {
+	frozen atomic.Uint64 // Number of items already frozen
+	tail   atomic.Uint64 // Number of the first stored item in the freezer
+
+	datadir  string
+	readonly bool
+	tables   map[string]*freezerTable
+
+	// writeLock serializes writers. Readers running through ReadAncients hold
+	// it for reading, so they see a consistent view across all tables.
+	writeLock  sync.RWMutex
+	writeBatch *freezerBatch
+	closeOnce  sync.Once
+}
+
+// NewFreezer opens the freezer in datadir with one table per entry of tables,
+// each using the given compression. A zero maxTableSize selects the default
+// data file size limit. Tables left misaligned by an unclean shutdown are cut
+// back to the items they all have in common.
+func NewFreezer(datadir string, maxTableSize uint32, tables map[string]Compression) (store.AncientStore, error) {
+	return openFreezer(datadir, maxTableSize, tables, false)
+}
+
+// NewFreezerReadOnly opens an existing freezer without modifying it. Writes and
+// truncations fail with store.ErrReadOnly, and tables that need a repair fail to
+// open with store.ErrCorrupted.
+func NewFreezerReadOnly(datadir string, tables map[string]Compression) (store.AncientStore, error) {
+	return openFreezer(datadir, defaultMaxTableSize, tables, true)
+}
+
+func openFreezer(datadir string, maxTableSize uint32, tables map[string]Compression, readonly bool) (store.AncientStore, error) {
+	if maxTableSize == 0 {
+		maxTableSize = defaultMaxTableSize
+	}
+	f := &Freezer{
+		datadir:  datadir,
+		readonly: readonly,
+		tables:   make(map[string]*freezerTable),
+	}
+	for name, comp := range tables {
+		table, err := newTable(datadir, name, comp, maxTableSize, readonly)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.tables[name] = table
+	}
+	if err := f.repair(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.writeBatch = newFreezerBatch(f)
+	return f, nil
+}
+
+// repair truncates all tables to the items they have in common. A read-only
+// freezer leaves the tables untouched and only exposes the common items.
+func (f *Freezer) repair() error {
+	var (
+		head = uint64(math.MaxUint64)
+		tail = uint64(0)
+	)
+	for _, table := range f.tables {
+		head = min(head, table.items.Load())
+		tail = max(tail, table.tail.Load())
+	}
+	if head == math.MaxUint64 {
+		head = 0
+	}
+	if tail > head {
+		return fmt.Errorf("%w: freezer tail %d above head %d", store.ErrCorrupted, tail, head)
+	}
+	for _, table := range f.tables {
+		if f.readonly {
+			break
+		}
+		if err := table.truncateHead(head); err != nil {
+			return err
+		}
+		if err := table.truncateTail(tail); err != nil {
+			return err
+		}
+	}
+	f.frozen.Store(head)
+	f.tail.Store(tail)
+	return nil
+}
+
+// Ancient retrieves an ancient binary blob from the append-only immutable files.
+func (f *Freezer) Ancient(kind string, number uint64) ([]byte, error) {
+	table, ok := f.tables[kind]
+	if !ok {
+		return nil, errUnknownTable
+	}
+	return table.retrieve(number)
+}
+
+// AncientRange retrieves multiple items in sequence, starting from the index 'start'.
+// It will return
+//   - at most 'count' items,
+//   - if maxBytes is specified: at least 1 item (even if exceeding the maxByteSize),
+//     but will otherwise return as many items as fit into maxByteSize.
+//   - if maxBytes is not specified, 'count' items will be returned if they are present.
+func (f *Freezer) AncientRange(kind string, start, count, maxBytes uint64) ([][]byte, error) {
+	table, ok := f.tables[kind]
+	if !ok {
+		return nil, errUnknownTable
+	}
+	return table.retrieveItems(start, count, maxBytes)
+}
+
+// Ancients returns the length of the frozen items.
+func (f *Freezer) Ancients() (uint64, error) {
+	return f.frozen.Load(), nil
+}
+
+// Tail returns the number of first stored item in the freezer.
+func (f *Freezer) Tail() (uint64, error) {
+	return f.tail.Load(), nil
+}
+
+// AncientSize returns the ancient size of the specified category.
+func (f *Freezer) AncientSize(kind string) (uint64, error) {
+	table, ok := f.tables[kind]
+	if !ok {
+		return 0, errUnknownTable
+	}
+	return table.size()
+}
+
+// ReadAncients runs the given read operation while ensuring that no writes take place
+// on the underlying freezer.
+func (f *Freezer) ReadAncients(fn func(store.AncientReaderOp) error) error {
+	f.writeLock.RLock()
+	defer f.writeLock.RUnlock()
+
+	return fn(f)
+}
+
+// ModifyAncients runs the given write operation. Nothing appended by fn is kept
+// if fn or the final commit fails, and every table must end up with the same
+// number of items.
+func (f *Freezer) ModifyAncients(fn func(store.AncientWriterOp) error) (writeSize int64, err error) {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	if f.readonly {
+		return 0, store.ErrReadOnly
+	}
+	// Roll back all tables to the starting position in case of error.
+	prevItem := f.frozen.Load()
+	defer func() {
+		if err != nil {
+			for _, table := range f.tables {
+				table.truncateHead(prevItem)
+			}
+		}
+	}()
+	f.writeBatch.reset()
+	if err := fn(f.writeBatch); err != nil {
+		return 0, err
+	}
+	item, writeSize, err := f.writeBatch.commit(prevItem)
+	if err != nil {
+		return 0, err
+	}
+	f.frozen.Store(item)
+	return writeSize, nil
+}
+
+// SyncAncient flushes all data tables to disk.
+func (f *Freezer) SyncAncient() error {
+	if f.readonly {
+		return nil
+	}
+	var errs []error
+	for _, table := range f.tables {
+		errs = append(errs, table.sync())
+	}
+	return errors.Join(errs...)
+}
+
+// TruncateHead discards any recent data above the provided threshold number.
+// It returns the previous head number.
+func (f *Freezer) TruncateHead(items uint64) (uint64, error) {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	if f.readonly {
+		return 0, store.ErrReadOnly
+	}
+	oitems := f.frozen.Load()
+	if oitems <= items {
+		return oitems, nil
+	}
+	if items < f.tail.Load() {
+		return oitems, errTruncateBelowTail
+	}
+	for _, table := range f.tables {
+		if err := table.truncateHead(items); err != nil {
+			return oitems, err
+		}
+	}
+	f.frozen.Store(items)
+	return oitems, nil
+}
+
+// TruncateTail discards all data below the provided threshold number.
+// It returns the previous tail number.
+func (f *Freezer) TruncateTail(tail uint64) (uint64, error) {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	if f.readonly {
+		return 0, store.ErrReadOnly
+	}
+	old := f.tail.Load()
+	if old >= tail {
+		return old, nil
+	}
+	if tail > f.frozen.Load() {
+		return old, errTruncateAboveHead
+	}
+	for _, table := range f.tables {
+		if err := table.truncateTail(tail); err != nil {
+			return old, err
+		}
+	}
+	f.tail.Store(tail)
+	return old, nil
+}
+
+// AncientDatadir returns the path of the ancient store.
+func (f *Freezer) AncientDatadir() (string, error) {
+	return f.datadir, nil
+}
+
+// Close terminates the chain freezer, closing all the data files.
+func (f *Freezer) Close() error {
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	var errs []error
+	f.closeOnce.Do(func() {
+		for _, table := range f.tables {
+			errs = append(errs, table.close())
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,431 @@
+package freezer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+const (
+	kindMessages = "messages"
+	kindRecords  = "records"
+)
+
+// testTables is the table layout used by most tests.
+var testTables = map[string]Compression{
+	kindMessages: SnappyCompression,
+	kindRecords:  NoCompression,
+}
+
+// testItem returns the deterministic payload stored for item i of kind.
+func testItem(kind string, i uint64) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%s-%d;", kind, i)), 3)
+}
+
+func newTestFreezer(t *testing.T, dir string, maxTableSize uint32) *Freezer {
+	t.Helper()
+	f, err := NewFreezer(dir, maxTableSize, testTables)
+	require.NoError(t, err)
+	return f.(*Freezer)
+}
+
+// appendItems appends items [from, to) to every table in a single call.
+func appendItems(t *testing.T, f *Freezer, from, to uint64) {
+	t.Helper()
+	_, err := f.ModifyAncients(func(op store.AncientWriterOp) error {
+		for i := from; i < to; i++ {
+			for kind := range testTables {
+				if err := op.AppendRaw(kind, i, testItem(kind, i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// checkItems verifies that exactly the items [tail, head) are readable.
+func checkItems(t *testing.T, f *Freezer, tail, head uint64) {
+	t.Helper()
+	ancients, _ := f.Ancients()
+	assert.Equal(t, head, ancients)
+	ftail, _ := f.Tail()
+	assert.Equal(t, tail, ftail)
+
+	for kind := range testTables {
+		for i := tail; i < head; i++ {
+			item, err := f.Ancient(kind, i)
+			require.NoError(t, err, "kind %s item %d", kind, i)
+			assert.Equal(t, testItem(kind, i), item)
+		}
+		if tail > 0 {
+			_, err := f.Ancient(kind, tail-1)
+			assert.ErrorIs(t, err, errOutOfBounds)
+		}
+		_, err := f.Ancient(kind, head)
+		assert.ErrorIs(t, err, errOutOfBounds)
+	}
+}
+
+func TestFreezer_AppendAndRead(t *testing.T) {
+	for _, comp := range []Compression{NoCompression, SnappyCompression, ZstdCompression} {
+		t.Run(comp.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			f, err := NewFreezer(dir, 0, map[string]Compression{kindMessages: comp})
+			require.NoError(t, err)
+
+			written, err := f.ModifyAncients(func(op store.AncientWriterOp) error {
+				for i := uint64(0); i < 10; i++ {
+					if err := op.AppendRaw(kindMessages, i, testItem(kindMessages, i)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Positive(t, written)
+			require.NoError(t, f.SyncAncient())
+			require.NoError(t, f.Close())
+
+			// Everything must survive a reopen
+			f, err = NewFreezer(dir, 0, map[string]Compression{kindMessages: comp})
+			require.NoError(t, err)
+			defer f.Close()
+
+			ancients, err := f.Ancients()
+			require.NoError(t, err)
+			assert.Equal(t, uint64(10), ancients)
+			for i := uint64(0); i < 10; i++ {
+				item, err := f.Ancient(kindMessages, i)
+				require.NoError(t, err)
+				assert.Equal(t, testItem(kindMessages, i), item)
+			}
+			size, err := f.AncientSize(kindMessages)
+			require.NoError(t, err)
+			assert.Positive(t, size)
+
+			datadir, err := f.AncientDatadir()
+			require.NoError(t, err)
+			assert.Equal(t, dir, datadir)
+		})
+	}
+}
+
+func TestFreezer_AncientRange(t *testing.T) {
+	f := newTestFreezer(t, t.TempDir(), 0)
+	defer f.Close()
+	appendItems(t, f, 0, 10)
+
+	items, err := f.AncientRange(kindRecords, 2, 5, 0)
+	require.NoError(t, err)
+	require.Len(t, items, 5)
+	for i, item := range items {
+		assert.Equal(t, testItem(kindRecords, uint64(i+2)), item)
+	}
+
+	// The count is capped by the number of stored items
+	items, err = f.AncientRange(kindRecords, 8, 5, 0)
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+
+	// maxBytes limits the result but always returns at least one item
+	itemSize := uint64(len(testItem(kindRecords, 2)))
+	items, err = f.AncientRange(kindRecords, 2, 5, 2*itemSize)
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+	items, err = f.AncientRange(kindRecords, 2, 5, 1)
+	require.NoError(t, err)
+	assert.Len(t, items, 1)
+
+	_, err = f.AncientRange(kindRecords, 10, 1, 0)
+	assert.ErrorIs(t, err, errOutOfBounds)
+	_, err = f.AncientRange("unknown", 0, 1, 0)
+	assert.ErrorIs(t, err, errUnknownTable)
+}
+
+func TestFreezer_ReadAncients(t *testing.T) {
+	f := newTestFreezer(t, t.TempDir(), 0)
+	defer f.Close()
+	appendItems(t, f, 0, 3)
+
+	err := f.ReadAncients(func(op store.AncientReaderOp) error {
+		ancients, err := op.Ancients()
+		if err != nil {
+			return err
+		}
+		item, err := op.Ancient(kindMessages, ancients-1)
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, testItem(kindMessages, 2), item)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestFreezer_ModifyAncientsRollback(t *testing.T) {
+	f := newTestFreezer(t, t.TempDir(), 0)
+	defer f.Close()
+	appendItems(t, f, 0, 5)
+
+	t.Run("out of order insertion", func(t *testing.T) {
+		_, err := f.ModifyAncients(func(op store.AncientWriterOp) error {
+			if err := op.AppendRaw(kindMessages, 5, testItem(kindMessages, 5)); err != nil {
+				return err
+			}
+			return op.AppendRaw(kindMessages, 7, testItem(kindMessages, 7))
+		})
+		assert.ErrorIs(t, err, errOutOrderInsertion)
+		checkItems(t, f, 0, 5)
+	})
+
+	t.Run("misaligned tables", func(t *testing.T) {
+		_, err := f.ModifyAncients(func(op store.AncientWriterOp) error {
+			return op.AppendRaw(kindMessages, 5, testItem(kindMessages, 5))
+		})
+		assert.Error(t, err)
+		checkItems(t, f, 0, 5)
+	})
+
+	t.Run("callback error", func(t *testing.T) {
+		failure := fmt.Errorf("failure")
+		_, err := f.ModifyAncients(func(op store.AncientWriterOp) error {
+			op.AppendRaw(kindMessages, 5, testItem(kindMessages, 5))
+			op.AppendRaw(kindRecords, 5, testItem(kindRecords, 5))
+			return failure
+		})
+		assert.ErrorIs(t, err, failure)
+		checkItems(t, f, 0, 5)
+	})
+
+	// The freezer must still accept the next item after a rollback
+	appendItems(t, f, 5, 6)
+	checkItems(t, f, 0, 6)
+}
+
+func TestFreezer_Append(t *testing.T) {
+	f, err := NewFreezer(t.TempDir(), 0, map[string]Compression{kindRecords: ZstdCompression})
+	require.NoError(t, err)
+	defer f.Close()
+
+	type record struct {
+		DID  string `json:"did"`
+		Seq  uint64 `json:"seq"`
+		Addr string `json:"addr"`
+	}
+	_, err = f.ModifyAncients(func(op store.AncientWriterOp) error {
+		if err := op.Append(kindRecords, 0, []byte("raw")); err != nil {
+			return err
+		}
+		return op.Append(kindRecords, 1, &record{DID: "did:lca:alice", Seq: 3, Addr: "127.0.0.1:10123"})
+	})
+	require.NoError(t, err)
+
+	item, err := f.Ancient(kindRecords, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("raw"), item)
+
+	item, err = f.Ancient(kindRecords, 1)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"did":"did:lca:alice","seq":3,"addr":"127.0.0.1:10123"}`, string(item))
+}
+
+func TestFreezer_Truncate(t *testing.T) {
+	dir := t.TempDir()
+	// Small data files force the items to spread over many of them
+	f := newTestFreezer(t, dir, 100)
+	appendItems(t, f, 0, 30)
+	checkItems(t, f, 0, 30)
+
+	dataFiles := func(kind string) int {
+		matches, err := filepath.Glob(filepath.Join(dir, kind+".*.rdat"))
+		require.NoError(t, err)
+		return len(matches)
+	}
+	before := dataFiles(kindRecords)
+	require.Greater(t, before, 3)
+
+	old, err := f.TruncateHead(20)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(30), old)
+	checkItems(t, f, 0, 20)
+	assert.Less(t, dataFiles(kindRecords), before)
+
+	old, err = f.TruncateTail(7)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), old)
+	checkItems(t, f, 7, 20)
+
+	_, err = f.TruncateHead(5)
+	assert.ErrorIs(t, err, errTruncateBelowTail)
+	_, err = f.TruncateTail(25)
+	assert.ErrorIs(t, err, errTruncateAboveHead)
+
+	// Appends continue at the head and the tail survives a reopen
+	appendItems(t, f, 20, 25)
+	require.NoError(t, f.Close())
+
+	f = newTestFreezer(t, dir, 100)
+	defer f.Close()
+	checkItems(t, f, 7, 25)
+
+	// Truncating the tail up to the head keeps the freezer appendable
+	_, err = f.TruncateTail(25)
+	require.NoError(t, err)
+	checkItems(t, f, 25, 25)
+	assert.Equal(t, 1, dataFiles(kindRecords))
+	appendItems(t, f, 25, 27)
+	checkItems(t, f, 25, 27)
+}
+
+func TestFreezer_Repair(t *testing.T) {
+	t.Run("data written past the index", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newTestFreezer(t, dir, 0)
+		appendItems(t, f, 0, 5)
+		require.NoError(t, f.Close())
+
+		// Simulate a crash after the data of an item was written, but before
+		// its index entry made it to disk
+		data, err := os.OpenFile(filepath.Join(dir, kindRecords+".0000.rdat"), os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		_, err = data.Write([]byte("partial item"))
+		require.NoError(t, err)
+		require.NoError(t, data.Close())
+
+		f = newTestFreezer(t, dir, 0)
+		checkItems(t, f, 0, 5)
+		appendItems(t, f, 5, 6)
+		checkItems(t, f, 0, 6)
+		require.NoError(t, f.Close())
+	})
+
+	t.Run("index written past the data", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newTestFreezer(t, dir, 0)
+		appendItems(t, f, 0, 5)
+		require.NoError(t, f.Close())
+
+		// Lose the last item's data and leave half an index entry behind
+		name := filepath.Join(dir, kindRecords+".0000.rdat")
+		stat, err := os.Stat(name)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(name, stat.Size()-1))
+
+		index, err := os.OpenFile(filepath.Join(dir, kindRecords+".ridx"), os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		_, err = index.Write([]byte{0, 0, 0})
+		require.NoError(t, err)
+		require.NoError(t, index.Close())
+
+		// The damaged table drops its last item and the other one follows
+		f = newTestFreezer(t, dir, 0)
+		defer f.Close()
+		checkItems(t, f, 0, 4)
+	})
+
+	t.Run("interrupted head truncation", func(t *testing.T) {
+		dir := t.TempDir()
+		f := newTestFreezer(t, dir, 50)
+		appendItems(t, f, 0, 10)
+		require.NoError(t, f.Close())
+
+		// A data file beyond the indexed head is left over from a truncation
+		// that crashed before deleting it
+		stray := filepath.Join(dir, kindRecords+".0099.rdat")
+		require.NoError(t, os.WriteFile(stray, []byte("stale"), 0644))
+
+		f = newTestFreezer(t, dir, 50)
+		defer f.Close()
+		checkItems(t, f, 0, 10)
+		_, err := os.Stat(stray)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestFreezer_Closed(t *testing.T) {
+	f := newTestFreezer(t, t.TempDir(), 0)
+	appendItems(t, f, 0, 1)
+	require.NoError(t, f.Close())
+	require.NoError(t, f.Close())
+
+	_, err := f.Ancient(kindRecords, 0)
+	assert.ErrorIs(t, err, store.ErrClosed)
+	_, err = f.ModifyAncients(func(op store.AncientWriterOp) error {
+		return op.AppendRaw(kindRecords, 1, nil)
+	})
+	assert.Error(t, err)
+}
+
+func TestFreezer_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewFreezerReadOnly(dir, testTables)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	f := newTestFreezer(t, dir, 0)
+	appendItems(t, f, 0, 5)
+	require.NoError(t, f.Close())
+
+	ro, err := NewFreezerReadOnly(dir, testTables)
+	require.NoError(t, err)
+	f = ro.(*Freezer)
+	checkItems(t, f, 0, 5)
+
+	_, err = f.ModifyAncients(func(op store.AncientWriterOp) error {
+		return op.AppendRaw(kindRecords, 5, nil)
+	})
+	assert.ErrorIs(t, err, store.ErrReadOnly)
+	_, err = f.TruncateHead(2)
+	assert.ErrorIs(t, err, store.ErrReadOnly)
+	_, err = f.TruncateTail(2)
+	assert.ErrorIs(t, err, store.ErrReadOnly)
+	require.NoError(t, f.Close())
+
+	// Damage that a writable freezer would repair is reported instead
+	name := filepath.Join(dir, kindRecords+".0000.rdat")
+	stat, err := os.Stat(name)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(name, stat.Size()-1))
+
+	_, err = NewFreezerReadOnly(dir, testTables)
+	assert.ErrorIs(t, err, store.ErrCorrupted)
+	f = newTestFreezer(t, dir, 0)
+	defer f.Close()
+	checkItems(t, f, 0, 4)
+}
+
+func TestDatabase(t *testing.T) {
+	db, err := NewDatabaseWithFreezer(memorydb.NewMemoryDBStore(), t.TempDir(), 0, testTables)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Put([]byte("recent"), []byte("hot")))
+	_, err = db.ModifyAncients(func(op store.AncientWriterOp) error {
+		if err := op.AppendRaw(kindMessages, 0, []byte("cold")); err != nil {
+			return err
+		}
+		return op.AppendRaw(kindRecords, 0, []byte("cold"))
+	})
+	require.NoError(t, err)
+
+	value, err := db.Get([]byte("recent"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hot"), value)
+
+	item, err := db.Ancient(kindMessages, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("cold"), item)
+
+	require.NoError(t, db.Close())
+	_, err = db.Get([]byte("recent"))
+	assert.Error(t, err)
+	_, err = db.Ancient(kindMessages, 0)
+	assert.ErrorIs(t, err, store.ErrClosed)
+}
@@ -0,0 +1,679 @@
+package freezer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wang900115/LCA/store"
+)
+
+const (
+	// indexHeaderSize is the size of the index file header, holding the number
+	// of items removed from the tail of the table.
+	indexHeaderSize = 8
+
+	// indexEntrySize is the size of a single index entry.
+	indexEntrySize = 8
+)
+
+// indexEntry points at a position within a data file.
+//
+// The index file starts with the header, followed by one marker entry holding
+// the position where the first stored item begins. Every later entry holds the
+// position where the respective item ends. An item starts where the previous
+// entry points to, or at offset zero when the previous entry belongs to an
+// older data file.
+type indexEntry struct {
+	filenum uint32 // data file the position belongs to
+	offset  uint32 // byte offset within that data file
+}
+
+// unmarshal decodes an index entry from b.
+func (e *indexEntry) unmarshal(b []byte) {
+	e.filenum = binary.BigEndian.Uint32(b[:4])
+	e.offset = binary.BigEndian.Uint32(b[4:8])
+}
+
+// append appends the encoded entry to b.
+func (e indexEntry) append(b []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, e.filenum)
+	return binary.BigEndian.AppendUint32(b, e.offset)
+}
+
+// bounds returns the start and end offsets of the item ending at e, given the
+// entry before it, along with the data file the item lives in.
+func (e indexEntry) bounds(prev indexEntry) (uint32, uint32, uint32) {
+	if prev.filenum != e.filenum {
+		return 0, e.offset, e.filenum
+	}
+	return prev.offset, e.offset, e.filenum
+}
+
+// freezerTable is an append-only table of items of a single kind. Items are
+// concatenated into a sequence of data files, each limited to maxFileSize
+// bytes, and located through a fixed width index file.
+type freezerTable struct {
+	items atomic.Uint64 // Number of items stored, including the ones removed from the tail
+	tail  atomic.Uint64 // Number of items removed from the tail
+
+	name        string
+	path        string
+	comp        Compression
+	maxFileSize uint32
+	readonly    bool
+
+	index     *os.File            // Index file, nil once the table is closed
+	files     map[uint32]*os.File // Open data files, from tailId up to headId
+	head      *os.File            // Data file currently being appended to
+	headId    uint32              // Number of the head data file
+	headBytes int64               // Number of bytes written to the head data file
+	tailId    uint32              // Number of the oldest data file still in use
+
+	lock sync.RWMutex
+}
+
+// newTable opens the named table in path, creating it if it does not exist
+// and repairing whatever an unclean shutdown left behind. A read-only table
+// must already exist and is never modified.
+func newTable(path string, name string, comp Compression, maxFileSize uint32, readonly bool) (*freezerTable, error) {
+	if !comp.valid() {
+		return nil, fmt.Errorf("freezer table %s: unknown compression %d", name, comp)
+	}
+	t := &freezerTable{
+		name:        name,
+		path:        path,
+		comp:        comp,
+		maxFileSize: maxFileSize,
+		readonly:    readonly,
+		files:       make(map[uint32]*os.File),
+	}
+	var (
+		index *os.File
+		err   error
+	)
+	if readonly {
+		index, err = os.Open(t.indexName())
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("freezer table %s: %w", name, store.ErrNotFound)
+		}
+	} else {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		// A leftover temporary index is an interrupted tail truncation which never
+		// got renamed into place, the live index is still intact.
+		if err := os.Remove(t.indexName() + ".tmp"); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		index, err = os.OpenFile(t.indexName(), os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.index = index
+	if err := t.repair(); err != nil {
+		t.close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// indexName returns the path of the index file.
+func (t *freezerTable) indexName() string {
+	return filepath.Join(t.path, fmt.Sprintf("%s.%sidx", t.name, t.comp.prefix()))
+}
+
+// dataName returns the path of the data file with the given number.
+func (t *freezerTable) dataName(filenum uint32) string {
+	return filepath.Join(t.path, fmt.Sprintf("%s.%04d.%sdat", t.name, filenum, t.comp.prefix()))
+}
+
+// repair cross checks the index against the data files and truncates both to
+// the last item that was fully written. Appends write the data before the
+// index, so any data past the last index entry is discarded, while index
+// entries pointing past the end of the data are dropped.
+//
+// A read-only table ignores leftovers past the index, which are never read,
+// but reports an index pointing past the data as corruption.
+func (t *freezerTable) repair() error {
+	stat, err := t.index.Stat()
+	if err != nil {
+		return err
+	}
+	size := stat.Size()
+
+	// An index without a marker entry is either brand new or its first write
+	// was interrupted, start from an empty table in both cases.
+	if size < indexHeaderSize+indexEntrySize {
+		if t.readonly {
+			return t.corrupted("index of %d bytes has no marker entry", size)
+		}
+		if err := t.index.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := t.index.WriteAt(make([]byte, indexHeaderSize+indexEntrySize), 0); err != nil {
+			return err
+		}
+		size = indexHeaderSize + indexEntrySize
+	}
+	// Drop any partially written trailing entry.
+	if overflow := (size - indexHeaderSize) % indexEntrySize; overflow != 0 {
+		size -= overflow
+		if !t.readonly {
+			if err := t.index.Truncate(size); err != nil {
+				return err
+			}
+		}
+	}
+	buf := make([]byte, indexHeaderSize+indexEntrySize)
+	if _, err := t.index.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	var marker, last indexEntry
+	tail := binary.BigEndian.Uint64(buf[:indexHeaderSize])
+	marker.unmarshal(buf[indexHeaderSize:])
+	if err := t.readEntry(&last, size-indexEntrySize); err != nil {
+		return err
+	}
+	// Walk the index back until it points into existing data.
+	headBytes, err := dataSize(t.dataName(last.filenum))
+	if err != nil {
+		return err
+	}
+	for int64(last.offset) > headBytes {
+		if t.readonly {
+			return t.corrupted("index points past the end of data file %d", last.filenum)
+		}
+		if size == indexHeaderSize+indexEntrySize {
+			return t.corrupted("data file %d is missing items before the tail", last.filenum)
+		}
+		size -= indexEntrySize
+		if err := t.index.Truncate(size); err != nil {
+			return err
+		}
+		prev := last.filenum
+		if err := t.readEntry(&last, size-indexEntrySize); err != nil {
+			return err
+		}
+		if last.filenum != prev {
+			if headBytes, err = dataSize(t.dataName(last.filenum)); err != nil {
+				return err
+			}
+		}
+	}
+	// Remove data files that fell outside the index, left behind by interrupted
+	// head or tail truncations, or by a head advance that never got indexed.
+	if !t.readonly {
+		if err := t.removeFiles(func(filenum uint32) bool {
+			return filenum < marker.filenum || filenum > last.filenum
+		}); err != nil {
+			return err
+		}
+	}
+	for filenum := marker.filenum; filenum <= last.filenum; filenum++ {
+		var (
+			f   *os.File
+			err error
+		)
+		if t.readonly {
+			f, err = os.Open(t.dataName(filenum))
+			if os.IsNotExist(err) {
+				return t.corrupted("missing data file %d", filenum)
+			}
+		} else {
+			f, err = os.OpenFile(t.dataName(filenum), os.O_RDWR|os.O_CREATE, 0644)
+		}
+		if err != nil {
+			return err
+		}
+		t.files[filenum] = f
+	}
+	t.tailId, t.headId = marker.filenum, last.filenum
+	t.head = t.files[t.headId]
+	t.headBytes = int64(last.offset)
+	t.tail.Store(tail)
+	t.items.Store(tail + uint64(size-indexHeaderSize-indexEntrySize)/indexEntrySize)
+
+	if t.readonly {
+		return nil
+	}
+	// Discard any data written past the last index entry.
+	if headBytes > int64(last.offset) {
+		if err := t.head.Truncate(int64(last.offset)); err != nil {
+			return err
+		}
+	}
+	if err := t.index.Sync(); err != nil {
+		return err
+	}
+	return t.head.Sync()
+}
+
+// corrupted returns an error wrapping store.ErrCorrupted that describes a
+// damaged table.
+func (t *freezerTable) corrupted(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: freezer table %s: %s", store.ErrCorrupted, t.name, fmt.Sprintf(format, args...))
+}
+
+// dataSize returns the size of the named data file, or zero if it does not
+// exist yet.
+func dataSize(name string) (int64, error) {
+	stat, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// removeFiles deletes the data files of this table matched by drop.
+func (t *freezerTable) removeFiles(drop func(filenum uint32) bool) error {
+	entries, err := os.ReadDir(t.path)
+	if err != nil {
+		return err
+	}
+	prefix, suffix := t.name+".", "."+t.comp.prefix()+"dat"
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		filenum, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), 10, 32)
+		if err != nil || !drop(uint32(filenum)) {
+			continue
+		}
+		if f, ok := t.files[uint32(filenum)]; ok {
+			f.Close()
+			delete(t.files, uint32(filenum))
+		}
+		if err := os.Remove(filepath.Join(t.path, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readEntry reads the index entry stored at the given byte offset.
+func (t *freezerTable) readEntry(e *indexEntry, offset int64) error {
+	buf := make([]byte, indexEntrySize)
+	if _, err := t.index.ReadAt(buf, offset); err != nil {
+		return err
+	}
+	e.unmarshal(buf)
+	return nil
+}
+
+// entryOffset returns the byte offset of the index entry at which the given
+// item ends.
+func (t *freezerTable) entryOffset(item uint64) int64 {
+	return indexHeaderSize + int64(item-t.tail.Load()+1)*indexEntrySize
+}
+
+// retrieve looks up the item with the given number.
+func (t *freezerTable) retrieve(item uint64) ([]byte, error) {
+	items, err := t.retrieveItems(item, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+// retrieveItems returns up to count consecutive items starting at start. Once
+// at least one item is collected, no item is added that would push the total
+// size over maxBytes. A zero maxBytes disables the limit.
+func (t *freezerTable) retrieveItems(start, count, maxBytes uint64) ([][]byte, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.index == nil {
+		return nil, store.ErrClosed
+	}
+	items, tail := t.items.Load(), t.tail.Load()
+	if start < tail || start >= items {
+		return nil, errOutOfBounds
+	}
+	if count > items-start {
+		count = items - start
+	}
+	// Read the entry before the first item too, it marks where that item begins.
+	indices := make([]byte, (count+1)*indexEntrySize)
+	if _, err := t.index.ReadAt(indices, t.entryOffset(start)-indexEntrySize); err != nil {
+		return nil, err
+	}
+	var (
+		output = make([][]byte, 0, count)
+		size   uint64
+		prev   indexEntry
+		cur    indexEntry
+	)
+	prev.unmarshal(indices)
+	for i := uint64(0); i < count; i++ {
+		cur.unmarshal(indices[(i+1)*indexEntrySize:])
+		from, to, filenum := cur.bounds(prev)
+		prev = cur
+
+		f, ok := t.files[filenum]
+		if !ok {
+			return nil, t.corrupted("missing data file %d", filenum)
+		}
+		blob := make([]byte, to-from)
+		if _, err := f.ReadAt(blob, int64(from)); err != nil {
+			return nil, err
+		}
+		item, err := t.comp.decompress(blob)
+		if err != nil {
+			return nil, t.corrupted("item %d: %v", start+i, err)
+		}
+		if maxBytes > 0 && len(output) > 0 && size+uint64(len(item)) > maxBytes {
+			break
+		}
+		size += uint64(len(item))
+		output = append(output, item)
+	}
+	return output, nil
+}
+
+// size returns the total number of bytes used by the table on disk.
+func (t *freezerTable) size() (uint64, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.index == nil {
+		return 0, store.ErrClosed
+	}
+	stat, err := t.index.Stat()
+	if err != nil {
+		return 0, err
+	}
+	total := uint64(stat.Size())
+	for _, f := range t.files {
+		stat, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		total += uint64(stat.Size())
+	}
+	return total, nil
+}
+
+// write appends the buffered data to the head data file, followed by the index
+// entries describing it.
+func (t *freezerTable) write(data []byte, indices []byte, items uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return store.ErrClosed
+	}
+	if _, err := t.head.WriteAt(data, t.headBytes); err != nil {
+		return err
+	}
+	t.headBytes += int64(len(data))
+	if _, err := t.index.WriteAt(indices, t.entryOffset(t.items.Load())); err != nil {
+		return err
+	}
+	t.items.Store(items)
+	return nil
+}
+
+// advanceHead syncs the current head data file and starts a new one.
+func (t *freezerTable) advanceHead() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return store.ErrClosed
+	}
+	if err := t.head.Sync(); err != nil {
+		return err
+	}
+	filenum := t.headId + 1
+	f, err := os.OpenFile(t.dataName(filenum), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	t.files[filenum] = f
+	t.head, t.headId, t.headBytes = f, filenum, 0
+	return nil
+}
+
+// truncateHead discards all items numbered items and above.
+func (t *freezerTable) truncateHead(items uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return store.ErrClosed
+	}
+	if t.items.Load() <= items {
+		return nil
+	}
+	if items < t.tail.Load() {
+		return errTruncateBelowTail
+	}
+	var last indexEntry
+	if err := t.readEntry(&last, t.entryOffset(items)-indexEntrySize); err != nil {
+		return err
+	}
+	// Shrink the index first, so a crash midway leaves extra data behind that
+	// the next repair discards, never entries pointing to missing data.
+	if err := t.index.Truncate(t.entryOffset(items)); err != nil {
+		return err
+	}
+	if err := t.index.Sync(); err != nil {
+		return err
+	}
+	if last.filenum != t.headId {
+		if err := t.removeFiles(func(filenum uint32) bool { return filenum > last.filenum }); err != nil {
+			return err
+		}
+		t.head, t.headId = t.files[last.filenum], last.filenum
+	}
+	if err := t.head.Truncate(int64(last.offset)); err != nil {
+		return err
+	}
+	t.headBytes = int64(last.offset)
+	t.items.Store(items)
+	return t.head.Sync()
+}
+
+// truncateTail discards all items numbered below items. The index is rewritten
+// without the removed entries and swapped in atomically, after which data files
+// holding only removed items are deleted. Items sharing a data file with live
+// ones stay on disk until the whole file falls behind the tail.
+func (t *freezerTable) truncateTail(items uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return store.ErrClosed
+	}
+	if t.tail.Load() >= items {
+		return nil
+	}
+	if t.items.Load() < items {
+		return errTruncateAboveHead
+	}
+	// The entry where the last removed item ends becomes the new marker, unless
+	// the next item starts a new data file.
+	var marker indexEntry
+	offset := t.entryOffset(items - 1)
+	if err := t.readEntry(&marker, offset); err != nil {
+		return err
+	}
+	stat, err := t.index.Stat()
+	if err != nil {
+		return err
+	}
+	rest := make([]byte, stat.Size()-offset-indexEntrySize)
+	if _, err := t.index.ReadAt(rest, offset+indexEntrySize); err != nil && err != io.EOF {
+		return err
+	}
+	if len(rest) > 0 {
+		var next indexEntry
+		next.unmarshal(rest)
+		if next.filenum != marker.filenum {
+			marker = indexEntry{filenum: next.filenum}
+		}
+	}
+	buf := binary.BigEndian.AppendUint64(make([]byte, 0, indexHeaderSize+indexEntrySize+len(rest)), items)
+	buf = append(marker.append(buf), rest...)
+
+	index, err := t.replaceIndex(buf)
+	if err != nil {
+		return err
+	}
+	t.index.Close()
+	t.index = index
+	t.tail.Store(items)
+
+	if err := t.removeFiles(func(filenum uint32) bool { return filenum < marker.filenum }); err != nil {
+		return err
+	}
+	t.tailId = marker.filenum
+	return nil
+}
+
+// replaceIndex writes content into a temporary file and renames it over the
+// index file, returning the new index file opened for writing.
+func (t *freezerTable) replaceIndex(content []byte) (*os.File, error) {
+	tmp := t.indexName() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, t.indexName()); err != nil {
+		return nil, err
+	}
+	if err := syncDir(t.path); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(t.indexName(), os.O_RDWR, 0644)
+}
+
+// syncDir flushes the directory entry changes in path to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// sync flushes the index and the head data file to disk.
+func (t *freezerTable) sync() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return store.ErrClosed
+	}
+	return errors.Join(t.index.Sync(), t.head.Sync())
+}
+
+// close closes all files of the table. Any later access fails with store.ErrClosed.
+func (t *freezerTable) close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return nil
+	}
+	errs := []error{t.index.Close()}
+	for _, f := range t.files {
+		errs = append(errs, f.Close())
+	}
+	t.index, t.head, t.files = nil, nil, nil
+	return errors.Join(errs...)
+}
+
+// tableBatch buffers items appended to a table during a ModifyAncients call.
+type tableBatch struct {
+	t          *freezerTable
+	data       []byte
+	indices    []byte
+	curItem    uint64 // Number of the next item to be appended
+	totalBytes int64  // Number of bytes appended since the last reset
+}
+
+// batchBufferLimit is the buffered data size above which a table batch writes
+// out early.
+const batchBufferLimit = 2 * 1024 * 1024
+
+// reset discards buffered items and aligns the batch with the table head.
+func (b *tableBatch) reset() {
+	b.data, b.indices = b.data[:0], b.indices[:0]
+	b.curItem = b.t.items.Load()
+	b.totalBytes = 0
+}
+
+// appendRaw buffers the item with the given number, which must directly follow
+// the previously appended one.
+func (b *tableBatch) appendRaw(item uint64, blob []byte) error {
+	if item != b.curItem {
+		return fmt.Errorf("%w: have %d want %d", errOutOrderInsertion, item, b.curItem)
+	}
+	encoded := b.t.comp.compress(blob)
+	if uint64(len(encoded)) > math.MaxUint32 {
+		return errItemTooLarge
+	}
+	// Roll over to a new data file if the item does not fit in the current one.
+	// An item larger than a whole file still gets a file of its own.
+	buffered := uint64(b.t.headBytes) + uint64(len(b.data))
+	if buffered > 0 && buffered+uint64(len(encoded)) > uint64(b.t.maxFileSize) {
+		if err := b.commit(); err != nil {
+			return err
+		}
+		if err := b.t.advanceHead(); err != nil {
+			return err
+		}
+	}
+	end := uint64(b.t.headBytes) + uint64(len(b.data)) + uint64(len(encoded))
+	if end > math.MaxUint32 {
+		return errItemTooLarge
+	}
+	b.data = append(b.data, encoded...)
+	b.indices = indexEntry{filenum: b.t.headId, offset: uint32(end)}.append(b.indices)
+	b.totalBytes += int64(len(encoded))
+	b.curItem++
+
+	if len(b.data) > batchBufferLimit {
+		return b.commit()
+	}
+	return nil
+}
+
+// commit writes the buffered items to the table.
+func (b *tableBatch) commit() error {
+	if len(b.indices) == 0 {
+		return nil
+	}
+	if err := b.t.write(b.data, b.indices, b.curItem); err != nil {
+		return err
+	}
+	b.data, b.indices = b.data[:0], b.indices[:0]
+	return nil
+}
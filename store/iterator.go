@@ -1,19 +1,36 @@
 package store
 
+// Iterator iterates over a database's key/value pairs in ascending key order.
+//
+// When it encounters an error any seek will return false and will yield no key/
+// value pairs. The error can be queried by calling the Error method. Calling
+// Release is still necessary.
+//
+// An iterator must be released after use, but it is not necessary to read an
+// iterator until exhaustion. An iterator is not safe for concurrent use, but it
+// is safe to use multiple iterators concurrently.
 type Iterator interface {
 	// Next advances the iterator to the next key-value pair.
 	Next() bool
 	// Error returns any error encountered during iteration.
 	Error() error
-	// Key returns the current key.
+	// Key returns the current key. The caller should not modify the contents
+	// of the returned slice, and its contents may change on the next call to Next.
 	Key() []byte
-	// Value returns the current value.
+	// Value returns the current value. The caller should not modify the contents
+	// of the returned slice, and its contents may change on the next call to Next.
 	Value() []byte
 	// Release releases the resources associated with the iterator.
 	Release()
 }
 
+// Iteratee wraps the NewIterator methods of a backing data store.
 type Iteratee interface {
-	// NewIterator creates a new iterator over the key-value store.
+	// NewIterator creates a binary-alphabetical iterator over a subset
+	// of database content with a particular key prefix, starting at a particular
+	// initial key (or after, if it does not exist).
+	//
+	// Note: This method assumes that the prefix is NOT part of the start, so there's
+	// no need for the caller to prepend the prefix to the start
 	NewIterator(prefix []byte, start []byte) (Iterator, error)
 }
@@ -0,0 +1,142 @@
+package leveldb
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/wang900115/LCA/store"
+)
+
+// Kinds of queued batch operations.
+const (
+	opPut = iota
+	opDelete
+	opDeleteRange
+)
+
+// batchOp is a queued batch operation. A range deletion keeps its bounds in
+// key and end, nil end meaning the range is unbounded.
+type batchOp struct {
+	kind  int
+	key   []byte
+	value []byte
+	end   []byte
+}
+
+// batch is a write-only leveldb batch that commits changes to its host store
+// when Write is called. A batch cannot be used concurrently.
+//
+// LevelDB has no range tombstones, so range deletions are kept in order with
+// the other operations and resolved into key deletions on Write. That way a
+// range deletion also removes the keys queued before it in the same batch.
+type batch struct {
+	db   *leveldb.DB
+	ops  []batchOp
+	size int
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	b.ops = append(b.ops, batchOp{kind: opPut, key: bytes.Clone(key), value: bytes.Clone(value)})
+	b.size += len(key) + len(value)
+	return nil
+}
+
+// Delete inserts a key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	b.ops = append(b.ops, batchOp{kind: opDelete, key: bytes.Clone(key)})
+	b.size += len(key)
+	return nil
+}
+
+// InsertRange queues an overwrite of every key currently stored within
+// [startKey, endKey). The affected keys are resolved when the call is made.
+func (b *batch) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	it := b.db.NewIterator(&util.Range{Start: startKey, Limit: endKey}, nil)
+	defer it.Release()
+	for it.Next() {
+		b.Put(it.Key(), value)
+	}
+	return storeError(it.Error())
+}
+
+// DeleteRange queues the removal of every key within [startKey, endKey). The
+// affected keys are resolved when the batch is written.
+func (b *batch) DeleteRange(startKey []byte, endKey []byte) error {
+	b.ops = append(b.ops, batchOp{kind: opDeleteRange, key: bytes.Clone(startKey), end: bytes.Clone(endKey)})
+	b.size += len(startKey) + len(endKey)
+	return nil
+}
+
+// ValueSize retrieves the amount of data queued up for writing.
+func (b *batch) ValueSize() int {
+	return b.size
+}
+
+// Write flushes any accumulated data to disk.
+func (b *batch) Write() error {
+	wb := new(leveldb.Batch)
+	for i, op := range b.ops {
+		switch op.kind {
+		case opPut:
+			wb.Put(op.key, op.value)
+		case opDelete:
+			wb.Delete(op.key)
+		case opDeleteRange:
+			r := &util.Range{Start: op.key, Limit: op.end}
+			it := b.db.NewIterator(r, nil)
+			for it.Next() {
+				wb.Delete(it.Key())
+			}
+			it.Release()
+			if err := it.Error(); err != nil {
+				return storeError(err)
+			}
+			// Keys queued earlier are not in the store yet
+			for _, prev := range b.ops[:i] {
+				if prev.kind == opPut && inRange(prev.key, r) {
+					wb.Delete(prev.key)
+				}
+			}
+		}
+	}
+	return storeError(b.db.Write(wb, nil))
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() error {
+	b.ops = b.ops[:0]
+	b.size = 0
+	return nil
+}
+
+// Replay replays the batch contents. Range deletions can only be replayed
+// into writers that also implement store.KeyValueRanger.
+func (b *batch) Replay(w store.KeyValueWriter) error {
+	for _, op := range b.ops {
+		var err error
+		switch op.kind {
+		case opPut:
+			err = w.Put(op.key, op.value)
+		case opDelete:
+			err = w.Delete(op.key)
+		case opDeleteRange:
+			ranger, ok := w.(store.KeyValueRanger)
+			if !ok {
+				return fmt.Errorf("replay target does not support range deletion")
+			}
+			err = ranger.DeleteRange(op.key, op.end)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inRange reports whether key falls within r.
+func inRange(key []byte, r *util.Range) bool {
+	return bytes.Compare(key, r.Start) >= 0 && (r.Limit == nil || bytes.Compare(key, r.Limit) < 0)
+}
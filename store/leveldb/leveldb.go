@@ -1,52 +1,249 @@
 package leveldb
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+
 	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/wang900115/LCA/store"
 )
 
-type LevelStore interface {
-	Has(key []byte) (bool, error)
-	Put(key []byte, value []byte) error
-	Get(key []byte) ([]byte, error)
-	Delete(key []byte) error
-	Close() error
-}
+// Ensure LevelDBStore implements store.KeyValueStore interface
+var _ store.KeyValueStore = (*LevelDBStore)(nil)
 
 type LevelDBStore struct {
 	DB *leveldb.DB
 }
 
-func NewLevelDBStore(path string) (LevelStore, error) {
-	db, err := leveldb.OpenFile(path, nil)
+func NewLevelDBStore(path string) (store.KeyValueStore, error) {
+	return openLevelDB(path, nil)
+}
+
+// NewLevelDBStoreReadOnly opens an existing LevelDB store in read-only mode.
+// Every write fails with store.ErrReadOnly.
+func NewLevelDBStoreReadOnly(path string) (store.KeyValueStore, error) {
+	return openLevelDB(path, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+}
+
+func openLevelDB(path string, options *opt.Options) (store.KeyValueStore, error) {
+	db, err := leveldb.OpenFile(path, options)
 	if err != nil {
-		return nil, err
+		return nil, storeError(err)
 	}
 	return &LevelDBStore{
 		DB: db,
 	}, nil
 }
 
+// storeError converts a goleveldb error into its store counterpart.
+func storeError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, leveldb.ErrNotFound):
+		return store.ErrNotFound
+	case errors.Is(err, leveldb.ErrClosed):
+		return store.ErrClosed
+	case errors.Is(err, leveldb.ErrReadOnly):
+		return store.ErrReadOnly
+	case lerrors.IsCorrupted(err):
+		return fmt.Errorf("%w: %v", store.ErrCorrupted, err)
+	}
+	return err
+}
+
 // Has checks if the given key exists in the LevelDB store.
 func (db *LevelDBStore) Has(key []byte) (bool, error) {
-	return db.DB.Has(key, nil)
+	has, err := db.DB.Has(key, nil)
+	return has, storeError(err)
 }
 
 // Put stores the given key-value pair in the LevelDB store.
 func (db *LevelDBStore) Put(key []byte, value []byte) error {
-	return db.DB.Put(key, value, nil)
+	return storeError(db.DB.Put(key, value, nil))
 }
 
 // Get retrieves the value associated with the given key from the LevelDB store.
 func (db *LevelDBStore) Get(key []byte) ([]byte, error) {
-	return db.DB.Get(key, nil)
+	value, err := db.DB.Get(key, nil)
+	return value, storeError(err)
 }
 
 // Delete removes the key-value pair associated with the given key from the LevelDB store.
 func (db *LevelDBStore) Delete(key []byte) error {
-	return db.DB.Delete(key, nil)
+	return storeError(db.DB.Delete(key, nil))
+}
+
+// InsertRange overwrites every existing key within [startKey, endKey) with the given value.
+// LevelDB has no range keys, so the affected keys are collected and written in one batch.
+func (db *LevelDBStore) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	batch := new(leveldb.Batch)
+	it := db.DB.NewIterator(&util.Range{Start: startKey, Limit: endKey}, nil)
+	for it.Next() {
+		batch.Put(it.Key(), value)
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return storeError(err)
+	}
+	return storeError(db.DB.Write(batch, nil))
+}
+
+// DeleteRange removes all keys within [startKey, endKey). A nil endKey means
+// the range is unbounded. LevelDB has no range tombstones, so the keys are
+// deleted through a single atomic batch.
+func (db *LevelDBStore) DeleteRange(startKey []byte, endKey []byte) error {
+	batch := new(leveldb.Batch)
+	it := db.DB.NewIterator(&util.Range{Start: startKey, Limit: endKey}, nil)
+	for it.Next() {
+		batch.Delete(it.Key())
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return storeError(err)
+	}
+	return storeError(db.DB.Write(batch, nil))
+}
+
+// Stat returns the LevelDB statistics gathered by the engine.
+func (db *LevelDBStore) Stat() (map[string]interface{}, error) {
+	var stats leveldb.DBStats
+	if err := db.DB.Stats(&stats); err != nil {
+		return nil, storeError(err)
+	}
+	levelFiles := make([]int64, len(stats.LevelTablesCounts))
+	for i, n := range stats.LevelTablesCounts {
+		levelFiles[i] = int64(n)
+	}
+	var diskSize int64
+	for _, size := range stats.LevelSizes {
+		diskSize += size
+	}
+	return map[string]interface{}{
+		store.StatLevelSizes:       append([]int64(nil), stats.LevelSizes...),
+		store.StatLevelFiles:       levelFiles,
+		store.StatDiskSize:         diskSize,
+		"leveldb.writedelay.count": int64(stats.WriteDelayCount),
+		"leveldb.writedelay.time":  stats.WriteDelayDuration,
+		"leveldb.writepaused":      stats.WritePaused,
+		"leveldb.io.read":          stats.IORead,
+		"leveldb.io.write":         stats.IOWrite,
+		"leveldb.blockcache.size":  int64(stats.BlockCacheSize),
+		"leveldb.openedtables":     int64(stats.OpenedTablesCount),
+		"leveldb.alivesnaps":       int64(stats.AliveSnapshots),
+		"leveldb.aliveiters":       int64(stats.AliveIterators),
+	}, nil
+}
+
+// Sync flushes written data to persistent storage. goleveldb skips synced
+// writes of empty batches and has no call to sync its journal, so the
+// memtable is flushed instead: opening a transaction writes it to a synced
+// table file and records that in the synced manifest.
+func (db *LevelDBStore) Sync() error {
+	tr, err := db.DB.OpenTransaction()
+	switch {
+	case errors.Is(err, leveldb.ErrReadOnly):
+		// Nothing was written, nothing to flush
+		return nil
+	case err != nil:
+		return storeError(err)
+	}
+	tr.Discard()
+	return nil
+}
+
+// Compact flattens the underlying data store for the given key range. A nil
+// startKey starts at the beginning of the key space and a nil endKey runs
+// to the end of it.
+func (db *LevelDBStore) Compact(startKey []byte, endKey []byte) error {
+	return storeError(db.DB.CompactRange(util.Range{Start: startKey, Limit: endKey}))
+}
+
+// NewBatch creates a write-only batch that commits atomically to this store.
+func (db *LevelDBStore) NewBatch() store.Batch {
+	return &batch{db: db.DB}
+}
+
+// NewBatchWithSize creates a write-only batch. goleveldb v1.0.0 cannot
+// pre-allocate batch buffers, so the size hint is ignored.
+func (db *LevelDBStore) NewBatchWithSize(size int) store.Batch {
+	return db.NewBatch()
+}
+
+// NewIterator creates an iterator over the keys with the given prefix,
+// starting at prefix+start.
+func (db *LevelDBStore) NewIterator(prefix []byte, start []byte) (store.Iterator, error) {
+	r := util.BytesPrefix(prefix)
+	r.Start = append(r.Start, start...)
+	return &levelIterator{db.DB.NewIterator(r, nil)}, nil
+}
+
+// NewSnapshot creates a point-in-time view of the store backed by a native
+// LevelDB snapshot.
+func (db *LevelDBStore) NewSnapshot() (store.Snapshot, error) {
+	snap, err := db.DB.GetSnapshot()
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return &snapshot{db: snap}, nil
 }
 
 // Close closes the LevelDB store.
 func (db *LevelDBStore) Close() error {
-	return db.DB.Close()
+	return storeError(db.DB.Close())
+}
+
+// levelIterator wraps a goleveldb iterator to report store errors.
+type levelIterator struct {
+	iterator.Iterator
+}
+
+// Error returns any accumulated error. Exhausting all the key/value pairs
+// is not considered to be an error.
+func (it *levelIterator) Error() error {
+	return storeError(it.Iterator.Error())
+}
+
+// snapshot wraps a LevelDB snapshot to report store errors. goleveldb does
+// not guard reads on a released snapshot, so release is tracked here.
+type snapshot struct {
+	db   *leveldb.Snapshot // Nil once released
+	lock sync.RWMutex
+}
+
+// Has retrieves if a key was present when the snapshot was taken.
+func (snap *snapshot) Has(key []byte) (bool, error) {
+	snap.lock.RLock()
+	defer snap.lock.RUnlock()
+	if snap.db == nil {
+		return false, store.ErrClosed
+	}
+	has, err := snap.db.Has(key, nil)
+	return has, storeError(err)
+}
+
+// Get retrieves the value a key held when the snapshot was taken.
+func (snap *snapshot) Get(key []byte) ([]byte, error) {
+	snap.lock.RLock()
+	defer snap.lock.RUnlock()
+	if snap.db == nil {
+		return nil, store.ErrClosed
+	}
+	value, err := snap.db.Get(key, nil)
+	return value, storeError(err)
+}
+
+// Release releases the underlying LevelDB snapshot.
+func (snap *snapshot) Release() {
+	snap.lock.Lock()
+	defer snap.lock.Unlock()
+	if snap.db != nil {
+		snap.db.Release()
+		snap.db = nil
+	}
 }
@@ -9,11 +9,16 @@ import (
 	"testing"
 	"time"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/dbtest"
 )
 
+// errNotFound is the error every backend reports for missing keys. Most tests
+// below name their database store, shadowing the package name.
+var errNotFound = store.ErrNotFound
+
 // setupTestDB creates a temporary LevelDB instance for testing
-func setupTestDB(t testing.TB) (LevelStore, string) {
+func setupTestDB(t testing.TB) (store.KeyValueStore, string) {
 	tempDir := filepath.Join(os.TempDir(), fmt.Sprintf("leveldb_test_%d", time.Now().UnixNano()))
 
 	store, err := NewLevelDBStore(tempDir)
@@ -25,7 +30,7 @@ func setupTestDB(t testing.TB) (LevelStore, string) {
 }
 
 // cleanupTestDB removes the temporary database
-func cleanupTestDB(t testing.TB, store LevelStore, path string) {
+func cleanupTestDB(t testing.TB, store store.KeyValueStore, path string) {
 	if err := store.Close(); err != nil {
 		t.Errorf("Failed to close database: %v", err)
 	}
@@ -80,7 +85,7 @@ func TestNewLevelDBStore(t *testing.T) {
 				os.RemoveAll(tt.path)
 			}()
 
-			// Verify store implements LevelStore interface
+			// Verify store implements store.KeyValueStore interface
 			if store == nil {
 				t.Errorf("NewLevelDBStore() returned nil store")
 			}
@@ -221,8 +226,8 @@ func TestLevelDBStore_Delete(t *testing.T) {
 	if err == nil {
 		t.Errorf("Get() should return error for deleted key")
 	}
-	if err != leveldb.ErrNotFound {
-		t.Errorf("Get() error = %v, want %v", err, leveldb.ErrNotFound)
+	if err != errNotFound {
+		t.Errorf("Get() error = %v, want %v", err, errNotFound)
 	}
 }
 
@@ -250,8 +255,8 @@ func TestLevelDBStore_Get_NonExistentKey(t *testing.T) {
 	if err == nil {
 		t.Errorf("Get() should return error for non-existent key")
 	}
-	if err != leveldb.ErrNotFound {
-		t.Errorf("Get() error = %v, want %v", err, leveldb.ErrNotFound)
+	if err != errNotFound {
+		t.Errorf("Get() error = %v, want %v", err, errNotFound)
 	}
 }
 
@@ -466,6 +471,16 @@ func TestLevelDBStore_Close(t *testing.T) {
 	}
 }
 
+func TestLevelDBStore_Suite(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() store.KeyValueStore {
+		db, err := NewLevelDBStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create test database: %v", err)
+		}
+		return db
+	})
+}
+
 // Benchmark tests
 func BenchmarkLevelDBStore_Put(b *testing.B) {
 	store, path := setupTestDB(b)
@@ -506,3 +521,52 @@ func BenchmarkLevelDBStore_Get(b *testing.B) {
 		}
 	}
 }
+
+func TestLevelDBStore_ReadOnly(t *testing.T) {
+	dbtest.TestReadOnlySuite(t, NewLevelDBStore, NewLevelDBStoreReadOnly)
+}
+
+func TestLevelDBStore_Sync(t *testing.T) {
+	path := t.TempDir()
+	db, err := NewLevelDBStore(path)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("sync_key_%d", i)), []byte("value")); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	// The memtable was flushed into a table file
+	stats, err := db.Stat()
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	var files int64
+	for _, n := range stats[store.StatLevelFiles].([]int64) {
+		files += n
+	}
+	if files == 0 {
+		t.Errorf("Sync() left no table files")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := db.Sync(); err != store.ErrClosed {
+		t.Errorf("Sync() after close error = %v, want %v", err, store.ErrClosed)
+	}
+
+	db, err = NewLevelDBStoreReadOnly(path)
+	if err != nil {
+		t.Fatalf("NewLevelDBStoreReadOnly() error = %v", err)
+	}
+	defer db.Close()
+	if err := db.Sync(); err != nil {
+		t.Errorf("Sync() on read-only store error = %v", err)
+	}
+}
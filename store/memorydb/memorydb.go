@@ -1,72 +1,474 @@
+// Package memorydb implements the store.KeyValueStore interface on top of an
+// in-memory map, so store consumers can be tested without touching disk.
 package memorydb
 
 import (
-	"errors"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
-)
 
-var (
-	errMemorydbClosed   = errors.New("database closed")
-	errMemorydbNotFound = errors.New("not found")
+	"github.com/wang900115/LCA/store"
 )
 
-type MemoryDB interface {
-	Has(key string) (bool, error)
-	Put(key string, value []byte) error
-	Get(key string) ([]byte, error)
-	Delete(key string) error
-}
+// Ensure MemoryDBStore implements store.KeyValueStore interface
+var _ store.KeyValueStore = (*MemoryDBStore)(nil)
 
+// MemoryDBStore is an ephemeral key-value store. Apart from basic data storage
+// functionality it also supports batch writes and iterating over the keyspace in
+// binary-alphabetical order.
 type MemoryDBStore struct {
-	db   map[string][]byte
-	lock sync.RWMutex
+	db    map[string][]byte
+	snaps map[*snapshot]struct{} // Live snapshots, preserving overwritten values
+	lock  sync.RWMutex
 }
 
-func NewMemoryDBStore() MemoryDB {
+func NewMemoryDBStore() store.KeyValueStore {
 	return &MemoryDBStore{
 		db: make(map[string][]byte),
 	}
 }
 
-func (db *MemoryDBStore) Has(key string) (bool, error) {
+// Has checks if the given key exists in the memory store.
+func (db *MemoryDBStore) Has(key []byte) (bool, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 	if db.db == nil {
-		return false, errMemorydbClosed
+		return false, store.ErrClosed
 	}
-	_, exists := db.db[key]
+	_, exists := db.db[string(key)]
 	return exists, nil
 }
 
-func (db *MemoryDBStore) Put(key string, value []byte) error {
+// Put stores a copy of the given key-value pair in the memory store.
+func (db *MemoryDBStore) Put(key []byte, value []byte) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 	if db.db == nil {
-		return errMemorydbClosed
+		return store.ErrClosed
 	}
-	db.db[key] = value
+	db.preserve(string(key))
+	db.db[string(key)] = bytes.Clone(value)
 	return nil
 }
 
-func (db *MemoryDBStore) Get(key string) ([]byte, error) {
+// Get retrieves a copy of the value associated with the given key.
+func (db *MemoryDBStore) Get(key []byte) ([]byte, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 	if db.db == nil {
-		return nil, errMemorydbClosed
+		return nil, store.ErrClosed
 	}
-	value, exists := db.db[key]
+	value, exists := db.db[string(key)]
 	if !exists {
-		return nil, errMemorydbNotFound
+		return nil, store.ErrNotFound
+	}
+	return bytes.Clone(value), nil
+}
+
+// Delete removes the key-value pair associated with the given key.
+func (db *MemoryDBStore) Delete(key []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.db == nil {
+		return store.ErrClosed
+	}
+	db.preserve(string(key))
+	delete(db.db, string(key))
+	return nil
+}
+
+// InsertRange overwrites every existing key within [startKey, endKey) with the given value.
+func (db *MemoryDBStore) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.db == nil {
+		return store.ErrClosed
+	}
+	for key := range db.db {
+		if keyInRange(key, string(startKey), endKey) {
+			db.preserve(key)
+			db.db[key] = bytes.Clone(value)
+		}
+	}
+	return nil
+}
+
+// DeleteRange removes all keys within [startKey, endKey). A nil endKey means
+// the range is unbounded.
+func (db *MemoryDBStore) DeleteRange(startKey []byte, endKey []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.db == nil {
+		return store.ErrClosed
+	}
+	for key := range db.db {
+		if keyInRange(key, string(startKey), endKey) {
+			db.preserve(key)
+			delete(db.db, key)
+		}
+	}
+	return nil
+}
+
+// Stat returns the number of entries and the bytes held by the store.
+func (db *MemoryDBStore) Stat() (map[string]interface{}, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.db == nil {
+		return nil, store.ErrClosed
+	}
+	var size int64
+	for key, value := range db.db {
+		size += int64(len(key) + len(value))
+	}
+	return map[string]interface{}{
+		store.StatMemTableSize: size,
+		"memorydb.count":       int64(len(db.db)),
+	}, nil
+}
+
+// Sync is a no-op for the memory store, there is nothing to flush.
+func (db *MemoryDBStore) Sync() error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.db == nil {
+		return store.ErrClosed
 	}
-	return value, nil
+	return nil
+}
+
+// Compact is a no-op for the memory store, there is nothing to compact.
+func (db *MemoryDBStore) Compact(startKey []byte, endKey []byte) error {
+	return db.Sync()
 }
 
-func (db *MemoryDBStore) Delete(key string) error {
+// NewBatch creates a write-only batch that commits atomically to this store.
+func (db *MemoryDBStore) NewBatch() store.Batch {
+	return &batch{db: db}
+}
+
+// NewBatchWithSize creates a write-only batch with a pre-allocated buffer.
+func (db *MemoryDBStore) NewBatchWithSize(size int) store.Batch {
+	return &batch{db: db, writes: make([]keyvalue, 0, size)}
+}
+
+// NewIterator creates an iterator over the keys with the given prefix,
+// starting at prefix+start. The iterator works on a copy of the matching
+// entries, so later writes to the store are not visible through it.
+func (db *MemoryDBStore) NewIterator(prefix []byte, start []byte) (store.Iterator, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.db == nil {
+		return nil, store.ErrClosed
+	}
+	var (
+		pr     = string(prefix)
+		st     = string(append(bytes.Clone(prefix), start...))
+		keys   = make([]string, 0, len(db.db))
+		values = make([][]byte, 0, len(db.db))
+	)
+	// Collect the keys from the memory database corresponding to the given prefix
+	// and start
+	for key := range db.db {
+		if !strings.HasPrefix(key, pr) {
+			continue
+		}
+		if key >= st {
+			keys = append(keys, key)
+		}
+	}
+	// Sort the items and retrieve the associated values
+	sort.Strings(keys)
+	for _, key := range keys {
+		values = append(values, db.db[key])
+	}
+	return &iterator{
+		index:  -1,
+		keys:   keys,
+		values: values,
+	}, nil
+}
+
+// NewSnapshot creates a copy-on-write view of the current state of the store.
+// Nothing is copied up front; instead every later write saves the value it
+// replaces into the live snapshots.
+func (db *MemoryDBStore) NewSnapshot() (store.Snapshot, error) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 	if db.db == nil {
-		return errMemorydbClosed
+		return nil, store.ErrClosed
+	}
+	snap := &snapshot{db: db, saved: make(map[string]savedValue)}
+	if db.snaps == nil {
+		db.snaps = make(map[*snapshot]struct{})
+	}
+	db.snaps[snap] = struct{}{}
+	return snap, nil
+}
+
+// Close deallocates the internal map and ensures any consecutive data access op
+// fails with an error.
+func (db *MemoryDBStore) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.db = nil
+	for snap := range db.snaps {
+		snap.saved = nil
 	}
-	delete(db.db, key)
+	db.snaps = nil
 	return nil
 }
+
+// preserve saves the current value of key into every live snapshot which has
+// not seen it change yet. It must be called with the write lock held, before
+// the key is modified.
+func (db *MemoryDBStore) preserve(key string) {
+	for snap := range db.snaps {
+		if _, ok := snap.saved[key]; ok {
+			continue
+		}
+		value, exists := db.db[key]
+		snap.saved[key] = savedValue{value: value, exists: exists}
+	}
+}
+
+// keyInRange reports whether key lies within [start, end). A nil end means
+// the range is unbounded.
+func keyInRange(key, start string, end []byte) bool {
+	return key >= start && (end == nil || key < string(end))
+}
+
+// keyvalue is a key-value tuple tagged with a deletion field to allow creating
+// memory-database write batches. A range deletion of [key, end) sets ranged,
+// a nil end meaning the range is unbounded.
+type keyvalue struct {
+	key    string
+	value  []byte
+	delete bool
+	ranged bool
+	end    []byte
+}
+
+// batch is a write-only memory batch that commits changes to its host
+// database when Write is called. A batch cannot be used concurrently.
+type batch struct {
+	db     *MemoryDBStore
+	writes []keyvalue
+	size   int
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	b.writes = append(b.writes, keyvalue{key: string(key), value: bytes.Clone(value)})
+	b.size += len(key) + len(value)
+	return nil
+}
+
+// Delete inserts a key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	b.writes = append(b.writes, keyvalue{key: string(key), delete: true})
+	b.size += len(key)
+	return nil
+}
+
+// InsertRange queues an overwrite of every key currently stored within
+// [startKey, endKey). The affected keys are resolved when the call is made.
+func (b *batch) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	b.db.lock.RLock()
+	defer b.db.lock.RUnlock()
+	if b.db.db == nil {
+		return store.ErrClosed
+	}
+	for key := range b.db.db {
+		if keyInRange(key, string(startKey), endKey) {
+			b.writes = append(b.writes, keyvalue{key: key, value: bytes.Clone(value)})
+			b.size += len(key) + len(value)
+		}
+	}
+	return nil
+}
+
+// DeleteRange queues the removal of every key within [startKey, endKey). The
+// affected keys are resolved when the batch is written, so the keys queued
+// before in the same batch are removed too.
+func (b *batch) DeleteRange(startKey []byte, endKey []byte) error {
+	b.writes = append(b.writes, keyvalue{key: string(startKey), delete: true, ranged: true, end: bytes.Clone(endKey)})
+	b.size += len(startKey) + len(endKey)
+	return nil
+}
+
+// ValueSize retrieves the amount of data queued up for writing.
+func (b *batch) ValueSize() int {
+	return b.size
+}
+
+// Write flushes any accumulated data to the memory database.
+func (b *batch) Write() error {
+	b.db.lock.Lock()
+	defer b.db.lock.Unlock()
+	if b.db.db == nil {
+		return store.ErrClosed
+	}
+	for _, kv := range b.writes {
+		if kv.ranged {
+			for key := range b.db.db {
+				if keyInRange(key, kv.key, kv.end) {
+					b.db.preserve(key)
+					delete(b.db.db, key)
+				}
+			}
+			continue
+		}
+		b.db.preserve(kv.key)
+		if kv.delete {
+			delete(b.db.db, kv.key)
+			continue
+		}
+		b.db.db[kv.key] = kv.value
+	}
+	return nil
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() error {
+	b.writes = b.writes[:0]
+	b.size = 0
+	return nil
+}
+
+// Replay replays the batch contents. Range deletions can only be replayed
+// into writers that also implement store.KeyValueRanger.
+func (b *batch) Replay(w store.KeyValueWriter) error {
+	for _, kv := range b.writes {
+		if kv.ranged {
+			ranger, ok := w.(store.KeyValueRanger)
+			if !ok {
+				return fmt.Errorf("replay target does not support range deletion")
+			}
+			if err := ranger.DeleteRange([]byte(kv.key), kv.end); err != nil {
+				return err
+			}
+			continue
+		}
+		if kv.delete {
+			if err := w.Delete([]byte(kv.key)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.Put([]byte(kv.key), kv.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savedValue is the state of a key at the time a snapshot was taken.
+type savedValue struct {
+	value  []byte
+	exists bool
+}
+
+// snapshot is a point-in-time view of a memory store. Keys changed since the
+// snapshot was taken are answered from saved, all others from the live map.
+type snapshot struct {
+	db    *MemoryDBStore
+	saved map[string]savedValue // Guarded by db.lock, nil once released
+}
+
+// Has retrieves if a key was present when the snapshot was taken.
+func (snap *snapshot) Has(key []byte) (bool, error) {
+	snap.db.lock.RLock()
+	defer snap.db.lock.RUnlock()
+	if snap.saved == nil {
+		return false, store.ErrClosed
+	}
+	if saved, ok := snap.saved[string(key)]; ok {
+		return saved.exists, nil
+	}
+	_, exists := snap.db.db[string(key)]
+	return exists, nil
+}
+
+// Get retrieves a copy of the value a key held when the snapshot was taken.
+func (snap *snapshot) Get(key []byte) ([]byte, error) {
+	snap.db.lock.RLock()
+	defer snap.db.lock.RUnlock()
+	if snap.saved == nil {
+		return nil, store.ErrClosed
+	}
+	value, exists := snap.db.db[string(key)]
+	if saved, ok := snap.saved[string(key)]; ok {
+		value, exists = saved.value, saved.exists
+	}
+	if !exists {
+		return nil, store.ErrNotFound
+	}
+	return bytes.Clone(value), nil
+}
+
+// Release stops tracking writes for the snapshot and drops the saved values.
+func (snap *snapshot) Release() {
+	snap.db.lock.Lock()
+	defer snap.db.lock.Unlock()
+
+	delete(snap.db.snaps, snap)
+	snap.saved = nil
+}
+
+// iterator can walk over the (potentially partial) keyspace of a memory key
+// value store. Internally it is a deep copy of the entire iterated state,
+// sorted by keys.
+type iterator struct {
+	index  int
+	keys   []string
+	values [][]byte
+}
+
+// Next moves the iterator to the next key/value pair. It returns whether the
+// iterator is exhausted.
+func (it *iterator) Next() bool {
+	// Short circuit if iterator is already exhausted in the forward direction.
+	if it.index >= len(it.keys) {
+		return false
+	}
+	it.index += 1
+	return it.index < len(it.keys)
+}
+
+// Error returns any accumulated error. Exhausting all the key/value pairs
+// is not considered to be an error. A memory iterator cannot encounter errors.
+func (it *iterator) Error() error {
+	return nil
+}
+
+// Key returns the key of the current key/value pair, or nil if done. The caller
+// should not modify the contents of the returned slice, and its contents may
+// change on the next call to Next.
+func (it *iterator) Key() []byte {
+	// Short circuit if iterator is not in a valid position
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return []byte(it.keys[it.index])
+}
+
+// Value returns the value of the current key/value pair, or nil if done. The
+// caller should not modify the contents of the returned slice, and its contents
+// may change on the next call to Next.
+func (it *iterator) Value() []byte {
+	// Short circuit if iterator is not in a valid position
+	if it.index < 0 || it.index >= len(it.keys) {
+		return nil
+	}
+	return it.values[it.index]
+}
+
+// Release releases associated resources. Release should always succeed and can
+// be called multiple times without causing error.
+func (it *iterator) Release() {
+	it.index, it.keys, it.values = -1, nil, nil
+}
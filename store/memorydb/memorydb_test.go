@@ -9,6 +9,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/dbtest"
 )
 
 type TestUser struct {
@@ -47,10 +49,10 @@ func TestMemoryDB_BasicOperations(t *testing.T) {
 		data, err := json.Marshal(user)
 		require.NoError(t, err)
 
-		err = db.Put(user.ID, data)
+		err = db.Put([]byte(user.ID), data)
 		assert.NoError(t, err)
 
-		retrievedData, err := db.Get(user.ID)
+		retrievedData, err := db.Get([]byte(user.ID))
 		assert.NoError(t, err)
 		assert.NotNil(t, retrievedData)
 
@@ -68,38 +70,38 @@ func TestMemoryDB_BasicOperations(t *testing.T) {
 		user := &TestUser{ID: "user1", Name: "Alice"}
 		data, _ := json.Marshal(user)
 
-		err := db.Put(user.ID, data)
+		err := db.Put([]byte(user.ID), data)
 		require.NoError(t, err)
 
-		exists, err := db.Has(user.ID)
+		exists, err := db.Has([]byte(user.ID))
 		assert.NoError(t, err)
 		assert.True(t, exists)
 
-		err = db.Delete(user.ID)
+		err = db.Delete([]byte(user.ID))
 		assert.NoError(t, err)
 
-		exists, err = db.Has(user.ID)
+		exists, err = db.Has([]byte(user.ID))
 		assert.NoError(t, err)
 		assert.False(t, exists)
 
-		_, err = db.Get(user.ID)
+		_, err = db.Get([]byte(user.ID))
 		assert.Error(t, err)
-		assert.Equal(t, errMemorydbNotFound, err)
+		assert.Equal(t, store.ErrNotFound, err)
 	})
 
 	t.Run("check data existence", func(t *testing.T) {
 		db := NewMemoryDBStore()
 
-		exists, err := db.Has("nonexistent")
+		exists, err := db.Has([]byte("nonexistent"))
 		assert.NoError(t, err)
 		assert.False(t, exists)
 
 		user := &TestUser{ID: "user1", Name: "Alice"}
 		data, _ := json.Marshal(user)
-		err = db.Put(user.ID, data)
+		err = db.Put([]byte(user.ID), data)
 		require.NoError(t, err)
 
-		exists, err = db.Has(user.ID)
+		exists, err = db.Has([]byte(user.ID))
 		assert.NoError(t, err)
 		assert.True(t, exists)
 	})
@@ -109,25 +111,49 @@ func TestMemoryDB_ErrorHandling(t *testing.T) {
 	t.Run("get nonexistent data", func(t *testing.T) {
 		db := NewMemoryDBStore()
 
-		_, err := db.Get("nonexistent")
+		_, err := db.Get([]byte("nonexistent"))
 		assert.Error(t, err)
-		assert.Equal(t, errMemorydbNotFound, err)
+		assert.Equal(t, store.ErrNotFound, err)
 	})
 
 	t.Run("delete nonexistent data", func(t *testing.T) {
 		db := NewMemoryDBStore()
 
-		err := db.Delete("nonexistent")
+		err := db.Delete([]byte("nonexistent"))
 		assert.NoError(t, err)
 	})
 
 	t.Run("has nonexistent data", func(t *testing.T) {
 		db := NewMemoryDBStore()
 
-		exists, err := db.Has("nonexistent")
+		exists, err := db.Has([]byte("nonexistent"))
 		assert.NoError(t, err)
 		assert.False(t, exists)
 	})
+
+	t.Run("access after close", func(t *testing.T) {
+		db := NewMemoryDBStore()
+		require.NoError(t, db.Put([]byte("key"), []byte("value")))
+		b := db.NewBatch()
+		require.NoError(t, b.Put([]byte("other"), []byte("value")))
+		require.NoError(t, db.Close())
+
+		_, err := db.Has([]byte("key"))
+		assert.Equal(t, store.ErrClosed, err)
+		_, err = db.Get([]byte("key"))
+		assert.Equal(t, store.ErrClosed, err)
+		assert.Equal(t, store.ErrClosed, db.Put([]byte("key"), nil))
+		assert.Equal(t, store.ErrClosed, db.Delete([]byte("key")))
+		assert.Equal(t, store.ErrClosed, b.Write())
+		_, err = db.NewIterator(nil, nil)
+		assert.Equal(t, store.ErrClosed, err)
+	})
+}
+
+func TestMemoryDB_Suite(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() store.KeyValueStore {
+		return NewMemoryDBStore()
+	})
 }
 
 func TestMemoryDB_ConcurrentOperations(t *testing.T) {
@@ -153,7 +179,7 @@ func TestMemoryDB_ConcurrentOperations(t *testing.T) {
 					data, err := json.Marshal(user)
 					require.NoError(t, err)
 
-					err = db.Put(user.ID, data)
+					err = db.Put([]byte(user.ID), data)
 					assert.NoError(t, err)
 				}
 			}(i)
@@ -167,11 +193,11 @@ func TestMemoryDB_ConcurrentOperations(t *testing.T) {
 				for j := 0; j < numOperations; j++ {
 					userID := fmt.Sprintf("user-%d-%d", id, j)
 
-					exists, err := db.Has(userID)
+					exists, err := db.Has([]byte(userID))
 					assert.NoError(t, err)
 
 					if exists {
-						_, err := db.Get(userID)
+						_, err := db.Get([]byte(userID))
 						assert.NoError(t, err)
 					}
 				}
@@ -186,7 +212,7 @@ func TestMemoryDB_ConcurrentOperations(t *testing.T) {
 		for i := 0; i < numGoroutines; i++ {
 			for j := 0; j < numOperations; j++ {
 				userID := fmt.Sprintf("user-%d-%d", i, j)
-				exists, err := db.Has(userID)
+				exists, err := db.Has([]byte(userID))
 				assert.NoError(t, err)
 				if exists {
 					actualCount++
@@ -207,7 +233,7 @@ func TestMemoryDB_ConcurrentOperations(t *testing.T) {
 				Name: fmt.Sprintf("User%d", i),
 			}
 			data, _ := json.Marshal(user)
-			err := db.Put(user.ID, data)
+			err := db.Put([]byte(user.ID), data)
 			require.NoError(t, err)
 		}
 
@@ -219,7 +245,7 @@ func TestMemoryDB_ConcurrentOperations(t *testing.T) {
 				defer wg.Done()
 
 				userID := fmt.Sprintf("user-%d", id)
-				err := db.Delete(userID)
+				err := db.Delete([]byte(userID))
 				assert.NoError(t, err)
 			}(i)
 		}
@@ -228,14 +254,14 @@ func TestMemoryDB_ConcurrentOperations(t *testing.T) {
 
 		for i := 0; i < 50; i++ {
 			userID := fmt.Sprintf("user-%d", i)
-			exists, err := db.Has(userID)
+			exists, err := db.Has([]byte(userID))
 			assert.NoError(t, err)
 			assert.False(t, exists)
 		}
 
 		for i := 50; i < numUsers; i++ {
 			userID := fmt.Sprintf("user-%d", i)
-			exists, err := db.Has(userID)
+			exists, err := db.Has([]byte(userID))
 			assert.NoError(t, err)
 			assert.True(t, exists)
 		}
@@ -256,11 +282,11 @@ func TestMemoryDB_DataIntegrity(t *testing.T) {
 
 		data, err := json.Marshal(originalUser)
 		require.NoError(t, err)
-		err = db.Put(originalUser.ID, data)
+		err = db.Put([]byte(originalUser.ID), data)
 		require.NoError(t, err)
 
 		for i := 0; i < 10; i++ {
-			retrievedData, err := db.Get(originalUser.ID)
+			retrievedData, err := db.Get([]byte(originalUser.ID))
 			assert.NoError(t, err)
 
 			var retrievedUser TestUser
@@ -283,10 +309,10 @@ func TestMemoryDB_DataIntegrity(t *testing.T) {
 
 		updatedData, err := json.Marshal(updatedUser)
 		require.NoError(t, err)
-		err = db.Put(updatedUser.ID, updatedData)
+		err = db.Put([]byte(updatedUser.ID), updatedData)
 		require.NoError(t, err)
 
-		retrievedData, err := db.Get(updatedUser.ID)
+		retrievedData, err := db.Get([]byte(updatedUser.ID))
 		assert.NoError(t, err)
 
 		var finalUser TestUser
@@ -331,16 +357,16 @@ func TestMemoryDB_MessagingScenarios(t *testing.T) {
 			data, err := json.Marshal(msg)
 			require.NoError(t, err)
 
-			err = db.Put(msg.ID, data)
+			err = db.Put([]byte(msg.ID), data)
 			assert.NoError(t, err)
 		}
 
 		for _, msg := range messages {
-			exists, err := db.Has(msg.ID)
+			exists, err := db.Has([]byte(msg.ID))
 			assert.NoError(t, err)
 			assert.True(t, exists)
 
-			data, err := db.Get(msg.ID)
+			data, err := db.Get([]byte(msg.ID))
 			assert.NoError(t, err)
 
 			var retrieved TestMessage
@@ -373,17 +399,17 @@ func TestMemoryDB_MessagingScenarios(t *testing.T) {
 
 			// 使用 "contact:" 前缀来区分不同类型的数据
 			key := "contact:" + contact.DID
-			err = db.Put(key, data)
+			err = db.Put([]byte(key), data)
 			assert.NoError(t, err)
 		}
 
 		for _, contact := range contacts {
 			key := "contact:" + contact.DID
-			exists, err := db.Has(key)
+			exists, err := db.Has([]byte(key))
 			assert.NoError(t, err)
 			assert.True(t, exists)
 
-			data, err := db.Get(key)
+			data, err := db.Get([]byte(key))
 			assert.NoError(t, err)
 
 			var retrieved Contact
@@ -395,6 +421,119 @@ func TestMemoryDB_MessagingScenarios(t *testing.T) {
 	})
 }
 
+func TestMemoryDB_Batch(t *testing.T) {
+	t.Run("write applies queued operations", func(t *testing.T) {
+		db := NewMemoryDBStore()
+		require.NoError(t, db.Put([]byte("stale"), []byte("v")))
+
+		b := db.NewBatch()
+		require.NoError(t, b.Put([]byte("k1"), []byte("v1")))
+		require.NoError(t, b.Put([]byte("k2"), []byte("v2")))
+		require.NoError(t, b.Delete([]byte("stale")))
+		assert.Equal(t, 2+2+2+2+5, b.ValueSize())
+
+		exists, err := db.Has([]byte("k1"))
+		assert.NoError(t, err)
+		assert.False(t, exists, "batch visible before Write")
+
+		require.NoError(t, b.Write())
+
+		value, err := db.Get([]byte("k2"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v2"), value)
+
+		exists, err = db.Has([]byte("stale"))
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("range operations", func(t *testing.T) {
+		db := NewMemoryDBStore()
+		for _, key := range []string{"a", "b", "c", "d"} {
+			require.NoError(t, db.Put([]byte(key), []byte(key)))
+		}
+
+		b := db.NewBatch()
+		require.NoError(t, b.InsertRange([]byte("a"), []byte("c"), []byte("x")))
+		require.NoError(t, b.DeleteRange([]byte("c"), nil))
+		require.NoError(t, b.Write())
+
+		for key, want := range map[string]string{"a": "x", "b": "x"} {
+			value, err := db.Get([]byte(key))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(want), value)
+		}
+		for _, key := range []string{"c", "d"} {
+			exists, err := db.Has([]byte(key))
+			assert.NoError(t, err)
+			assert.False(t, exists)
+		}
+	})
+
+	t.Run("reset and replay", func(t *testing.T) {
+		db := NewMemoryDBStore()
+
+		b := db.NewBatchWithSize(2)
+		require.NoError(t, b.Put([]byte("k1"), []byte("v1")))
+		require.NoError(t, b.Reset())
+		assert.Equal(t, 0, b.ValueSize())
+
+		require.NoError(t, b.Put([]byte("k2"), []byte("v2")))
+		require.NoError(t, b.Delete([]byte("k3")))
+
+		other := db.NewBatch()
+		require.NoError(t, b.Replay(other))
+		require.NoError(t, other.Write())
+
+		exists, err := db.Has([]byte("k1"))
+		assert.NoError(t, err)
+		assert.False(t, exists)
+
+		value, err := db.Get([]byte("k2"))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v2"), value)
+	})
+}
+
+func TestMemoryDB_Iterator(t *testing.T) {
+	db := NewMemoryDBStore()
+	for _, key := range []string{"contact:bob", "contact:alice", "msg:1", "contact:carol"} {
+		require.NoError(t, db.Put([]byte(key), []byte(key)))
+	}
+
+	collect := func(prefix, start string) []string {
+		it, err := db.NewIterator([]byte(prefix), []byte(start))
+		require.NoError(t, err)
+		defer it.Release()
+
+		var keys []string
+		for it.Next() {
+			assert.Equal(t, it.Key(), it.Value())
+			keys = append(keys, string(it.Key()))
+		}
+		assert.NoError(t, it.Error())
+		return keys
+	}
+
+	assert.Equal(t, []string{"contact:alice", "contact:bob", "contact:carol", "msg:1"}, collect("", ""))
+	assert.Equal(t, []string{"contact:alice", "contact:bob", "contact:carol"}, collect("contact:", ""))
+	assert.Equal(t, []string{"contact:bob", "contact:carol"}, collect("contact:", "b"))
+	assert.Empty(t, collect("peer:", ""))
+
+	t.Run("snapshot of the keyspace", func(t *testing.T) {
+		it, err := db.NewIterator([]byte("msg:"), nil)
+		require.NoError(t, err)
+		defer it.Release()
+
+		require.NoError(t, db.Put([]byte("msg:2"), []byte("msg:2")))
+		var count int
+		for it.Next() {
+			count++
+		}
+		assert.Equal(t, 1, count)
+	})
+}
+
 func TestMemoryDB_PerformanceBasic(t *testing.T) {
 	t.Run("large dataset performance test", func(t *testing.T) {
 		if testing.Short() {
@@ -415,7 +554,7 @@ func TestMemoryDB_PerformanceBasic(t *testing.T) {
 			data, err := json.Marshal(user)
 			require.NoError(t, err)
 
-			err = db.Put(user.ID, data)
+			err = db.Put([]byte(user.ID), data)
 			require.NoError(t, err)
 		}
 		insertDuration := time.Since(start)
@@ -424,7 +563,7 @@ func TestMemoryDB_PerformanceBasic(t *testing.T) {
 		start = time.Now()
 		for i := 0; i < 1000; i++ {
 			userID := fmt.Sprintf("user-%d", i)
-			_, err := db.Get(userID)
+			_, err := db.Get([]byte(userID))
 			assert.NoError(t, err)
 		}
 		queryDuration := time.Since(start)
@@ -433,7 +572,7 @@ func TestMemoryDB_PerformanceBasic(t *testing.T) {
 		start = time.Now()
 		for i := 0; i < 1000; i++ {
 			userID := fmt.Sprintf("user-%d", i)
-			exists, err := db.Has(userID)
+			exists, err := db.Has([]byte(userID))
 			assert.NoError(t, err)
 			assert.True(t, exists)
 		}
@@ -462,7 +601,7 @@ func BenchmarkMemoryDB_Put(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		err := db.Put(users[i].ID, data[i])
+		err := db.Put([]byte(users[i].ID), data[i])
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -478,7 +617,7 @@ func BenchmarkMemoryDB_Get(b *testing.B) {
 			Name: fmt.Sprintf("User%d", i),
 		}
 		data, _ := json.Marshal(user)
-		err := db.Put(user.ID, data)
+		err := db.Put([]byte(user.ID), data)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -487,7 +626,7 @@ func BenchmarkMemoryDB_Get(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		userID := fmt.Sprintf("user-%d", i%1000)
-		_, err := db.Get(userID)
+		_, err := db.Get([]byte(userID))
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -503,7 +642,7 @@ func BenchmarkMemoryDB_Has(b *testing.B) {
 			Name: fmt.Sprintf("User%d", i),
 		}
 		data, _ := json.Marshal(user)
-		err := db.Put(user.ID, data)
+		err := db.Put([]byte(user.ID), data)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -512,7 +651,7 @@ func BenchmarkMemoryDB_Has(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		userID := fmt.Sprintf("user-%d", i%1000)
-		_, err := db.Has(userID)
+		_, err := db.Has([]byte(userID))
 		if err != nil {
 			b.Fatal(err)
 		}
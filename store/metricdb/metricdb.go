@@ -0,0 +1,260 @@
+// Package metricdb implements a store.KeyValueStore decorator which records
+// operation counts, latencies and engine statistics into a metric.Registry.
+//
+// Every metric is registered under the namespace given to NewMetricDBStore:
+//
+//	get/count, get/time, get/hit, get/miss, get/hitratio
+//	has/count, has/time, put/count, put/time, delete/count, delete/time
+//	batch/size, batch/time
+//
+// Engine statistics returned by Stat are exported as gauges: the common keys
+// under their own names, per level values as level/<n>/size and
+// level/<n>/files, and engine specific numbers with dots turned into slashes,
+// such as pebble/blockcache/hits. Every pair of hits and misses counters also
+// gets a hitratio gauge next to it.
+package metricdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wang900115/LCA/metric"
+	"github.com/wang900115/LCA/store"
+)
+
+// Ensure MetricDBStore implements store.KeyValueStore interface
+var _ store.KeyValueStore = (*MetricDBStore)(nil)
+
+// Names of the common Stat keys in the registry.
+var statNames = map[string]string{
+	store.StatMemTableSize:   "memtable/size",
+	store.StatCompactionDebt: "compaction/debt",
+	store.StatDiskSize:       "disk/size",
+}
+
+// timed pairs the counter and latency timer of one operation.
+type timed struct {
+	count *metric.Counter
+	time  *metric.ResettingTimer
+}
+
+func newTimed(namespace, name string, r metric.Registry) timed {
+	return timed{
+		count: metric.GetOrRegisterCounter(namespace+name+"/count", r),
+		time:  metric.GetOrRegisterResettingTimer(namespace+name+"/time", r),
+	}
+}
+
+// mark records one operation which started at start.
+func (t timed) mark(start time.Time) {
+	t.count.Inc(1)
+	t.time.UpdateSince(start)
+}
+
+// MetricDBStore records metrics about the operations on an underlying
+// key-value store. Operations which are not metered pass straight through.
+type MetricDBStore struct {
+	store.KeyValueStore
+
+	namespace string
+	registry  metric.Registry
+
+	get, has, put, delete timed
+	getHit, getMiss       *metric.Counter
+	getHitRatio           *metric.GaugeFloat64
+	batchSize             metric.Histogram
+	batchTime             *metric.ResettingTimer
+
+	quit      chan struct{} // Stops the stats refresh loop
+	done      chan struct{} // Closed once the refresh loop returned
+	closeOnce sync.Once
+}
+
+// NewMetricDBStore wraps db, registering its metrics in r under namespace.
+// The engine statistics are refreshed every refresh interval until the store
+// is closed; a non-positive interval disables the refresh. A nil registry
+// means metric.DefaultRegistry. The wrapper takes ownership of db.
+func NewMetricDBStore(db store.KeyValueStore, namespace string, r metric.Registry, refresh time.Duration) *MetricDBStore {
+	if r == nil {
+		r = metric.DefaultRegistry
+	}
+	m := &MetricDBStore{
+		KeyValueStore: db,
+		namespace:     namespace,
+		registry:      r,
+		get:           newTimed(namespace, "get", r),
+		has:           newTimed(namespace, "has", r),
+		put:           newTimed(namespace, "put", r),
+		delete:        newTimed(namespace, "delete", r),
+		getHit:        metric.GetOrRegisterCounter(namespace+"get/hit", r),
+		getMiss:       metric.GetOrRegisterCounter(namespace+"get/miss", r),
+		getHitRatio:   metric.GetOrRegisterGaugeFloat64(namespace+"get/hitratio", r),
+		batchSize:     metric.GetOrRegisterHistogram(namespace+"batch/size", r, metric.NewExpDecaySample(1028, 0.015)),
+		batchTime:     metric.GetOrRegisterResettingTimer(namespace+"batch/time", r),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if refresh > 0 {
+		go m.meter(refresh)
+	} else {
+		close(m.done)
+	}
+	return m
+}
+
+// Has checks if the given key exists, counting and timing the lookup.
+func (db *MetricDBStore) Has(key []byte) (bool, error) {
+	defer db.has.mark(time.Now())
+	return db.KeyValueStore.Has(key)
+}
+
+// Get retrieves the value for the given key, counting hits and misses.
+func (db *MetricDBStore) Get(key []byte) ([]byte, error) {
+	defer db.get.mark(time.Now())
+	value, err := db.KeyValueStore.Get(key)
+	switch {
+	case err == nil:
+		db.getHit.Inc(1)
+	case errors.Is(err, store.ErrNotFound):
+		db.getMiss.Inc(1)
+	}
+	return value, err
+}
+
+// Put stores the given key-value pair, counting and timing the write.
+func (db *MetricDBStore) Put(key []byte, value []byte) error {
+	defer db.put.mark(time.Now())
+	return db.KeyValueStore.Put(key, value)
+}
+
+// Delete removes the given key, counting and timing the write.
+func (db *MetricDBStore) Delete(key []byte) error {
+	defer db.delete.mark(time.Now())
+	return db.KeyValueStore.Delete(key)
+}
+
+// NewBatch creates a write-only batch whose writes are metered.
+func (db *MetricDBStore) NewBatch() store.Batch {
+	return &batch{Batch: db.KeyValueStore.NewBatch(), db: db}
+}
+
+// NewBatchWithSize creates a write-only batch with a pre-allocated buffer
+// whose writes are metered.
+func (db *MetricDBStore) NewBatchWithSize(size int) store.Batch {
+	return &batch{Batch: db.KeyValueStore.NewBatchWithSize(size), db: db}
+}
+
+// Close stops refreshing the engine statistics and closes the underlying store.
+func (db *MetricDBStore) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.quit)
+	})
+	<-db.done
+	return db.KeyValueStore.Close()
+}
+
+// meter periodically refreshes the engine statistics until the store is closed.
+func (db *MetricDBStore) meter(refresh time.Duration) {
+	defer close(db.done)
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A failing Stat leaves the gauges at their last values, the
+			// store reports the failure to its own callers
+			db.updateStats()
+		case <-db.quit:
+			return
+		}
+	}
+}
+
+// updateStats exports the statistics of the underlying store as gauges.
+func (db *MetricDBStore) updateStats() error {
+	hits, misses := db.getHit.Snapshot().Count(), db.getMiss.Snapshot().Count()
+	if hits+misses > 0 {
+		db.getHitRatio.Update(float64(hits) / float64(hits+misses))
+	}
+	stats, err := db.KeyValueStore.Stat()
+	if err != nil {
+		return err
+	}
+	for key, value := range stats {
+		switch key {
+		case store.StatLevelSizes, store.StatLevelFiles:
+			levels, ok := value.([]int64)
+			if !ok {
+				continue
+			}
+			suffix := "size"
+			if key == store.StatLevelFiles {
+				suffix = "files"
+			}
+			for i, v := range levels {
+				db.gauge(fmt.Sprintf("level/%d/%s", i, suffix)).Update(v)
+			}
+			continue
+		}
+		v, ok := statValue(value)
+		if !ok {
+			continue
+		}
+		name, ok := statNames[key]
+		if !ok {
+			name = strings.ReplaceAll(key, ".", "/")
+		}
+		db.gauge(name).Update(v)
+
+		// Derive the hit ratio of every cache reporting hits and misses
+		if prefix, found := strings.CutSuffix(key, ".hits"); found {
+			if misses, ok := statValue(stats[prefix+".misses"]); ok && v+misses > 0 {
+				ratio := metric.GetOrRegisterGaugeFloat64(db.namespace+strings.ReplaceAll(prefix, ".", "/")+"/hitratio", db.registry)
+				ratio.Update(float64(v) / float64(v+misses))
+			}
+		}
+	}
+	return nil
+}
+
+// gauge returns the named gauge of the store, registering it on first use.
+func (db *MetricDBStore) gauge(name string) *metric.Gauge {
+	return metric.GetOrRegisterGauge(db.namespace+name, db.registry)
+}
+
+// statValue converts a numeric Stat value to a gauge value.
+func statValue(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	case time.Duration:
+		return int64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// batch meters the size and latency of the batch writes.
+type batch struct {
+	store.Batch
+	db *MetricDBStore
+}
+
+// Write flushes the batch to the underlying store, recording its size.
+func (b *batch) Write() error {
+	defer b.db.batchTime.UpdateSince(time.Now())
+	b.db.batchSize.Update(int64(b.Batch.ValueSize()))
+	return b.Batch.Write()
+}
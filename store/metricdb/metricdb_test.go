@@ -0,0 +1,107 @@
+package metricdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/metric"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/dbtest"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+// statStore reports fixed engine statistics on top of a memory store.
+type statStore struct {
+	store.KeyValueStore
+	stats map[string]interface{}
+}
+
+func (s *statStore) Stat() (map[string]interface{}, error) {
+	return s.stats, nil
+}
+
+func TestMetricDB_Suite(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() store.KeyValueStore {
+		return NewMetricDBStore(memorydb.NewMemoryDBStore(), "db/", metric.NewRegistry(), 0)
+	})
+}
+
+func TestMetricDB_Operations(t *testing.T) {
+	r := metric.NewRegistry()
+	db := NewMetricDBStore(memorydb.NewMemoryDBStore(), "db/", r, 0)
+	defer db.Close()
+
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Delete([]byte("b")))
+	_, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	_, err = db.Get([]byte("b"))
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	_, err = db.Has([]byte("a"))
+	require.NoError(t, err)
+
+	b := db.NewBatch()
+	require.NoError(t, b.Put([]byte("c"), []byte("1234")))
+	require.NoError(t, b.Write())
+
+	counts := map[string]int64{
+		"db/get/count": 2, "db/get/hit": 1, "db/get/miss": 1,
+		"db/has/count": 1, "db/put/count": 2, "db/delete/count": 1,
+	}
+	for name, want := range counts {
+		assert.Equal(t, want, r.Get(name).(*metric.Counter).Snapshot().Count(), name)
+	}
+	assert.Equal(t, 2, r.Get("db/put/time").(*metric.ResettingTimer).Snapshot().Count())
+	assert.Equal(t, int64(1), r.Get("db/batch/size").(metric.Histogram).Snapshot().Count())
+	assert.Equal(t, int64(5), r.Get("db/batch/size").(metric.Histogram).Snapshot().Max())
+
+	require.NoError(t, db.updateStats())
+	assert.Equal(t, 0.5, r.Get("db/get/hitratio").(*metric.GaugeFloat64).Snapshot().Value())
+	assert.Equal(t, int64(2), r.Get("db/memorydb/count").(*metric.Gauge).Snapshot().Value())
+	assert.NotNil(t, r.Get("db/memtable/size"))
+}
+
+func TestMetricDB_EngineStats(t *testing.T) {
+	r := metric.NewRegistry()
+	db := NewMetricDBStore(&statStore{
+		KeyValueStore: memorydb.NewMemoryDBStore(),
+		stats: map[string]interface{}{
+			store.StatLevelSizes:       []int64{10, 20},
+			store.StatLevelFiles:       []int64{1, 2},
+			store.StatCompactionDebt:   int64(300),
+			"pebble.blockcache.hits":   int64(3),
+			"pebble.blockcache.misses": int64(1),
+			"leveldb.writepaused":      true,
+			"leveldb.io.read":          uint64(42),
+			"engine.name":              "ignored",
+		},
+	}, "db/", r, time.Millisecond)
+	defer db.Close()
+
+	gauges := map[string]int64{
+		"db/level/0/size": 10, "db/level/1/size": 20,
+		"db/level/0/files": 1, "db/level/1/files": 2,
+		"db/compaction/debt":          300,
+		"db/pebble/blockcache/hits":   3,
+		"db/pebble/blockcache/misses": 1,
+		"db/leveldb/writepaused":      1,
+		"db/leveldb/io/read":          42,
+	}
+	// The refresh loop picks the statistics up on its own
+	require.Eventually(t, func() bool {
+		for name, want := range gauges {
+			if g, ok := r.Get(name).(*metric.Gauge); !ok || g.Snapshot().Value() != want {
+				return false
+			}
+		}
+		g, ok := r.Get("db/pebble/blockcache/hitratio").(*metric.GaugeFloat64)
+		return ok && g.Snapshot().Value() == 0.75
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, r.Get("db/engine/name"))
+
+	require.NoError(t, db.Close())
+	require.NoError(t, db.Close())
+}
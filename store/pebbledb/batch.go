@@ -0,0 +1,182 @@
+package pebbledb
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/wang900115/LCA/store"
+)
+
+// batch is a write-only batch that commits changes to its host database
+// when Write is called. A batch cannot be used concurrently.
+type batch struct {
+	db   *PebbleDBStore
+	b    *pebble.Batch
+	size int
+	end  []byte      // Key right after the largest key queued
+	open []openRange // Range deletions without end, in queue order
+}
+
+// openRange is a range deletion without end, queued before the operation at
+// index of the batch. Its end is resolved when the batch is written.
+type openRange struct {
+	start []byte
+	index uint32
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	if err := b.b.Set(key, value, nil); err != nil {
+		return err
+	}
+	if end := append(bytes.Clone(key), 0x00); bytes.Compare(end, b.end) > 0 {
+		b.end = end
+	}
+	b.size += len(key) + len(value)
+	return nil
+}
+
+// Delete inserts a key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	if err := b.b.Delete(key, nil); err != nil {
+		return err
+	}
+	b.size += len(key)
+	return nil
+}
+
+// InsertRange queues an overwrite of every key currently stored within
+// [startKey, endKey). The affected keys are resolved when the call is made.
+func (b *batch) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	b.db.quitLock.RLock()
+	defer b.db.quitLock.RUnlock()
+	if b.db.closed {
+		return store.ErrClosed
+	}
+	before := b.b.Count()
+	if err := insertRange(b.db.DB, b.b, startKey, endKey, value); err != nil {
+		return storeError(err)
+	}
+	b.size += int(b.b.Count()-before) * len(value)
+	return nil
+}
+
+// DeleteRange queues a native range tombstone covering [startKey, endKey). A
+// nil endKey is bounded by the keys stored or queued when the batch is
+// written, as pebble has no key sorting after every other.
+func (b *batch) DeleteRange(startKey []byte, endKey []byte) error {
+	if endKey == nil {
+		b.open = append(b.open, openRange{start: bytes.Clone(startKey), index: b.b.Count()})
+		b.size += len(startKey)
+		return nil
+	}
+	if err := b.b.DeleteRange(startKey, endKey, nil); err != nil {
+		return err
+	}
+	b.size += len(startKey) + len(endKey)
+	return nil
+}
+
+// each calls op with the queued operations in order, and open with the start
+// of every range deletion without end where it was queued.
+func (b *batch) each(op func(kind pebble.InternalKeyKind, key, value []byte) error, open func(start []byte) error) error {
+	reader := b.b.Reader()
+	pending := b.open
+	for i := uint32(0); ; i++ {
+		for len(pending) > 0 && pending[0].index == i {
+			if err := open(pending[0].start); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
+		kind, k, v, ok, err := reader.Next()
+		if !ok || err != nil {
+			return err
+		}
+		if err := op(kind, k, v); err != nil {
+			return err
+		}
+	}
+}
+
+// ValueSize retrieves the amount of data queued up for writing.
+func (b *batch) ValueSize() int {
+	return b.size
+}
+
+// Write flushes any accumulated data to disk.
+func (b *batch) Write() error {
+	b.db.quitLock.RLock()
+	defer b.db.quitLock.RUnlock()
+	if b.db.closed {
+		return store.ErrClosed
+	}
+	if len(b.open) == 0 {
+		return storeError(b.db.DB.Apply(b.b, pebble.Sync))
+	}
+	// Rebuild the batch with the open ranges ending after the last key
+	end, err := endOfKeys(b.db.DB)
+	if err != nil {
+		return storeError(err)
+	}
+	if bytes.Compare(b.end, end) > 0 {
+		end = b.end
+	}
+	wb := b.db.DB.NewBatch()
+	defer wb.Close()
+	err = b.each(func(kind pebble.InternalKeyKind, k, v []byte) error {
+		switch kind {
+		case pebble.InternalKeyKindSet:
+			return wb.Set(k, v, nil)
+		case pebble.InternalKeyKindDelete:
+			return wb.Delete(k, nil)
+		case pebble.InternalKeyKindRangeDelete:
+			return wb.DeleteRange(k, v, nil)
+		}
+		return fmt.Errorf("unhandled batch operation %s", kind)
+	}, func(start []byte) error {
+		if bytes.Compare(start, end) >= 0 {
+			return nil
+		}
+		return wb.DeleteRange(start, end, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return storeError(b.db.DB.Apply(wb, pebble.Sync))
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() error {
+	b.b.Reset()
+	b.size = 0
+	b.end = nil
+	b.open = nil
+	return nil
+}
+
+// Replay replays the batch contents. Range deletions can only be replayed
+// into writers that also implement store.KeyValueRanger.
+func (b *batch) Replay(w store.KeyValueWriter) error {
+	deleteRange := func(start, end []byte) error {
+		ranger, ok := w.(store.KeyValueRanger)
+		if !ok {
+			return fmt.Errorf("replay target does not support range deletion")
+		}
+		return ranger.DeleteRange(start, end)
+	}
+	return b.each(func(kind pebble.InternalKeyKind, k, v []byte) error {
+		switch kind {
+		case pebble.InternalKeyKindSet:
+			return w.Put(k, v)
+		case pebble.InternalKeyKindDelete:
+			return w.Delete(k)
+		case pebble.InternalKeyKindRangeDelete:
+			return deleteRange(k, v)
+		}
+		return fmt.Errorf("unhandled batch operation %s", kind)
+	}, func(start []byte) error {
+		return deleteRange(start, nil)
+	})
+}
@@ -1,60 +1,409 @@
 package pebbledb
 
-import "github.com/cockroachdb/pebble"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
 
-type PebbleStore interface {
-	Has(key []byte) (bool, error)
-	Put(key []byte, value []byte) error
-	Get(key []byte) ([]byte, error)
-	Delete(key []byte) error
-	Close() error
-}
+	"github.com/cockroachdb/pebble"
+	"github.com/wang900115/LCA/store"
+)
+
+// Ensure PebbleDBStore implements store.KeyValueStore interface
+var _ store.KeyValueStore = (*PebbleDBStore)(nil)
 
 type PebbleDBStore struct {
 	DB *pebble.DB
+
+	readonly bool         // Whether the store was opened in read-only mode
+	quitLock sync.RWMutex // Mutex protecting the closed flag
+	closed   bool         // Pebble panics when used after Close, so track it here
+}
+
+func NewPebbleDBStore(path string) (store.KeyValueStore, error) {
+	return openPebble(path, false)
+}
+
+// NewPebbleDBStoreReadOnly opens an existing Pebble store in read-only mode.
+// Every write fails with store.ErrReadOnly.
+func NewPebbleDBStoreReadOnly(path string) (store.KeyValueStore, error) {
+	return openPebble(path, true)
 }
 
-func NewPebbleDBStore(path string) (PebbleStore, error) {
-	db, err := pebble.Open(path, &pebble.Options{})
+func openPebble(path string, readonly bool) (store.KeyValueStore, error) {
+	db, err := pebble.Open(path, &pebble.Options{
+		ReadOnly:         readonly,
+		ErrorIfNotExists: readonly,
+	})
 	if err != nil {
-		return nil, err
+		return nil, storeError(err)
 	}
 	return &PebbleDBStore{
-		DB: db,
+		DB:       db,
+		readonly: readonly,
 	}, nil
 }
 
+// storeError converts a Pebble error into its store counterpart.
+func storeError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, pebble.ErrNotFound):
+		return store.ErrNotFound
+	case errors.Is(err, pebble.ErrClosed):
+		return store.ErrClosed
+	case errors.Is(err, pebble.ErrReadOnly):
+		return store.ErrReadOnly
+	case pebble.IsCorruptionError(err):
+		return fmt.Errorf("%w: %v", store.ErrCorrupted, err)
+	}
+	return err
+}
+
 // Has checks if the given key exists in the Pebble store.
 func (db *PebbleDBStore) Has(key []byte) (bool, error) {
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return false, store.ErrClosed
+	}
 	_, closer, err := db.DB.Get(key)
-	if err != nil {
-		return false, err
+	if err == pebble.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, storeError(err)
 	}
-	defer closer.Close()
+	closer.Close()
 	return true, nil
 }
 
 // Put stores the given key-value pair in the Pebble store.
 func (db *PebbleDBStore) Put(key []byte, value []byte) error {
-	return db.DB.Set(key, value, pebble.Sync)
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return store.ErrClosed
+	}
+	return storeError(db.DB.Set(key, value, pebble.Sync))
 }
 
 // Get retrieves the value associated with the given key from the Pebble store.
 func (db *PebbleDBStore) Get(key []byte) ([]byte, error) {
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return nil, store.ErrClosed
+	}
 	value, closer, err := db.DB.Get(key)
 	if err != nil {
-		return nil, err
+		return nil, storeError(err)
 	}
 	defer closer.Close()
-	return value, nil
+	// The returned slice is only valid until the closer is released.
+	return bytes.Clone(value), nil
 }
 
 // Delete removes the key-value pair associated with the given key from the Pebble store.
 func (db *PebbleDBStore) Delete(key []byte) error {
-	return db.DB.Delete(key, pebble.Sync)
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return store.ErrClosed
+	}
+	return storeError(db.DB.Delete(key, pebble.Sync))
+}
+
+// InsertRange overwrites every existing key within [startKey, endKey) with the given value.
+func (db *PebbleDBStore) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return store.ErrClosed
+	}
+	b := db.DB.NewBatch()
+	if err := insertRange(db.DB, b, startKey, endKey, value); err != nil {
+		b.Close()
+		return storeError(err)
+	}
+	return storeError(b.Commit(pebble.Sync))
+}
+
+// DeleteRange removes all keys within [startKey, endKey) using a native range
+// tombstone. A nil endKey means the range is unbounded.
+func (db *PebbleDBStore) DeleteRange(startKey []byte, endKey []byte) error {
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return store.ErrClosed
+	}
+	if endKey == nil {
+		end, err := endOfKeys(db.DB)
+		if end == nil || err != nil {
+			return storeError(err)
+		}
+		endKey = end
+	}
+	return storeError(db.DB.DeleteRange(startKey, endKey, pebble.Sync))
+}
+
+// Stat returns the Pebble metrics gathered by the engine.
+func (db *PebbleDBStore) Stat() (map[string]interface{}, error) {
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return nil, store.ErrClosed
+	}
+	m := db.DB.Metrics()
+	levelSizes := make([]int64, len(m.Levels))
+	levelFiles := make([]int64, len(m.Levels))
+	for i, level := range m.Levels {
+		levelSizes[i] = level.Size
+		levelFiles[i] = level.NumFiles
+	}
+	return map[string]interface{}{
+		store.StatLevelSizes:        levelSizes,
+		store.StatLevelFiles:        levelFiles,
+		store.StatMemTableSize:      int64(m.MemTable.Size),
+		store.StatCompactionDebt:    int64(m.Compact.EstimatedDebt),
+		store.StatDiskSize:          int64(m.DiskSpaceUsage()),
+		"pebble.compact.count":      m.Compact.Count,
+		"pebble.compact.inprogress": m.Compact.NumInProgress,
+		"pebble.memtable.count":     m.MemTable.Count,
+		"pebble.wal.size":           int64(m.WAL.Size),
+		"pebble.blockcache.size":    m.BlockCache.Size,
+		"pebble.blockcache.hits":    m.BlockCache.Hits,
+		"pebble.blockcache.misses":  m.BlockCache.Misses,
+		"pebble.readamp":            int64(m.ReadAmp()),
+	}, nil
+}
+
+// Sync flushes the Pebble write-ahead log to disk. Pebble refuses to sync an
+// empty batch, so an empty log record is written with the sync flag set. A
+// read-only store has nothing to flush.
+func (db *PebbleDBStore) Sync() error {
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return store.ErrClosed
+	}
+	if db.readonly {
+		return nil
+	}
+	return storeError(db.DB.LogData(nil, pebble.Sync))
+}
+
+// Compact flattens the underlying data store for the given key range. A nil
+// startKey starts at the beginning of the key space and a nil endKey runs
+// to the end of it.
+func (db *PebbleDBStore) Compact(startKey []byte, endKey []byte) error {
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return store.ErrClosed
+	}
+	if endKey == nil {
+		end, err := endOfKeys(db.DB)
+		if end == nil || err != nil {
+			return storeError(err)
+		}
+		endKey = end
+	}
+	return storeError(db.DB.Compact(startKey, endKey, true))
+}
+
+// NewBatch creates a write-only batch that commits atomically to this store.
+func (db *PebbleDBStore) NewBatch() store.Batch {
+	return &batch{db: db, b: db.DB.NewBatch()}
+}
+
+// NewBatchWithSize creates a write-only batch with a pre-allocated buffer.
+func (db *PebbleDBStore) NewBatchWithSize(size int) store.Batch {
+	return &batch{db: db, b: db.DB.NewBatchWithSize(size)}
+}
+
+// NewIterator creates an iterator over the keys with the given prefix,
+// starting at prefix+start.
+func (db *PebbleDBStore) NewIterator(prefix []byte, start []byte) (store.Iterator, error) {
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return nil, store.ErrClosed
+	}
+	iter, err := db.DB.NewIter(&pebble.IterOptions{
+		LowerBound: append(append([]byte(nil), prefix...), start...),
+		UpperBound: upperBound(prefix),
+	})
+	if err != nil {
+		return nil, storeError(err)
+	}
+	iter.First()
+	return &pebbleIterator{iter: iter, moved: true}, nil
+}
+
+// NewSnapshot creates a point-in-time view of the store backed by a native
+// Pebble snapshot.
+func (db *PebbleDBStore) NewSnapshot() (store.Snapshot, error) {
+	db.quitLock.RLock()
+	defer db.quitLock.RUnlock()
+	if db.closed {
+		return nil, store.ErrClosed
+	}
+	return &snapshot{db: db, snap: db.DB.NewSnapshot()}, nil
 }
 
 // Close closes the Pebble store.
 func (db *PebbleDBStore) Close() error {
-	return db.DB.Close()
+	db.quitLock.Lock()
+	defer db.quitLock.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	return storeError(db.DB.Close())
+}
+
+// snapshot wraps a Pebble snapshot, guarding it against use after either the
+// snapshot or its store was closed.
+type snapshot struct {
+	db   *PebbleDBStore
+	snap *pebble.Snapshot // Nil once released
+	lock sync.RWMutex
+}
+
+// Has retrieves if a key was present when the snapshot was taken.
+func (snap *snapshot) Has(key []byte) (bool, error) {
+	_, err := snap.Get(key)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Get retrieves the value a key held when the snapshot was taken.
+func (snap *snapshot) Get(key []byte) ([]byte, error) {
+	snap.db.quitLock.RLock()
+	defer snap.db.quitLock.RUnlock()
+	snap.lock.RLock()
+	defer snap.lock.RUnlock()
+	if snap.db.closed || snap.snap == nil {
+		return nil, store.ErrClosed
+	}
+	value, closer, err := snap.snap.Get(key)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	defer closer.Close()
+	return bytes.Clone(value), nil
+}
+
+// Release releases the underlying Pebble snapshot. Once the store is closed
+// the snapshot is gone with it and only the handle is dropped.
+func (snap *snapshot) Release() {
+	snap.db.quitLock.RLock()
+	defer snap.db.quitLock.RUnlock()
+	snap.lock.Lock()
+	defer snap.lock.Unlock()
+	if snap.snap == nil {
+		return
+	}
+	if !snap.db.closed {
+		snap.snap.Close()
+	}
+	snap.snap = nil
+}
+
+// endOfKeys returns the key right after the last key stored in db, nil if it
+// is empty. Pebble has no open ended range bound, so it stands in for the end
+// of the key space.
+func endOfKeys(db *pebble.DB) ([]byte, error) {
+	iter, err := db.NewIter(nil)
+	if err != nil {
+		return nil, err
+	}
+	var end []byte
+	if iter.Last() {
+		end = append(bytes.Clone(iter.Key()), 0x00)
+	}
+	return end, iter.Close()
+}
+
+// upperBound returns the upper bound for the given prefix, or nil when the
+// prefix has no upper bound (empty or all 0xff).
+func upperBound(prefix []byte) (limit []byte) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		c := prefix[i]
+		if c == 0xff {
+			continue
+		}
+		limit = make([]byte, i+1)
+		copy(limit, prefix)
+		limit[i] = c + 1
+		break
+	}
+	return limit
+}
+
+// insertRange queues an overwrite of every key within [startKey, endKey) into b.
+func insertRange(db *pebble.DB, b *pebble.Batch, startKey, endKey, value []byte) error {
+	iter, err := db.NewIter(&pebble.IterOptions{LowerBound: startKey, UpperBound: endKey})
+	if err != nil {
+		return err
+	}
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := b.Set(iter.Key(), value, nil); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+// pebbleIterator is a wrapper of underlying iterator in storage engine.
+// The purpose of this structure is to implement the missing APIs.
+type pebbleIterator struct {
+	iter  *pebble.Iterator
+	moved bool
+}
+
+// Next moves the iterator to the next key/value pair. It returns whether the
+// iterator is exhausted.
+func (iter *pebbleIterator) Next() bool {
+	if iter.moved {
+		iter.moved = false
+		return iter.iter.Valid()
+	}
+	return iter.iter.Next()
+}
+
+// Error returns any accumulated error. Exhausting all the key/value pairs
+// is not considered to be an error.
+func (iter *pebbleIterator) Error() error {
+	return storeError(iter.iter.Error())
+}
+
+// Key returns the key of the current key/value pair, or nil if done. The caller
+// should not modify the contents of the returned slice, and its contents may
+// change on the next call to Next.
+func (iter *pebbleIterator) Key() []byte {
+	return iter.iter.Key()
+}
+
+// Value returns the value of the current key/value pair, or nil if done. The
+// caller should not modify the contents of the returned slice, and its contents
+// may change on the next call to Next.
+func (iter *pebbleIterator) Value() []byte {
+	return iter.iter.Value()
+}
+
+// Release releases associated resources. Release should always succeed and can
+// be called multiple times without causing error.
+func (iter *pebbleIterator) Release() {
+	if iter.iter != nil {
+		iter.iter.Close()
+		iter.iter = nil
+	}
 }
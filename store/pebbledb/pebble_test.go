@@ -8,9 +8,15 @@ import (
 	"testing"
 	"time"
 
-	"github.com/cockroachdb/pebble"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/dbtest"
+	"github.com/wang900115/LCA/store/memorydb"
 )
 
+// errNotFound is the error every backend reports for missing keys. Most tests
+// below name their database store, shadowing the package name.
+var errNotFound = store.ErrNotFound
+
 // Helper function to create a temporary directory for testing
 func createTempDir(t testing.TB) string {
 	dir, err := os.MkdirTemp("", "pebble_test_*")
@@ -28,7 +34,7 @@ func cleanupDir(t testing.TB, dir string) {
 }
 
 // Helper function to create a test store
-func createTestPebbleStore(t testing.TB) (PebbleStore, string) {
+func createTestPebbleStore(t testing.TB) (store.KeyValueStore, string) {
 	dir := createTempDir(t)
 	store, err := NewPebbleDBStore(dir)
 	if err != nil {
@@ -101,7 +107,7 @@ func TestPebbleStore_Has(t *testing.T) {
 
 	// Key should not exist initially
 	exists, err := store.Has(key)
-	if err == nil {
+	if err != nil {
 		t.Fatalf("Has() failed: %v", err)
 	}
 	if exists {
@@ -155,7 +161,7 @@ func TestPebbleStore_Delete(t *testing.T) {
 
 	// Verify it doesn't exist
 	exists, err = store.Has(key)
-	if err == nil {
+	if err != nil {
 		t.Fatalf("Has() failed: %v", err)
 	}
 	if exists {
@@ -167,7 +173,7 @@ func TestPebbleStore_Delete(t *testing.T) {
 	if err == nil {
 		t.Error("Get() should return error for deleted key")
 	}
-	if err != pebble.ErrNotFound {
+	if err != errNotFound {
 		t.Errorf("Get() should return ErrNotFound, got: %v", err)
 	}
 }
@@ -181,7 +187,7 @@ func TestPebbleStore_GetNonExistentKey(t *testing.T) {
 	if err == nil {
 		t.Error("Get() should return error for non-existent key")
 	}
-	if err != pebble.ErrNotFound {
+	if err != errNotFound {
 		t.Errorf("Get() should return ErrNotFound, got: %v", err)
 	}
 }
@@ -260,7 +266,7 @@ func TestPebbleStore_ConcurrentReadWrite(t *testing.T) {
 				time.Sleep(time.Millisecond)
 
 				value, err := store.Get(key)
-				if err != nil && err != pebble.ErrNotFound {
+				if err != nil && err != errNotFound {
 					errChan <- fmt.Errorf("worker %d: Get failed: %v", workerID, err)
 					return
 				}
@@ -323,7 +329,7 @@ func TestPebbleStore_HighConcurrencyStress(t *testing.T) {
 					localOps["put"]++
 				case 2, 3: // Get (40% of operations)
 					_, err := store.Get(key)
-					if err != nil && err != pebble.ErrNotFound {
+					if err != nil && err != errNotFound {
 						mu.Lock()
 						errors = append(errors, fmt.Errorf("worker %d: Get failed: %v", workerID, err))
 						mu.Unlock()
@@ -364,6 +370,56 @@ func TestPebbleStore_HighConcurrencyStress(t *testing.T) {
 	t.Logf("Stress test completed. Operations: %+v", operations)
 }
 
+func TestPebbleStore_BatchOpenRange(t *testing.T) {
+	db, err := NewPebbleDBStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create PebbleDBStore: %v", err)
+	}
+	defer db.Close()
+
+	b := db.NewBatch()
+	b.Put([]byte("a"), nil)
+	b.DeleteRange([]byte("a"), nil)
+	b.Put([]byte("b"), nil)
+	// Keys stored after the range was queued are resolved at Write
+	high := append(bytes.Repeat([]byte{0xff}, 32), "more"...)
+	for _, k := range [][]byte{[]byte("c"), high} {
+		if err := db.Put(k, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Write(); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	for k, want := range map[string]bool{"a": false, "b": true, "c": false, string(high): false} {
+		if has, _ := db.Has([]byte(k)); has != want {
+			t.Errorf("Has(%x) = %v, want %v", k, has, want)
+		}
+	}
+
+	// Replay keeps the range open and in order
+	mem := memorydb.NewMemoryDBStore()
+	mem.Put([]byte("z"), nil)
+	if err := b.Replay(mem); err != nil {
+		t.Fatalf("Replay() error = %v", err)
+	}
+	for k, want := range map[string]bool{"a": false, "b": true, "z": false} {
+		if has, _ := mem.Has([]byte(k)); has != want {
+			t.Errorf("replayed Has(%s) = %v, want %v", k, has, want)
+		}
+	}
+}
+
+func TestPebbleStore_Suite(t *testing.T) {
+	dbtest.TestDatabaseSuite(t, func() store.KeyValueStore {
+		db, err := NewPebbleDBStore(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create PebbleDBStore: %v", err)
+		}
+		return db
+	})
+}
+
 // Benchmark tests
 func BenchmarkPebbleStore_Put(b *testing.B) {
 	store, dir := createTestPebbleStore(b)
@@ -425,3 +481,7 @@ func BenchmarkPebbleStore_ConcurrentReadWrite(b *testing.B) {
 		}
 	})
 }
+
+func TestPebbleStore_ReadOnly(t *testing.T) {
+	dbtest.TestReadOnlySuite(t, NewPebbleDBStore, NewPebbleDBStoreReadOnly)
+}
@@ -0,0 +1,22 @@
+package store
+
+// Snapshot is a point-in-time, read-only view of a key-value store. Writes to
+// the store made after the snapshot was taken are not visible through it.
+type Snapshot interface {
+	// Has retrieves if a key was present when the snapshot was taken.
+	Has(key []byte) (bool, error)
+	// Get retrieves the value a key held when the snapshot was taken.
+	Get(key []byte) ([]byte, error)
+	// Release releases associated resources. Reads after Release fail with
+	// ErrClosed. Release should always succeed and can be called multiple times
+	// without causing error.
+	Release()
+}
+
+// Snapshotter wraps the NewSnapshot method of a backing data store.
+type Snapshotter interface {
+	// NewSnapshot creates a snapshot of the current state of the store.
+	// Snapshots must be released once used up, otherwise the engine is kept
+	// from reclaiming the stale data they pin.
+	NewSnapshot() (Snapshot, error)
+}
@@ -0,0 +1,302 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+)
+
+// table is a wrapper around a key-value store that prefixes each key access
+// with a pre-configured string, so several namespaces can share one database.
+type table struct {
+	db     KeyValueStore
+	prefix string
+}
+
+// NewTable returns a key-value store that prefixes all keys with a given
+// string. Keys read back through iterators have the prefix stripped, and
+// ranged operations never reach outside the namespace.
+func NewTable(db KeyValueStore, prefix string) KeyValueStore {
+	return &table{
+		db:     db,
+		prefix: prefix,
+	}
+}
+
+// Has retrieves if a prefixed version of a key is present in the database.
+func (t *table) Has(key []byte) (bool, error) {
+	return t.db.Has(append([]byte(t.prefix), key...))
+}
+
+// Get retrieves the given prefixed key if it's present in the database.
+func (t *table) Get(key []byte) ([]byte, error) {
+	return t.db.Get(append([]byte(t.prefix), key...))
+}
+
+// Put inserts the given value into the database at a prefixed version of the
+// provided key.
+func (t *table) Put(key []byte, value []byte) error {
+	return t.db.Put(append([]byte(t.prefix), key...), value)
+}
+
+// Delete removes the given prefixed key from the database.
+func (t *table) Delete(key []byte) error {
+	return t.db.Delete(append([]byte(t.prefix), key...))
+}
+
+// InsertRange overwrites every existing key of the namespace within
+// [startKey, endKey) with the given value.
+func (t *table) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	start, end := t.bounds(startKey, endKey)
+	return t.db.InsertRange(start, end, value)
+}
+
+// DeleteRange removes all keys of the namespace within [startKey, endKey). A
+// nil endKey runs to the end of the namespace.
+func (t *table) DeleteRange(startKey []byte, endKey []byte) error {
+	start, end := t.bounds(startKey, endKey)
+	return t.db.DeleteRange(start, end)
+}
+
+// Stat returns the statistics of the underlying database, which are shared
+// by every table on it.
+func (t *table) Stat() (map[string]interface{}, error) {
+	return t.db.Stat()
+}
+
+// Sync flushes the underlying database.
+func (t *table) Sync() error {
+	return t.db.Sync()
+}
+
+// Compact flattens the underlying data store for the given key range of the
+// namespace. A nil startKey starts at the beginning of the namespace and a nil
+// endKey runs to the end of it.
+func (t *table) Compact(startKey []byte, endKey []byte) error {
+	start, end := t.bounds(startKey, endKey)
+	return t.db.Compact(start, end)
+}
+
+// NewBatch creates a write-only database that buffers changes to its host db
+// until a final write is called, each operation prefixing all keys with the
+// pre-configured string.
+func (t *table) NewBatch() Batch {
+	return &tableBatch{t.db.NewBatch(), t}
+}
+
+// NewBatchWithSize creates a write-only database batch with pre-allocated buffer.
+func (t *table) NewBatchWithSize(size int) Batch {
+	return &tableBatch{t.db.NewBatchWithSize(size), t}
+}
+
+// NewIterator creates a binary-alphabetical iterator over a subset of the
+// namespace with a particular key prefix, starting at a particular initial key.
+// The namespace prefix is stripped from the returned keys.
+func (t *table) NewIterator(prefix []byte, start []byte) (Iterator, error) {
+	iter, err := t.db.NewIterator(append([]byte(t.prefix), prefix...), start)
+	if err != nil {
+		return nil, err
+	}
+	return &tableIterator{iter: iter, prefix: len(t.prefix)}, nil
+}
+
+// NewSnapshot creates a snapshot of the underlying database, reading through
+// the namespace.
+func (t *table) NewSnapshot() (Snapshot, error) {
+	snap, err := t.db.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &tableSnapshot{snap: snap, prefix: t.prefix}, nil
+}
+
+// Close is a noop to implement the KeyValueStore interface. The underlying
+// database is shared with other tables and has to be closed by its owner.
+func (t *table) Close() error {
+	return nil
+}
+
+// bounds converts a range within the namespace into a range of the underlying
+// database, clamping open ends to the namespace.
+func (t *table) bounds(startKey []byte, endKey []byte) ([]byte, []byte) {
+	start := append([]byte(t.prefix), startKey...)
+	if endKey == nil {
+		return start, upperBound([]byte(t.prefix))
+	}
+	return start, append([]byte(t.prefix), endKey...)
+}
+
+// upperBound returns the smallest key greater than every key with the given
+// prefix, or nil when there is none (empty or all 0xff prefix).
+func upperBound(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] == 0xff {
+			continue
+		}
+		limit := make([]byte, i+1)
+		copy(limit, prefix)
+		limit[i]++
+		return limit
+	}
+	return nil
+}
+
+// tableBatch is a wrapper around a database batch that prefixes each key access
+// with a pre-configured string.
+type tableBatch struct {
+	batch Batch
+	table *table
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *tableBatch) Put(key, value []byte) error {
+	return b.batch.Put(append([]byte(b.table.prefix), key...), value)
+}
+
+// Delete inserts a key removal into the batch for later committing.
+func (b *tableBatch) Delete(key []byte) error {
+	return b.batch.Delete(append([]byte(b.table.prefix), key...))
+}
+
+// InsertRange queues an overwrite of the namespace keys within [startKey, endKey).
+func (b *tableBatch) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	start, end := b.table.bounds(startKey, endKey)
+	return b.batch.InsertRange(start, end, value)
+}
+
+// DeleteRange queues the removal of the namespace keys within [startKey, endKey).
+func (b *tableBatch) DeleteRange(startKey []byte, endKey []byte) error {
+	start, end := b.table.bounds(startKey, endKey)
+	return b.batch.DeleteRange(start, end)
+}
+
+// ValueSize retrieves the amount of data queued up for writing.
+func (b *tableBatch) ValueSize() int {
+	return b.batch.ValueSize()
+}
+
+// Write flushes any accumulated data to disk.
+func (b *tableBatch) Write() error {
+	return b.batch.Write()
+}
+
+// Reset resets the batch for reuse.
+func (b *tableBatch) Reset() error {
+	return b.batch.Reset()
+}
+
+// Replay replays the batch contents, with the namespace prefix stripped.
+func (b *tableBatch) Replay(w KeyValueWriter) error {
+	return b.batch.Replay(&tableReplayer{w: w, prefix: b.table.prefix})
+}
+
+// tableReplayer is a wrapper around a batch replayer which truncates
+// the added prefix.
+type tableReplayer struct {
+	w      KeyValueWriter
+	prefix string
+}
+
+// Put implements the interface KeyValueWriter.
+func (r *tableReplayer) Put(key []byte, value []byte) error {
+	return r.w.Put(key[len(r.prefix):], value)
+}
+
+// Delete implements the interface KeyValueWriter.
+func (r *tableReplayer) Delete(key []byte) error {
+	return r.w.Delete(key[len(r.prefix):])
+}
+
+// InsertRange implements the interface KeyValueRanger.
+func (r *tableReplayer) InsertRange(startKey []byte, endKey []byte, value []byte) error {
+	ranger, err := r.ranger()
+	if err != nil {
+		return err
+	}
+	return ranger.InsertRange(startKey[len(r.prefix):], r.end(endKey), value)
+}
+
+// DeleteRange implements the interface KeyValueRanger.
+func (r *tableReplayer) DeleteRange(startKey []byte, endKey []byte) error {
+	ranger, err := r.ranger()
+	if err != nil {
+		return err
+	}
+	return ranger.DeleteRange(startKey[len(r.prefix):], r.end(endKey))
+}
+
+func (r *tableReplayer) ranger() (KeyValueRanger, error) {
+	ranger, ok := r.w.(KeyValueRanger)
+	if !ok {
+		return nil, errors.New("replay target does not support range operations")
+	}
+	return ranger, nil
+}
+
+// end truncates the prefix from the end of a range. An end outside the
+// namespace is where the namespace ends, which is an open end after the
+// prefix is gone.
+func (r *tableReplayer) end(endKey []byte) []byte {
+	if !bytes.HasPrefix(endKey, []byte(r.prefix)) {
+		return nil
+	}
+	return endKey[len(r.prefix):]
+}
+
+// tableIterator is a wrapper around a database iterator that strips the
+// namespace prefix from the returned keys.
+type tableIterator struct {
+	iter   Iterator
+	prefix int
+}
+
+// Next moves the iterator to the next key/value pair.
+func (it *tableIterator) Next() bool {
+	return it.iter.Next()
+}
+
+// Error returns any accumulated error.
+func (it *tableIterator) Error() error {
+	return it.iter.Error()
+}
+
+// Key returns the key of the current key/value pair, without the namespace
+// prefix, or nil if done.
+func (it *tableIterator) Key() []byte {
+	key := it.iter.Key()
+	if key == nil {
+		return nil
+	}
+	return key[it.prefix:]
+}
+
+// Value returns the value of the current key/value pair, or nil if done.
+func (it *tableIterator) Value() []byte {
+	return it.iter.Value()
+}
+
+// Release releases associated resources.
+func (it *tableIterator) Release() {
+	it.iter.Release()
+}
+
+// tableSnapshot is a wrapper around a database snapshot that prefixes each key
+// access with a pre-configured string.
+type tableSnapshot struct {
+	snap   Snapshot
+	prefix string
+}
+
+// Has retrieves if a prefixed version of a key was present in the snapshot.
+func (s *tableSnapshot) Has(key []byte) (bool, error) {
+	return s.snap.Has(append([]byte(s.prefix), key...))
+}
+
+// Get retrieves the value a prefixed version of a key held in the snapshot.
+func (s *tableSnapshot) Get(key []byte) ([]byte, error) {
+	return s.snap.Get(append([]byte(s.prefix), key...))
+}
+
+// Release releases the underlying snapshot.
+func (s *tableSnapshot) Release() {
+	s.snap.Release()
+}
@@ -0,0 +1,110 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wang900115/LCA/store"
+	"github.com/wang900115/LCA/store/memorydb"
+)
+
+// collect drains the iterator into a map of key to value.
+func collect(t *testing.T, it store.Iterator) map[string]string {
+	t.Helper()
+	defer it.Release()
+	items := make(map[string]string)
+	for it.Next() {
+		items[string(it.Key())] = string(it.Value())
+	}
+	require.NoError(t, it.Error())
+	return items
+}
+
+func TestTable(t *testing.T) {
+	db := memorydb.NewMemoryDBStore()
+	defer db.Close()
+
+	docs := store.NewTable(db, "d")
+	peers := store.NewTable(db, "p")
+
+	// Neighbouring keys of the underlying store stay out of every range below
+	require.NoError(t, db.Put([]byte("c"), []byte("outside")))
+	require.NoError(t, db.Put([]byte("e"), []byte("outside")))
+
+	require.NoError(t, docs.Put([]byte("1"), []byte("doc1")))
+	require.NoError(t, docs.Put([]byte("2"), []byte("doc2")))
+	require.NoError(t, peers.Put([]byte("1"), []byte("peer1")))
+
+	value, err := docs.Get([]byte("1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("doc1"), value)
+	value, err = peers.Get([]byte("1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("peer1"), value)
+	_, err = peers.Get([]byte("2"))
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	value, err = db.Get([]byte("d2"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("doc2"), value)
+
+	it, err := docs.NewIterator(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"1": "doc1", "2": "doc2"}, collect(t, it))
+	it, err = docs.NewIterator(nil, []byte("2"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"2": "doc2"}, collect(t, it))
+
+	// Batches prefix their writes and strip the prefix again on replay
+	batch := docs.NewBatch()
+	require.NoError(t, batch.Put([]byte("3"), []byte("doc3")))
+	require.NoError(t, batch.Delete([]byte("1")))
+	require.NoError(t, batch.Write())
+	replay := memorydb.NewMemoryDBStore()
+	require.NoError(t, batch.Replay(replay))
+	has, err := replay.Has([]byte("3"))
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	// Range deletions are replayed within the namespace too
+	require.NoError(t, replay.Put([]byte("4"), nil))
+	require.NoError(t, replay.Put([]byte("9"), nil))
+	batch = docs.NewBatch()
+	require.NoError(t, batch.DeleteRange([]byte("4"), []byte("5")))
+	require.NoError(t, batch.DeleteRange([]byte("8"), nil))
+	require.NoError(t, batch.Replay(replay))
+	it, err = replay.NewIterator(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"3": "doc3"}, collect(t, it))
+
+	snap, err := docs.NewSnapshot()
+	require.NoError(t, err)
+	defer snap.Release()
+
+	// Open ended ranges are clamped to the namespace
+	require.NoError(t, docs.InsertRange(nil, nil, []byte("blank")))
+	require.NoError(t, docs.Compact(nil, nil))
+	it, err = db.NewIterator(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"c": "outside", "d2": "blank", "d3": "blank", "e": "outside", "p1": "peer1",
+	}, collect(t, it))
+
+	require.NoError(t, docs.DeleteRange(nil, nil))
+	it, err = db.NewIterator(nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"c": "outside", "e": "outside", "p1": "peer1"}, collect(t, it))
+
+	value, err = snap.Get([]byte("3"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("doc3"), value)
+	has, err = snap.Has([]byte("1"))
+	require.NoError(t, err)
+	assert.False(t, has)
+
+	// Closing a table leaves the shared database open
+	require.NoError(t, docs.Close())
+	value, err = peers.Get([]byte("1"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("peer1"), value)
+}